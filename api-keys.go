@@ -0,0 +1,146 @@
+/*
+Scoped API Keys for service-to-service access, i.e. batch jobs and partner integrations.
+
+	An API key acts as the user that created it, limited to the scopes it was created with:
+		- accounts:read, accounts:write: bank accounts
+		- cards:read, cards:write: account cards
+		- transactions:read, transactions:write: account transactions
+	The fields that manage the user (the profile, password, two-factor authentication, API keys) and the staff fields
+	cannot be used with an API key at all; they need the user to sign in.
+
+	Keys look like bgk_<key id>.<secret>. The secret is 32 random bytes; only its SHA-256 hash is stored in the
+	ApiKeys repository, so a key is shown once, when it is created. A key is sent in the Authorization header as
+	"ApiKey <key>", or as "Bearer <key>" for clients that only support bearer tokens.
+	Keys do not expire unless created with an expiry, and stop working once revoked.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	apiKeyPrefix      = "bgk_"
+	apiKeySecretBytes = 32
+	apiKeyTouchPeriod = time.Hour // the last used time of a key is recorded at most once per period
+)
+
+// The scopes an API key can be granted
+const (
+	scopeAccountsRead      = "accounts:read"
+	scopeAccountsWrite     = "accounts:write"
+	scopeCardsRead         = "cards:read"
+	scopeCardsWrite        = "cards:write"
+	scopeTransactionsRead  = "transactions:read"
+	scopeTransactionsWrite = "transactions:write"
+)
+
+// The scopes an API key can be granted, in the order they are listed
+var validScopes = []string{
+	scopeAccountsRead,
+	scopeAccountsWrite,
+	scopeCardsRead,
+	scopeCardsWrite,
+	scopeTransactionsRead,
+	scopeTransactionsWrite,
+}
+
+var errInvalidApiKey = errors.New("invalid API key")
+
+// Check if the token is an API key rather than a JWT
+func isApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// Generate a new API key; returns the key to show the user once, its id, and the hash of its secret to store
+func newApiKey() (string, string, string, error) {
+	b := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	keyId := uuid.NewV4().String()
+	secret := base64.RawURLEncoding.EncodeToString(b) // the URL alphabet has no dots, so the secret cannot contain one
+	return apiKeyPrefix + keyId + "." + secret, keyId, hashApiKeySecret(secret), nil
+}
+
+// Split the API key into its key id and secret
+func parseApiKey(key string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), ".", 2)
+	if !isApiKey(key) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Validate the API key and return the principal it identifies.
+
+	The key must exist, its secret must match the stored hash, and it must not be revoked or expired.
+	Records when the key was last used, at most once an hour; a failure to record it is logged.
+*/
+func (a *authSvc) validateApiKey(key string) (*Principal, error) {
+	keyId, secret, ok := parseApiKey(strings.TrimSpace(key))
+	if !ok {
+		return nil, errInvalidApiKey
+	}
+	repo := boldlygo.Repositories().ApiKeys()
+	stored, err := repo.Find(keyId)
+	if err != nil {
+		return nil, err
+	}
+	// compare the hashes in constant time, so the time taken does not reveal how much of the secret matched
+	if stored == nil || subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(stored.SecretHash)) != 1 {
+		return nil, errInvalidApiKey
+	}
+	now := time.Now()
+	if stored.RevokedAt != 0 {
+		return nil, errors.New("API key has been revoked")
+	}
+	if stored.ExpiresAt != 0 && stored.ExpiresAt <= now.Unix() {
+		return nil, errors.New("API key has expired")
+	}
+	if now.Sub(time.Unix(stored.LastUsedAt, 0)) >= apiKeyTouchPeriod {
+		if err := repo.Touch(keyId, now.Unix()); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record API key use: %v", err))
+		}
+	}
+	return &Principal{Email: stored.Email, Scopes: stored.Scopes, ApiKeyId: stored.KeyId, ExpiresAt: stored.ExpiresAt}, nil
+}
+
+// Check the scopes are known, and normalize them; records the problems on the scopes field
+func checkScopes(scopes []string, invalid *validationError) []string {
+	granted := map[string]bool{}
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !contains(validScopes, scope) {
+			invalid.Add("scopes", fmt.Sprintf("%q is not a scope. must be one of %s", scope, strings.Join(validScopes, ", ")))
+			continue
+		}
+		granted[scope] = true
+	}
+	if len(scopes) == 0 {
+		invalid.Add("scopes", "must not be empty")
+	}
+	var normalized []string
+	for _, scope := range validScopes {
+		if granted[scope] {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Create an API key of the signed in user with the scopes; returns the key and its id
+func createApiKey(t *testing.T, authorization string, scopes ...string) (string, string) {
+	t.Helper()
+	var created struct {
+		CreateApiKey struct {
+			Key    string
+			ApiKey struct{ KeyId string }
+		}
+	}
+	mustDo(t, authorization, `mutation($scopes: [String!]!) { createApiKey(name: "test", scopes: $scopes) { key apiKey { keyId } } }`,
+		map[string]interface{}{"scopes": scopes}, &created)
+	return created.CreateApiKey.Key, created.CreateApiKey.ApiKey.KeyId
+}
+
+// An API key acts as its user within its scopes, and cannot use the fields that need the user to sign in
+func TestApiKeyScopes(t *testing.T) {
+	email := "apikey@example.com"
+	authorization := signUp(t, email)
+	openAccount(t, authorization, email, "USD")
+	key, _ := createApiKey(t, authorization, scopeAccountsRead)
+	read := `query($bankId: String!) { bankAccounts(bankId: $bankId) { accountId } }`
+	variables := map[string]interface{}{"bankId": testBankId(email)}
+	for _, header := range []string{"ApiKey " + key, "Bearer " + key} {
+		var accounts struct{ BankAccounts []struct{ AccountId string } }
+		mustDo(t, header, read, variables, &accounts)
+		if len(accounts.BankAccounts) != 1 {
+			t.Errorf("read %d BankAccounts with %s; want 1", len(accounts.BankAccounts), strings.Fields(header)[0])
+		}
+	}
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"open an account without accounts:write", `mutation($bankId: String!) {
+			saveBankAccount(acct: {bankId: $bankId, accountName: "Savings", accountType: "SAVINGS", last4: "5678"}) { accountId }
+		}`},
+		{"read the profile", `{ me { email } }`},
+		{"create another API key", `mutation { createApiKey(name: "more", scopes: ["accounts:write"]) { key } }`},
+	}
+	for _, test := range tests {
+		if code := errorCode(do("ApiKey "+key, test.query, variables)); code != errCodeForbidden {
+			t.Errorf("%s: failed with %q; want %q", test.name, code, errCodeForbidden)
+		}
+	}
+}
+
+// A revoked key, or a key with the wrong secret, does not authenticate
+func TestRevokedApiKey(t *testing.T) {
+	authorization := signUp(t, "apikey-revoked@example.com")
+	key, keyId := createApiKey(t, authorization, scopeAccountsRead)
+	query := `{ apiKeys { keyId } }`
+	if code := errorCode(do("ApiKey "+key[:len(key)-1]+"x", query, nil)); code != errCodeUnauthenticated {
+		t.Errorf("a key with the wrong secret failed with %q; want %q", code, errCodeUnauthenticated)
+	}
+	var revoked struct{ RevokeApiKey struct{ KeyId string } }
+	mustDo(t, authorization, `mutation($keyId: String!) { revokeApiKey(keyId: $keyId) { keyId } }`, map[string]interface{}{"keyId": keyId}, &revoked)
+	if code := errorCode(do("ApiKey "+key, `{ bankAccounts(bankId: "`+testBankId("apikey-revoked@example.com")+`") { accountId } }`, nil)); code != errCodeUnauthenticated {
+		t.Errorf("the revoked key failed with %q; want %q", code, errCodeUnauthenticated)
+	}
+}
+
+// Scopes are trimmed, lower-cased, deduplicated and listed in order; unknown scopes and no scopes are rejected
+func TestCheckScopes(t *testing.T) {
+	invalid := &validationError{}
+	scopes := checkScopes([]string{" Transactions:Read", "accounts:read", "accounts:read"}, invalid)
+	if invalid.Err() != nil || strings.Join(scopes, ",") != "accounts:read,transactions:read" {
+		t.Errorf("the scopes were checked as %v, %v; want accounts:read and transactions:read", scopes, invalid.Err())
+	}
+	for _, scopes := range [][]string{{"accounts:delete"}, {}} {
+		invalid := &validationError{}
+		if checkScopes(scopes, invalid); invalid.Err() == nil {
+			t.Errorf("the scopes %v were accepted", scopes)
+		}
+	}
+}
+
+// Keys look like bgk_<key id>.<secret>
+func TestParseApiKey(t *testing.T) {
+	key, keyId, _, err := newApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, secret, ok := parseApiKey(key); !ok || id != keyId || secret == "" {
+		t.Errorf("the new key parsed as %q, %q, %v; want its key id and secret", id, secret, ok)
+	}
+	for _, malformed := range []string{"bgk_", "bgk_id", "bgk_.secret", "bgk_id.", "key.secret"} {
+		if _, _, ok := parseApiKey(malformed); ok {
+			t.Errorf("the malformed key %q parsed", malformed)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Security Audit Trail.
+
+	Security relevant events are saved to the AuditEvents repository, keyed by the subject they concern
+	(i.e. "email:name@example.com" or "ip:10.0.0.1") and ordered by time.
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// The types of audited events
+const (
+	auditLockedOut = "LOCKED_OUT"
+	auditUnlocked  = "UNLOCKED"
+
+	auditTotpEnabled              = "TOTP_ENABLED"
+	auditTotpDisabled             = "TOTP_DISABLED"
+	auditRecoveryCodeUsed         = "RECOVERY_CODE_USED"
+	auditRecoveryCodesRegenerated = "RECOVERY_CODES_REGENERATED"
+
+	auditPasswordResetRequested = "PASSWORD_RESET_REQUESTED"
+	auditPasswordReset          = "PASSWORD_RESET"
+	auditPasswordChanged        = "PASSWORD_CHANGED"
+	auditEmailVerified          = "EMAIL_VERIFIED"
+	auditEmailChangeRequested   = "EMAIL_CHANGE_REQUESTED"
+	auditEmailChanged           = "EMAIL_CHANGED"
+
+	auditStaffAccess       = "STAFF_ACCESS"
+	auditStaffAccessDenied = "STAFF_ACCESS_DENIED"
+	auditUserLocked        = "USER_LOCKED"
+	auditUserUnlocked      = "USER_UNLOCKED"
+	auditRolesChanged      = "ROLES_CHANGED"
+
+	auditApiKeyCreated = "API_KEY_CREATED"
+	auditApiKeyRevoked = "API_KEY_REVOKED"
+
+	auditOAuthClientRegistered = "OAUTH_CLIENT_REGISTERED"
+	auditAppConnected          = "APP_CONNECTED"
+	auditAppRevoked            = "APP_REVOKED"
+
+	auditUserProvisioned = "USER_PROVISIONED"
+	auditIdentityLinked  = "IDENTITY_LINKED"
+	auditIdentityRefused = "IDENTITY_REFUSED"
+)
+
+// The time of an event in its id; fixed width, so the ids of a subject sort in the order the events occurred
+const auditEventLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Record the event in the audit trail. A failure to save the event is logged rather than failing the request
+func audit(subject, eventType, detail string) {
+	now := time.Now().UTC()
+	event := &AuditEvent{
+		Subject:    subject,
+		EventId:    now.Format(auditEventLayout) + "#" + uuid.NewV4().String(),
+		EventType:  eventType,
+		OccurredAt: now,
+		Detail:     detail,
+	}
+	if err := boldlygo.Repositories().AuditEvents().Save(event); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to save audit event %s %s for %s: %v", eventType, detail, subject, err))
+	}
+}
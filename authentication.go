@@ -8,33 +8,116 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/mitchellh/mapstructure"
+	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	authSecretKey  = "AUTH_SECRET"
-	tokenExpiryMin = 60
-	bearerTokenKey = "Bearer "
+	authSecretKey             = "AUTH_SECRET"
+	tokenExpiryMin            = 60
+	refreshTokenExpiryDays    = 7
+	challengeTokenExpiryMin   = 5
+	appRefreshTokenExpiryDays = 90
+	bearerTokenKey            = "Bearer "
+	apiKeyTokenKey            = "ApiKey "
+
+	// the typ claim distinguishes access tokens from refresh tokens, so neither can be used as the other
+	tokenTypeAccess     = "access"
+	tokenTypeRefresh    = "refresh"
+	tokenTypeChallenge  = "challenge"   // proves the password was verified; exchanged with a two-factor code for tokens
+	tokenTypeAppAccess  = "app-access"  // issued to a connected app through OAuth2, limited to the scopes the user granted
+	tokenTypeAppRefresh = "app-refresh" // exchanged by a connected app at the token endpoint for new app access tokens
 )
 
+// The caller identified by a validated access token or API key
+type Principal struct {
+	Email     string
+	Roles     []string // from the access token; none for an API key or a connected app
+	Scopes    []string // the scopes of the API key or connected app; a signed in user has every scope
+	ApiKeyId  string   // the id of the API key the caller authenticated with; empty otherwise
+	GrantId   string   // the id of the grant of the connected app the caller is; empty otherwise
+	ClientId  string   // the OAuth2 client id of the connected app the caller is; empty otherwise
+	ExpiresAt int64    // epoch seconds the token or API key expires; 0 if it does not expire
+}
+
+// Check if the principal acts for the user with limited scopes, i.e. is an API key or connected app
+func (p *Principal) Delegated() bool {
+	return p.ApiKeyId != "" || p.GrantId != ""
+}
+
+// Check if the principal may use the scope; always true for a signed in user
+func (p *Principal) HasScope(scope string) bool {
+	if !p.Delegated() {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// The claims of a validated refresh token
+type RefreshClaims struct {
+	Email     string
+	Jti       string
+	IssuedAt  int64 // epoch seconds
+	ExpiresAt int64 // epoch seconds
+}
+
 type AuthSvc interface {
 	Initialize()
 	HashPwd(pwd string) (*string, error)
 	VerifyPwd(hashedPwd, pwd string) bool
+	CheckPwdPolicy(pwd, email string) []string
 	BuildToken(user User) (*string, *int64, error)
-	ValidateToken(authHeader interface{}) (interface{}, error)
+	BuildRefreshToken(user User) (*string, *int64, error)
+	ValidateToken(authHeader interface{}) (*Principal, error)
+	ValidateRefreshToken(token string) (*RefreshClaims, error)
+	BuildChallengeToken(user User) (*string, *int64, error)
+	ValidateChallengeToken(token string) (string, error)
+	BuildAppToken(grant OAuthGrant) (*string, *int64, error)
+	BuildAppRefreshToken(grant OAuthGrant) (*string, *int64, error)
+	ValidateAppRefreshToken(token string) (string, error)
+	GenerateTotpSecret(email string) (string, string, error)
+	VerifyTotp(secret, code string, lastStep int64) (int64, bool)
+	GenerateRecoveryCodes() ([]string, []string, error)
+	HashRecoveryCode(code string) string
+	JWKS() JSONWebKeySet
 }
 
 type authSvc struct {
-	authSecret []byte
+	authSecret  []byte
+	signingKeys *signingKeySet // nil if no AUTH_KEYS_FILE is configured; tokens are then signed with HS256 and the Auth Secret
+	pwdPolicy   *passwordPolicy
+	dummyHash   string // compared against when there is no stored hash, so the time taken does not reveal it
+	totpIssuer  string
 }
 
 // Initialize the Auth Service.
-// Get the Auth Secret out of the environment.
+// Get the Auth Secret, the signing keys file and the password policy out of the environment.
+// If the signing keys are configured, the Auth Secret is only used to validate HS256 tokens issued before them
 func (a *authSvc) Initialize() {
 	secret := os.Getenv(authSecretKey)
 	a.authSecret = []byte(secret)
+	a.pwdPolicy = loadPasswordPolicy()
+	dummyHash, err := a.HashPwd(uuid.NewV4().String())
+	if err != nil {
+		panic(err)
+	}
+	a.dummyHash = *dummyHash
+	a.totpIssuer = os.Getenv(totpIssuerKey)
+	if a.totpIssuer == "" {
+		a.totpIssuer = defaultTotpIssuer
+	}
+	if keysFile := os.Getenv(authKeysFileKey); keysFile != "" {
+		keys, err := loadSigningKeys(keysFile, refreshTokenExpiryDays*24*time.Hour)
+		if err != nil {
+			panic(err)
+		}
+		a.signingKeys = keys
+	}
 }
 
 // Utilize the bcrypt package to Salt and Hash the incoming password.
@@ -51,8 +134,14 @@ func (a *authSvc) HashPwd(pwd string) (*string, error) {
 }
 
 // Given the hashed password stored for the user and the passed in password to test against,
-// use the bcrypt package to compare the passwords and validate they are the same
+// use the bcrypt package to compare the passwords and validate they are the same.
+// With no hashed password, i.e. for an unknown user, the password is compared to a dummy hash and never matches;
+// the comparison takes the same time either way, so the response time does not reveal if the user exists
 func (a *authSvc) VerifyPwd(hashedPwd, pwd string) bool {
+	if hashedPwd == "" {
+		bcrypt.CompareHashAndPassword([]byte(a.dummyHash), []byte(pwd))
+		return false
+	}
 	storedPwd, submittedPwd := []byte(hashedPwd), []byte(pwd)     // convert both the hashed password and submitted password to byte arrays
 	err := bcrypt.CompareHashAndPassword(storedPwd, submittedPwd) // compare the password byte slices for equality
 	if err != nil {
@@ -61,60 +150,267 @@ func (a *authSvc) VerifyPwd(hashedPwd, pwd string) bool {
 	return true // passwords match, return true
 }
 
-// Utilize the JWT library to generate a token with the given claims
-// - email
-// - name
-// Sign the token with the auth secret
-// Get the expires at timestamp: now + 60min
+// Build a short-lived access token for the user; expires in 60min.
+// Returns the signed token and its expires at timestamp in nanoseconds
 func (a *authSvc) BuildToken(user User) (*string, *int64, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": user.Email,
-	})
-	signedToken, err := token.SignedString(a.authSecret) // sign the token
+	return a.buildToken(user, tokenTypeAccess, tokenExpiryMin*time.Minute)
+}
+
+// Build a refresh token for the user, used to get new access tokens until it expires in 7 days or is revoked.
+// Returns the signed token and its expires at timestamp in nanoseconds
+func (a *authSvc) BuildRefreshToken(user User) (*string, *int64, error) {
+	return a.buildToken(user, tokenTypeRefresh, refreshTokenExpiryDays*24*time.Hour)
+}
+
+// Check the password against the password policy; returns a message for each rule it breaks
+func (a *authSvc) CheckPwdPolicy(pwd, email string) []string {
+	return a.pwdPolicy.Check(pwd, email)
+}
+
+// Build a short-lived challenge token for a user with two-factor authentication enabled, whose password was verified.
+// Returns the signed token and its expires at timestamp in nanoseconds
+func (a *authSvc) BuildChallengeToken(user User) (*string, *int64, error) {
+	return a.buildToken(user, tokenTypeChallenge, challengeTokenExpiryMin*time.Minute)
+}
+
+// Build a short-lived access token for the connected app of the grant; expires in 60min.
+// Returns the signed token and its expires at timestamp in nanoseconds
+func (a *authSvc) BuildAppToken(grant OAuthGrant) (*string, *int64, error) {
+	return a.buildAppToken(grant, tokenTypeAppAccess, tokenExpiryMin*time.Minute)
+}
+
+// Build a refresh token for the connected app of the grant, used to get new app access tokens until it expires in
+// 90 days or the grant is revoked. Returns the signed token and its expires at timestamp in nanoseconds
+func (a *authSvc) BuildAppRefreshToken(grant OAuthGrant) (*string, *int64, error) {
+	return a.buildAppToken(grant, tokenTypeAppRefresh, appRefreshTokenExpiryDays*24*time.Hour)
+}
+
+// Validate the app refresh token signature, expiry and type, and return the id of its grant.
+// Does not check if the grant was revoked; grants are recorded in the OAuthGrants repository
+func (a *authSvc) ValidateAppRefreshToken(token string) (string, error) {
+	claims, err := a.parseToken(token, tokenTypeAppRefresh)
+	if err != nil {
+		return "", err
+	}
+	grantId, _ := claims["gid"].(string)
+	return grantId, nil
+}
+
+// Utilize the JWT library to generate a token for the user with the given claims
+// - email
+// - typ: access or refresh
+// - roles: the roles of the user, for access tokens
+func (a *authSvc) buildToken(user User, tokenType string, lifetime time.Duration) (*string, *int64, error) {
+	claims := jwt.MapClaims{"email": user.Email}
+	if tokenType == tokenTypeAccess {
+		claims["roles"] = user.RoleNames()
+	}
+	return a.signToken(claims, tokenType, lifetime)
+}
+
+// Utilize the JWT library to generate a token for the connected app of the grant with the given claims
+// - email: the user the grant is for, when it was issued; the grant decides who the token acts as
+// - gid: the grant id, checked on every use so revoking the grant stops the token working
+// - client_id, scope: the connected app and the scopes the user granted it
+func (a *authSvc) buildAppToken(grant OAuthGrant, tokenType string, lifetime time.Duration) (*string, *int64, error) {
+	claims := jwt.MapClaims{
+		"email":     grant.Email,
+		"gid":       grant.GrantId,
+		"client_id": grant.ClientId,
+		"scope":     strings.Join(grant.Scopes, " "),
+	}
+	return a.signToken(claims, tokenType, lifetime)
+}
+
+// Add the standard claims to the token claims and sign it
+// - typ: the token type
+// - iat: now
+// - exp: now + the token lifetime
+// - jti: unique token id, used to revoke the token
+// Sign the token with the current signing key, identified by the kid header; or the auth secret if no keys are configured
+func (a *authSvc) signToken(claims jwt.MapClaims, tokenType string, lifetime time.Duration) (*string, *int64, error) {
+	now := time.Now().Unix()                       // get current time; token times are in whole seconds
+	expiresAt := now + int64(lifetime/time.Second) // add the lifetime to current time to get token expiry
+	claims["typ"] = tokenType
+	claims["iat"] = now
+	claims["exp"] = expiresAt
+	claims["jti"] = uuid.NewV4().String()
+	var (
+		token *jwt.Token
+		key   interface{} = a.authSecret
+	)
+	if a.signingKeys != nil {
+		signingKey, err := a.signingKeys.current(time.Unix(now, 0))
+		if err != nil {
+			return nil, nil, err
+		}
+		token = jwt.NewWithClaims(signingKey.method, claims)
+		token.Header["kid"] = signingKey.kid
+		key = signingKey.privateKey
+	} else {
+		token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	}
+	signedToken, err := token.SignedString(key) // sign the token
 	if err != nil {
 		return nil, nil, err
 	}
-	now := time.Now()                                      // get current time
-	nowPlusExpiry := now.Add(tokenExpiryMin * time.Minute) // add 60 minutes to current time to get token expiry
-	nowPlusExpiryTimestamp := nowPlusExpiry.UnixNano()     // get the expiry timestamp
-	return &signedToken, &nowPlusExpiryTimestamp, nil
+	expiresAtTimestamp := time.Unix(expiresAt, 0).UnixNano() // the expiry timestamp, exactly as the exp claim enforces it
+	return &signedToken, &expiresAtTimestamp, nil
 }
 
 // Validate the authorization token.
-// Using the Authorization Header, validate that it contains a token and that the token is valid.
-// If the token exists and is valid, return nil; otherwise return the error
-func (a *authSvc) ValidateToken(authHeader interface{}) (interface{}, error) {
+// Using the Authorization Header, validate that it contains either an access token that is valid and not expired,
+// an app access token of a connected app whose grant is not revoked,
+// or an API key that is valid, not expired and not revoked. API keys are sent as "ApiKey <key>" or "Bearer <key>".
+// If the token or key is valid, return the principal it identifies; otherwise return the error
+func (a *authSvc) ValidateToken(authHeader interface{}) (*Principal, error) {
 	// validate an Authorization header token is present in the request
-	if authHeader == nil {
-		return nil, errors.New("no valid Authorization token in request")
-	}
-	header := authHeader.(string)
+	header, _ := authHeader.(string)
 	if header == "" {
 		return nil, errors.New("no valid Authorization token in request")
 	}
+	if strings.HasPrefix(header, apiKeyTokenKey) {
+		return a.validateApiKey(strings.TrimPrefix(header, apiKeyTokenKey))
+	}
 	// validate that it is a Bearer token
 	if !strings.HasPrefix(header, bearerTokenKey) {
 		return nil, errors.New("authorization token is not valid Bearer token")
 	}
-	t := strings.Replace(header, bearerTokenKey, "", -1)
-	// parse the header token
-	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("there was an parsing the given token. please validate the token is for this service")
-		}
-		return a.authSecret, nil
-	})
+	t := strings.TrimPrefix(header, bearerTokenKey)
+	if isApiKey(t) {
+		return a.validateApiKey(t)
+	}
+	claims, err := a.parseToken(t, tokenTypeAccess, tokenTypeAppAccess)
 	if err != nil {
 		return nil, err
 	}
-	// validate token and get claims
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		var decodedToken map[string]string
-		err = mapstructure.Decode(claims, &decodedToken)
+	exp, _ := claims["exp"].(float64) // JSON numbers are decoded as float64
+	if claims["typ"] == tokenTypeAppAccess {
+		grantId, _ := claims["gid"].(string)
+		principal, err := a.validateAppGrant(grantId)
 		if err != nil {
 			return nil, err
 		}
-		return decodedToken["email"], nil
+		principal.ExpiresAt = int64(exp)
+		return principal, nil
+	}
+	email, _ := claims["email"].(string)
+	principal := &Principal{Email: email, ExpiresAt: int64(exp)}
+	roles, ok := claims["roles"].([]interface{}) // JSON arrays are decoded as []interface{}
+	if !ok {
+		roles = []interface{}{roleCustomer} // issued before roles were added to the claims
+	}
+	for _, role := range roles {
+		if r, ok := role.(string); ok {
+			principal.Roles = append(principal.Roles, r)
+		}
+	}
+	return principal, nil
+}
+
+// Validate the refresh token signature, expiry and type, and return its claims.
+// Does not check if the token was revoked; revoked tokens are recorded in the RevokedTokens repository
+func (a *authSvc) ValidateRefreshToken(token string) (*RefreshClaims, error) {
+	claims, err := a.parseToken(token, tokenTypeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64) // JSON numbers are decoded as float64
+	return &RefreshClaims{Email: email, Jti: jti, IssuedAt: int64(iat), ExpiresAt: int64(exp)}, nil
+}
+
+// Validate the challenge token signature, expiry and type, and return the email claim
+func (a *authSvc) ValidateChallengeToken(token string) (string, error) {
+	claims, err := a.parseToken(token, tokenTypeChallenge)
+	if err != nil {
+		return "", err
+	}
+	email, _ := claims["email"].(string)
+	return email, nil
+}
+
+// Generate a new TOTP secret for the user; returns the secret and the otpauth URI to enroll an authenticator app with
+func (a *authSvc) GenerateTotpSecret(email string) (string, string, error) {
+	secret, err := newTotpSecret()
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totpUri(a.totpIssuer, email, secret), nil
+}
+
+// Verify the TOTP code against the secret; the code must be for a time step after the last one used.
+// Returns the time step of the code, to store as the last one used
+func (a *authSvc) VerifyTotp(secret, code string, lastStep int64) (int64, bool) {
+	return verifyTotpCode(secret, code, lastStep, time.Now())
+}
+
+// Generate a new set of recovery codes; returns the codes to show the user once, and the hashes to store
+func (a *authSvc) GenerateRecoveryCodes() ([]string, []string, error) {
+	return newRecoveryCodes()
+}
+
+// Hash the recovery code the user entered, to compare against the stored hashes
+func (a *authSvc) HashRecoveryCode(code string) string {
+	return hashRecoveryCode(code)
+}
+
+// Parse the token, verify the signature, that it has not expired and is of one of the token types; return its claims
+func (a *authSvc) parseToken(t string, tokenTypes ...string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(t, a.verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid authorization token") // token is not valid, return error
+	}
+	// tokens issued without an expiry would be valid forever, so the exp claim is required
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("authorization token has no expiry. please authenticate again")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("authorization token has expired")
+	}
+	for _, tokenType := range tokenTypes {
+		if claims["typ"] == tokenType {
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("authorization token is not a valid %s token", tokenTypes[0])
+}
+
+/*
+Get the key to verify the token signature with.
+
+	Select the key by the token header:
+		- Tokens with a kid header are verified with the public key of that signing key, using the algorithm of the key
+		- Tokens without a kid are HS256 tokens, verified with the auth secret; rejected if only signing keys are configured
+*/
+func (a *authSvc) verificationKey(token *jwt.Token) (interface{}, error) {
+	if kid, ok := token.Header["kid"].(string); ok && a.signingKeys != nil {
+		key := a.signingKeys.find(kid, time.Now())
+		if key == nil {
+			return nil, fmt.Errorf("authorization token was signed with an unknown or expired key %q", kid)
+		}
+		// the algorithm in the header is not trusted; it must be the algorithm of the key
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("authorization token algorithm %s does not match key %q", token.Method.Alg(), kid)
+		}
+		return key.publicKey, nil
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || (a.signingKeys != nil && len(a.authSecret) == 0) {
+		return nil, fmt.Errorf("there was an parsing the given token. please validate the token is for this service")
+	}
+	return a.authSecret, nil
+}
+
+// The public signing keys, in the JSON Web Key Set format; empty if tokens are signed with the auth secret
+func (a *authSvc) JWKS() JSONWebKeySet {
+	if a.signingKeys == nil {
+		return JSONWebKeySet{Keys: []JSONWebKey{}}
 	}
-	return nil, errors.New("invalid authorization token") // token is not valid, return error
+	return a.signingKeys.JWKS(time.Now())
 }
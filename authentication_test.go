@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type testAuth struct {
+	Success      bool
+	Message      string
+	Token        string
+	RefreshToken string
+}
+
+// Sign in with the password; returns the tokens
+func signIn(t *testing.T, email string) testAuth {
+	t.Helper()
+	var signedIn struct{ Authenticate testAuth }
+	mustDo(t, "", `mutation($email: String!, $pwd: String!) { authenticate(email: $email, password: $pwd) { success message token refreshToken } }`,
+		map[string]interface{}{"email": email, "pwd": testPwd}, &signedIn)
+	if !signedIn.Authenticate.Success {
+		t.Fatalf("unable to sign in as %s: %s", email, signedIn.Authenticate.Message)
+	}
+	return signedIn.Authenticate
+}
+
+// Issue a new access token with the refresh token
+func refresh(t *testing.T, refreshToken string) testAuth {
+	t.Helper()
+	var refreshed struct{ RefreshToken testAuth }
+	mustDo(t, "", `mutation($refreshToken: String!) { refreshToken(refreshToken: $refreshToken) { success message token refreshToken } }`,
+		map[string]interface{}{"refreshToken": refreshToken}, &refreshed)
+	return refreshed.RefreshToken
+}
+
+// A refresh token issues access tokens until it is revoked by logging out; neither token can be used as the other
+func TestRefreshTokenAndLogout(t *testing.T) {
+	email := "refresh@example.com"
+	signUp(t, email)
+	auth := signIn(t, email)
+	refreshed := refresh(t, auth.RefreshToken)
+	if !refreshed.Success || refreshed.Token == "" || refreshed.RefreshToken != auth.RefreshToken {
+		t.Fatalf("refreshing returned %+v; want a new access token and the same refresh token", refreshed)
+	}
+	var me struct{ Me struct{ Email string } }
+	mustDo(t, "Bearer "+refreshed.Token, `{ me { email } }`, nil, &me)
+	if me.Me.Email != email {
+		t.Errorf("the refreshed token is for %q; want %q", me.Me.Email, email)
+	}
+	if code := errorCode(do("Bearer "+auth.RefreshToken, `{ me { email } }`, nil)); code != errCodeUnauthenticated {
+		t.Errorf("using the refresh token as an access token failed with %q; want %q", code, errCodeUnauthenticated)
+	}
+	if refresh(t, auth.Token).Success {
+		t.Error("refreshed with an access token")
+	}
+	var loggedOut struct{ Logout bool }
+	mustDo(t, "", `mutation($refreshToken: String!) { logout(refreshToken: $refreshToken) }`, map[string]interface{}{"refreshToken": auth.RefreshToken}, &loggedOut)
+	if !loggedOut.Logout {
+		t.Fatal("unable to log out")
+	}
+	if refresh(t, auth.RefreshToken).Success {
+		t.Error("refreshed with a revoked refresh token")
+	}
+}
+
+// Tokens are rejected once they expire, and tokens issued without an expiry are never accepted
+func TestAccessTokenExpiry(t *testing.T) {
+	auth := &authSvc{authSecret: []byte("expiry-secret")}
+	valid, _, err := auth.signToken(map[string]interface{}{"email": "expiry@example.com"}, tokenTypeAccess, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := auth.ValidateToken(bearerTokenKey + *valid)
+	if err != nil || principal.Email != "expiry@example.com" || principal.ExpiresAt <= time.Now().Unix() {
+		t.Errorf("the unexpired token validated as %+v, %v; want its email and expiry", principal, err)
+	}
+	expired, _, err := auth.signToken(map[string]interface{}{"email": "expiry@example.com"}, tokenTypeAccess, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ValidateToken(bearerTokenKey + *expired); err == nil {
+		t.Error("the expired token validated")
+	}
+	unexpiring, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"email": "expiry@example.com", "typ": tokenTypeAccess}).SignedString(auth.authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ValidateToken(bearerTokenKey + unexpiring); err == nil {
+		t.Error("the token without an expiry validated")
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Ownership-based Authorization of the GraphQL fields.
+
+	Every query and mutation wraps its resolver with authorize and an ownership rule:
+		- the caller is identified by the email in the Authorization header token, or the user of the API key or
+		  connected app
+		- the rule verifies that the caller owns the record the field reads or writes
+	The resolver only runs once both checks pass. The public fields are not wrapped: authenticate, verifyTotp,
+	refreshToken, logout, register, requestPasswordReset, resetPassword, verifyEmail and confirmEmailChange.
+	The staff fields are wrapped with requireRole instead; see roles.go.
+
+	Fields wrapped with authorize cannot be used with an API key or by a connected app. The bank account, card and
+	transaction fields are wrapped with authorizeScope instead, which also lets an API key or connected app with the
+	scope through; nested fields that read other records check the scope with requireScope. See api-keys.go and oauth.go.
+	node and nodes fetch each record through the authorization of the query that reads it; see node.go.
+
+	Ownership follows the keys of the records:
+		- a Bank is owned by its owning user, as returned by the bank service; the bank service knows a user by the
+		  email they registered with, even after they change it
+		- a BankAccount belongs to a Bank
+		- Cards and Transactions belong to a BankAccount
+
+	Records that do not exist are reported the same as records owned by another user, so ids cannot be probed.
+*/
+package main
+
+import (
+	"context"
+
+	"github.com/graphql-go/graphql"
+	"github.com/satori/go.uuid"
+)
+
+// Verifies the caller, identified by their email, owns the record a field touches
+type ownershipRule func(p graphql.ResolveParams, email string) error
+
+// Verifies the caller owns the record with the id
+type ownershipCheck func(email string, id interface{}) error
+
+// Wrap the resolver so it only runs for a signed in caller that passes the ownership rule; API keys and apps are rejected
+func authorize(rule ownershipRule, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return authorizeScope("", rule, resolve)
+}
+
+// Wrap the resolver so it only runs for a signed in caller, or an API key or app with the scope, that passes the ownership rule
+func authorizeScope(scope string, rule ownershipRule, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		principal, err := callerPrincipal(p.Context)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkScope(principal, scope); err != nil {
+			return nil, err
+		}
+		if err := rule(p, principal.Email); err != nil {
+			return nil, err
+		}
+		return resolve(p)
+	}
+}
+
+// Wrap the resolver of a nested field so it only runs if the caller may use the scope
+func requireScope(scope string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		principal, err := callerPrincipal(p.Context)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkScope(principal, scope); err != nil {
+			return nil, err
+		}
+		return resolve(p)
+	}
+}
+
+// Check the caller may use the scope. A signed in user has every scope; an empty scope is never granted to an API key or app
+func checkScope(principal *Principal, scope string) error {
+	if !principal.Delegated() {
+		return nil
+	}
+	if scope == "" {
+		return ErrSignInRequired
+	}
+	if !principal.HasScope(scope) {
+		return scopeRequiredError(scope)
+	}
+	return nil
+}
+
+// Get the email of the caller from the Authorization header token, app token or API key in the context
+func callerEmail(ctx context.Context) (string, error) {
+	principal, err := callerPrincipal(ctx)
+	if err != nil {
+		return "", err
+	}
+	return principal.Email, nil
+}
+
+/*
+Get the principal of the caller from the Authorization header token, app token or API key in the context.
+The events of a subscription carry the principal validated when it was authorized, so it is not validated again
+*/
+func callerPrincipal(ctx context.Context) (*Principal, error) {
+	if principal, ok := ctx.Value("Principal").(*Principal); ok {
+		return principal, nil
+	}
+	principal, err := boldlygo.AuthService().ValidateToken(ctx.Value("Authorization"))
+	if err != nil {
+		return nil, &codedError{errCodeUnauthenticated, err.Error()}
+	}
+	if principal.Email == "" {
+		return nil, &codedError{errCodeUnauthenticated, "the authorization token does not identify a user"}
+	}
+	return principal, nil
+}
+
+// Get the IP address of the client from the context, to throttle failed attempts and budget anonymous callers
+func callerIP(ctx context.Context) string {
+	ip, _ := ctx.Value("ClientIP").(string)
+	return ip
+}
+
+// Any authenticated caller passes; for fields that act on the caller's own user record
+func signedIn(p graphql.ResolveParams, email string) error {
+	return nil
+}
+
+// The caller must own the record identified by the named argument
+func arg(name string, owns ownershipCheck) ownershipRule {
+	return func(p graphql.ResolveParams, email string) error {
+		return owns(email, p.Args[name])
+	}
+}
+
+// The caller must own the record identified by the field of the named input object argument
+func inputField(name, field string, owns ownershipCheck) ownershipRule {
+	return func(p graphql.ResolveParams, email string) error {
+		input, _ := p.Args[name].(map[string]interface{})
+		return owns(email, input[field])
+	}
+}
+
+// The caller must be the owning user of the Bank
+func ownsBank(email string, id interface{}) error {
+	bankId, err := parseId(id)
+	if err != nil {
+		return err
+	}
+	owner, err := bankOwner(email)
+	if err != nil {
+		return err
+	}
+	bank, err := GetBank(owner, bankId)
+	if err != nil {
+		return err
+	}
+	if bank == nil || bank.OwningUserId != owner || bank.BankId != bankId.String() {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// The id the bank service knows the caller by; it stays the same when the caller changes their email
+func bankOwner(email string) (string, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return "", err
+	}
+	return user.BankOwnerId(), nil
+}
+
+// The caller must own the Bank the BankAccount belongs to
+func ownsAccount(email string, id interface{}) error {
+	accountId, err := parseId(id)
+	if err != nil {
+		return err
+	}
+	account, err := boldlygo.Repositories().BankAccounts().FindByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return ErrForbidden
+	}
+	return ownsBank(email, account.BankId)
+}
+
+// Convert an id argument to a UUID
+func parseId(id interface{}) (uuid.UUID, error) {
+	s, ok := id.(string)
+	if !ok {
+		return uuid.Nil, ErrForbidden
+	}
+	parsed, err := uuid.FromString(s)
+	if err != nil {
+		return uuid.Nil, ErrInvalidId
+	}
+	return parsed, nil
+}
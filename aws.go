@@ -2,24 +2,61 @@
 AWS Configuration/Initialization.
 
 Instantiates a session with the AWS SDK for use and opens/exposes a connection to a DynamoDB instance.
+
+	Configuration is read from the environment:
+		- AWS_REGION: the AWS region to connect to; defaults to us-east-1
+		- DYNAMODB_ENDPOINT: a custom DynamoDB endpoint URL, i.e. http://localhost:8000 for DynamoDB Local
+		- DYNAMODB_TABLE_PREFIX: prepended to every table name, i.e. "dev-" resolves the Users table to "dev-Users"
 */
 package main
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
+const (
+	dynamoDbEndpointKey    = "DYNAMODB_ENDPOINT"
+	dynamoDbTablePrefixKey = "DYNAMODB_TABLE_PREFIX"
+)
+
+// DynamoDB table names, before the environment table prefix is applied
+const (
+	usersTable         = "Users"
+	bankAccountsTable  = "BankAccounts"
+	cardsTable         = "Cards"
+	transactionsTable  = "Transactions"
+	revokedTokensTable = "RevokedTokens"
+	loginAttemptsTable = "LoginAttempts"
+	auditEventsTable   = "AuditEvents"
+	oneTimeTokensTable = "OneTimeTokens"
+	apiKeysTable       = "ApiKeys"
+	oauthClientsTable  = "OAuthClients"
+	oauthGrantsTable   = "OAuthGrants"
+)
+
+// DynamoDB global secondary index names
+const (
+	bankAccountsAccountIdIndex = "accountId-index" // BankAccounts by accountId, to find the bank an account belongs to
+	apiKeysEmailIndex          = "email-index"     // ApiKeys by email, to list the keys of a user
+	oauthGrantsEmailIndex      = "email-index"     // OAuthGrants by email, to list the connected apps of a user
+	transactionsDateIndex      = "dateKey-index"   // Transactions by accountId in date order, to read date ranges
+)
+
 type AwsConfig interface {
 	Init()
 	DynamoDbSvc() *dynamodb.DynamoDB
+	TableName(name string) string
 }
 
 type awsConf struct {
 	dynamodbSvc *dynamodb.DynamoDB
+	tablePrefix string
 }
 
 /*
@@ -28,6 +65,7 @@ Initialize the AWS Service.
 	Uses the AWS_ACCESS_KEY & AWS_SECRET_KEY values stored in the environment to connect to the AWS Account.
 
 	Once the credentials are loaded, instantiate a new DynamoDB service instance
+	in the configured region, against the custom endpoint if one is set.
 */
 func (c *awsConf) Init() {
 	// establish the aws config with the env access key and secret
@@ -35,13 +73,24 @@ func (c *awsConf) Init() {
 	if err != nil {
 		panic(err)
 	}
-	cfg.Region = endpoints.UsEast1RegionID
+	if cfg.Region == "" {
+		cfg.Region = endpoints.UsEast1RegionID // default region if AWS_REGION is not set
+	}
+	if endpoint := os.Getenv(dynamoDbEndpointKey); endpoint != "" {
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(endpoint) // i.e. DynamoDB Local
+	}
+	c.tablePrefix = os.Getenv(dynamoDbTablePrefixKey)
 	// use config to build dynamodb svc
 	c.dynamodbSvc = dynamodb.New(cfg)
-	fmt.Println("AWS Service Initiated")
+	fmt.Println(fmt.Sprintf("AWS Service Initiated: region %s, table prefix %q", cfg.Region, c.tablePrefix))
 }
 
 // Expose the DynamoDb service instance
 func (c *awsConf) DynamoDbSvc() *dynamodb.DynamoDB {
 	return c.dynamodbSvc
 }
+
+// Resolve the environment specific name of the table by applying the configured table prefix
+func (c *awsConf) TableName(name string) string {
+	return c.tablePrefix + name
+}
@@ -1,13 +1,81 @@
 package main
 
 import (
+	"time"
+
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/relay"
 	"github.com/satori/go.uuid"
-	"golang.org/x/net/context"
 )
 
+const (
+	defaultPageSize = 25  // the records in a connection page when neither first nor last is set
+	maxPageSize     = 100 // the most records first or last can ask a connection for
+)
+
+// A page of a connection. count counts every record of the connection; it only runs if totalCount is selected
+type countedConnection struct {
+	Edges    []*relay.Edge  `json:"edges"`
+	PageInfo relay.PageInfo `json:"pageInfo"`
+	count    func() (int, error)
+}
+
+// The fields every connection adds to the relay connection type
+var connectionFields = graphql.Fields{
+	"totalCount": &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.Int),
+		Description: "The number of records in the connection, across every page; counted separately, so only select it when needed",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if c, ok := p.Source.(*countedConnection); ok {
+				return c.count()
+			}
+			return nil, nil
+		},
+	},
+}
+
 var (
+	// SCALAR TYPES
+	MoneyScalar = graphql.NewScalar(graphql.ScalarConfig{
+		Name: "Money",
+		Description: "An exact amount of money in an ISO 4217 currency." +
+			" Serialized as a decimal string followed by the currency code, i.e. \"-12.34 USD\"",
+		Serialize: func(value interface{}) interface{} {
+			switch m := value.(type) {
+			case Money:
+				return m.String()
+			case *Money:
+				return m.String()
+			}
+			return nil
+		},
+		ParseValue: func(value interface{}) interface{} {
+			if s, ok := value.(string); ok {
+				if m, err := ParseMoney(s); err == nil {
+					return m
+				}
+			}
+			return nil
+		},
+		ParseLiteral: func(valueAST ast.Value) interface{} {
+			if s, ok := valueAST.(*ast.StringValue); ok {
+				if m, err := ParseMoney(s.Value); err == nil {
+					return m
+				}
+			}
+			return nil
+		},
+	})
+	// ENUM TYPES
+	SortDirectionEnum = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "SortDirection",
+		Description: "The order to sort records in",
+		Values: graphql.EnumValueConfigMap{
+			"ASC":  &graphql.EnumValueConfig{Value: "ASC", Description: "Oldest or smallest first"},
+			"DESC": &graphql.EnumValueConfig{Value: "DESC", Description: "Newest or largest first"},
+		},
+	})
 	// OUTPUT TYPES
 	AuthType = graphql.NewObject(graphql.ObjectConfig{
 		Name: "Auth",
@@ -16,18 +84,149 @@ var (
 			"message":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"token":     &graphql.Field{Type: graphql.String},
 			"expiresAt": &graphql.Field{Type: graphql.Float},
+
+			"refreshToken":     &graphql.Field{Type: graphql.String},
+			"refreshExpiresAt": &graphql.Field{Type: graphql.Float},
+
+			"twoFactorRequired":  &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"challengeToken":     &graphql.Field{Type: graphql.String},
+			"challengeExpiresAt": &graphql.Field{Type: graphql.Float},
+		},
+	})
+	TotpEnrollmentType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "TotpEnrollment",
+		Description: "The secret to add to an authenticator app, directly or as a QR code of the otpauth URI",
+		Fields: graphql.Fields{
+			"secret":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"otpauthUri": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 		},
 	})
 	UserType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "User",
+		Name:       "User",
+		Interfaces: []*graphql.Interface{nodeDefinitions.NodeInterface},
+		IsTypeOf:   isNodeType("User"),
 		Fields: graphql.Fields{
+			"id":    globalIdField("User"),
 			"email": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+
+			"emailVerified": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"totpEnabled":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"roles": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if u, ok := p.Source.(*User); ok {
+						return u.RoleNames(), nil
+					}
+					return nil, nil
+				},
+			},
+			"locked":       &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"lockedReason": &graphql.Field{Type: graphql.String},
+			"identities": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(ExternalIdentityType))),
+				Description: "The identity provider accounts the user signs in with",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if u, ok := p.Source.(*User); ok {
+						return append([]ExternalIdentity{}, u.Identities...), nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+	ExternalIdentityType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ExternalIdentity",
+		Description: "An identity provider account linked to a user",
+		Fields: graphql.Fields{
+			"provider": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"subject":  &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "The id the identity provider knows the user by"},
+			"linkedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: epochTime(func(s interface{}) int64 { return s.(ExternalIdentity).LinkedAt })},
+		},
+	})
+	ApiKeyType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ApiKey",
+		Description: "A scoped API key for service-to-service access; the key itself is only returned when it is created",
+		Fields: graphql.Fields{
+			"keyId":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"scopes": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+
+			"createdAt":  &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: epochTime(func(s interface{}) int64 { return s.(*ApiKey).CreatedAt })},
+			"expiresAt":  &graphql.Field{Type: graphql.DateTime, Resolve: epochTime(func(s interface{}) int64 { return s.(*ApiKey).ExpiresAt })},
+			"lastUsedAt": &graphql.Field{Type: graphql.DateTime, Description: "Recorded to within an hour", Resolve: epochTime(func(s interface{}) int64 { return s.(*ApiKey).LastUsedAt })},
+			"revokedAt":  &graphql.Field{Type: graphql.DateTime, Resolve: epochTime(func(s interface{}) int64 { return s.(*ApiKey).RevokedAt })},
+		},
+	})
+	NewApiKeyType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "NewApiKey",
+		Fields: graphql.Fields{
+			"apiKey": &graphql.Field{Type: graphql.NewNonNull(ApiKeyType)},
+			"key":    &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "The API key; store it now, as it cannot be shown again"},
+		},
+	})
+	OAuthClientType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "OAuthClient",
+		Description: "A third-party app registered to request access to users' records through OAuth2",
+		Fields: graphql.Fields{
+			"clientId":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"redirectUris": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"scopes":       &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"confidential": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if c, ok := p.Source.(*OAuthClient); ok {
+						return c.SecretHash != "", nil
+					}
+					return false, nil
+				},
+			},
+		},
+	})
+	NewOAuthClientType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "NewOAuthClient",
+		Fields: graphql.Fields{
+			"client":       &graphql.Field{Type: graphql.NewNonNull(OAuthClientType)},
+			"clientSecret": &graphql.Field{Type: graphql.String, Description: "The client secret of a confidential app; store it now, as it cannot be shown again"},
+		},
+	})
+	ConnectedAppType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ConnectedApp",
+		Description: "A third-party app the user allowed to access their records",
+		Fields: graphql.Fields{
+			"clientId": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"scopes":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+
+			"connectedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: epochTime(func(s interface{}) int64 { return s.(*ConnectedApp).ConnectedAt })},
+			"lastUsedAt":  &graphql.Field{Type: graphql.DateTime, Description: "Recorded to within an hour", Resolve: epochTime(func(s interface{}) int64 { return s.(*ConnectedApp).LastUsedAt })},
+		},
+	})
+	IdentityProviderType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "IdentityProvider",
+		Description: "An OIDC identity provider users can sign in with, i.e. a corporate identity provider",
+		Fields: graphql.Fields{
+			"id":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"domains": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), Description: "The email domains it may sign in; empty for any"},
+		},
+	})
+	OidcLoginType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "OidcLogin",
+		Description: "Where to send the user to sign in with an identity provider",
+		Fields: graphql.Fields{
+			"authorizationUrl": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"state":            &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "Keep it, and check the identity provider sends the same state back"},
+			"expiresAt":        &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: epochTime(func(s interface{}) int64 { return s.(*OidcLogin).ExpiresAt })},
 		},
 	})
 	BankType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "Bank",
+		Name:       "Bank",
+		Interfaces: []*graphql.Interface{nodeDefinitions.NodeInterface},
+		IsTypeOf:   isNodeType("Bank"),
 		Fields: graphql.Fields{
+			"id":            globalIdField("Bank"),
 			"owningUserId":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"bankId":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"bankName":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
@@ -37,17 +236,21 @@ var (
 	BankAccountType = graphql.NewObject(graphql.ObjectConfig{
 		Name:        "BankAccount",
 		Description: "The users Bank Account information",
+		Interfaces:  []*graphql.Interface{nodeDefinitions.NodeInterface},
+		IsTypeOf:    isNodeType("BankAccount"),
 		Fields: graphql.Fields{
+			"id":             globalIdField("BankAccount"),
 			"bankId":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"accountId":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"accountName":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"accountType":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"last4":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-			"currentBalance": &graphql.Field{Type: graphql.Float},
+			"currentBalance": &graphql.Field{Type: MoneyScalar},
+			"version":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Incremented on every change; send it back when updating"},
 			"activeCard": &graphql.Field{
 				Type:        CardType,
 				Description: "The Active Card associated with the BankAccount",
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: requireScope(scopeCardsRead, func(p graphql.ResolveParams) (interface{}, error) {
 					if a, ok := p.Source.(*BankAccount); ok {
 						acctId, err := uuid.FromString(a.AccountId)
 						if err != nil {
@@ -56,12 +259,13 @@ var (
 						return GetActiveAccountCard(acctId)
 					}
 					return nil, nil
-				},
+				}),
 			},
 			"transactions": &graphql.Field{
-				Type:        graphql.NewList(TransactionType),
-				Description: "A list of Transactions associated to the Account",
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Type:              graphql.NewList(TransactionType),
+				Description:       "A list of Transactions associated to the Account",
+				DeprecationReason: "Reads every Transaction. Use txnsConn",
+				Resolve: requireScope(scopeTransactionsRead, func(p graphql.ResolveParams) (interface{}, error) {
 					if a, ok := p.Source.(*BankAccount); ok {
 						acctId, err := uuid.FromString(a.AccountId)
 						if err != nil {
@@ -70,41 +274,49 @@ var (
 						return GetAccountTransactions(acctId)
 					}
 					return nil, nil
-				},
+				}),
 			},
-			"txnsConn": &graphql.Field{
-				Type: TransactionConnection.ConnectionType,
-				Args: relay.ConnectionArgs,
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					// convert args map[string]interface into ConnectionArguments
-					args := relay.NewConnectionArguments(p.Args)
-					// get transactions for current account
-					var txns []interface{}
+			"cardsConn": &graphql.Field{
+				Type:        CardConnection.ConnectionType,
+				Description: "A page of the Cards associated to the Account",
+				Args:        relay.ConnectionArgs,
+				Resolve: requireScope(scopeCardsRead, func(p graphql.ResolveParams) (interface{}, error) {
 					if a, ok := p.Source.(*BankAccount); ok {
 						acctId, err := uuid.FromString(a.AccountId)
 						if err != nil {
 							return nil, err
 						}
-						transactions, err := GetAccountTransactions(acctId)
+						return resolveConnection(p, cardPages(acctId), func() (int, error) { return CountAccountCards(acctId) })
+					}
+					return nil, nil
+				}),
+			},
+			"txnsConn": &graphql.Field{
+				Type:        TransactionConnection.ConnectionType,
+				Description: "A page of the Transactions associated to the Account that match the filter arguments, in date order",
+				Args:        transactionConnectionArgs(),
+				Resolve: requireScope(scopeTransactionsRead, func(p graphql.ResolveParams) (interface{}, error) {
+					if a, ok := p.Source.(*BankAccount); ok {
+						acctId, err := uuid.FromString(a.AccountId)
 						if err != nil {
 							return nil, err
 						}
-						for _, txn := range transactions {
-							txns = append(txns, txn)
+						filter, err := transactionFilterOf(p.Args)
+						if err != nil {
+							return nil, err
 						}
+						descending := p.Args["sort"] == "DESC"
+						return resolveConnection(p, transactionPages(acctId, filter, descending), func() (int, error) { return CountAccountTransactions(acctId, filter) })
 					}
-					// let relay library figure out the result, given
-					// - the list of transactions for this bank account
-					// - and the filter arguments (i.e. first, last, after, before)
-					return relay.ConnectionFromArray(txns, args), nil
-				},
+					return nil, nil
+				}),
 			},
 			"bank": &graphql.Field{
 				Type:        BankType,
 				Description: "The Bank record the Account Belongs to",
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					tokenEmail, err := boldlygo.AuthService().ValidateToken(p.Context.Value("Authorization"))
-					if err != nil || tokenEmail == nil {
+					email, err := callerEmail(p.Context)
+					if err != nil {
 						return nil, nil
 					}
 					if a, ok := p.Source.(*BankAccount); ok {
@@ -112,21 +324,39 @@ var (
 						if err != nil {
 							return nil, err
 						}
-						return GetBank(tokenEmail.(string), bankId)
+						owner, err := bankOwner(email)
+						if err != nil {
+							return nil, err
+						}
+						return GetBank(owner, bankId)
 					}
 					return nil, nil
 				},
 			},
 		},
 	})
+	BankAccountConnection = relay.ConnectionDefinitions(relay.ConnectionConfig{
+		Name:             "BankAccount",
+		NodeType:         BankAccountType,
+		ConnectionFields: connectionFields,
+	})
+	CardConnection = relay.ConnectionDefinitions(relay.ConnectionConfig{
+		Name:             "Card",
+		NodeType:         CardType,
+		ConnectionFields: connectionFields,
+	})
 	TransactionConnection = relay.ConnectionDefinitions(relay.ConnectionConfig{
-		Name:     "Txn",
-		NodeType: TransactionType,
+		Name:             "Txn",
+		NodeType:         TransactionType,
+		ConnectionFields: connectionFields,
 	})
 	CardType = graphql.NewObject(graphql.ObjectConfig{
 		Name:        "Card",
 		Description: "A Debit/Credit Card record associated to a Users Bank Account",
+		Interfaces:  []*graphql.Interface{nodeDefinitions.NodeInterface},
+		IsTypeOf:    isNodeType("Card"),
 		Fields: graphql.Fields{
+			"id":          globalIdField("Card"),
 			"accountId":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"cardId":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"last4":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
@@ -134,26 +364,27 @@ var (
 			"expiryYear":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"cvv":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"active":      &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"version":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Incremented on every change; send it back when updating"},
 		},
 	})
 	TransactionType = graphql.NewObject(graphql.ObjectConfig{
 		Name:        "Transaction",
 		Description: "A Transaction record associated with the BankAccount",
+		Interfaces:  []*graphql.Interface{nodeDefinitions.NodeInterface},
+		IsTypeOf:    isNodeType("Transaction"),
 		Fields: graphql.Fields{
-			"id": relay.GlobalIDField("TxnType", func(obj interface{}, info graphql.ResolveInfo, ctx context.Context) (string, error) {
-				return "transactionId", nil
-			}),
+			"id":              globalIdField("Transaction"),
 			"accountId":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"transactionId":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"transactionDate": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
-			"amount":          &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"amount":          &graphql.Field{Type: graphql.NewNonNull(MoneyScalar)},
 			"transactionType": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"description":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"cardId":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 			"card": &graphql.Field{
 				Type:        CardType,
 				Description: "The Card associated with the Transaction",
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: requireScope(scopeCardsRead, func(p graphql.ResolveParams) (interface{}, error) {
 					if t, ok := p.Source.(*Transaction); ok {
 						if t.CardId == nil {
 							return nil, nil
@@ -169,7 +400,7 @@ var (
 						return GetAccountCard(acctId, cardId)
 					}
 					return nil, nil
-				},
+				}),
 			},
 		},
 	})
@@ -182,16 +413,24 @@ var (
 			"name":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 		},
 	})
+	ProfileInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "ProfileInput",
+		Description: "The profile fields to update; fields that are not set are left unchanged",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
 	BankAccountInputType = graphql.NewInputObject(graphql.InputObjectConfig{
 		Name:        "BankAccountInput",
 		Description: "The BankAccount input object to use to create/update a BankAccount record",
 		Fields: graphql.InputObjectConfigFieldMap{
-			"bankId":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"accountId":      &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"accountName":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"accountType":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"last4":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"currentBalance": &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"bankId":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"accountId":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"accountName": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"accountType": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"last4":       &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"currency":    &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "The ISO 4217 currency of a new BankAccount; defaults to USD. Ignored on update"},
+			"version":     &graphql.InputObjectFieldConfig{Type: graphql.Int, Description: "The version read; required to update"},
 		},
 	})
 	CardInputType = graphql.NewInputObject(graphql.InputObjectConfig{
@@ -205,6 +444,7 @@ var (
 			"expiryYear":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"cvv":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"active":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Boolean)},
+			"version":     &graphql.InputObjectFieldConfig{Type: graphql.Int, Description: "The version read; required to update"},
 		},
 	})
 	TransactionInputType = graphql.NewInputObject(graphql.InputObjectConfig{
@@ -214,10 +454,181 @@ var (
 			"accountId":       &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"transactionId":   &graphql.InputObjectFieldConfig{Type: graphql.String},
 			"transactionDate": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.DateTime)},
-			"amount":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Float)},
+			"amount":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(MoneyScalar)},
 			"transactionType": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"description":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"cardId":          &graphql.InputObjectFieldConfig{Type: graphql.String},
 		},
 	})
 )
+
+// Resolve an epoch seconds time of the source record as a DateTime; null if it is not set
+func epochTime(get func(source interface{}) int64) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if seconds := get(p.Source); seconds != 0 {
+			return time.Unix(seconds, 0).UTC(), nil
+		}
+		return nil, nil
+	}
+}
+
+/*
+Map the relay connection arguments to the repository PageRequest.
+
+  - first/after: read forward, starting after the "after" cursor
+  - last/before: read backward, starting before the "before" cursor
+  - neither first nor last: read the default page size forward
+*/
+func connectionPageRequest(args relay.ConnectionArguments) PageRequest {
+	if args.Last > 0 || (args.Before != "" && args.First < 0) {
+		pageReq := PageRequest{StartKey: string(args.Before), Reverse: true, Limit: defaultPageSize}
+		if args.Last > 0 {
+			pageReq.Limit = args.Last
+		}
+		return pageReq
+	}
+	pageReq := PageRequest{StartKey: string(args.After), Limit: defaultPageSize}
+	if args.First > 0 {
+		pageReq.Limit = args.First
+	}
+	return pageReq
+}
+
+/*
+Resolve a connection field with the page the connection arguments select.
+readPage reads a page of the records, returning their edges and if more records exist past the page. The records are
+only counted if totalCount is selected
+*/
+func resolveConnection(p graphql.ResolveParams, readPage func(PageRequest) ([]*relay.Edge, bool, error), count func() (int, error)) (interface{}, error) {
+	args := relay.NewConnectionArguments(p.Args)
+	if args.First > maxPageSize || args.Last > maxPageSize {
+		return nil, ErrPageTooLarge
+	}
+	conn := &countedConnection{Edges: []*relay.Edge{}, count: count}
+	if args.First == 0 || args.Last == 0 {
+		return conn, nil // an empty page was requested
+	}
+	pageReq := connectionPageRequest(args)
+	edges, hasMore, err := readPage(pageReq)
+	if err != nil {
+		return nil, err
+	}
+	conn.Edges = edges
+	if len(edges) > 0 {
+		conn.PageInfo.StartCursor = edges[0].Cursor
+		conn.PageInfo.EndCursor = edges[len(edges)-1].Cursor
+	}
+	// records exist before a page read after a cursor, and after a page read before a cursor
+	if pageReq.Reverse {
+		conn.PageInfo.HasPreviousPage = hasMore
+		conn.PageInfo.HasNextPage = pageReq.StartKey != ""
+	} else {
+		conn.PageInfo.HasNextPage = hasMore
+		conn.PageInfo.HasPreviousPage = pageReq.StartKey != ""
+	}
+	return conn, nil
+}
+
+// Read the pages of the BankAccounts of the Bank; each edge cursor is the BankAccount primary key
+func bankAccountPages(bankId uuid.UUID) func(PageRequest) ([]*relay.Edge, bool, error) {
+	return func(pageReq PageRequest) ([]*relay.Edge, bool, error) {
+		page, err := GetUserBankAccountsPage(bankId, pageReq)
+		if err != nil {
+			return nil, false, err
+		}
+		edges := make([]*relay.Edge, 0, len(page.Accounts))
+		for _, account := range page.Accounts {
+			edges = append(edges, &relay.Edge{Node: account, Cursor: relay.ConnectionCursor(bankAccountCursor(account))})
+		}
+		return edges, page.HasMore, nil
+	}
+}
+
+// Read the pages of the Cards of the BankAccount; each edge cursor is the Card primary key
+func cardPages(accountId uuid.UUID) func(PageRequest) ([]*relay.Edge, bool, error) {
+	return func(pageReq PageRequest) ([]*relay.Edge, bool, error) {
+		page, err := GetAccountCardsPage(accountId, pageReq)
+		if err != nil {
+			return nil, false, err
+		}
+		edges := make([]*relay.Edge, 0, len(page.Cards))
+		for _, card := range page.Cards {
+			edges = append(edges, &relay.Edge{Node: card, Cursor: relay.ConnectionCursor(cardCursor(card))})
+		}
+		return edges, page.HasMore, nil
+	}
+}
+
+/*
+The arguments of the Transaction connection: the relay connection arguments, the filters and the sort direction.
+The filters combine; dateFrom is inclusive and dateTo exclusive, so the ranges of consecutive statements do not overlap
+*/
+func transactionConnectionArgs() graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{
+		"dateFrom":            &graphql.ArgumentConfig{Type: graphql.DateTime, Description: "Transactions dated at or after"},
+		"dateTo":              &graphql.ArgumentConfig{Type: graphql.DateTime, Description: "Transactions dated before"},
+		"amountMin":           &graphql.ArgumentConfig{Type: MoneyScalar, Description: "Transactions of at least the amount, in its currency"},
+		"amountMax":           &graphql.ArgumentConfig{Type: MoneyScalar, Description: "Transactions of at most the amount, in its currency"},
+		"transactionType":     &graphql.ArgumentConfig{Type: graphql.String},
+		"cardId":              &graphql.ArgumentConfig{Type: graphql.String},
+		"descriptionContains": &graphql.ArgumentConfig{Type: graphql.String, Description: "Case sensitive"},
+		"sort":                &graphql.ArgumentConfig{Type: SortDirectionEnum, DefaultValue: "ASC", Description: "The transaction date order"},
+	}
+	for name, arg := range relay.ConnectionArgs {
+		args[name] = arg
+	}
+	return args
+}
+
+// Build the TransactionFilter from the filter arguments of the Transaction connection
+func transactionFilterOf(args map[string]interface{}) (TransactionFilter, error) {
+	var filter TransactionFilter
+	var err error
+	if filter.DateFrom, err = dateTimeArg(args["dateFrom"]); err != nil {
+		return filter, err
+	}
+	if filter.DateTo, err = dateTimeArg(args["dateTo"]); err != nil {
+		return filter, err
+	}
+	if amount, ok := args["amountMin"].(Money); ok {
+		filter.AmountMin = &amount
+	}
+	if amount, ok := args["amountMax"].(Money); ok {
+		filter.AmountMax = &amount
+	}
+	filter.TransactionType, _ = args["transactionType"].(string)
+	filter.CardId, _ = args["cardId"].(string)
+	filter.DescriptionContains, _ = args["descriptionContains"].(string)
+	return filter, nil
+}
+
+// A DateTime argument; the DateTime scalar parses variables to a time, but leaves literals as the string. The zero time if not set
+func dateTimeArg(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, ErrInvalidDateTime
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// Read the pages of the Transactions of the BankAccount matching the filter, in date order; each edge cursor is the Transaction date key
+func transactionPages(accountId uuid.UUID, filter TransactionFilter, descending bool) func(PageRequest) ([]*relay.Edge, bool, error) {
+	return func(pageReq PageRequest) ([]*relay.Edge, bool, error) {
+		pageReq.Descending = descending
+		page, err := GetAccountTransactionsPage(accountId, filter, pageReq)
+		if err != nil {
+			return nil, false, err
+		}
+		edges := make([]*relay.Edge, 0, len(page.Transactions))
+		for _, txn := range page.Transactions {
+			edges = append(edges, &relay.Edge{Node: txn, Cursor: relay.ConnectionCursor(transactionCursor(txn))})
+		}
+		return edges, page.HasMore, nil
+	}
+}
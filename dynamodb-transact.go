@@ -0,0 +1,82 @@
+/*
+DynamoDB TransactWriteItems Operation.
+
+	The vendored aws-sdk-go-v2 preview predates the DynamoDB transactions API, so the TransactWriteItems
+	request is built here on top of the DynamoDB client. The client's JSON RPC handlers marshal the input,
+	sign the request and unmarshal errors exactly as they do for the generated operations.
+*/
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	opTransactWriteItems                     = "TransactWriteItems"
+	errCodeTransactionCanceledException      = "TransactionCanceledException"
+	cancellationReasonConditionalCheckFailed = "ConditionalCheckFailed"
+)
+
+type transactWriteItemsInput struct {
+	_ struct{} `type:"structure"`
+
+	TransactItems []transactWriteItem `min:"1" type:"list" required:"true"`
+}
+
+// A single write in the transaction; exactly one of Put or Update is set
+type transactWriteItem struct {
+	_ struct{} `type:"structure"`
+
+	Put    *transactPut    `type:"structure"`
+	Update *transactUpdate `type:"structure"`
+}
+
+type transactPut struct {
+	_ struct{} `type:"structure"`
+
+	ConditionExpression       *string                            `type:"string"`
+	ExpressionAttributeNames  map[string]string                  `type:"map"`
+	ExpressionAttributeValues map[string]dynamodb.AttributeValue `type:"map"`
+	Item                      map[string]dynamodb.AttributeValue `type:"map" required:"true"`
+	TableName                 *string                            `min:"3" type:"string" required:"true"`
+}
+
+type transactUpdate struct {
+	_ struct{} `type:"structure"`
+
+	ConditionExpression       *string                            `type:"string"`
+	ExpressionAttributeNames  map[string]string                  `type:"map"`
+	ExpressionAttributeValues map[string]dynamodb.AttributeValue `type:"map"`
+	Key                       map[string]dynamodb.AttributeValue `type:"map" required:"true"`
+	TableName                 *string                            `min:"3" type:"string" required:"true"`
+	UpdateExpression          *string                            `type:"string" required:"true"`
+}
+
+type transactWriteItemsOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// Send the TransactWriteItems request; every write in the input succeeds or none of them are applied
+func transactWriteItems(svc *dynamodb.DynamoDB, input *transactWriteItemsInput) error {
+	op := &aws.Operation{
+		Name:       opTransactWriteItems,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := svc.NewRequest(op, input, &transactWriteItemsOutput{})
+	return req.Send()
+}
+
+// Check if the error is a canceled transaction caused by a failed condition expression
+func isTransactionConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != errCodeTransactionCanceledException {
+		return false
+	}
+	// the cancellation reasons are listed in the message, i.e. "... [ConditionalCheckFailed, None]"
+	return strings.Contains(aerr.Message(), cancellationReasonConditionalCheckFailed)
+}
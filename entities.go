@@ -7,12 +7,173 @@ type Auth struct {
 	Message   string `json:"message"`
 	Token     string `json:"token"`
 	ExpiresAt int64  `json:"expiresAt"`
+
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt int64  `json:"refreshExpiresAt"`
+
+	TwoFactorRequired  bool   `json:"twoFactorRequired"`
+	ChallengeToken     string `json:"challengeToken"`
+	ChallengeExpiresAt int64  `json:"challengeExpiresAt"`
+}
+
+// A refresh token revoked by logging out; kept until the token expires
+type RevokedToken struct {
+	Jti       string `json:"jti"`
+	ExpiresAt int64  `json:"expiresAt"` // epoch seconds
+}
+
+// A single use token emailed to a user, i.e. to reset their password; only the hash of the token is stored
+type OneTimeToken struct {
+	TokenHash string `json:"tokenHash"` // SHA-256 of the token, hex encoded
+	Purpose   string `json:"purpose"`
+	Email     string `json:"email"`
+	NewEmail  string `json:"newEmail,omitempty"` // the email to change to, for an email change token
+	IssuedAt  int64  `json:"issuedAt"`           // epoch seconds
+	ExpiresAt int64  `json:"expiresAt"`          // epoch seconds
+
+	// the request an OAuth2 authorization code was issued for
+	ClientId      string   `json:"clientId,omitempty"`
+	RedirectUri   string   `json:"redirectUri,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+	CodeChallenge string   `json:"codeChallenge,omitempty"` // the PKCE S256 code challenge
+
+	// the OIDC login a state was issued for
+	Provider     string `json:"provider,omitempty"`     // the id of the identity provider
+	Nonce        string `json:"nonce,omitempty"`        // the ID token must carry the nonce
+	CodeVerifier string `json:"codeVerifier,omitempty"` // the PKCE code verifier to exchange the code with
+}
+
+// A long-lived key for service-to-service access, acting as the user that created it; only the hash of its secret is stored
+type ApiKey struct {
+	KeyId      string   `json:"keyId"`
+	Email      string   `json:"email"` // the user the key acts as
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	SecretHash string   `json:"secretHash"`           // SHA-256 of the secret, hex encoded
+	CreatedAt  int64    `json:"createdAt"`            // epoch seconds
+	ExpiresAt  int64    `json:"expiresAt,omitempty"`  // epoch seconds; 0 if the key does not expire
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"` // epoch seconds, to within an hour; 0 if never used
+	RevokedAt  int64    `json:"revokedAt,omitempty"`  // epoch seconds; 0 unless revoked
+}
+
+// A newly created API key, with the key itself; the key is only ever returned here
+type NewApiKey struct {
+	ApiKey *ApiKey `json:"apiKey"`
+	Key    string  `json:"key"`
+}
+
+// A third-party app registered to request access to users' records through OAuth2
+type OAuthClient struct {
+	ClientId     string   `json:"clientId"`
+	Name         string   `json:"name"`
+	RedirectUris []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`               // the scopes the app may request
+	SecretHash   string   `json:"secretHash,omitempty"` // SHA-256 of the client secret, hex encoded; empty for a public client
+	CreatedAt    int64    `json:"createdAt"`            // epoch seconds
+	CreatedBy    string   `json:"createdBy"`            // the admin that registered the app
+}
+
+// A newly registered OAuthClient, with its secret; the secret is only ever returned here
+type NewOAuthClient struct {
+	Client       *OAuthClient `json:"client"`
+	ClientSecret string       `json:"clientSecret,omitempty"`
+}
+
+// The access a user granted a connected app; app tokens only work while the grant is not revoked
+type OAuthGrant struct {
+	GrantId    string   `json:"grantId"`
+	Email      string   `json:"email"` // the user the app acts as
+	ClientId   string   `json:"clientId"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"createdAt"`            // epoch seconds
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"` // epoch seconds, to within an hour; 0 if never used
+	RevokedAt  int64    `json:"revokedAt,omitempty"`  // epoch seconds; 0 unless revoked
+}
+
+// An app the user connected, as listed to the user
+type ConnectedApp struct {
+	ClientId    string   `json:"clientId"`
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	ConnectedAt int64    `json:"connectedAt"`          // epoch seconds
+	LastUsedAt  int64    `json:"lastUsedAt,omitempty"` // epoch seconds, to within an hour; 0 if never used
+}
+
+// An OIDC identity provider users can sign in with, i.e. a customer's corporate identity provider
+type IdentityProvider struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"` // the email domains it may sign in; empty for any
+}
+
+// Where to send the user to sign in with an identity provider, and the state to expect back
+type OidcLogin struct {
+	AuthorizationUrl string `json:"authorizationUrl"`
+	State            string `json:"state"`
+	ExpiresAt        int64  `json:"expiresAt"` // epoch seconds
+}
+
+// Failed sign in attempts of an email or client IP address; discarded once they expire
+type LoginAttempts struct {
+	Subject     string `json:"subject"`     // "email:<email>" or "ip:<address>"
+	Failures    int    `json:"failures"`    // failures since the last lockout
+	Lockouts    int    `json:"lockouts"`    // lockouts in a row; each one doubles the next lockout duration
+	LockedUntil int64  `json:"lockedUntil"` // epoch seconds; 0 if not locked out
+	ExpiresAt   int64  `json:"expiresAt"`   // epoch seconds
+}
+
+// An entry in the security audit trail
+type AuditEvent struct {
+	Subject    string    `json:"subject"`
+	EventId    string    `json:"eventId"` // the occurredAt time then a unique id, so the events of a subject sort by time
+	EventType  string    `json:"eventType"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Detail     string    `json:"detail"`
 }
 
 type User struct {
 	Email string `json:"email"`
 	Pwd   string `json:"pwd"`
 	Name  string `json:"name"`
+
+	EmailVerified bool   `json:"emailVerified"`     // the user followed the link emailed to them
+	PwdChangedAt  int64  `json:"pwdChangedAt"`      // epoch seconds; refresh tokens issued before are no longer accepted
+	BankUserId    string `json:"bankUserId"`        // the id the bank service knows the user by: the email they registered with
+	MovedTo       string `json:"movedTo,omitempty"` // only set on the record left at a previous email; the current email
+
+	Roles        []string `json:"roles"`                  // customer, support and/or admin; empty is a customer
+	Locked       bool     `json:"locked"`                 // locked by staff; the user cannot sign in or use their tokens
+	LockedReason string   `json:"lockedReason,omitempty"` // why staff locked the user
+
+	TotpSecret    string   `json:"totpSecret"`    // base32 TOTP secret; set on enrollment, before it is enabled
+	TotpEnabled   bool     `json:"totpEnabled"`   // two-factor authentication is required to sign in
+	TotpLastStep  int64    `json:"totpLastStep"`  // the time step of the last code used, so a code cannot be replayed
+	RecoveryCodes []string `json:"recoveryCodes"` // SHA-256 hashes of the unused recovery codes
+
+	Identities []ExternalIdentity `json:"identities,omitempty"` // the identity provider accounts the user signs in with
+
+	Version int64 `json:"version"` // incremented on every save, so a save never overwrites another made since the read
+}
+
+// An identity provider account linked to a User, by the subject the provider knows them by
+type ExternalIdentity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	LinkedAt int64  `json:"linkedAt"` // epoch seconds
+}
+
+// The id the bank service knows the user by. Users registered before it was recorded are known by their email
+func (u *User) BankOwnerId() string {
+	if u.BankUserId != "" {
+		return u.BankUserId
+	}
+	return u.Email
+}
+
+// The TOTP secret and otpauth URI to enroll an authenticator app with
+type TotpEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauthUri"`
 }
 
 type Bank struct {
@@ -23,12 +184,13 @@ type Bank struct {
 }
 
 type BankAccount struct {
-	BankId         string  `json:"bankId"`
-	AccountId      string  `json:"accountId"`
-	AccountName    string  `json:"accountName"`
-	AccountType    string  `json:"accountType"`
-	Last4          string  `json:"last4"`
-	CurrentBalance float64 `json:"currentBalance"`
+	BankId         string `json:"bankId"`
+	AccountId      string `json:"accountId"`
+	AccountName    string `json:"accountName"`
+	AccountType    string `json:"accountType"`
+	Last4          string `json:"last4"`
+	CurrentBalance Money  `json:"currentBalance"`
+	Version        int64  `json:"version"`
 }
 
 type Card struct {
@@ -39,13 +201,14 @@ type Card struct {
 	ExpiryYear  string `json:"expiryYear"`
 	CVV         string `json:"cvv"`
 	Active      bool   `json:"active"`
+	Version     int64  `json:"version"`
 }
 
 type Transaction struct {
 	AccountId       string    `json:"accountId"`
 	TransactionId   string    `json:"transactionId"`
 	TransactionDate time.Time `json:"transactionDate"`
-	Amount          float64   `json:"amount"`
+	Amount          Money     `json:"amount"`
 	TransactionType string    `json:"transactionType"`
 	Description     string    `json:"description"`
 	CardId          *string   `json:"cardId"`
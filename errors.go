@@ -0,0 +1,168 @@
+/*
+Errors surfaced to GraphQL clients.
+
+	Each error carries a machine readable code, returned in the extensions of the GraphQL error:
+		{"message": "...", "extensions": {"code": "CONFLICT"}}
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	errCodeConflict      = "CONFLICT"
+	errCodeNotFound      = "NOT_FOUND"
+	errCodeAlreadyExists = "ALREADY_EXISTS"
+	errCodeInvalidInput  = "INVALID_INPUT"
+
+	errCodeUnauthenticated = "UNAUTHENTICATED"
+	errCodeForbidden       = "FORBIDDEN"
+	errCodeTooManyAttempts = "TOO_MANY_ATTEMPTS"
+
+	errCodeQueryTooComplex = "QUERY_TOO_COMPLEX"
+	errCodeRateLimited     = "RATE_LIMITED"
+)
+
+var (
+	// Returned when a record was changed since the version the client read
+	ErrConflict = &codedError{errCodeConflict, "the record was changed by another request. reload it and try again"}
+	// Returned when writing to a BankAccount that does not exist
+	ErrBankAccountNotFound = &codedError{errCodeNotFound, "the BankAccount does not exist"}
+	// Returned when writing to a Card that does not exist
+	ErrCardNotFound = &codedError{errCodeNotFound, "the Card does not exist"}
+	// Returned when registering an email that already has a User
+	ErrUserExists = &codedError{errCodeAlreadyExists, "a user is already registered with the email"}
+	// Returned when the caller does not own the record, or it does not exist
+	ErrForbidden = &codedError{errCodeForbidden, "you do not have access to this record"}
+	// Returned when the caller does not have a role the field requires
+	ErrRoleRequired = &codedError{errCodeForbidden, "your role does not allow this operation"}
+	// Returned when a field that manages the user or needs a staff role is used with an API key or by a connected app
+	ErrSignInRequired = &codedError{errCodeForbidden, "this operation cannot be used with an API key or by a connected app. please sign in"}
+	// Returned when revoking an API key the caller does not have
+	ErrApiKeyNotFound = &codedError{errCodeNotFound, "the API key does not exist"}
+	// Returned when revoking an app the caller has not connected
+	ErrConnectedAppNotFound = &codedError{errCodeNotFound, "the app is not connected"}
+	// Returned when signing in with an identity provider that is not configured
+	ErrIdentityProviderNotFound = &codedError{errCodeNotFound, "the identity provider does not exist"}
+	// Returned when an id argument is not a UUID
+	ErrInvalidId = &codedError{errCodeInvalidInput, "the id is not a valid UUID"}
+	// Returned when reading a page after or before a cursor that is not of a record of the connection
+	ErrInvalidCursor = &codedError{errCodeInvalidInput, "invalid page cursor"}
+	// Returned when a connection is asked for more records than a page can have
+	ErrPageTooLarge = &codedError{errCodeInvalidInput, "first and last must be at most 100"}
+	// Returned when a DateTime argument is not an RFC 3339 date time
+	ErrInvalidDateTime = &codedError{errCodeInvalidInput, "dates must be RFC 3339 date times, i.e. \"2024-01-31T00:00:00Z\""}
+	// Returned when filtering Transactions by a date range that ends before it starts
+	ErrInvalidDateRange = &codedError{errCodeInvalidInput, "dateFrom must be before dateTo"}
+	// Returned when filtering Transactions by an amount range that is empty, or in two currencies
+	ErrInvalidAmountRange = &codedError{errCodeInvalidInput, "amountMin must be at most amountMax, in the same currency"}
+	// Returned when fetching a node by an id that is not a global id of a Node type
+	ErrInvalidNodeId = &codedError{errCodeInvalidInput, "the id is not a valid node id"}
+	// Returned when fetching more nodes than nodes allows at once
+	ErrTooManyNodeIds = &codedError{errCodeInvalidInput, "at most 100 ids can be fetched at once"}
+	// Returned when the user the token was issued to was locked by staff
+	ErrUserLocked = &codedError{errCodeForbidden, "the account is locked. please contact support"}
+	// Returned when the user the token was issued to no longer exists
+	ErrUserNotFound = &codedError{errCodeUnauthenticated, "unable to find the user the token was issued to"}
+	// Returned when enrolling a user that already has two-factor authentication enabled
+	ErrTotpEnabled = &codedError{errCodeAlreadyExists, "two-factor authentication is already enabled. disable it before enrolling again"}
+	// Returned when confirming two-factor authentication before enrolling
+	ErrTotpNotEnrolled = &codedError{errCodeNotFound, "two-factor authentication is not enrolled. call enrollTotp first"}
+	// Returned when changing two-factor authentication of a user that does not have it enabled
+	ErrTotpNotEnabled = &codedError{errCodeNotFound, "two-factor authentication is not enabled"}
+	// Returned when the email or client IP address is locked out after too many failed attempts
+	ErrTooManyAttempts = &codedError{errCodeTooManyAttempts, "too many failed attempts. please try again later"}
+)
+
+// Returned when the API key or connected app the caller is does not have the scope a field requires
+func scopeRequiredError(scope string) error {
+	return &codedError{errCodeForbidden, "access to the " + scope + " scope was not granted"}
+}
+
+// Returned when an operation nests fields deeper than the maximum depth
+func queryTooDeepError(depth, maxDepth int) error {
+	return &codedError{errCodeQueryTooComplex, fmt.Sprintf("the query has a depth of %d, over the maximum of %d", depth, maxDepth)}
+}
+
+// Returned when an operation costs more than the maximum cost
+func queryTooCostlyError(cost, maxCost int) error {
+	return &codedError{errCodeQueryTooComplex, fmt.Sprintf("the query costs %d, over the maximum of %d. select fewer nested lists, or fewer records with first or last", cost, maxCost)}
+}
+
+// Returned when a fragment of a request spreads itself, directly or through other fragments
+func fragmentCycleError(name string) error {
+	return &codedError{errCodeInvalidInput, fmt.Sprintf("the fragment %s spreads itself", name)}
+}
+
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+// Expose the error code in the GraphQL error extensions
+func (e *codedError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// A problem with a single field of a mutation input
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+/*
+Returned when mutation input fails validation. Lists every problem by field in the extensions:
+
+	{"code": "INVALID_INPUT", "fields": [{"field": "pwd", "message": "must be at least 8 characters"}]}
+*/
+type validationError struct {
+	fields []FieldError
+}
+
+// Record a problem with the field
+func (e *validationError) Add(field, message string) {
+	e.fields = append(e.fields, FieldError{Field: field, Message: message})
+}
+
+// Return the validationError if any problems were recorded, otherwise nil
+func (e *validationError) Err() error {
+	if len(e.fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *validationError) Error() string {
+	var problems []string
+	for _, f := range e.fields {
+		problems = append(problems, f.Field+" "+f.Message)
+	}
+	return "invalid input: " + strings.Join(problems, "; ")
+}
+
+func (e *validationError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": errCodeInvalidInput, "fields": e.fields}
+}
+
+/*
+Returned when the caller has spent their query cost budget. The extensions carry the seconds until the operation fits:
+
+	{"code": "RATE_LIMITED", "retryAfter": 12}
+*/
+type costBudgetError struct {
+	retryAfter int // seconds
+}
+
+func (e *costBudgetError) Error() string {
+	return fmt.Sprintf("the query cost budget is spent. please try again in %d seconds", e.retryAfter)
+}
+
+func (e *costBudgetError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": errCodeRateLimited, "retryAfter": e.retryAfter}
+}
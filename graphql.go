@@ -1,7 +1,7 @@
 /*
 GraphQL Instance for the Boldly Go Application.
 
-	Instantiates the GraphQL Schema with all of the queries and mutations to be used for the app.
+	Instantiates the GraphQL Schema with all of the queries, mutations and subscriptions to be used for the app.
 */
 package main
 
@@ -10,6 +10,7 @@ import (
 	"fmt"
 
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/relay"
 	"github.com/mitchellh/mapstructure"
 	"github.com/satori/go.uuid"
 )
@@ -18,12 +19,14 @@ type BoldlyGoGraphQL interface {
 	BuildSchema() graphql.Schema
 	buildQuery()
 	buildMutation()
+	buildSubscription()
 }
 
 type boldlyGoGraphQL struct {
-	queries   graphql.ObjectConfig
-	mutations graphql.ObjectConfig
-	schema    graphql.Schema
+	queries       graphql.ObjectConfig
+	mutations     graphql.ObjectConfig
+	subscriptions graphql.ObjectConfig
+	schema        graphql.Schema
 }
 
 // Build the Boldly Go RootQuery object which contains the queries being exposed by the service.
@@ -31,26 +34,91 @@ func (b *boldlyGoGraphQL) buildQuery() {
 	b.queries = graphql.ObjectConfig{
 		Name: "RootQuery",
 		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        UserType,
+				Description: "Get the signed in user",
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return GetProfile(email)
+				}),
+			},
+			"apiKeys": &graphql.Field{
+				Type:        graphql.NewList(ApiKeyType),
+				Description: "Get the API keys of the signed in user, newest first",
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return ListApiKeys(email)
+				}),
+			},
+			"connectedApps": &graphql.Field{
+				Type:        graphql.NewList(ConnectedAppType),
+				Description: "Get the third-party apps the signed in user connected, most recently connected first",
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return ConnectedApps(email)
+				}),
+			},
+			"identityProviders": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(IdentityProviderType))),
+				Description: "Get the identity providers users can sign in with, i.e. to show a button for each",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return IdentityProviders(), nil
+				},
+			},
+			"node": nodeDefinitions.NodeField, // fetch a User, Bank, BankAccount, Card or Transaction by its global id
+			"nodes": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(nodeDefinitions.NodeInterface)),
+				Description: "Fetches objects given their IDs; an object that cannot be fetched is null",
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID))),
+					},
+				},
+				Resolve: fetchNodes,
+			},
 			"bankAccounts": &graphql.Field{
-				Type:        graphql.NewList(BankAccountType),
-				Description: "Get a list of the users BankAccount records by the Bank primary key",
+				Type:              graphql.NewList(BankAccountType),
+				Description:       "Get a list of the users BankAccount records by the Bank primary key",
+				DeprecationReason: "Reads every BankAccount. Use bankAccountsConn",
 				Args: graphql.FieldConfigArgument{
 					"bankId": &graphql.ArgumentConfig{
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					_, err := boldlygo.AuthService().ValidateToken(p.Context.Value("Authorization")) // validate auth token exists and is valid
+				Resolve: authorizeScope(scopeAccountsRead, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
+					bankId := p.Args["bankId"]                       // get passed in bankId from arguments
+					_bankId, err := uuid.FromString(bankId.(string)) // convert the bankId arg to a UUID
 					if err != nil {
 						return nil, err
 					}
+					return GetUserBankAccounts(_bankId) // get a list of the users BankAccounts by the bankId
+				}),
+			},
+			"bankAccountsConn": &graphql.Field{
+				Type:        BankAccountConnection.ConnectionType,
+				Description: "Get a page of the users BankAccount records by the Bank primary key",
+				Args: relay.NewConnectionArgs(graphql.FieldConfigArgument{
+					"bankId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				}),
+				Resolve: authorizeScope(scopeAccountsRead, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
 					bankId := p.Args["bankId"]                       // get passed in bankId from arguments
 					_bankId, err := uuid.FromString(bankId.(string)) // convert the bankId arg to a UUID
 					if err != nil {
 						return nil, err
 					}
-					return GetUserBankAccounts(_bankId) // get a list of the users BankAccounts by the bankId
-				},
+					return resolveConnection(p, bankAccountPages(_bankId), func() (int, error) { return CountUserBankAccounts(_bankId) })
+				}),
 			},
 			"bankAccount": &graphql.Field{
 				Type:        BankAccountType,
@@ -63,7 +131,7 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeAccountsRead, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
 					bankId := p.Args["bankId"]                       // get passed in bankId from args
 					_bankId, err := uuid.FromString(bankId.(string)) // convert the bankId arg to a UUID
 					if err != nil {
@@ -75,24 +143,42 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						return nil, err
 					}
 					return GetUserBankAccount(_bankId, _acctId) // get a unique BankAccount by the BankId and AccountId
-				},
+				}),
 			},
 			"accountCards": &graphql.Field{
-				Type:        graphql.NewList(CardType),
-				Description: "A list of cards associated to the BankAccount",
+				Type:              graphql.NewList(CardType),
+				Description:       "A list of cards associated to the BankAccount",
+				DeprecationReason: "Reads every Card. Use accountCardsConn",
 				Args: graphql.FieldConfigArgument{
 					"accountId": &graphql.ArgumentConfig{
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeCardsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
 					acctId := p.Args["accountId"]                    // get passed in accountId from args
 					_acctId, err := uuid.FromString(acctId.(string)) // convert the acctId arg to a UUID
 					if err != nil {
 						return nil, err
 					}
 					return GetAccountCards(_acctId)
-				},
+				}),
+			},
+			"accountCardsConn": &graphql.Field{
+				Type:        CardConnection.ConnectionType,
+				Description: "A page of the cards associated to the BankAccount",
+				Args: relay.NewConnectionArgs(graphql.FieldConfigArgument{
+					"accountId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				}),
+				Resolve: authorizeScope(scopeCardsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
+					acctId := p.Args["accountId"]                    // get passed in accountId from args
+					_acctId, err := uuid.FromString(acctId.(string)) // convert the acctId arg to a UUID
+					if err != nil {
+						return nil, err
+					}
+					return resolveConnection(p, cardPages(_acctId), func() (int, error) { return CountAccountCards(_acctId) })
+				}),
 			},
 			"accountCard": &graphql.Field{
 				Type:        CardType,
@@ -105,7 +191,7 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeCardsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
 					acctId := p.Args["accountId"]                    // get passed in accountId from args
 					_acctId, err := uuid.FromString(acctId.(string)) // convert the acctId arg to a UUID
 					if err != nil {
@@ -117,7 +203,7 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						return nil, err
 					}
 					return GetAccountCard(_acctId, _cardId) // get a unique BankAccount Card by the AccountId and CardId
-				},
+				}),
 			},
 			"accountTransaction": &graphql.Field{
 				Type:        TransactionType,
@@ -130,7 +216,7 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeTransactionsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
 					acctId := p.Args["accountId"]                    // get passed in accountId from args
 					_acctId, err := uuid.FromString(acctId.(string)) // convert the acctId arg to a UUID
 					if err != nil {
@@ -142,7 +228,51 @@ func (b *boldlyGoGraphQL) buildQuery() {
 						return nil, err
 					}
 					return GetAccountTransaction(_acctId, _transactionId) // get a unique BankAccount Transaction by the AccountId and TransactionId
+				}),
+			},
+			"adminSearchUsers": &graphql.Field{
+				Type:        graphql.NewList(UserType),
+				Description: "Staff only: search the users by part of their email or name",
+				Args: graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"limit": &graphql.ArgumentConfig{
+						Type: graphql.Int,
+					},
+				},
+				Resolve: requireRole(supportRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					limit, _ := p.Args["limit"].(int)
+					return SearchUsers(p.Args["query"].(string), limit)
+				}),
+			},
+			"adminUser": &graphql.Field{
+				Type:        UserType,
+				Description: "Staff only: get any user by their email",
+				Args: graphql.FieldConfigArgument{
+					"email": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
 				},
+				Resolve: requireRole(supportRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					return GetUser(p.Args["email"].(string))
+				}),
+			},
+			"adminBankAccount": &graphql.Field{
+				Type:        BankAccountType,
+				Description: "Staff only: get any BankAccount record by its account id",
+				Args: graphql.FieldConfigArgument{
+					"accountId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: requireRole(supportRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					accountId, err := uuid.FromString(p.Args["accountId"].(string))
+					if err != nil {
+						return nil, err
+					}
+					return GetAnyBankAccount(accountId)
+				}),
 			},
 		},
 	}
@@ -166,9 +296,322 @@ func (b *boldlyGoGraphQL) buildMutation() {
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					email, pwd := p.Args["email"].(string), p.Args["password"].(string)
-					return Authenticate(email, pwd), nil
+					return Authenticate(email, pwd, callerIP(p.Context)), nil
 				},
 			},
+			"refreshToken": &graphql.Field{
+				Type:        graphql.NewNonNull(AuthType),
+				Description: "Issue a new auth token using a refresh token returned by authenticate",
+				Args: graphql.FieldConfigArgument{
+					"refreshToken": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return RefreshToken(p.Args["refreshToken"].(string)), nil
+				},
+			},
+			"logout": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Revoke the refresh token so it can no longer be used to issue auth tokens",
+				Args: graphql.FieldConfigArgument{
+					"refreshToken": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Logout(p.Args["refreshToken"].(string))
+				},
+			},
+			"verifyTotp": &graphql.Field{
+				Type:        graphql.NewNonNull(AuthType),
+				Description: "Exchange the challenge token returned by authenticate, with a two-factor code or recovery code, for an auth token",
+				Args: graphql.FieldConfigArgument{
+					"challengeToken": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					challengeToken, code := p.Args["challengeToken"].(string), p.Args["code"].(string)
+					return VerifyTotpChallenge(challengeToken, code, callerIP(p.Context)), nil
+				},
+			},
+			"startOidcLogin": &graphql.Field{
+				Type:        OidcLoginType,
+				Description: "Start signing in with the identity provider. Returns the URL to send the user to, and the state to check it sends back",
+				Args: graphql.FieldConfigArgument{
+					"provider": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return StartOidcLogin(p.Args["provider"].(string))
+				},
+			},
+			"authenticateOidc": &graphql.Field{
+				Type:        graphql.NewNonNull(AuthType),
+				Description: "Authenticate the user with the code and state the identity provider redirected them back with. Returns an auth token",
+				Args: graphql.FieldConfigArgument{
+					"provider": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"state": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					provider, code, state := p.Args["provider"].(string), p.Args["code"].(string), p.Args["state"].(string)
+					return AuthenticateOidc(provider, code, state), nil
+				},
+			},
+			"requestPasswordReset": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Email a link to reset the password, if a user is registered with the email",
+				Args: graphql.FieldConfigArgument{
+					"email": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return RequestPasswordReset(p.Args["email"].(string))
+				},
+			},
+			"resetPassword": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Set a new password using the token from a password reset link",
+				Args: graphql.FieldConfigArgument{
+					"token": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"password": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return ResetPassword(p.Args["token"].(string), p.Args["password"].(string))
+				},
+			},
+			"verifyEmail": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Verify the email using the token from an email verification link",
+				Args: graphql.FieldConfigArgument{
+					"token": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return VerifyEmail(p.Args["token"].(string))
+				},
+			},
+			"changePassword": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Change the password of the signed in user. Other sessions must sign in again",
+				Args: graphql.FieldConfigArgument{
+					"currentPassword": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"newPassword": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					currentPwd, newPwd := p.Args["currentPassword"].(string), p.Args["newPassword"].(string)
+					return ChangePassword(email, currentPwd, newPwd, callerIP(p.Context))
+				}),
+			},
+			"updateProfile": &graphql.Field{
+				Type:        UserType,
+				Description: "Update the profile of the signed in user",
+				Args: graphql.FieldConfigArgument{
+					"profile": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(ProfileInputType),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					profile, _ := p.Args["profile"].(map[string]interface{})
+					var name *string
+					if n, ok := profile["name"].(string); ok {
+						name = &n
+					}
+					return UpdateProfile(email, name)
+				}),
+			},
+			"changeEmail": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Email a link to the new email to confirm changing the email of the signed in user",
+				Args: graphql.FieldConfigArgument{
+					"newEmail": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"password": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					newEmail, pwd := p.Args["newEmail"].(string), p.Args["password"].(string)
+					return ChangeEmail(email, newEmail, pwd, callerIP(p.Context))
+				}),
+			},
+			"confirmEmailChange": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Change the email using the token from an email change link. Sign in again with the new email",
+				Args: graphql.FieldConfigArgument{
+					"token": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return ConfirmEmailChange(p.Args["token"].(string))
+				},
+			},
+			"requestEmailVerification": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Email the signed in user a new link to verify their email",
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return RequestEmailVerification(email)
+				}),
+			},
+			"enrollTotp": &graphql.Field{
+				Type:        TotpEnrollmentType,
+				Description: "Start enrolling the signed in user in two-factor authentication. Returns the secret for the authenticator app",
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return EnrollTotp(email)
+				}),
+			},
+			"confirmTotp": &graphql.Field{
+				Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+				Description: "Enable two-factor authentication with a code from the authenticator app. Returns the recovery codes",
+				Args: graphql.FieldConfigArgument{
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return ConfirmTotp(email, p.Args["code"].(string), callerIP(p.Context))
+				}),
+			},
+			"disableTotp": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Disable two-factor authentication with a code from the authenticator app or a recovery code",
+				Args: graphql.FieldConfigArgument{
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return DisableTotp(email, p.Args["code"].(string), callerIP(p.Context))
+				}),
+			},
+			"regenerateRecoveryCodes": &graphql.Field{
+				Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+				Description: "Replace the recovery codes, with a code from the authenticator app or a recovery code. Returns the new codes",
+				Args: graphql.FieldConfigArgument{
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return RegenerateRecoveryCodes(email, p.Args["code"].(string), callerIP(p.Context))
+				}),
+			},
+			"createApiKey": &graphql.Field{
+				Type:        NewApiKeyType,
+				Description: "Create an API key that acts as the signed in user, limited to the scopes. Returns the key once",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"scopes": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+					"expiresInDays": &graphql.ArgumentConfig{
+						Type:        graphql.Int,
+						Description: "Days until the key expires; the key does not expire if not set",
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					var scopes []string
+					for _, scope := range p.Args["scopes"].([]interface{}) {
+						scopes = append(scopes, scope.(string))
+					}
+					expiresInDays, _ := p.Args["expiresInDays"].(int)
+					return CreateApiKey(email, p.Args["name"].(string), scopes, expiresInDays)
+				}),
+			},
+			"revokeApiKey": &graphql.Field{
+				Type:        ApiKeyType,
+				Description: "Revoke an API key of the signed in user; it stops working immediately",
+				Args: graphql.FieldConfigArgument{
+					"keyId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return RevokeApiKey(email, p.Args["keyId"].(string))
+				}),
+			},
+			"revokeConnectedApp": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Revoke the access of a third-party app the signed in user connected; its tokens stop working immediately",
+				Args: graphql.FieldConfigArgument{
+					"clientId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					email, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return RevokeConnectedApp(email, p.Args["clientId"].(string))
+				}),
+			},
 			"register": &graphql.Field{
 				Type:        UserType,
 				Description: "Register a new user record",
@@ -188,6 +631,99 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					return u.Register()              // save user and return
 				},
 			},
+			"adminLockUser": &graphql.Field{
+				Type:        UserType,
+				Description: "Admin only: lock a user, so they cannot sign in or use their tokens",
+				Args: graphql.FieldConfigArgument{
+					"email": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"reason": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: requireRole(adminRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					staffEmail, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return LockUser(staffEmail, p.Args["email"].(string), p.Args["reason"].(string))
+				}),
+			},
+			"adminUnlockUser": &graphql.Field{
+				Type:        UserType,
+				Description: "Admin only: unlock a locked user",
+				Args: graphql.FieldConfigArgument{
+					"email": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: requireRole(adminRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					staffEmail, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return UnlockUser(staffEmail, p.Args["email"].(string))
+				}),
+			},
+			"adminSetUserRoles": &graphql.Field{
+				Type:        UserType,
+				Description: "Admin only: set the roles of a user, from customer, support and admin",
+				Args: graphql.FieldConfigArgument{
+					"email": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"roles": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+				},
+				Resolve: requireRole(adminRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					staffEmail, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					var roles []string
+					for _, role := range p.Args["roles"].([]interface{}) {
+						roles = append(roles, role.(string))
+					}
+					return SetUserRoles(staffEmail, p.Args["email"].(string), roles)
+				}),
+			},
+			"adminRegisterOAuthClient": &graphql.Field{
+				Type:        NewOAuthClientType,
+				Description: "Admin only: register a third-party app that users can connect through OAuth2",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"redirectUris": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+					"scopes": &graphql.ArgumentConfig{
+						Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+						Description: "The scopes the app may request",
+					},
+					"confidential": &graphql.ArgumentConfig{
+						Type:        graphql.Boolean,
+						Description: "Issue a client secret, for an app with a server that can keep it secret",
+					},
+				},
+				Resolve: requireRole(adminRoles, func(p graphql.ResolveParams) (interface{}, error) {
+					staffEmail, err := callerEmail(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					var redirectUris, scopes []string
+					for _, uri := range p.Args["redirectUris"].([]interface{}) {
+						redirectUris = append(redirectUris, uri.(string))
+					}
+					for _, scope := range p.Args["scopes"].([]interface{}) {
+						scopes = append(scopes, scope.(string))
+					}
+					confidential, _ := p.Args["confidential"].(bool)
+					return RegisterOAuthClient(staffEmail, p.Args["name"].(string), redirectUris, scopes, confidential)
+				}),
+			},
 			"saveBankAccount": &graphql.Field{
 				Type:        BankAccountType,
 				Description: "Save a new BankAccount record",
@@ -196,7 +732,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 						Type: graphql.NewNonNull(BankAccountInputType),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeAccountsWrite, inputField("acct", "bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
 					acct := p.Args["acct"]                              // get the BankAccount input out of the arguments
 					bankAccountMap, ok := acct.(map[string]interface{}) // convert the input type to a BankAccount
 					if !ok {
@@ -204,8 +740,9 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					}
 					var bankAccount = new(BankAccount)                // instantiate bank account
 					mapstructure.Decode(bankAccountMap, &bankAccount) // destructure bankAccountMap into BankAccount
-					return bankAccount.Save()                         // save bank account and return
-				},
+					bankAccount.CurrentBalance.Currency, _ = bankAccountMap["currency"].(string)
+					return bankAccount.Save() // save bank account and return
+				}),
 			},
 			"updateBankAccount": &graphql.Field{
 				Type:        BankAccountType,
@@ -215,7 +752,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 						Type: graphql.NewNonNull(BankAccountInputType),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeAccountsWrite, inputField("acct", "bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
 					acct := p.Args["acct"]                              // get the BankAccount input out of the arguments
 					bankAccountMap, ok := acct.(map[string]interface{}) // convert the input type to a BankAccount
 					if !ok {
@@ -224,7 +761,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					var bankAccount = new(BankAccount)                // instantiate bank account
 					mapstructure.Decode(bankAccountMap, &bankAccount) // destructure bankAccountMap into BankAccount
 					return bankAccount.Update()                       // save bank account and return
-				},
+				}),
 			},
 			"saveAccountCard": &graphql.Field{
 				Type:        CardType,
@@ -234,7 +771,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 						Type: graphql.NewNonNull(CardInputType),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeCardsWrite, inputField("card", "accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
 					c := p.Args["card"]                       // get the Card input out of the arguments
 					cardMap, ok := c.(map[string]interface{}) // convert the input type to a Card Map
 					if !ok {
@@ -243,7 +780,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					var card = new(Card)                // instantiate card
 					mapstructure.Decode(cardMap, &card) // destructure cardMap into Card
 					return card.Save()                  // save card and return
-				},
+				}),
 			},
 			"inactivateAccountCard": &graphql.Field{
 				Type:        CardType,
@@ -253,7 +790,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 						Type: graphql.NewNonNull(CardInputType),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeCardsWrite, inputField("card", "accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
 					c := p.Args["card"]                       // get the Card input out of the arguments
 					cardMap, ok := c.(map[string]interface{}) // convert the input type to a Card Map
 					if !ok {
@@ -262,7 +799,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					var card = new(Card)                // instantiate card
 					mapstructure.Decode(cardMap, &card) // destructure cardMap into Card
 					return card.Inactivate()            // inactivate card and return
-				},
+				}),
 			},
 			"saveTransaction": &graphql.Field{
 				Type:        TransactionType,
@@ -275,7 +812,7 @@ func (b *boldlyGoGraphQL) buildMutation() {
 						Type: graphql.NewNonNull(TransactionInputType),
 					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				Resolve: authorizeScope(scopeTransactionsWrite, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
 					bankId := p.Args["bankId"]                       // get passed in bankId from args
 					_bankId, err := uuid.FromString(bankId.(string)) // convert the bankId arg to a UUID
 					if err != nil {
@@ -289,7 +826,39 @@ func (b *boldlyGoGraphQL) buildMutation() {
 					var txn = new(Transaction)        // instantiate Transaction
 					mapstructure.Decode(txnMap, &txn) // destructure txnMap into a Transaction
 					return txn.Save(_bankId)          // return the saved transaction
+				}),
+			},
+		},
+	}
+}
+
+/*
+Build the Boldly Go RootSubscription object which exposes the subscriptions available to this service.
+Subscriptions are served over WebSocket at /subscriptions; see subscriptions.go
+*/
+func (b *boldlyGoGraphQL) buildSubscription() {
+	b.subscriptions = graphql.ObjectConfig{
+		Name: "RootSubscription",
+		Fields: graphql.Fields{
+			"transactionPosted": &graphql.Field{
+				Type:        TransactionType,
+				Description: "The Transactions posted to the BankAccount, as they are saved",
+				Args: graphql.FieldConfigArgument{
+					"accountId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: subscriptionField(scopeTransactionsRead, transactionPostedTopic),
+			},
+			"balanceChanged": &graphql.Field{
+				Type:        BankAccountType,
+				Description: "The BankAccount each time its balance changes, or it is updated",
+				Args: graphql.FieldConfigArgument{
+					"accountId": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
 				},
+				Resolve: subscriptionField(scopeAccountsRead, balanceChangedTopic),
 			},
 		},
 	}
@@ -300,16 +869,19 @@ Initialize the Boldly Go GraphQL Schema Instance
 
 	Build all of the queries being exposed
 	Build all of the mutation being exposed
+	Build all of the subscriptions being exposed
 
-	Utilize the queries and mutations to build the GraphQL Schema instance
+	Utilize the queries, mutations and subscriptions to build the GraphQL Schema instance
 */
 func (b *boldlyGoGraphQL) BuildSchema() graphql.Schema {
-	b.buildQuery()    // build all queries
-	b.buildMutation() // build all mutations
-	// use the built queries and mutations to build the graphql schema config
+	b.buildQuery()        // build all queries
+	b.buildMutation()     // build all mutations
+	b.buildSubscription() // build all subscriptions
+	// use the built queries, mutations and subscriptions to build the graphql schema config
 	schemaConfig := graphql.SchemaConfig{
-		Query:    graphql.NewObject(b.queries),
-		Mutation: graphql.NewObject(b.mutations),
+		Query:        graphql.NewObject(b.queries),
+		Mutation:     graphql.NewObject(b.mutations),
+		Subscription: graphql.NewObject(b.subscriptions),
 	}
 	// build the graphql schema instance
 	schema, err := graphql.NewSchema(schemaConfig)
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/satori/go.uuid"
+)
+
+const testPwd = "Correct1Horse"
+
+// Run the tests against the in-memory repositories, with a fake bank service that gives each user one Bank
+func TestMain(m *testing.M) {
+	outbox, err := ioutil.TempDir("", "boldly-go-outbox")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(storageBackendKey, storageBackendMemory)
+	os.Setenv(authSecretKey, "test-secret")
+	os.Setenv(mailOutboxDirKey, outbox)
+	bank := httptest.NewServer(http.HandlerFunc(fakeBankHandler))
+	bankUrl = bank.URL + "/api/v1/user/{email}/bank/{bankId}"
+	boldlygo.Initialize()
+	code := m.Run()
+	bank.Close()
+	os.RemoveAll(outbox)
+	os.Exit(code)
+}
+
+// Serve GET /api/v1/user/{email}/bank/{bankId}: the user owns the Bank if it is their test Bank
+func fakeBankHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 7 || parts[5] != "bank" || parts[6] != testBankId(parts[4]) {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(&Bank{OwningUserId: parts[4], BankId: parts[6], BankName: "Test Bank", AccountNumber: "1"})
+}
+
+// The id of the Bank the fake bank service says the user owns
+func testBankId(email string) string {
+	return uuid.NewV5(uuid.NamespaceURL, "bank:"+email).String()
+}
+
+// Run the operation as the caller with the Authorization header value; empty for an anonymous caller
+func do(authorization, query string, variables map[string]interface{}) *graphql.Result {
+	ctx := context.WithValue(context.Background(), "Authorization", authorization)
+	ctx = context.WithValue(ctx, "ClientIP", "192.0.2.1")
+	return graphql.Do(graphql.Params{
+		Schema:         *boldlygo.GraphQLSchema(),
+		RequestString:  query,
+		VariableValues: variables,
+		Context:        ctx,
+	})
+}
+
+// Run the operation, failing the test if it has errors, and decode its data into out
+func mustDo(t *testing.T, authorization, query string, variables map[string]interface{}, out interface{}) {
+	t.Helper()
+	result := do(authorization, query, variables)
+	if result.HasErrors() {
+		t.Fatalf("%s: %v", query, result.Errors)
+	}
+	data, err := json.Marshal(result.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The code in the extensions of the first error of the result; empty if it has none
+func errorCode(result *graphql.Result) string {
+	if len(result.Errors) == 0 {
+		return ""
+	}
+	code, _ := result.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+// Register a user with the email and sign in; returns the Authorization header value to send as them
+func signUp(t *testing.T, email string) string {
+	t.Helper()
+	variables := map[string]interface{}{"email": email, "pwd": testPwd}
+	var registered struct{}
+	mustDo(t, "", `mutation($email: String!, $pwd: String!) { register(user: {email: $email, pwd: $pwd, name: "Test"}) { email } }`, variables, &registered)
+	var signedIn struct {
+		Authenticate struct{ Token string }
+	}
+	mustDo(t, "", `mutation($email: String!, $pwd: String!) { authenticate(email: $email, password: $pwd) { token } }`, variables, &signedIn)
+	if signedIn.Authenticate.Token == "" {
+		t.Fatalf("unable to sign in as %s", email)
+	}
+	return "Bearer " + signedIn.Authenticate.Token
+}
+
+type testBankAccount struct {
+	AccountId      string
+	AccountName    string
+	CurrentBalance string
+	Version        int
+}
+
+// Open a BankAccount in the test Bank of the user
+func openAccount(t *testing.T, authorization, email, currency string) testBankAccount {
+	t.Helper()
+	var saved struct{ SaveBankAccount testBankAccount }
+	mustDo(t, authorization, `mutation($bankId: String!, $currency: String) {
+		saveBankAccount(acct: {bankId: $bankId, accountName: "Checking", accountType: "CHECKING", last4: "1234", currency: $currency}) {
+			accountId accountName currentBalance version
+		}
+	}`, map[string]interface{}{"bankId": testBankId(email), "currency": currency}, &saved)
+	return saved.SaveBankAccount
+}
+
+// Post a Transaction to the BankAccount
+func postTransaction(t *testing.T, authorization, email, accountId, date, amount, transactionType string) *graphql.Result {
+	t.Helper()
+	return do(authorization, `mutation($bankId: String!, $txn: TransactionInput!) { saveTransaction(bankId: $bankId, txn: $txn) { transactionId } }`,
+		map[string]interface{}{"bankId": testBankId(email), "txn": map[string]interface{}{
+			"accountId":       accountId,
+			"transactionDate": date,
+			"amount":          amount,
+			"transactionType": transactionType,
+			"description":     transactionType + " on " + date,
+		}})
+}
+
+// Only the signed in owner of a Bank can read its BankAccounts
+func TestBankAccountsRequireBankOwner(t *testing.T) {
+	owner, other := "owner@example.com", "other@example.com"
+	ownerAuth, otherAuth := signUp(t, owner), signUp(t, other)
+	account := openAccount(t, ownerAuth, owner, "eur")
+	if account.CurrentBalance != "0.00 EUR" || account.Version != 1 {
+		t.Errorf("a new EUR account opens with %s at version %d; want 0.00 EUR at version 1", account.CurrentBalance, account.Version)
+	}
+	query := `query($bankId: String!, $accountId: String!) { bankAccount(bankId: $bankId, accountId: $accountId) { accountId } }`
+	variables := map[string]interface{}{"bankId": testBankId(owner), "accountId": account.AccountId}
+	var read struct{ BankAccount testBankAccount }
+	mustDo(t, ownerAuth, query, variables, &read)
+	if read.BankAccount.AccountId != account.AccountId {
+		t.Errorf("the owner read account %q; want %q", read.BankAccount.AccountId, account.AccountId)
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		bankId        string
+		code          string
+	}{
+		{"another user", otherAuth, testBankId(owner), errCodeForbidden},
+		{"anonymous", "", testBankId(owner), errCodeUnauthenticated},
+		{"a bad token", "Bearer not-a-token", testBankId(owner), errCodeUnauthenticated},
+		{"a malformed bank id", ownerAuth, "not-a-uuid", errCodeInvalidInput},
+	}
+	for _, test := range tests {
+		variables := map[string]interface{}{"bankId": test.bankId, "accountId": account.AccountId}
+		if code := errorCode(do(test.authorization, query, variables)); code != test.code {
+			t.Errorf("reading as %s failed with %q; want %q", test.name, code, test.code)
+		}
+	}
+}
+
+// A Bank without BankAccounts lists none, rather than null
+func TestBankAccountsOfEmptyBank(t *testing.T) {
+	email := "empty@example.com"
+	auth := signUp(t, email)
+	var read struct{ BankAccounts []testBankAccount }
+	mustDo(t, auth, `query($bankId: String!) { bankAccounts(bankId: $bankId) { accountId } }`, map[string]interface{}{"bankId": testBankId(email)}, &read)
+	if read.BankAccounts == nil || len(read.BankAccounts) != 0 {
+		t.Errorf("the empty Bank lists %v; want []", read.BankAccounts)
+	}
+}
+
+// Transactions change the balance; updating the BankAccount does not, and fails on a stale version
+func TestTransactionsChangeBalance(t *testing.T) {
+	email := "balance@example.com"
+	auth := signUp(t, email)
+	account := openAccount(t, auth, email, "")
+	for _, txn := range []struct{ amount, transactionType string }{{"10.00 USD", "DEBIT"}, {"2.50 USD", "CREDIT"}} {
+		if result := postTransaction(t, auth, email, account.AccountId, "2024-01-15T10:00:00Z", txn.amount, txn.transactionType); result.HasErrors() {
+			t.Fatalf("posting %s: %v", txn.amount, result.Errors)
+		}
+	}
+	if result := postTransaction(t, auth, email, account.AccountId, "2024-01-16T10:00:00Z", "1.00 EUR", "DEBIT"); !result.HasErrors() {
+		t.Error("posted a EUR Transaction to a USD account")
+	}
+	var read struct{ BankAccount testBankAccount }
+	mustDo(t, auth, `query($bankId: String!, $accountId: String!) { bankAccount(bankId: $bankId, accountId: $accountId) { version } }`,
+		map[string]interface{}{"bankId": testBankId(email), "accountId": account.AccountId}, &read)
+	update := `mutation($acct: BankAccountInput!) { updateBankAccount(acct: $acct) { accountName currentBalance version } }`
+	variables := map[string]interface{}{"acct": map[string]interface{}{
+		"bankId": testBankId(email), "accountId": account.AccountId, "accountName": "Bills", "accountType": "CHECKING", "last4": "1234", "version": read.BankAccount.Version,
+	}}
+	var updated struct{ UpdateBankAccount testBankAccount }
+	mustDo(t, auth, update, variables, &updated)
+	if got := updated.UpdateBankAccount; got.AccountName != "Bills" || got.CurrentBalance != "7.50 USD" {
+		t.Errorf("the updated account is %q with %s; want \"Bills\" with 7.50 USD", got.AccountName, got.CurrentBalance)
+	}
+	if code := errorCode(do(auth, update, variables)); code != errCodeConflict {
+		t.Errorf("updating at a stale version failed with %q; want %q", code, errCodeConflict)
+	}
+}
+
+// Following the end cursor of each page reads every Transaction once, in date order
+func TestTransactionPagesFollowCursors(t *testing.T) {
+	email := "pages@example.com"
+	auth := signUp(t, email)
+	account := openAccount(t, auth, email, "")
+	other := openAccount(t, auth, email, "")
+	for _, month := range []int{3, 1, 5, 2, 4} {
+		date := fmt.Sprintf("2024-%02d-15T10:00:00Z", month)
+		if result := postTransaction(t, auth, email, account.AccountId, date, "1.00 USD", "DEBIT"); result.HasErrors() {
+			t.Fatal(result.Errors)
+		}
+	}
+	postTransaction(t, auth, email, other.AccountId, "2024-01-01T00:00:00Z", "1.00 USD", "DEBIT")
+	query := `query($bankId: String!, $accountId: String!, $after: String) {
+		bankAccount(bankId: $bankId, accountId: $accountId) {
+			txnsConn(first: 2, after: $after) {
+				totalCount
+				edges { cursor node { transactionDate } }
+				pageInfo { hasNextPage endCursor }
+			}
+		}
+	}`
+	type page struct {
+		BankAccount struct {
+			TxnsConn struct {
+				TotalCount int
+				Edges      []struct {
+					Cursor string
+					Node   struct{ TransactionDate string }
+				}
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+	}
+	pageOf := func(accountId string, after interface{}) page {
+		var p page
+		mustDo(t, auth, query, map[string]interface{}{"bankId": testBankId(email), "accountId": accountId, "after": after}, &p)
+		return p
+	}
+	var dates []string
+	var after interface{}
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("more than 3 pages of 2 for 5 Transactions")
+		}
+		conn := pageOf(account.AccountId, after).BankAccount.TxnsConn
+		if conn.TotalCount != 5 {
+			t.Errorf("totalCount is %d; want 5", conn.TotalCount)
+		}
+		for _, edge := range conn.Edges {
+			dates = append(dates, edge.Node.TransactionDate[:7])
+		}
+		if !conn.PageInfo.HasNextPage {
+			break
+		}
+		after = conn.PageInfo.EndCursor
+	}
+	if got, want := strings.Join(dates, " "), "2024-01 2024-02 2024-03 2024-04 2024-05"; got != want {
+		t.Errorf("the pages hold %s; want %s", got, want)
+	}
+	otherCursor := pageOf(other.AccountId, nil).BankAccount.TxnsConn.Edges[0].Cursor
+	for _, cursor := range []string{"not-a-cursor", otherCursor} {
+		variables := map[string]interface{}{"bankId": testBankId(email), "accountId": account.AccountId, "after": cursor}
+		if code := errorCode(do(auth, query, variables)); code != errCodeInvalidInput {
+			t.Errorf("reading after cursor %q failed with %q; want %q", cursor, code, errCodeInvalidInput)
+		}
+	}
+}
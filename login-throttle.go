@@ -0,0 +1,161 @@
+/*
+Brute-force Protection for authenticating users.
+
+	Failed sign in attempts are counted per email and per client IP address in the LoginAttempts repository.
+	Once a subject reaches its maximum failures it is locked out, and sign in attempts for it fail without checking
+	the password. Each lockout in a row doubles the lockout duration, up to the maximum.
+	The counts of a subject are discarded 24 hours after its last failure or lockout, and a successful sign in clears
+	the counts of the email. Lockouts and unlocks are recorded in the audit trail.
+
+	Configured from the environment:
+		- LOGIN_MAX_FAILURES: failures of an email before it is locked out; defaults to 5
+		- LOGIN_MAX_FAILURES_PER_IP: failures from a client IP address before it is locked out; defaults to 20
+		- LOGIN_LOCKOUT_SECONDS: the duration of the first lockout; defaults to 60
+		- LOGIN_MAX_LOCKOUT_SECONDS: the longest lockout; defaults to 86400 (1 day)
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loginMaxFailuresKey      = "LOGIN_MAX_FAILURES"
+	loginMaxFailuresPerIpKey = "LOGIN_MAX_FAILURES_PER_IP"
+	loginLockoutSecondsKey   = "LOGIN_LOCKOUT_SECONDS"
+	loginMaxLockoutKey       = "LOGIN_MAX_LOCKOUT_SECONDS"
+
+	loginAttemptsExpiry = 24 * time.Hour
+
+	loginSubjectEmail = "email:"
+	loginSubjectIp    = "ip:"
+)
+
+type LoginThrottle interface {
+	Initialize()
+	LockedOut(email, ip string) (bool, error)
+	RecordFailure(email, ip string) error
+	RecordSuccess(email string) error
+}
+
+type loginThrottle struct {
+	maxFailures      int
+	maxFailuresPerIp int
+	lockout          time.Duration
+	maxLockout       time.Duration
+}
+
+// Initialize the Login Throttle from the limits in the environment
+func (t *loginThrottle) Initialize() {
+	t.maxFailures = envInt(loginMaxFailuresKey, 5)
+	t.maxFailuresPerIp = envInt(loginMaxFailuresPerIpKey, 20)
+	t.lockout = time.Duration(envInt(loginLockoutSecondsKey, 60)) * time.Second
+	t.maxLockout = time.Duration(envInt(loginMaxLockoutKey, 86400)) * time.Second
+}
+
+/*
+Check if the email or the client IP address is locked out.
+
+	Along the way, tidy the counts of each subject:
+		- counts past their expiry are discarded; the table time to live deletes them lazily
+		- a lockout that has ended is cleared and recorded in the audit trail
+*/
+func (t *loginThrottle) LockedOut(email, ip string) (bool, error) {
+	now := time.Now().Unix()
+	for _, subject := range loginSubjects(email, ip) {
+		attempts, err := boldlygo.Repositories().LoginAttempts().Find(subject)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case attempts == nil:
+			continue
+		case attempts.ExpiresAt <= now:
+			if err := boldlygo.Repositories().LoginAttempts().Delete(subject); err != nil {
+				return false, err
+			}
+		case attempts.LockedUntil > now:
+			return true, nil
+		case attempts.LockedUntil != 0:
+			unlocked, err := boldlygo.Repositories().LoginAttempts().Unlock(subject, attempts.LockedUntil)
+			if err != nil {
+				return false, err
+			}
+			if unlocked {
+				audit(subject, auditUnlocked, fmt.Sprintf("lockout %d ended", attempts.Lockouts))
+			}
+		}
+	}
+	return false, nil
+}
+
+// Count a failed sign in against the email and client IP address; lock out each one that reaches its maximum failures
+func (t *loginThrottle) RecordFailure(email, ip string) error {
+	now := time.Now()
+	for _, subject := range loginSubjects(email, ip) {
+		attempts, err := boldlygo.Repositories().LoginAttempts().AddFailure(subject, now.Add(loginAttemptsExpiry).Unix())
+		if err != nil {
+			return err
+		}
+		maxFailures := t.maxFailures
+		if strings.HasPrefix(subject, loginSubjectIp) {
+			maxFailures = t.maxFailuresPerIp
+		}
+		if attempts.Failures < maxFailures {
+			continue
+		}
+		duration := t.lockoutDuration(attempts.Lockouts)
+		lockedUntil := now.Add(duration)
+		locked, err := boldlygo.Repositories().LoginAttempts().Lock(subject, attempts.Failures, lockedUntil.Unix(), lockedUntil.Add(loginAttemptsExpiry).Unix())
+		if err != nil {
+			return err
+		}
+		if locked {
+			audit(subject, auditLockedOut, fmt.Sprintf("%d failed attempts; lockout %d for %s", attempts.Failures, attempts.Lockouts+1, duration))
+		}
+	}
+	return nil
+}
+
+// Clear the failure counts of the email after a successful sign in. The client IP address counts are kept
+func (t *loginThrottle) RecordSuccess(email string) error {
+	return boldlygo.Repositories().LoginAttempts().Delete(loginSubjectEmail + strings.ToLower(email))
+}
+
+// The lockout duration after the number of previous lockouts in a row: doubles each time, up to the maximum
+func (t *loginThrottle) lockoutDuration(previousLockouts int) time.Duration {
+	duration := t.lockout
+	for i := 0; i < previousLockouts && duration < t.maxLockout; i++ {
+		duration *= 2
+	}
+	if duration > t.maxLockout {
+		duration = t.maxLockout
+	}
+	return duration
+}
+
+// The subjects the attempts are counted against; the client IP address is skipped if it is unknown
+func loginSubjects(email, ip string) []string {
+	subjects := []string{loginSubjectEmail + strings.ToLower(email)}
+	if ip != "" {
+		subjects = append(subjects, loginSubjectIp+ip)
+	}
+	return subjects
+}
+
+// Read a positive number from the environment, or the default if it is not set. Panics on an invalid value
+func envInt(key string, defaultValue int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		panic(fmt.Errorf("invalid %s %q: must be a positive number", key, v))
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The types of the events recorded in the audit trail for the subject, in the order they occurred
+func auditEventTypes(subject string) []string {
+	repo := boldlygo.Repositories().AuditEvents().(*memoryAuditEventRepository)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	var types []string
+	for _, event := range repo.events {
+		if event.Subject == subject {
+			types = append(types, event.EventType)
+		}
+	}
+	return types
+}
+
+// Sign in with a wrong password the number of times
+func failSignIn(t *testing.T, email, ip string, times int) {
+	t.Helper()
+	for i := 0; i < times; i++ {
+		if auth := Authenticate(email, "Wrong1Horse", ip); auth.Success {
+			t.Fatal("signed in with a wrong password")
+		}
+	}
+}
+
+// Once an email reaches its maximum failures, even the right password is refused until the lockout ends
+func TestLoginThrottleLocksOutEmail(t *testing.T) {
+	email, ip := "lockout@example.com", "198.51.100.1"
+	signUp(t, email)
+	failSignIn(t, email, ip, 5)
+	if auth := Authenticate(email, testPwd, ip); auth.Success || auth.Message != "Too many failed sign in attempts. Please try again later" {
+		t.Errorf("signing in while locked out returned %+v; want too many failed attempts", auth)
+	}
+	if auth := Authenticate("Lockout@Example.com", testPwd, "198.51.100.2"); auth.Success {
+		t.Error("signed in from another IP address with the email in another case while it is locked out")
+	}
+	if types := auditEventTypes(loginSubjectEmail + email); len(types) != 1 || types[0] != auditLockedOut {
+		t.Errorf("the audit trail of the email is %v; want %s", types, auditLockedOut)
+	}
+	// end the lockout, as if its duration had passed; a lockout resets the failures
+	if locked, err := boldlygo.Repositories().LoginAttempts().Lock(loginSubjectEmail+email, 0, time.Now().Add(-time.Second).Unix(), time.Now().Add(time.Hour).Unix()); err != nil || !locked {
+		t.Fatalf("unable to end the lockout: %v", err)
+	}
+	if auth := Authenticate(email, testPwd, ip); !auth.Success {
+		t.Errorf("unable to sign in after the lockout ended: %s", auth.Message)
+	}
+	if types := auditEventTypes(loginSubjectEmail + email); len(types) != 2 || types[1] != auditUnlocked {
+		t.Errorf("the audit trail of the email is %v; want %s after the lockout", types, auditUnlocked)
+	}
+}
+
+// A successful sign in clears the failures of the email, so they do not add up to a lockout
+func TestLoginThrottleSuccessClearsFailures(t *testing.T) {
+	email, ip := "cleared@example.com", "198.51.100.3"
+	signUp(t, email)
+	for i := 0; i < 2; i++ {
+		failSignIn(t, email, ip, 4)
+		if auth := Authenticate(email, testPwd, ip); !auth.Success {
+			t.Fatalf("unable to sign in after 4 failures: %s", auth.Message)
+		}
+	}
+	if types := auditEventTypes(loginSubjectEmail + email); len(types) != 0 {
+		t.Errorf("the audit trail of the email is %v; want no lockouts", types)
+	}
+}
+
+// A client IP address failing for many emails is locked out, even for an email without failures
+func TestLoginThrottleLocksOutIp(t *testing.T) {
+	ip := "198.51.100.4"
+	email := "ip@example.com"
+	signUp(t, email)
+	for i := 0; i < 5; i++ {
+		failSignIn(t, fmt.Sprintf("unknown%d@example.com", i), ip, 4)
+	}
+	if auth := Authenticate(email, testPwd, ip); auth.Success {
+		t.Error("signed in from a locked out IP address")
+	}
+	if auth := Authenticate(email, testPwd, "198.51.100.5"); !auth.Success {
+		t.Errorf("unable to sign in from another IP address: %s", auth.Message)
+	}
+}
+
+// Each lockout in a row doubles the duration, up to the maximum
+func TestLoginThrottleLockoutDuration(t *testing.T) {
+	throttle := &loginThrottle{lockout: time.Minute, maxLockout: 5 * time.Minute}
+	for previous, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if got := throttle.lockoutDuration(previous); got != want {
+			t.Errorf("the lockout after %d lockouts is %s; want %s", previous, got, want)
+		}
+	}
+}
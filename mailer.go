@@ -0,0 +1,170 @@
+/*
+Outgoing Email, i.e. password reset and email verification links.
+
+	Mail is sent through the Mailer interface so the delivery can be swapped.
+	Implementations, picked by MAILER:
+		- outbox: writes each message as a .eml file to a directory; for local development (default)
+		- smtp: sends each message through an SMTP server
+
+	Configured from the environment:
+		- MAIL_FROM: the sender address; defaults to no-reply@boldlygo.local
+		- MAIL_OUTBOX_DIR: the directory the outbox mailer writes to; defaults to outbox
+		- SMTP_HOST, SMTP_PORT: the SMTP server; the port defaults to 587, upgraded to TLS when the server supports it
+		- SMTP_USERNAME, SMTP_PASSWORD: authenticate with PLAIN auth when a username is set
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	mailerKey        = "MAILER"
+	mailFromKey      = "MAIL_FROM"
+	mailOutboxDirKey = "MAIL_OUTBOX_DIR"
+	smtpHostKey      = "SMTP_HOST"
+	smtpPortKey      = "SMTP_PORT"
+	smtpUsernameKey  = "SMTP_USERNAME"
+	smtpPasswordKey  = "SMTP_PASSWORD"
+
+	mailerOutbox = "outbox"
+	mailerSmtp   = "smtp"
+
+	defaultMailFrom      = "no-reply@boldlygo.local"
+	defaultMailOutboxDir = "outbox"
+	defaultSmtpPort      = "587"
+)
+
+// A plain text email message
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Initialize()
+	Send(mail Mail) error
+}
+
+/*
+Build the Mailer implementation for the configured delivery.
+
+	Uses the MAILER value stored in the environment:
+		- "outbox" (or empty): write messages to the outbox directory
+		- "smtp": send messages through the SMTP server
+*/
+func NewMailer() Mailer {
+	switch mailer := os.Getenv(mailerKey); mailer {
+	case "", mailerOutbox:
+		return &outboxMailer{}
+	case mailerSmtp:
+		return &smtpMailer{}
+	default:
+		panic(fmt.Errorf("unsupported %s value %q", mailerKey, mailer))
+	}
+}
+
+type smtpMailer struct {
+	from string
+	addr string
+	auth smtp.Auth // nil if no username is configured
+}
+
+// Initialize the SMTP Mailer from the server in the environment. Panics if no server is configured
+func (m *smtpMailer) Initialize() {
+	host := os.Getenv(smtpHostKey)
+	if host == "" {
+		panic(fmt.Errorf("%s must be set when %s is %s", smtpHostKey, mailerKey, mailerSmtp))
+	}
+	port := os.Getenv(smtpPortKey)
+	if port == "" {
+		port = defaultSmtpPort
+	}
+	m.from = mailFrom()
+	m.addr = net.JoinHostPort(host, port)
+	if username := os.Getenv(smtpUsernameKey); username != "" {
+		m.auth = smtp.PlainAuth("", username, os.Getenv(smtpPasswordKey), host)
+	}
+}
+
+func (m *smtpMailer) Send(mail Mail) error {
+	msg, err := formatMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, msg)
+}
+
+type outboxMailer struct {
+	from string
+	dir  string
+}
+
+// Initialize the Outbox Mailer, creating the outbox directory. Panics if it cannot be created
+func (m *outboxMailer) Initialize() {
+	m.from = mailFrom()
+	m.dir = os.Getenv(mailOutboxDirKey)
+	if m.dir == "" {
+		m.dir = defaultMailOutboxDir
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		panic(err)
+	}
+}
+
+// Write the message to a new file in the outbox directory, named so the files sort by the time they were sent
+func (m *outboxMailer) Send(mail Mail) error {
+	msg, err := formatMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + uuid.NewV4().String() + ".eml"
+	path := filepath.Join(m.dir, name)
+	if err := ioutil.WriteFile(path, msg, 0600); err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("Mail to %s written to %s", mail.To, path))
+	return nil
+}
+
+// The sender address from the environment, or the default
+func mailFrom() string {
+	if from := os.Getenv(mailFromKey); from != "" {
+		return from
+	}
+	return defaultMailFrom
+}
+
+// Format the message with its headers (RFC 5322). Fails if a header value would break onto another line
+func formatMail(from string, mail Mail) ([]byte, error) {
+	headers := [][2]string{
+		{"From", from},
+		{"To", mail.To},
+		{"Subject", mail.Subject},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+	}
+	var msg bytes.Buffer
+	for _, h := range headers {
+		if strings.ContainsAny(h[1], "\r\n") {
+			return nil, errors.New("mail header " + h[0] + " must not contain line breaks")
+		}
+		msg.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(mail.Body, "\n", "\r\n", -1))
+	return msg.Bytes(), nil
+}
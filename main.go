@@ -9,77 +9,151 @@ Main entry point for Boldly Go GraphQL Application.
 		- Mutation to create a new bank account
 		- GraphQL Relay implementation to get user bank account with transactions
 
-	GraphQL Endpoint:
+	GraphQL Endpoints:
 		- /graphql
+		- /subscriptions: GraphQL subscriptions over WebSocket; see subscriptions.go
+
+	JSON Web Key Set Endpoint, to verify the auth tokens:
+		- /.well-known/jwks.json
+
+	OAuth2 Endpoints, for third-party apps; see oauth.go:
+		- /oauth/authorize: the consent page
+		- /oauth/token
+
+	Subcommands:
+		- migrate [status]: create/update the DynamoDB tables and apply pending migrations
+		- set-roles <email> <role,...>: set the roles of a user, i.e. to make the first admin
 */
 package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/handler"
 )
 
-const appPortKey = ":5000"
+const (
+	appPortKey           = ":5000"
+	trustProxyHeadersKey = "TRUST_PROXY_HEADERS" // "true" when running behind a proxy that sets X-Forwarded-For
+)
 
 type BoldlyGo interface {
 	Initialize()
 	GraphQLSchema() *graphql.Schema
-	DynamoDbSvc() *dynamodb.DynamoDB
+	Repositories() Repositories
 	AuthService() AuthSvc
+	LoginThrottle() LoginThrottle
+	Mailer() Mailer
+	OidcClient() OidcClient
+	PubSub() PubSub
+	QueryLimits() QueryLimits
 }
 
 type boldlyGo struct {
-	schema      *graphql.Schema
-	dynamodbSvc *dynamodb.DynamoDB
-	authsvc     AuthSvc
+	schema   *graphql.Schema
+	repos    Repositories
+	authsvc  AuthSvc
+	throttle LoginThrottle
+	mailer   Mailer
+	oidc     OidcClient
+	pubsub   PubSub
+	limits   QueryLimits
 }
 
 /*
 Initialize the Boldly Go API Service
 
 	Init required dependencies and services:
-		- AWS Service Instance
+		- Storage Repositories (AWS Service Instance when using DynamoDB)
 		- GraphQL Schema
+		- Auth Service, Login Throttle and Mailer
+		- OIDC Client, for the configured identity providers
+		- PubSub, for the GraphQL subscriptions
+		- Query Limits, checked before each GraphQL operation runs
 */
 func (b *boldlyGo) Initialize() {
 	var (
 		boldlyGoGraphQL BoldlyGoGraphQL = &boldlyGoGraphQL{}
-		awsSvc          AwsConfig       = &awsConf{}
+		repos           Repositories    = NewRepositories()
 		auth            AuthSvc         = &authSvc{}
+		throttle        LoginThrottle   = &loginThrottle{}
+		mailer          Mailer          = NewMailer()
+		oidc            OidcClient      = &oidcClient{}
+		pubsub          PubSub          = NewPubSub()
+		limits          QueryLimits     = &queryLimits{}
 	)
 	// init services
 	schema := boldlyGoGraphQL.BuildSchema() // build Boldly Go GraphQL Schema
 	b.schema = &schema
-	awsSvc.Init() // build and initialize AWS Services
-	b.dynamodbSvc = awsSvc.DynamoDbSvc()
+	repos.Initialize() // build and initialize the configured storage backend
+	b.repos = repos
 	auth.Initialize() // build and initialize Auth Service
 	b.authsvc = auth
+	throttle.Initialize() // build and initialize the sign in Login Throttle
+	b.throttle = throttle
+	mailer.Initialize() // build and initialize the configured Mailer
+	b.mailer = mailer
+	oidc.Initialize() // build and initialize the OIDC Client with the configured identity providers
+	b.oidc = oidc
+	pubsub.Initialize() // build and initialize the configured PubSub
+	b.pubsub = pubsub
+	limits.Initialize() // build and initialize the Query Limits for the schema
+	b.limits = limits
 }
 
 func (b *boldlyGo) GraphQLSchema() *graphql.Schema {
 	return b.schema
 }
 
-func (b *boldlyGo) DynamoDbSvc() *dynamodb.DynamoDB {
-	return b.dynamodbSvc
+func (b *boldlyGo) Repositories() Repositories {
+	return b.repos
 }
 
 func (b *boldlyGo) AuthService() AuthSvc {
 	return b.authsvc
 }
 
+func (b *boldlyGo) LoginThrottle() LoginThrottle {
+	return b.throttle
+}
+
+func (b *boldlyGo) Mailer() Mailer {
+	return b.mailer
+}
+
+func (b *boldlyGo) OidcClient() OidcClient {
+	return b.oidc
+}
+
+func (b *boldlyGo) PubSub() PubSub {
+	return b.pubsub
+}
+
+func (b *boldlyGo) QueryLimits() QueryLimits {
+	return b.limits
+}
+
 var boldlygo BoldlyGo = &boldlyGo{}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "set-roles" {
+		runSetRoles(os.Args[2:])
+		return
+	}
 	// instantiate Boldly Go Service
 	boldlygo.Initialize()
 	// instantiate mux router
@@ -92,6 +166,10 @@ func main() {
 		GraphiQL: true,
 	})
 	router.Handle("/graphql", authHeaderMiddleware(h))
+	router.HandleFunc("/subscriptions", subscriptionsHandler).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+	router.HandleFunc("/oauth/authorize", oauthAuthorizeHandler).Methods("GET", "POST")
+	router.HandleFunc("/oauth/token", oauthTokenHandler).Methods("POST")
 	// add CORS acceptance to all requests
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}),
@@ -103,11 +181,58 @@ func main() {
 	log.Fatal(http.ListenAndServe(appPortKey, handlers.LoggingHandler(os.Stdout, corsHandler)))
 }
 
-// Add the Authorization header to the context passed to the GraphQL Handler
+/*
+Add the Authorization header and the client IP address to the context passed to the GraphQL Handler.
+Operations over the query limits are rejected before they reach it
+*/
 func authHeaderMiddleware(next *handler.Handler) http.Handler {
+	trustProxy := os.Getenv(trustProxyHeadersKey) == "true"
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.WithValue(r.Context(), "Authorization", r.Header.Get("Authorization"))
-
+		ctx = context.WithValue(ctx, "ClientIP", clientIP(r, trustProxy))
+		if !checkQueryLimits(ctx, w, r) {
+			return
+		}
 		next.ContextHandler(ctx, w, r)
 	})
 }
+
+// Get the IP address of the client. Behind a trusted proxy, it is the last address the proxy added to X-Forwarded-For;
+// the addresses before it are set by the client and cannot be trusted
+func clientIP(r *http.Request, trustProxy bool) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustProxy && forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Publish the public keys used to sign auth tokens, so other services can verify them
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300") // keys are published before they sign tokens, so a short cache is safe
+	json.NewEncoder(w).Encode(boldlygo.AuthService().JWKS())
+}
+
+// Run the migrate subcommand against the configured DynamoDB instance
+func runMigrate(args []string) {
+	var awsSvc AwsConfig = &awsConf{}
+	awsSvc.Init() // build and initialize AWS Services
+	migrator := NewMigrator(awsSvc)
+	var err error
+	switch {
+	case len(args) == 0:
+		err = migrator.Migrate()
+	case args[0] == "status":
+		err = migrator.Status()
+	default:
+		err = fmt.Errorf("unknown migrate command %q; usage: migrate [status]", args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,780 @@
+/*
+DynamoDB Table Bootstrap and Migrations.
+
+	Run with the migrate subcommand:
+		- migrate: apply every pending migration, in version order
+		- migrate status: list each migration and when it was applied
+
+	Each migration declares its own schema change: the tables it creates and the indexes it adds to existing tables,
+	followed by any data changes (i.e. attribute backfills). Each applied migration is recorded in the
+	SchemaMigrations table so it is only ever applied once. tableSchemas declares the schema once every migration is
+	applied; it documents the tables and is checked against the migrations, but is never applied itself.
+
+	Uses the same AWS configuration as the service, so DYNAMODB_ENDPOINT and DYNAMODB_TABLE_PREFIX apply.
+	MIGRATION_INDEX_TIMEOUT_MINUTES is how long to wait for a new index to be active; defaults to 60.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+)
+
+const (
+	schemaMigrationsTable = "SchemaMigrations"
+	tableReadCapacity     = 5
+	tableWriteCapacity    = 5
+	indexPollInterval     = 5 * time.Second
+
+	indexTimeoutKey           = "MIGRATION_INDEX_TIMEOUT_MINUTES"
+	moneyMigrationCurrencyKey = "MONEY_MIGRATION_CURRENCY" // currency of the legacy float amounts; defaults to USD
+)
+
+type attributeSchema struct {
+	Name string
+	Type dynamodb.ScalarAttributeType
+}
+
+type indexSchema struct {
+	Name     string
+	HashKey  attributeSchema
+	RangeKey attributeSchema // empty Name if the index has no sort key
+}
+
+type tableSchema struct {
+	Name     string
+	HashKey  attributeSchema
+	RangeKey attributeSchema // empty Name if the table has no sort key
+	Indexes  []indexSchema   // global secondary indexes
+	TTL      string          // attribute holding the item expiry in epoch seconds; empty if items do not expire
+}
+
+// A global secondary index a migration adds to an existing table
+type tableIndex struct {
+	Table string
+	Index indexSchema
+}
+
+// The schema of every table used by the service once every migration is applied. Changing it does not change any table
+var tableSchemas = []tableSchema{
+	{
+		Name:    usersTable,
+		HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+	},
+	{
+		Name:     bankAccountsTable,
+		HashKey:  attributeSchema{"bankId", dynamodb.ScalarAttributeTypeS},
+		RangeKey: attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+		Indexes: []indexSchema{
+			{
+				Name:    bankAccountsAccountIdIndex,
+				HashKey: attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+	{
+		Name:     cardsTable,
+		HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+		RangeKey: attributeSchema{"cardId", dynamodb.ScalarAttributeTypeS},
+	},
+	{
+		Name:     transactionsTable,
+		HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+		RangeKey: attributeSchema{"transactionId", dynamodb.ScalarAttributeTypeS},
+		Indexes: []indexSchema{
+			{
+				Name:     transactionsDateIndex,
+				HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+				RangeKey: attributeSchema{"dateKey", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+	{
+		Name:    revokedTokensTable,
+		HashKey: attributeSchema{"jti", dynamodb.ScalarAttributeTypeS},
+		TTL:     "expiresAt",
+	},
+	{
+		Name:    loginAttemptsTable,
+		HashKey: attributeSchema{"subject", dynamodb.ScalarAttributeTypeS},
+		TTL:     "expiresAt",
+	},
+	{
+		Name:     auditEventsTable,
+		HashKey:  attributeSchema{"subject", dynamodb.ScalarAttributeTypeS},
+		RangeKey: attributeSchema{"eventId", dynamodb.ScalarAttributeTypeS},
+	},
+	{
+		Name:    oneTimeTokensTable,
+		HashKey: attributeSchema{"tokenHash", dynamodb.ScalarAttributeTypeS},
+		TTL:     "expiresAt",
+	},
+	{
+		Name:    apiKeysTable,
+		HashKey: attributeSchema{"keyId", dynamodb.ScalarAttributeTypeS},
+		Indexes: []indexSchema{
+			{
+				Name:    apiKeysEmailIndex,
+				HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+	{
+		Name:    oauthClientsTable,
+		HashKey: attributeSchema{"clientId", dynamodb.ScalarAttributeTypeS},
+	},
+	{
+		Name:    oauthGrantsTable,
+		HashKey: attributeSchema{"grantId", dynamodb.ScalarAttributeTypeS},
+		Indexes: []indexSchema{
+			{
+				Name:    oauthGrantsEmailIndex,
+				HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+}
+
+// The table recording the applied migrations
+var schemaMigrationsSchema = tableSchema{
+	Name:    schemaMigrationsTable,
+	HashKey: attributeSchema{"version", dynamodb.ScalarAttributeTypeN},
+}
+
+type migration struct {
+	Version     int
+	Description string
+	Tables      []tableSchema           // the tables the migration creates
+	Indexes     []tableIndex            // the indexes the migration adds to existing tables
+	Up          func(m *migrator) error // the data changes, run once the tables and indexes are active; nil if none
+}
+
+/*
+Every migration, in the order they are applied. Append new migrations with the next version; never edit applied ones.
+The schemas are written out in each migration rather than shared with tableSchemas, so they stay as they were applied
+*/
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "create the Users, BankAccounts, Cards and Transactions tables",
+		Tables: []tableSchema{
+			{
+				Name:    usersTable,
+				HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+			},
+			{
+				Name:     bankAccountsTable,
+				HashKey:  attributeSchema{"bankId", dynamodb.ScalarAttributeTypeS},
+				RangeKey: attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+			},
+			{
+				Name:     cardsTable,
+				HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+				RangeKey: attributeSchema{"cardId", dynamodb.ScalarAttributeTypeS},
+			},
+			{
+				Name:     transactionsTable,
+				HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+				RangeKey: attributeSchema{"transactionId", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "convert float currentBalance and amount values to exact Money maps",
+		Up: func(m *migrator) error {
+			currency := os.Getenv(moneyMigrationCurrencyKey)
+			if currency == "" {
+				currency = defaultCurrency
+			}
+			if err := m.convertFloatToMoney(bankAccountsTable, "currentBalance", currency, "bankId", "accountId"); err != nil {
+				return err
+			}
+			return m.convertFloatToMoney(transactionsTable, "amount", currency, "accountId", "transactionId")
+		},
+	},
+	{
+		Version:     3,
+		Description: "add the accountId index to the BankAccounts table",
+		Indexes: []tableIndex{
+			{
+				Table: bankAccountsTable,
+				Index: indexSchema{
+					Name:    bankAccountsAccountIdIndex,
+					HashKey: attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+				},
+			},
+		},
+	},
+	{
+		Version:     4,
+		Description: "create the RevokedTokens table",
+		Tables: []tableSchema{
+			{
+				Name:    revokedTokensTable,
+				HashKey: attributeSchema{"jti", dynamodb.ScalarAttributeTypeS},
+				TTL:     "expiresAt",
+			},
+		},
+	},
+	{
+		Version:     5,
+		Description: "create the LoginAttempts and AuditEvents tables",
+		Tables: []tableSchema{
+			{
+				Name:    loginAttemptsTable,
+				HashKey: attributeSchema{"subject", dynamodb.ScalarAttributeTypeS},
+				TTL:     "expiresAt",
+			},
+			{
+				Name:     auditEventsTable,
+				HashKey:  attributeSchema{"subject", dynamodb.ScalarAttributeTypeS},
+				RangeKey: attributeSchema{"eventId", dynamodb.ScalarAttributeTypeS},
+			},
+		},
+	},
+	{
+		Version:     6,
+		Description: "create the OneTimeTokens table",
+		Tables: []tableSchema{
+			{
+				Name:    oneTimeTokensTable,
+				HashKey: attributeSchema{"tokenHash", dynamodb.ScalarAttributeTypeS},
+				TTL:     "expiresAt",
+			},
+		},
+	},
+	{
+		Version:     7,
+		Description: "create the ApiKeys table",
+		Tables: []tableSchema{
+			{
+				Name:    apiKeysTable,
+				HashKey: attributeSchema{"keyId", dynamodb.ScalarAttributeTypeS},
+				Indexes: []indexSchema{
+					{
+						Name:    apiKeysEmailIndex,
+						HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+					},
+				},
+			},
+		},
+	},
+	{
+		Version:     8,
+		Description: "create the OAuthClients and OAuthGrants tables",
+		Tables: []tableSchema{
+			{
+				Name:    oauthClientsTable,
+				HashKey: attributeSchema{"clientId", dynamodb.ScalarAttributeTypeS},
+			},
+			{
+				Name:    oauthGrantsTable,
+				HashKey: attributeSchema{"grantId", dynamodb.ScalarAttributeTypeS},
+				Indexes: []indexSchema{
+					{
+						Name:    oauthGrantsEmailIndex,
+						HashKey: attributeSchema{"email", dynamodb.ScalarAttributeTypeS},
+					},
+				},
+			},
+		},
+	},
+	{
+		Version:     9,
+		Description: "add the date index to the Transactions table and backfill the dateKey of each Transaction",
+		Indexes: []tableIndex{
+			{
+				Table: transactionsTable,
+				Index: indexSchema{
+					Name:     transactionsDateIndex,
+					HashKey:  attributeSchema{"accountId", dynamodb.ScalarAttributeTypeS},
+					RangeKey: attributeSchema{"dateKey", dynamodb.ScalarAttributeTypeS},
+				},
+			},
+		},
+		Up: func(m *migrator) error {
+			return m.backfillTransactionDateKeys()
+		},
+	},
+}
+
+type migrationRecord struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	AppliedAt   time.Time `json:"appliedAt"`
+}
+
+type Migrator interface {
+	Migrate() error
+	Status() error
+}
+
+type migrator struct {
+	awsSvc AwsConfig
+	svc    *dynamodb.DynamoDB
+}
+
+// Build the Migrator from the initialized AWS Service
+func NewMigrator(awsSvc AwsConfig) Migrator {
+	return &migrator{awsSvc: awsSvc, svc: awsSvc.DynamoDbSvc()}
+}
+
+/*
+Apply the pending migrations.
+
+	Ensure the SchemaMigrations table exists, read the applied versions,
+	then apply and record each migration that has not been applied, in version order.
+	Stops at the first migration that fails; the failed migration is not recorded and is retried on the next run.
+*/
+func (m *migrator) Migrate() error {
+	if err := m.EnsureTable(schemaMigrationsSchema); err != nil {
+		return err
+	}
+	applied, err := m.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, mig := range sortedMigrations() {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		fmt.Println(fmt.Sprintf("Applying migration %d: %s", mig.Version, mig.Description))
+		if err := m.apply(mig); err != nil {
+			return fmt.Errorf("migration %d failed: %v", mig.Version, err)
+		}
+		if err := m.record(mig); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Migrations up to date")
+	return nil
+}
+
+/*
+Apply the migration: create its tables, add its indexes, then run its data changes.
+Each step is skipped if it is already done, so a migration that failed part way is completed when it is retried
+*/
+func (m *migrator) apply(mig migration) error {
+	if err := m.EnsureTables(mig.Tables); err != nil {
+		return err
+	}
+	for _, idx := range mig.Indexes {
+		if err := m.EnsureIndex(idx.Table, idx.Index); err != nil {
+			return err
+		}
+	}
+	if mig.Up == nil {
+		return nil
+	}
+	return mig.Up(m)
+}
+
+// Print every migration and when it was applied, or that it is pending
+func (m *migrator) Status() error {
+	applied, err := m.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, mig := range sortedMigrations() {
+		status := "pending"
+		if rec, ok := applied[mig.Version]; ok {
+			status = "applied " + rec.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Println(fmt.Sprintf("%4d  %-28s  %s", mig.Version, status, mig.Description))
+	}
+	return nil
+}
+
+// Create or update each of the tables from the schema
+func (m *migrator) EnsureTables(schemas []tableSchema) error {
+	for _, schema := range schemas {
+		if err := m.EnsureTable(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Create or update the table from the schema.
+
+	Compare the schema to the table description:
+		- If the table does not exist: create it with its key schema and indexes, and wait for it to be active
+		- If the table exists: create each index the table is missing, one at a time, waiting for each to be active
+	Then enable the Time to Live on the TTL attribute of the schema, if it is not already enabled.
+*/
+func (m *migrator) EnsureTable(schema tableSchema) error {
+	tableName := m.awsSvc.TableName(schema.Name)
+	output, err := m.svc.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)}).Send()
+	if isResourceNotFound(err) {
+		if err := m.createTable(tableName, schema); err != nil {
+			return err
+		}
+		return m.ensureTimeToLive(tableName, schema)
+	}
+	if err != nil {
+		return err
+	}
+	for _, idx := range schema.Indexes {
+		if err := m.ensureIndex(output.Table, idx); err != nil {
+			return err
+		}
+	}
+	return m.ensureTimeToLive(tableName, schema)
+}
+
+// Add the index to the existing table, unless the table already has it; wait for the index to be active
+func (m *migrator) EnsureIndex(table string, idx indexSchema) error {
+	tableName := m.awsSvc.TableName(table)
+	output, err := m.svc.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)}).Send()
+	if err != nil {
+		return err
+	}
+	return m.ensureIndex(output.Table, idx)
+}
+
+// Create the index on the described table if it is missing, and wait for it to be active
+func (m *migrator) ensureIndex(table *dynamodb.TableDescription, idx indexSchema) error {
+	tableName := aws.StringValue(table.TableName)
+	for _, existing := range table.GlobalSecondaryIndexes {
+		if aws.StringValue(existing.IndexName) == idx.Name {
+			return m.waitForIndex(tableName, idx.Name) // it may still be building, i.e. if a previous run timed out
+		}
+	}
+	fmt.Println(fmt.Sprintf("Creating index %s on table %s", idx.Name, tableName))
+	input := &dynamodb.UpdateTableInput{
+		TableName:            aws.String(tableName),
+		AttributeDefinitions: attributeDefinitions(idx.HashKey, idx.RangeKey),
+		GlobalSecondaryIndexUpdates: []dynamodb.GlobalSecondaryIndexUpdate{
+			{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName:             aws.String(idx.Name),
+					KeySchema:             keySchema(idx.HashKey, idx.RangeKey),
+					Projection:            &dynamodb.Projection{ProjectionType: dynamodb.ProjectionTypeAll},
+					ProvisionedThroughput: provisionedThroughput(),
+				},
+			},
+		},
+	}
+	if _, err := m.svc.UpdateTableRequest(input).Send(); err != nil {
+		return err
+	}
+	return m.waitForIndex(tableName, idx.Name)
+}
+
+// Enable the Time to Live on the TTL attribute of the schema, so DynamoDB deletes items once they expire
+func (m *migrator) ensureTimeToLive(tableName string, schema tableSchema) error {
+	if schema.TTL == "" {
+		return nil
+	}
+	output, err := m.svc.DescribeTimeToLiveRequest(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)}).Send()
+	if err != nil {
+		return err
+	}
+	if ttl := output.TimeToLiveDescription; ttl != nil &&
+		(ttl.TimeToLiveStatus == dynamodb.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == dynamodb.TimeToLiveStatusEnabling) {
+		return nil
+	}
+	fmt.Println(fmt.Sprintf("Enabling time to live on table %s", tableName))
+	_, err = m.svc.UpdateTimeToLiveRequest(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(schema.TTL),
+			Enabled:       aws.Bool(true),
+		},
+	}).Send()
+	return err
+}
+
+// Create the table with its key schema and indexes; wait for the table to be active
+func (m *migrator) createTable(tableName string, schema tableSchema) error {
+	fmt.Println(fmt.Sprintf("Creating table %s", tableName))
+	attrs := []attributeSchema{schema.HashKey, schema.RangeKey}
+	input := &dynamodb.CreateTableInput{
+		TableName:             aws.String(tableName),
+		KeySchema:             keySchema(schema.HashKey, schema.RangeKey),
+		ProvisionedThroughput: provisionedThroughput(),
+	}
+	for _, idx := range schema.Indexes {
+		attrs = append(attrs, idx.HashKey, idx.RangeKey)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, dynamodb.GlobalSecondaryIndex{
+			IndexName:             aws.String(idx.Name),
+			KeySchema:             keySchema(idx.HashKey, idx.RangeKey),
+			Projection:            &dynamodb.Projection{ProjectionType: dynamodb.ProjectionTypeAll},
+			ProvisionedThroughput: provisionedThroughput(),
+		})
+	}
+	input.AttributeDefinitions = attributeDefinitions(attrs...)
+	if _, err := m.svc.CreateTableRequest(input).Send(); err != nil {
+		return err
+	}
+	return m.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+}
+
+/*
+Poll the table until the index is active. Fails once the index timeout passes; DynamoDB keeps building the index,
+so migrating again waits for it to finish
+*/
+func (m *migrator) waitForIndex(tableName, indexName string) error {
+	timeout := time.Duration(envInt(indexTimeoutKey, 60)) * time.Minute
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := m.svc.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)}).Send()
+		if err != nil {
+			return err
+		}
+		for _, idx := range output.Table.GlobalSecondaryIndexes {
+			if aws.StringValue(idx.IndexName) == indexName && idx.IndexStatus == dynamodb.IndexStatusActive {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("index %s on table %s is not active after %v; migrate again to keep waiting", indexName, tableName, timeout)
+		}
+		time.Sleep(indexPollInterval)
+	}
+}
+
+/*
+Convert the legacy float number attribute of every item in the table to a Money map in the given currency.
+
+	Scan for the items where the attribute is still a number, and rewrite each on the condition it has not changed
+	since it was read. Items changed in between are skipped; they are no longer a legacy float value.
+*/
+func (m *migrator) convertFloatToMoney(table, attr, currency string, keyNames ...string) error {
+	projection := expression.NamesList(expression.Name(attr))
+	for _, key := range keyNames {
+		projection = projection.AddNames(expression.Name(key))
+	}
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name(attr).AttributeType(expression.Number)).
+		WithProjection(projection).
+		Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(m.awsSvc.TableName(table)),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	converted := 0
+	for {
+		output, err := m.svc.ScanRequest(input).Send()
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			legacy := item[attr]
+			amount, err := strconv.ParseFloat(aws.StringValue(legacy.N), 64)
+			if err != nil {
+				return err
+			}
+			money, err := MoneyFromFloat(amount, currency)
+			if err != nil {
+				return err
+			}
+			updateExpr, err := expression.NewBuilder().
+				WithUpdate(expression.Set(expression.Name(attr), expression.Value(money))).
+				WithCondition(expression.Name(attr).Equal(expression.Value(amount))).
+				Build()
+			if err != nil {
+				return err
+			}
+			key := map[string]dynamodb.AttributeValue{}
+			for _, name := range keyNames {
+				key[name] = item[name]
+			}
+			_, err = m.svc.UpdateItemRequest(&dynamodb.UpdateItemInput{
+				TableName:                 input.TableName,
+				Key:                       key,
+				UpdateExpression:          updateExpr.Update(),
+				ConditionExpression:       updateExpr.Condition(),
+				ExpressionAttributeNames:  updateExpr.Names(),
+				ExpressionAttributeValues: updateExpr.Values(),
+			}).Send()
+			if isConditionalCheckFailed(err) {
+				continue // changed since it was read
+			}
+			if err != nil {
+				return err
+			}
+			converted++
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+	fmt.Println(fmt.Sprintf("Converted %d %s %s values to %s Money", converted, m.awsSvc.TableName(table), attr, currency))
+	return nil
+}
+
+/*
+Set the dateKey of every Transaction written before the date index, so the index reads them in date order.
+
+	Scan for the Transactions without a dateKey, and set it on the condition it is still missing. The transactionDate
+	is never changed, so a Transaction posted in between already has the same dateKey.
+*/
+func (m *migrator) backfillTransactionDateKeys() error {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.AttributeNotExists(expression.Name("dateKey"))).
+		WithProjection(expression.NamesList(expression.Name("accountId"), expression.Name("transactionId"), expression.Name("transactionDate"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(m.awsSvc.TableName(transactionsTable)),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	backfilled := 0
+	for {
+		output, err := m.svc.ScanRequest(input).Send()
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			var txn Transaction
+			if err := dynamodbattribute.UnmarshalMap(item, &txn); err != nil {
+				return err
+			}
+			updateExpr, err := expression.NewBuilder().
+				WithUpdate(expression.Set(expression.Name("dateKey"), expression.Value(transactionDateKey(&txn)))).
+				WithCondition(expression.AttributeNotExists(expression.Name("dateKey"))).
+				Build()
+			if err != nil {
+				return err
+			}
+			_, err = m.svc.UpdateItemRequest(&dynamodb.UpdateItemInput{
+				TableName: input.TableName,
+				Key: map[string]dynamodb.AttributeValue{
+					"accountId":     item["accountId"],
+					"transactionId": item["transactionId"],
+				},
+				UpdateExpression:          updateExpr.Update(),
+				ConditionExpression:       updateExpr.Condition(),
+				ExpressionAttributeNames:  updateExpr.Names(),
+				ExpressionAttributeValues: updateExpr.Values(),
+			}).Send()
+			if isConditionalCheckFailed(err) {
+				continue // set since it was read
+			}
+			if err != nil {
+				return err
+			}
+			backfilled++
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+	fmt.Println(fmt.Sprintf("Set the dateKey of %d %s items", backfilled, m.awsSvc.TableName(transactionsTable)))
+	return nil
+}
+
+// Read the applied migration records, keyed by version. None have been applied if the SchemaMigrations table does not exist
+func (m *migrator) appliedMigrations() (map[int]migrationRecord, error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(m.awsSvc.TableName(schemaMigrationsTable))}
+	applied := map[int]migrationRecord{}
+	for {
+		output, err := m.svc.ScanRequest(input).Send()
+		if isResourceNotFound(err) {
+			return applied, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var records []migrationRecord
+		if err = dynamodbattribute.UnmarshalListOfMaps(output.Items, &records); err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			applied[rec.Version] = rec
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return applied, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// Record the migration as applied
+func (m *migrator) record(mig migration) error {
+	item, err := dynamodbattribute.MarshalMap(migrationRecord{
+		Version:     mig.Version,
+		Description: mig.Description,
+		AppliedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.svc.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(m.awsSvc.TableName(schemaMigrationsTable)),
+		Item:      item,
+	}).Send()
+	return err
+}
+
+// The migrations in ascending version order
+func sortedMigrations() []migration {
+	sorted := append([]migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
+
+// Build the key schema from the hash key and optional range key
+func keySchema(hashKey, rangeKey attributeSchema) []dynamodb.KeySchemaElement {
+	keys := []dynamodb.KeySchemaElement{
+		{AttributeName: aws.String(hashKey.Name), KeyType: dynamodb.KeyTypeHash},
+	}
+	if rangeKey.Name != "" {
+		keys = append(keys, dynamodb.KeySchemaElement{AttributeName: aws.String(rangeKey.Name), KeyType: dynamodb.KeyTypeRange})
+	}
+	return keys
+}
+
+// Build the distinct attribute definitions of the key attributes, skipping empty (absent) range keys
+func attributeDefinitions(attrs ...attributeSchema) []dynamodb.AttributeDefinition {
+	var defs []dynamodb.AttributeDefinition
+	seen := map[string]bool{}
+	for _, attr := range attrs {
+		if attr.Name == "" || seen[attr.Name] {
+			continue
+		}
+		seen[attr.Name] = true
+		defs = append(defs, dynamodb.AttributeDefinition{AttributeName: aws.String(attr.Name), AttributeType: attr.Type})
+	}
+	return defs
+}
+
+func provisionedThroughput() *dynamodb.ProvisionedThroughput {
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(tableReadCapacity),
+		WriteCapacityUnits: aws.Int64(tableWriteCapacity),
+	}
+}
+
+// Check if the error is a DynamoDB ResourceNotFoundException, i.e. the table does not exist
+func isResourceNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
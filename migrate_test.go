@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The migrations are numbered 1, 2, 3... so none is skipped or applied twice
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, mig := range sortedMigrations() {
+		if mig.Version != i+1 {
+			t.Fatalf("migration %d is at position %d; versions must count up from 1", mig.Version, i+1)
+		}
+	}
+}
+
+// Applying the schema change of every migration in order builds the schema declared in tableSchemas
+func TestMigrationsBuildTableSchemas(t *testing.T) {
+	migrated := map[string]tableSchema{}
+	for _, mig := range sortedMigrations() {
+		for _, table := range mig.Tables {
+			if _, ok := migrated[table.Name]; ok {
+				t.Errorf("migration %d creates the %s table, which an earlier migration created", mig.Version, table.Name)
+			}
+			migrated[table.Name] = table
+		}
+		for _, idx := range mig.Indexes {
+			table, ok := migrated[idx.Table]
+			if !ok {
+				t.Errorf("migration %d adds the %s index to the %s table before it is created", mig.Version, idx.Index.Name, idx.Table)
+				continue
+			}
+			table.Indexes = append(append([]indexSchema(nil), table.Indexes...), idx.Index)
+			migrated[idx.Table] = table
+		}
+	}
+	for _, want := range tableSchemas {
+		got, ok := migrated[want.Name]
+		if !ok {
+			t.Errorf("no migration creates the %s table", want.Name)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("the migrations build the %s table as %+v; tableSchemas declares %+v", want.Name, got, want)
+		}
+		delete(migrated, want.Name)
+	}
+	for name := range migrated {
+		t.Errorf("the migrations create the %s table, which tableSchemas does not declare", name)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Fixed-point Money type.
+
+	An amount of money is stored as an integer count of the minor units of its ISO 4217 currency (i.e. cents for USD),
+	so balance arithmetic is exact. In DynamoDB it is stored as a map: {amount: N, currency: S}.
+
+	The GraphQL Money scalar represents it as a decimal string followed by the currency code, i.e. "-12.34 USD".
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The number of minor unit digits of each supported ISO 4217 currency
+var currencyMinorUnits = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"NZD": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"USD": 2,
+}
+
+// The currency of BankAccounts opened without a currency
+const defaultCurrency = "USD"
+
+// Returned when combining Money of different currencies
+var ErrCurrencyMismatch = errors.New("money amounts are in different currencies")
+
+type Money struct {
+	Amount   int64  `json:"amount"`   // minor units of the currency
+	Currency string `json:"currency"` // ISO 4217 currency code
+}
+
+// Parse Money from its decimal string representation, i.e. "-12.34 USD". The amount may not have more digits than the currency
+func ParseMoney(s string) (Money, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 {
+		return Money{}, fmt.Errorf("invalid money %q: expected an amount and currency code, i.e. \"12.34 USD\"", s)
+	}
+	currency := strings.ToUpper(parts[1])
+	digits, ok := currencyMinorUnits[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("invalid money %q: unsupported currency %s", s, currency)
+	}
+	// split the decimal amount into the whole and fractional parts; never through a float
+	amount := parts[0]
+	negative := strings.HasPrefix(amount, "-")
+	if negative || strings.HasPrefix(amount, "+") {
+		amount = amount[1:] // one sign; any other is rejected below
+	}
+	whole, frac := amount, ""
+	if i := strings.Index(amount, "."); i >= 0 {
+		whole, frac = amount[:i], amount[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return Money{}, fmt.Errorf("invalid money %q: amount is not a decimal number", s)
+	}
+	if len(frac) > digits {
+		return Money{}, fmt.Errorf("invalid money %q: %s amounts have at most %d decimal places", s, currency, digits)
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+	if whole == "" {
+		whole = "0"
+	}
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || strings.ContainsAny(whole+frac, "+-") {
+		return Money{}, fmt.Errorf("invalid money %q: amount is not a decimal number", s)
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+// Convert a floating point amount to Money, rounding to the nearest minor unit. Only for migrating legacy float values
+func MoneyFromFloat(amount float64, currency string) (Money, error) {
+	digits, ok := currencyMinorUnits[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency %s", currency)
+	}
+	return Money{Amount: int64(math.Round(amount * math.Pow10(digits))), Currency: currency}, nil
+}
+
+// Format the Money as a decimal string followed by the currency code, i.e. "-12.34 USD"
+func (m Money) String() string {
+	digits := currencyMinorUnits[m.Currency]
+	abs := m.Amount
+	sign := ""
+	if abs < 0 {
+		abs, sign = -abs, "-"
+	}
+	s := strconv.FormatInt(abs, 10)
+	if digits > 0 {
+		if len(s) <= digits {
+			s = strings.Repeat("0", digits-len(s)+1) + s
+		}
+		s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	}
+	return fmt.Sprintf("%s%s %s", sign, s, m.Currency)
+}
+
+// Add the other Money amount; both must be in the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// The absolute value of the Money amount
+func (m Money) Abs() Money {
+	if m.Amount < 0 {
+		return Money{Amount: -m.Amount, Currency: m.Currency}
+	}
+	return m
+}
+
+// The Money amount with its sign flipped
+func (m Money) Negate() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
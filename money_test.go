@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+// Money is parsed into minor units without going through a float, and only to the digits of its currency
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"12.34 USD", Money{1234, "USD"}},
+		{"-12.34 usd", Money{-1234, "USD"}},
+		{"+0.1 USD", Money{10, "USD"}},
+		{"5 USD", Money{500, "USD"}},
+		{".5 USD", Money{50, "USD"}},
+		{"1000 JPY", Money{1000, "JPY"}},
+		{"1.234 BHD", Money{1234, "BHD"}},
+		{"0.07 EUR", Money{7, "EUR"}},
+	}
+	for _, test := range tests {
+		got, err := ParseMoney(test.in)
+		if err != nil || got != test.want {
+			t.Errorf("ParseMoney(%q) = %v, %v; want %v", test.in, got, err, test.want)
+		}
+	}
+	for _, in := range []string{"", "12.34", "USD", "12.34 XXX", "1.234 USD", "1.5 JPY", "1-2 USD", "--1 USD", "1.2.3 USD", "abc USD", "12.34 USD extra", "- USD", "+ USD", ". USD", "-. USD"} {
+		if got, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %v; want an error", in, got)
+		}
+	}
+}
+
+// Money formats with the digits of its currency, and parses back to the same amount
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{Money{1234, "USD"}, "12.34 USD"},
+		{Money{-5, "USD"}, "-0.05 USD"},
+		{Money{0, "EUR"}, "0.00 EUR"},
+		{Money{1000, "JPY"}, "1000 JPY"},
+		{Money{-1, "BHD"}, "-0.001 BHD"},
+	}
+	for _, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("%#v.String() = %q; want %q", test.in, got, test.want)
+		}
+		if parsed, err := ParseMoney(test.want); err != nil || parsed != test.in {
+			t.Errorf("ParseMoney(%q) = %v, %v; want %v", test.want, parsed, err, test.in)
+		}
+	}
+}
+
+// Only Money of the same currency can be added
+func TestMoneyAdd(t *testing.T) {
+	sum, err := Money{1050, "USD"}.Add(Money{-250, "USD"})
+	if err != nil || sum != (Money{800, "USD"}) {
+		t.Errorf("10.50 USD + -2.50 USD = %v, %v; want 8.00 USD", sum, err)
+	}
+	if _, err := (Money{100, "USD"}).Add(Money{100, "EUR"}); err != ErrCurrencyMismatch {
+		t.Errorf("1.00 USD + 1.00 EUR failed with %v; want %v", err, ErrCurrencyMismatch)
+	}
+}
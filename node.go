@@ -0,0 +1,211 @@
+/*
+Relay Global Object Identification of the records.
+
+	Users, Banks, BankAccounts, Cards and Transactions implement the Node interface. Their id field is a global id: the
+	base64 encoding of the type name and the keys of the record, so it is unique across types:
+		- User: "User:<email>"; a User gets a new id when they change their email
+		- Bank: "Bank:<bankId>:<owningUserId>"
+		- BankAccount: "BankAccount:<bankId>:<accountId>"
+		- Card: "Card:<accountId>:<cardId>"
+		- Transaction: "Transaction:<accountId>:<transactionId>"
+	Clients should treat the ids as opaque.
+
+	The node(id) and nodes(ids) queries refetch any of the records by their global id. Each record is authorized the same
+	as the query that reads it: the caller must own it, and an API key or connected app must have the scope to read it.
+	A User can be read by themselves, or by staff (audited). Records that do not exist are null; as with the queries,
+	a record whose BankAccount or Bank does not exist is reported as FORBIDDEN, like a record of another user.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/relay"
+	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+)
+
+const maxNodeIds = 100 // the ids nodes can fetch at once
+
+// A record that implements the Node interface, identified by its type name and keys
+type node interface {
+	nodeType() string
+	nodeKeys() []string
+}
+
+func (u *User) nodeType() string          { return "User" }
+func (u *User) nodeKeys() []string        { return []string{u.Email} }
+func (b *Bank) nodeType() string          { return "Bank" }
+func (b *Bank) nodeKeys() []string        { return []string{b.BankId, b.OwningUserId} }
+func (a *BankAccount) nodeType() string   { return "BankAccount" }
+func (a *BankAccount) nodeKeys() []string { return []string{a.BankId, a.AccountId} }
+func (c *Card) nodeType() string          { return "Card" }
+func (c *Card) nodeKeys() []string        { return []string{c.AccountId, c.CardId} }
+func (t *Transaction) nodeType() string   { return "Transaction" }
+func (t *Transaction) nodeKeys() []string { return []string{t.AccountId, t.TransactionId} }
+
+// Fetches a record of a type by its keys, passed as the arguments named by keys
+type nodeFetcher struct {
+	keys    []string
+	resolve graphql.FieldResolveFn
+}
+
+// The fetchers of each Node type; they are wrapped with the authorization of the query that reads the record
+var nodeFetchers = map[string]nodeFetcher{
+	"User": {
+		keys: []string{"email"},
+		resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			principal, err := callerPrincipal(p.Context)
+			if err != nil {
+				return nil, err
+			}
+			if strings.EqualFold(principal.Email, p.Args["email"].(string)) {
+				return authorize(signedIn, func(p graphql.ResolveParams) (interface{}, error) {
+					return nodeOrNil(GetProfile(principal.Email))
+				})(p)
+			}
+			return requireRole(supportRoles, func(p graphql.ResolveParams) (interface{}, error) {
+				return nodeOrNil(GetUser(p.Args["email"].(string)))
+			})(p)
+		},
+	},
+	"Bank": {
+		keys: []string{"bankId", "owningUserId"},
+		resolve: authorizeScope(scopeAccountsRead, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
+			email, err := callerEmail(p.Context)
+			if err != nil {
+				return nil, err
+			}
+			owner, err := bankOwner(email)
+			if err != nil {
+				return nil, err
+			}
+			if owner != p.Args["owningUserId"] {
+				return nil, ErrForbidden
+			}
+			return nodeOrNil(GetBank(owner, nodeKeyId(p, "bankId")))
+		}),
+	},
+	"BankAccount": {
+		keys: []string{"bankId", "accountId"},
+		resolve: authorizeScope(scopeAccountsRead, arg("bankId", ownsBank), func(p graphql.ResolveParams) (interface{}, error) {
+			return nodeOrNil(GetUserBankAccount(nodeKeyId(p, "bankId"), nodeKeyId(p, "accountId")))
+		}),
+	},
+	"Card": {
+		keys: []string{"accountId", "cardId"},
+		resolve: authorizeScope(scopeCardsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
+			return nodeOrNil(GetAccountCard(nodeKeyId(p, "accountId"), nodeKeyId(p, "cardId")))
+		}),
+	},
+	"Transaction": {
+		keys: []string{"accountId", "transactionId"},
+		resolve: authorizeScope(scopeTransactionsRead, arg("accountId", ownsAccount), func(p graphql.ResolveParams) (interface{}, error) {
+			return nodeOrNil(GetAccountTransaction(nodeKeyId(p, "accountId"), nodeKeyId(p, "transactionId")))
+		}),
+	},
+}
+
+// The Node interface, and the node root field
+var nodeDefinitions = relay.NewNodeDefinitions(relay.NodeDefinitionsConfig{
+	IDFetcher: func(id string, info graphql.ResolveInfo, ctx context.Context) (interface{}, error) {
+		return fetchNode(id, info, ctx)
+	},
+})
+
+// The id field of a Node type: the global id of the record
+func globalIdField(typeName string) *graphql.Field {
+	return relay.GlobalIDField(typeName, func(obj interface{}, info graphql.ResolveInfo, ctx context.Context) (string, error) {
+		if n, ok := obj.(node); ok && !reflect.ValueOf(n).IsNil() {
+			return strings.Join(n.nodeKeys(), ":"), nil
+		}
+		return "", nil
+	})
+}
+
+// Check the value is a record of the Node type, so the Node interface resolves to the type
+func isNodeType(typeName string) graphql.IsTypeOfFn {
+	return func(p graphql.IsTypeOfParams) bool {
+		n, ok := p.Value.(node)
+		return ok && n.nodeType() == typeName
+	}
+}
+
+/*
+Decode the global id into the type name and the keys of the record.
+relay.FromGlobalID keeps only the first key, so the keys are split here; the last key keeps any ":" in it, i.e. of an email
+*/
+func fromGlobalId(id string) (string, map[string]interface{}, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return "", nil, false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	fetcher, ok := nodeFetchers[parts[0]]
+	if !ok || len(parts) != 2 {
+		return "", nil, false
+	}
+	values := strings.SplitN(parts[1], ":", len(fetcher.keys))
+	if len(values) != len(fetcher.keys) {
+		return "", nil, false
+	}
+	keys := map[string]interface{}{}
+	for i, name := range fetcher.keys {
+		if values[i] == "" {
+			return "", nil, false
+		}
+		keys[name] = values[i]
+	}
+	return parts[0], keys, true
+}
+
+// Fetch the record with the global id, if the caller may read it
+func fetchNode(id string, info graphql.ResolveInfo, ctx context.Context) (interface{}, error) {
+	typeName, keys, ok := fromGlobalId(id)
+	if !ok {
+		return nil, ErrInvalidNodeId
+	}
+	return nodeFetchers[typeName].resolve(graphql.ResolveParams{Args: keys, Info: info, Context: ctx})
+}
+
+/*
+Fetch the records with the global ids, in the order of the ids.
+An id that is invalid, or a record the caller may not read, is null in the list, so it does not fail the others; the
+whole list fails if the caller is not authenticated
+*/
+func fetchNodes(p graphql.ResolveParams) (interface{}, error) {
+	ids, _ := p.Args["ids"].([]interface{})
+	if len(ids) > maxNodeIds {
+		return nil, ErrTooManyNodeIds
+	}
+	if _, err := callerPrincipal(p.Context); err != nil {
+		return nil, err
+	}
+	nodes := make([]interface{}, len(ids))
+	for i, id := range ids {
+		if record, err := fetchNode(id.(string), p.Info, p.Context); err == nil {
+			nodes[i] = record
+		}
+	}
+	return nodes, nil
+}
+
+// Convert a key argument to a UUID; keys that are not UUIDs find no record
+func nodeKeyId(p graphql.ResolveParams, name string) uuid.UUID {
+	s, _ := p.Args[name].(string)
+	return uuid.FromStringOrNil(s)
+}
+
+// Return nil for a record that does not exist, so the Node interface does not resolve a typed nil
+func nodeOrNil(record interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || reflect.ValueOf(record).IsNil() {
+		return nil, nil
+	}
+	return record, nil
+}
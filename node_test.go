@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+// Global ids decode into their type and keys; the last key keeps any ":" in it
+func TestFromGlobalId(t *testing.T) {
+	encode := func(id string) string { return base64.StdEncoding.EncodeToString([]byte(id)) }
+	typeName, keys, ok := fromGlobalId(encode("Card:account:card"))
+	if !ok || typeName != "Card" || keys["accountId"] != "account" || keys["cardId"] != "card" {
+		t.Errorf("the Card id decoded as %s %v %v", typeName, keys, ok)
+	}
+	if _, keys, ok := fromGlobalId(encode("User:name:with:colons@example.com")); !ok || keys["email"] != "name:with:colons@example.com" {
+		t.Errorf("the User id decoded as %v %v", keys, ok)
+	}
+	for _, invalid := range []string{"not base64!", encode("Account:1:2"), encode("Card:account"), encode("Card::card"), encode("User")} {
+		if _, _, ok := fromGlobalId(invalid); ok {
+			t.Errorf("the invalid id %q decoded", invalid)
+		}
+	}
+}
+
+// The ids of the records refetch them with node and nodes; records of another user, or that do not exist, are null
+func TestNodeFetchesOwnedRecords(t *testing.T) {
+	email := "node@example.com"
+	authorization := signUp(t, email)
+	account := openAccount(t, authorization, email, "USD")
+	var read struct {
+		Me          struct{ Id string }
+		BankAccount struct{ Id string }
+	}
+	mustDo(t, authorization, `query($bankId: String!, $accountId: String!) { me { id } bankAccount(bankId: $bankId, accountId: $accountId) { id } }`,
+		map[string]interface{}{"bankId": testBankId(email), "accountId": account.AccountId}, &read)
+
+	query := `query($id: ID!) { node(id: $id) { id ... on User { email } ... on BankAccount { accountId } } }`
+	var user struct{ Node struct{ Id, Email string } }
+	mustDo(t, authorization, query, map[string]interface{}{"id": read.Me.Id}, &user)
+	if user.Node.Id != read.Me.Id || user.Node.Email != email {
+		t.Errorf("the User node is %+v; want %s", user.Node, email)
+	}
+	var bankAccount struct {
+		Node struct{ Id, AccountId string }
+	}
+	mustDo(t, authorization, query, map[string]interface{}{"id": read.BankAccount.Id}, &bankAccount)
+	if bankAccount.Node.Id != read.BankAccount.Id || bankAccount.Node.AccountId != account.AccountId {
+		t.Errorf("the BankAccount node is %+v; want %s", bankAccount.Node, account.AccountId)
+	}
+
+	missing := base64.StdEncoding.EncodeToString([]byte("BankAccount:" + testBankId(email) + ":" + uuid.NewV4().String()))
+	ids := []string{read.Me.Id, read.BankAccount.Id, missing, "not an id"}
+	nodes := func(authorization string) []*struct{ Id string } {
+		var fetched struct{ Nodes []*struct{ Id string } }
+		mustDo(t, authorization, `query($ids: [ID!]!) { nodes(ids: $ids) { id } }`, map[string]interface{}{"ids": ids}, &fetched)
+		return fetched.Nodes
+	}
+	if fetched := nodes(authorization); len(fetched) != 4 || fetched[0] == nil || fetched[1] == nil || fetched[2] != nil || fetched[3] != nil {
+		t.Errorf("the owner fetched the nodes %v; want the User and BankAccount, then nulls", fetched)
+	}
+	other := signUp(t, "node-other@example.com")
+	if fetched := nodes(other); len(fetched) != 4 || fetched[0] != nil || fetched[1] != nil {
+		t.Errorf("another user fetched the nodes %v; want nulls", fetched)
+	}
+	if code := errorCode(do(other, query, map[string]interface{}{"id": read.BankAccount.Id})); code != errCodeForbidden {
+		t.Errorf("another user fetching the BankAccount node failed with %q; want %q", code, errCodeForbidden)
+	}
+}
@@ -0,0 +1,460 @@
+/*
+OAuth2 Authorization Server for third-party apps, i.e. budgeting apps reading a user's transactions.
+
+	Apps are registered by an admin with adminRegisterOAuthClient, with their redirect URIs and the scopes they may
+	request. Confidential apps (with a server) also get a client secret; public apps (mobile and single page apps) do not.
+	The scopes are the API key scopes; see api-keys.go.
+
+	The authorization code flow (RFC 6749) with PKCE (RFC 7636) is required for every app:
+		- the app sends the user to GET /oauth/authorize with response_type=code, client_id, redirect_uri, scope,
+		  state, code_challenge and code_challenge_method=S256
+		- the consent page shows the app and the scopes it asks for; the user signs in with their email, password and,
+		  if enabled, two-factor code, and allows or denies the app. The app never sees the password
+		- on allow, the user is redirected to the redirect_uri with a single use code, valid for 5 minutes
+		- the app exchanges the code and its code_verifier at POST /oauth/token for an app access token (60 minutes)
+		  and an app refresh token (90 days); grant_type=refresh_token gets new app access tokens
+	App access tokens are sent as "Authorization: Bearer <token>" and only work on the fields of the scopes granted.
+
+	Allowing an app records a grant; the user's connected apps are their active grants. Revoking a connected app revokes
+	its grant, which stops its access and refresh tokens working immediately, as the grant is checked on every use.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	purposeOAuthCode        = "oauth-code"
+	oauthCodeExpiry         = 5 * time.Minute
+	codeChallengeMethodS256 = "S256"
+)
+
+// The OAuth2 error codes (RFC 6749 sections 4.1.2.1 and 5.2)
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+	oauthInvalidScope            = "invalid_scope"
+	oauthAccessDenied            = "access_denied"
+	oauthServerError             = "server_error"
+)
+
+// What each scope lets an app do, as shown on the consent page
+var scopeDescriptions = map[string]string{
+	scopeAccountsRead:      "View your bank accounts and balances",
+	scopeAccountsWrite:     "Create and update your bank accounts",
+	scopeCardsRead:         "View your cards",
+	scopeCardsWrite:        "Add and deactivate your cards",
+	scopeTransactionsRead:  "View your transactions",
+	scopeTransactionsWrite: "Record transactions on your accounts",
+}
+
+// A PKCE code verifier or S256 code challenge (RFC 7636 section 4.1); a challenge is always 43 characters
+var (
+	codeVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+)
+
+// An OAuth2 error, returned to the app by redirect from the authorization endpoint or as JSON from the token endpoint
+type oauthError struct {
+	code        string
+	description string
+}
+
+func (e *oauthError) Error() string {
+	return e.code + ": " + e.description
+}
+
+// A validated request to the authorization endpoint
+type authorizationRequest struct {
+	Client        *OAuthClient
+	RedirectUri   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// The response of the token endpoint (RFC 6749 section 5.1)
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// A scope on the consent page
+type consentScope struct {
+	Name        string
+	Description string
+}
+
+// The data of the consent page template
+type consentPage struct {
+	ClientName string
+	Scopes     []consentScope
+	Params     map[string]string // the authorization request, sent back with the form
+	Email      string
+	Message    string // why the last submit failed
+	Error      string // set instead of the form when the request cannot be redirected back to the app
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Boldly Go</title>
+<style>
+body { font-family: sans-serif; max-width: 28rem; margin: 3rem auto; padding: 0 1rem; color: #222; }
+label { display: block; margin-top: 0.75rem; }
+input { width: 100%; padding: 0.4rem; box-sizing: border-box; }
+button { margin-top: 1rem; padding: 0.5rem 1rem; }
+.message { color: #a00; }
+</style>
+</head>
+<body>
+{{if .Error}}
+<h1>Unable to connect the app</h1>
+<p class="message">{{.Error}}</p>
+{{else}}
+<h1>Connect {{.ClientName}}</h1>
+<p><strong>{{.ClientName}}</strong> would like to:</p>
+<ul>
+{{range .Scopes}}<li>{{.Description}} <small>({{.Name}})</small></li>
+{{end}}</ul>
+<p>Sign in to allow it. {{.ClientName}} will not see your password, and you can disconnect it at any time.</p>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username"></label>
+<label>Password <input type="password" name="password" autocomplete="current-password"></label>
+<label>Two-factor code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label>
+<button type="submit" name="action" value="allow">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+/*
+Handle the authorization endpoint.
+
+	GET shows the consent page for the authorization request.
+	POST is the consent form: deny redirects back to the app with access_denied; allow signs the user in and redirects
+	back to the app with an authorization code. A failed sign in shows the consent page again with the problem.
+	Requests with an unknown client or redirect URI are never redirected, so the endpoint cannot be used to send users
+	to another site; they show the problem instead.
+*/
+func oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderConsentPage(w, http.StatusBadRequest, &consentPage{Error: "The request is invalid."})
+		return
+	}
+	params := r.Form
+	if r.Method == http.MethodPost {
+		params = r.PostForm // the form is sent back as it was shown; the query string is not used
+	}
+	req, err := parseAuthorizationRequest(params)
+	if req == nil {
+		renderConsentPage(w, http.StatusBadRequest, &consentPage{Error: err.description})
+		return
+	}
+	if err != nil {
+		redirectToClient(w, r, req, url.Values{"error": {err.code}, "error_description": {err.description}})
+		return
+	}
+	page := newConsentPage(req)
+	if r.Method != http.MethodPost {
+		renderConsentPage(w, http.StatusOK, page)
+		return
+	}
+	if params.Get("action") != "allow" {
+		redirectToClient(w, r, req, url.Values{"error": {oauthAccessDenied}, "error_description": {"the user denied access"}})
+		return
+	}
+	page.Email = strings.TrimSpace(params.Get("email"))
+	user, message := signInForConsent(page.Email, params.Get("password"), strings.TrimSpace(params.Get("code")), requestIP(r))
+	if user == nil {
+		page.Message = message
+		renderConsentPage(w, http.StatusOK, page)
+		return
+	}
+	code, codeErr := issueAuthorizationCode(user, req)
+	if codeErr != nil {
+		fmt.Println(fmt.Sprintf("Unable to issue authorization code: %v", codeErr))
+		redirectToClient(w, r, req, url.Values{"error": {oauthServerError}, "error_description": {"unable to issue an authorization code"}})
+		return
+	}
+	redirectToClient(w, r, req, url.Values{"code": {code}})
+}
+
+/*
+Handle the token endpoint.
+
+	Authenticates the app: a confidential app sends its client secret with HTTP basic auth or the client_secret
+	parameter; a public app sends only its client_id. Then exchanges the grant:
+		- authorization_code: the code, redirect_uri and code_verifier of the authorization request
+		- refresh_token: the app refresh token; the scope parameter is not supported, the grant's scopes are kept
+*/
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	var (
+		tokens *oauthTokenResponse
+		err    error
+	)
+	client, err := authenticateOAuthClient(r)
+	if err == nil {
+		switch grantType := r.PostForm.Get("grant_type"); grantType {
+		case "authorization_code":
+			tokens, err = exchangeAuthorizationCode(client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		case "refresh_token":
+			tokens, err = refreshAppToken(client, r.PostForm.Get("refresh_token"))
+		default:
+			err = &oauthError{oauthUnsupportedGrantType, fmt.Sprintf("grant_type %q is not supported", grantType)}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		oerr, ok := err.(*oauthError)
+		status := http.StatusBadRequest
+		switch {
+		case !ok:
+			fmt.Println(fmt.Sprintf("Unable to issue app tokens: %v", err))
+			oerr, status = &oauthError{oauthServerError, "unable to issue tokens right now"}, http.StatusInternalServerError
+		case oerr.code == oauthInvalidClient:
+			w.Header().Set("WWW-Authenticate", `Basic realm="boldly-go"`)
+			status = http.StatusUnauthorized
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": oerr.code, "error_description": oerr.description})
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+/*
+Validate the parameters of an authorization request.
+
+	Returns a nil request with the error if the client or redirect URI is not valid; the error cannot be redirected.
+	Returns the request with the error if another parameter is not valid; the error is redirected back to the app.
+	The redirect URI may be left out if the client has only one.
+*/
+func parseAuthorizationRequest(params url.Values) (*authorizationRequest, *oauthError) {
+	client, err := boldlygo.Repositories().OAuthClients().Find(params.Get("client_id"))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to find OAuth client: %v", err))
+		return nil, &oauthError{oauthServerError, "Unable to connect the app right now. Please try again later."}
+	}
+	if client == nil {
+		return nil, &oauthError{oauthInvalidClient, "The app is not registered."}
+	}
+	req := &authorizationRequest{Client: client, RedirectUri: params.Get("redirect_uri"), State: params.Get("state")}
+	if req.RedirectUri == "" && len(client.RedirectUris) == 1 {
+		req.RedirectUri = client.RedirectUris[0]
+	}
+	if !contains(client.RedirectUris, req.RedirectUri) {
+		return nil, &oauthError{oauthInvalidRequest, "The redirect URI is not registered for the app."}
+	}
+	if responseType := params.Get("response_type"); responseType != "code" {
+		return req, &oauthError{oauthUnsupportedResponseType, "response_type must be code"}
+	}
+	scopes, scopeErr := parseRequestedScopes(client, params.Get("scope"))
+	if scopeErr != nil {
+		return req, scopeErr
+	}
+	req.Scopes = scopes
+	if params.Get("code_challenge_method") != codeChallengeMethodS256 || !codeChallengePattern.MatchString(params.Get("code_challenge")) {
+		return req, &oauthError{oauthInvalidRequest, "PKCE is required: send a code_challenge with code_challenge_method S256"}
+	}
+	req.CodeChallenge = params.Get("code_challenge")
+	return req, nil
+}
+
+// Parse the space separated scopes of the request; each must be one the client may request
+func parseRequestedScopes(client *OAuthClient, scope string) ([]string, *oauthError) {
+	requested := map[string]bool{}
+	for _, s := range strings.Fields(scope) {
+		if !contains(client.Scopes, s) {
+			return nil, &oauthError{oauthInvalidScope, fmt.Sprintf("the app may not request the %s scope", s)}
+		}
+		requested[s] = true
+	}
+	var scopes []string
+	for _, s := range validScopes {
+		if requested[s] {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, &oauthError{oauthInvalidScope, "at least one scope is required"}
+	}
+	return scopes, nil
+}
+
+// Build the consent page of the request, with the parameters to send back with the form
+func newConsentPage(req *authorizationRequest) *consentPage {
+	page := &consentPage{
+		ClientName: req.Client.Name,
+		Params: map[string]string{
+			"response_type":         "code",
+			"client_id":             req.Client.ClientId,
+			"redirect_uri":          req.RedirectUri,
+			"scope":                 strings.Join(req.Scopes, " "),
+			"state":                 req.State,
+			"code_challenge":        req.CodeChallenge,
+			"code_challenge_method": codeChallengeMethodS256,
+		},
+	}
+	for _, scope := range req.Scopes {
+		page.Scopes = append(page.Scopes, consentScope{Name: scope, Description: scopeDescriptions[scope]})
+	}
+	return page
+}
+
+// Write the consent page. The page takes a password, so it must not be framed by another site or cached
+func renderConsentPage(w http.ResponseWriter, status int, page *consentPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := consentTemplate.Execute(w, page); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to render the consent page: %v", err))
+	}
+}
+
+// Redirect the user back to the app at the redirect URI of the request, with the response parameters and the state
+func redirectToClient(w http.ResponseWriter, r *http.Request, req *authorizationRequest, response url.Values) {
+	redirect, _ := url.Parse(req.RedirectUri) // registered redirect URIs are validated when the client is registered
+	query := redirect.Query()
+	for name, values := range response {
+		query[name] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// Authenticate the app calling the token endpoint by its client id and, for a confidential app, its client secret
+func authenticateOAuthClient(r *http.Request) (*OAuthClient, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &oauthError{oauthInvalidRequest, "the request body must be form encoded"}
+	}
+	clientId, secret, basic := r.BasicAuth()
+	if basic {
+		// the credentials are form encoded before they are put in the header (RFC 6749 section 2.3.1)
+		clientId, _ = url.QueryUnescape(clientId)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := boldlygo.Repositories().OAuthClients().Find(clientId)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, &oauthError{oauthInvalidClient, "unknown client"}
+	}
+	if client.SecretHash != "" && subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, &oauthError{oauthInvalidClient, "the client secret is incorrect"}
+	}
+	return client, nil
+}
+
+// Check the PKCE code verifier against the S256 code challenge of the authorization request
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if !codeVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+/*
+Validate the grant of an app access token and return the principal of the connected app.
+
+	The grant must exist and not be revoked; the app acts as the user of the grant, with the scopes they granted.
+	Records when the grant was last used, at most once an hour; a failure to record it is logged.
+*/
+func (a *authSvc) validateAppGrant(grantId string) (*Principal, error) {
+	repo := boldlygo.Repositories().OAuthGrants()
+	grant, err := repo.Find(grantId)
+	if err != nil {
+		return nil, err
+	}
+	if grant == nil || grant.RevokedAt != 0 {
+		return nil, errors.New("the app's access has been revoked")
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(grant.LastUsedAt, 0)) >= apiKeyTouchPeriod {
+		if err := repo.Touch(grantId, now.Unix()); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record connected app use: %v", err))
+		}
+	}
+	return &Principal{Email: grant.Email, Scopes: grant.Scopes, GrantId: grant.GrantId, ClientId: grant.ClientId}, nil
+}
+
+// Check a redirect URI can be registered: absolute, without a fragment, and https unless it is on the local machine.
+// Private-use schemes, i.e. com.example.app:/callback, are allowed for native apps
+func checkRedirectUri(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return fmt.Sprintf("%q must be an absolute URI", uri)
+	}
+	if u.Fragment != "" {
+		return fmt.Sprintf("%q must not have a fragment", uri)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if host := u.Hostname(); host != "localhost" && host != "127.0.0.1" && host != "::1" {
+			return fmt.Sprintf("%q must use https, unless it is on localhost", uri)
+		}
+	default:
+		if !strings.Contains(u.Scheme, ".") {
+			return fmt.Sprintf("%q must use https, or a private-use scheme like com.example.app", uri)
+		}
+	}
+	return ""
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// The client IP address of the request, to throttle failed sign ins
+func requestIP(r *http.Request) string {
+	return clientIP(r, os.Getenv(trustProxyHeadersKey) == "true")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
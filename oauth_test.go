@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The PKCE verifier must hash to the S256 challenge (RFC 7636 appendix B), and be 43 to 128 unreserved characters
+func TestVerifyCodeChallenge(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	tests := []struct {
+		verifier  string
+		challenge string
+		ok        bool
+	}{
+		{verifier, challenge, true},
+		{verifier, verifier, false}, // a plain challenge is not supported
+		{verifier[1:] + "A", challenge, false},
+		{verifier[:42], challenge, false},
+		{strings.Repeat("a", 129), challenge, false},
+		{verifier[:42] + "+", challenge, false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if ok := verifyCodeChallenge(test.verifier, test.challenge); ok != test.ok {
+			t.Errorf("verifyCodeChallenge(%q, %q) = %v; want %v", test.verifier, test.challenge, ok, test.ok)
+		}
+	}
+}
+
+// Redirect URIs must be absolute and without a fragment: https, http on the local machine, or a private-use scheme
+func TestCheckRedirectUri(t *testing.T) {
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://app.example.com/callback", false},
+		{"https://app.example.com/callback#fragment", false},
+		{"com.example.app:/callback", true},
+		{"myapp:/callback", false},
+		{"/callback", false},
+	}
+	for _, test := range tests {
+		if problem := checkRedirectUri(test.uri); (problem == "") != test.valid {
+			t.Errorf("checkRedirectUri(%q) = %q; want valid %v", test.uri, problem, test.valid)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+/*
+OIDC Client for signing in with external identity providers, i.e. the corporate identity provider of a customer.
+
+	The identity providers are configured in the JSON file at OIDC_PROVIDERS_FILE:
+		[
+			{"id": "acme", "name": "Acme Corp", "issuer": "https://login.acme.com", "clientId": "boldly-go",
+			 "clientSecret": "...", "redirectUri": "https://app.example.com/oidc/callback", "domains": ["acme.com"]}
+		]
+	The issuer must use https, unless it is on localhost, i.e. a mock issuer run for development and tests.
+	The redirectUri defaults to /oidc/callback of the APP_URL. The clientSecret is left out for a public client.
+	If domains is set, the provider may only sign in users with an email in one of the domains.
+
+	The provider metadata is discovered from <issuer>/.well-known/openid-configuration on first use, and again hourly.
+	The signing keys are fetched from its jwks_uri, and fetched again when a token is signed with a key not seen before,
+	at most once a minute, so keys the provider rotates in are picked up.
+
+	ID tokens must be signed with an RSA or EC key of the provider; tokens signed with a shared secret or not signed
+	are refused. The issuer, audience, expiry and nonce are checked, allowing a minute of clock skew.
+*/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	oidcProvidersFileKey = "OIDC_PROVIDERS_FILE"
+	oidcDiscoveryPath    = "/.well-known/openid-configuration"
+	oidcDiscoveryTtl     = time.Hour
+	oidcKeysMinRefresh   = time.Minute // the signing keys are fetched again at most once per period
+	oidcHttpTimeout      = 10 * time.Second
+	oidcClockSkew        = time.Minute
+	oidcMaxResponseBytes = 1 << 20
+	oidcScopes           = "openid email profile"
+)
+
+// The algorithms ID tokens may be signed with
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+type OidcClient interface {
+	Initialize()
+	Providers() []IdentityProvider
+	AuthorizationUrl(providerId, state, nonce, codeChallenge string) (string, error)
+	Exchange(providerId, code, codeVerifier, nonce string) (*OidcIdentity, error)
+}
+
+// The user an identity provider signed in, from the claims of their ID token
+type OidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// A provider entry of the OIDC_PROVIDERS_FILE
+type oidcProviderConfig struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"` // optional; empty for a public client
+	RedirectUri  string   `json:"redirectUri"`  // optional; defaults to /oidc/callback of the APP_URL
+	Domains      []string `json:"domains"`      // optional; the email domains the provider may sign in
+}
+
+// The provider metadata (OpenID Connect Discovery 1.0 section 3)
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	config oidcProviderConfig
+
+	mu            sync.Mutex
+	metadata      *oidcMetadata
+	discoveredAt  time.Time
+	keys          map[string]interface{} // the public signing keys of the provider, by kid
+	keysFetchedAt time.Time
+}
+
+type oidcClient struct {
+	providers []*oidcProvider
+	http      *http.Client
+}
+
+// Initialize the OIDC Client with the providers file in the environment; without one, no providers are configured
+func (c *oidcClient) Initialize() {
+	c.http = &http.Client{Timeout: oidcHttpTimeout}
+	if providersFile := os.Getenv(oidcProvidersFileKey); providersFile != "" {
+		providers, err := loadOidcProviders(providersFile)
+		if err != nil {
+			panic(err)
+		}
+		c.providers = providers
+	}
+}
+
+// Load the identity providers configured in the providers file
+func loadOidcProviders(path string) ([]*oidcProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []oidcProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid identity providers file %s: %v", path, err)
+	}
+	var providers []*oidcProvider
+	ids := map[string]bool{}
+	for _, config := range configs {
+		if config.Id == "" || config.Name == "" || config.ClientId == "" {
+			return nil, fmt.Errorf("identity provider %q in %s must have an id, name and clientId", config.Id, path)
+		}
+		if ids[config.Id] {
+			return nil, fmt.Errorf("identity provider %q is configured twice in %s", config.Id, path)
+		}
+		ids[config.Id] = true
+		if problem := checkIssuer(config.Issuer); problem != "" {
+			return nil, fmt.Errorf("identity provider %q in %s: issuer %s", config.Id, path, problem)
+		}
+		if config.RedirectUri == "" {
+			config.RedirectUri = appLink(oidcCallbackPath, "")
+		}
+		for i, domain := range config.Domains {
+			config.Domains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		}
+		providers = append(providers, &oidcProvider{config: config})
+	}
+	return providers, nil
+}
+
+// Check the issuer is an https URL, or an http URL on localhost; returns the problem, or empty if there is none
+func checkIssuer(issuer string) string {
+	u, err := url.Parse(issuer)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Sprintf("%q must be an absolute URL", issuer)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Sprintf("%q must not have a query or fragment", issuer)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if host := u.Hostname(); host != "localhost" && host != "127.0.0.1" && host != "::1" {
+			return fmt.Sprintf("%q must use https, unless it is on localhost", issuer)
+		}
+	default:
+		return fmt.Sprintf("%q must use https", issuer)
+	}
+	return ""
+}
+
+// The configured identity providers, in the order they are configured
+func (c *oidcClient) Providers() []IdentityProvider {
+	providers := []IdentityProvider{}
+	for _, p := range c.providers {
+		providers = append(providers, IdentityProvider{
+			Id:      p.config.Id,
+			Name:    p.config.Name,
+			Domains: append([]string{}, p.config.Domains...),
+		})
+	}
+	return providers
+}
+
+// Check the identity provider may sign in the email
+func (p *IdentityProvider) AllowsEmail(email string) bool {
+	if len(p.Domains) == 0 {
+		return true
+	}
+	return contains(p.Domains, strings.ToLower(email[strings.LastIndex(email, "@")+1:]))
+}
+
+func (c *oidcClient) find(providerId string) *oidcProvider {
+	for _, p := range c.providers {
+		if p.config.Id == providerId {
+			return p
+		}
+	}
+	return nil
+}
+
+// Build the URL of the authorization endpoint of the provider to send the user to, to sign in with the provider
+func (c *oidcClient) AuthorizationUrl(providerId, state, nonce, codeChallenge string) (string, error) {
+	p := c.find(providerId)
+	if p == nil {
+		return "", ErrIdentityProviderNotFound
+	}
+	metadata, err := c.discover(p)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientId},
+		"redirect_uri":          {p.config.RedirectUri},
+		"scope":                 {oidcScopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {codeChallengeMethodS256},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+/*
+Exchange the authorization code the provider redirected the user back with, and validate the ID token it returns.
+Returns the identity the ID token asserts
+*/
+func (c *oidcClient) Exchange(providerId, code, codeVerifier, nonce string) (*OidcIdentity, error) {
+	p := c.find(providerId)
+	if p == nil {
+		return nil, ErrIdentityProviderNotFound
+	}
+	metadata, err := c.discover(p)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectUri},
+		"code_verifier": {codeVerifier},
+	}
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientId)
+	}
+	req, err := http.NewRequest("POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// client_secret_basic; the credentials are form encoded before they are put in the header (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseBytes)).Decode(&tokens); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid token endpoint response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("the token endpoint returned %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IdToken == "" {
+		return nil, errors.New("the token endpoint returned no id_token")
+	}
+	return c.validateIdToken(p, metadata, tokens.IdToken, nonce)
+}
+
+/*
+Validate the ID token and return the identity it asserts.
+
+	The token must be signed by the provider, and:
+		- be issued by the provider to this client; if it has other audiences, the azp claim must be this client
+		- not be expired, or issued in the future
+		- carry the nonce of the sign in, so a token issued for another sign in cannot be replayed
+*/
+func (c *oidcClient) validateIdToken(p *oidcProvider, metadata *oidcMetadata, idToken, nonce string) (*OidcIdentity, error) {
+	// the claims are validated below, with the clock skew allowed
+	parser := &jwt.Parser{ValidMethods: oidcSigningMethods, SkipClaimsValidation: true}
+	token, err := parser.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.signingKey(p, metadata.JwksUri, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != p.config.Issuer {
+		return nil, fmt.Errorf("the ID token was issued by %q, not %q", iss, p.config.Issuer)
+	}
+	audiences := claimStrings(claims["aud"])
+	if !contains(audiences, p.config.ClientId) {
+		return nil, fmt.Errorf("the ID token was issued to %v, not %q", audiences, p.config.ClientId)
+	}
+	if azp, ok := claims["azp"].(string); (ok || len(audiences) > 1) && azp != p.config.ClientId {
+		return nil, fmt.Errorf("the ID token was authorized for %q, not %q", azp, p.config.ClientId)
+	}
+	if !claims.VerifyExpiresAt(now.Add(-oidcClockSkew).Unix(), true) {
+		return nil, errors.New("the ID token has expired")
+	}
+	if !claims.VerifyIssuedAt(now.Add(oidcClockSkew).Unix(), true) {
+		return nil, errors.New("the ID token was issued in the future")
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, errors.New("the ID token nonce does not match the sign in")
+	}
+	identity := &OidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("the ID token has no subject")
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.Email = strings.TrimSpace(identity.Email)
+	identity.Name, _ = claims["name"].(string)
+	identity.Name = strings.TrimSpace(identity.Name)
+	// some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	return identity, nil
+}
+
+// The values of a claim that is a string or an array of strings, like aud
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Get the metadata of the provider, discovering it if it is not cached or is more than an hour old.
+// If discovering fails, metadata discovered before is used until it succeeds again
+func (c *oidcClient) discover(p *oidcProvider) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil && time.Since(p.discoveredAt) < oidcDiscoveryTtl {
+		return p.metadata, nil
+	}
+	metadata := &oidcMetadata{}
+	err := c.getJson(strings.TrimRight(p.config.Issuer, "/")+oidcDiscoveryPath, metadata)
+	// the metadata must be for the configured issuer, so another issuer cannot sign users in through the provider
+	if err == nil && metadata.Issuer != p.config.Issuer {
+		err = fmt.Errorf("the metadata is for issuer %q", metadata.Issuer)
+	}
+	if err == nil && (metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksUri == "") {
+		err = errors.New("the metadata must have an authorization_endpoint, token_endpoint and jwks_uri")
+	}
+	if err != nil {
+		if p.metadata != nil {
+			fmt.Println(fmt.Sprintf("Unable to discover identity provider %s again; using the metadata discovered before: %v", p.config.Id, err))
+			return p.metadata, nil
+		}
+		return nil, fmt.Errorf("unable to discover identity provider %s: %v", p.config.Id, err)
+	}
+	p.metadata, p.discoveredAt = metadata, time.Now()
+	return metadata, nil
+}
+
+// Get the public key the provider signs with under the kid, fetching the keys of the provider if it is not known
+func (c *oidcClient) signingKey(p *oidcProvider, jwksUri, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := findOidcKey(p.keys, kid); key != nil {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < oidcKeysMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set JSONWebKeySet
+	if err := c.getJson(jwksUri, &set); err != nil {
+		return nil, fmt.Errorf("unable to fetch the signing keys of identity provider %s: %v", p.config.Id, err)
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := parseJSONWebKey(jwk); err == nil {
+			keys[jwk.Kid] = key
+		} // keys of other types are not used to sign ID tokens
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	if key := findOidcKey(keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Find the key by its kid. A token without a kid can only be verified if the provider has a single key
+func findOidcKey(keys map[string]interface{}, kid string) interface{} {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+// Parse the public key of an RSA or EC JSON Web Key
+func parseJSONWebKey(jwk JSONWebKey) (interface{}, error) {
+	decode := func(values ...string) ([]*big.Int, error) {
+		var ints []*big.Int
+		for _, value := range values {
+			b, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("invalid key %q", jwk.Kid)
+			}
+			ints = append(ints, new(big.Int).SetBytes(b))
+		}
+		return ints, nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		ints, err := decode(jwk.N, jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !ints[1].IsInt64() || ints[1].Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid key %q", jwk.Kid)
+		}
+		return &rsa.PublicKey{N: ints[0], E: int(ints[1].Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		ints, err := decode(jwk.X, jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: ints[0], Y: ints[1]}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// Get the JSON document at the URL into v
+func (c *oidcClient) getJson(uri string, v interface{}) error {
+	resp, err := c.http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseBytes)).Decode(v)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testOidcProvider = "test-idp"
+	testOidcClientId = "boldly-go"
+)
+
+/*
+A fake identity provider serving discovery, its signing keys and the token endpoint.
+
+	The test registers the ID token claims an authorization code is exchanged for, as if the user signed in with the
+	provider. The token endpoint checks the PKCE code verifier against the challenge of the authorization URL.
+*/
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]testOidcGrant // keyed by authorization code
+}
+
+type testOidcGrant struct {
+	claims        jwt.MapClaims
+	codeChallenge string
+}
+
+// Start the fake identity provider, and configure it as the only identity provider until the test ends
+func startTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, grants: map[string]testOidcGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+
+	dir, err := ioutil.TempDir("", "boldly-go-oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	providersFile := filepath.Join(dir, "providers.json")
+	providers := fmt.Sprintf(`[{"id": %q, "name": "Test IdP", "issuer": %q, "clientId": %q}]`, testOidcProvider, issuer.server.URL, testOidcClientId)
+	if err := ioutil.WriteFile(providersFile, []byte(providers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(oidcProvidersFileKey, providersFile)
+	defer os.Unsetenv(oidcProvidersFileKey)
+	client := &oidcClient{}
+	client.Initialize()
+	app := boldlygo.(*boldlyGo)
+	previous := app.oidc
+	app.oidc = client
+	t.Cleanup(func() {
+		app.oidc = previous
+		issuer.server.Close()
+	})
+	return issuer
+}
+
+func (i *testIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(&oidcMetadata{
+		Issuer:                i.server.URL,
+		AuthorizationEndpoint: i.server.URL + "/authorize",
+		TokenEndpoint:         i.server.URL + "/token",
+		JwksUri:               i.server.URL + "/jwks",
+	})
+}
+
+func (i *testIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []JSONWebKey{{
+		Kty: "RSA",
+		Kid: "test-idp-key",
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+	}}})
+}
+
+// Exchange an authorization code for the ID token of its grant, once
+func (i *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	i.mu.Lock()
+	grant, ok := i.grants[r.PostForm.Get("code")]
+	delete(i.grants, r.PostForm.Get("code"))
+	i.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("client_id") != testOidcClientId || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "test-idp-key"
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+/*
+Sign in with the identity provider as the subject with the verified email.
+The change, if set, edits the ID token claims before the provider issues them
+*/
+func (i *testIssuer) signIn(t *testing.T, subject, email string, change func(claims jwt.MapClaims)) Auth {
+	t.Helper()
+	login, err := StartOidcLogin(testOidcProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizationUrl, err := url.Parse(login.AuthorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := authorizationUrl.Query()
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            i.server.URL,
+		"aud":            testOidcClientId,
+		"sub":            subject,
+		"email":          email,
+		"email_verified": true,
+		"nonce":          params.Get("nonce"),
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if change != nil {
+		change(claims)
+	}
+	code := "code-" + params.Get("state")
+	i.mu.Lock()
+	i.grants[code] = testOidcGrant{claims: claims, codeChallenge: params.Get("code_challenge")}
+	i.mu.Unlock()
+	return AuthenticateOidc(testOidcProvider, code, params.Get("state"))
+}
+
+// Signing in with an email no User has provisions a User, without a password, linked to the account at the provider
+func TestOidcProvisionsUser(t *testing.T) {
+	issuer := startTestIssuer(t)
+	if auth := issuer.signIn(t, "subject-new", "OIDC-New@Example.com", nil); !auth.Success || auth.Token == "" {
+		t.Fatalf("unable to sign in with the identity provider: %s", auth.Message)
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail("oidc-new@example.com")
+	if err != nil || user == nil {
+		t.Fatalf("the User was not provisioned: %v", err)
+	}
+	if !user.EmailVerified || user.Pwd != "" || user.Name != "oidc-new" || len(user.Identities) != 1 || user.Identities[0].Subject != "subject-new" {
+		t.Errorf("the User was provisioned as %+v; want a verified email, no password and the linked subject", user)
+	}
+	if auth := issuer.signIn(t, "subject-new", "oidc-new@example.com", nil); !auth.Success {
+		t.Errorf("unable to sign in again with the identity provider: %s", auth.Message)
+	}
+	if types := auditEventTypes(loginSubjectEmail + "oidc-new@example.com"); len(types) != 1 || types[0] != auditUserProvisioned {
+		t.Errorf("the audit trail of the User is %v; want %s", types, auditUserProvisioned)
+	}
+}
+
+// The first sign in with the provider links it to the User with the email; a password nobody verified stops working
+func TestOidcLinksExistingUser(t *testing.T) {
+	issuer := startTestIssuer(t)
+	email := "oidc-existing@example.com"
+	signUp(t, email)
+	if auth := issuer.signIn(t, "subject-existing", email, nil); !auth.Success {
+		t.Fatalf("unable to sign in with the identity provider: %s", auth.Message)
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Identities) != 1 || user.Identities[0].Provider != testOidcProvider || user.Identities[0].Subject != "subject-existing" {
+		t.Errorf("the User has the identities %+v; want the account at the provider linked", user.Identities)
+	}
+	if auth := Authenticate(email, testPwd, "192.0.2.1"); auth.Success {
+		t.Error("signed in with the password registered before the email was verified")
+	}
+}
+
+// A User linked to an account at the provider cannot be signed in by another account with the same email
+func TestOidcRefusesDifferentSubject(t *testing.T) {
+	issuer := startTestIssuer(t)
+	email := "oidc-linked@example.com"
+	if auth := issuer.signIn(t, "subject-linked", email, nil); !auth.Success {
+		t.Fatalf("unable to sign in with the identity provider: %s", auth.Message)
+	}
+	auth := issuer.signIn(t, "subject-other", email, nil)
+	if auth.Success || !strings.Contains(auth.Message, "linked to a different Test IdP account") {
+		t.Errorf("signing in as another subject returned %+v; want it refused", auth)
+	}
+	if types := auditEventTypes(loginSubjectEmail + email); len(types) != 2 || types[1] != auditIdentityRefused {
+		t.Errorf("the audit trail of the User is %v; want %s after provisioning", types, auditIdentityRefused)
+	}
+}
+
+// An email the provider has not verified does not sign in, or provision a User
+func TestOidcRefusesUnverifiedEmail(t *testing.T) {
+	issuer := startTestIssuer(t)
+	email := "oidc-unverified@example.com"
+	for _, verified := range []interface{}{false, "false", nil} {
+		auth := issuer.signIn(t, "subject-unverified", email, func(claims jwt.MapClaims) {
+			claims["email_verified"] = verified
+		})
+		if auth.Success || !strings.Contains(auth.Message, "has not verified your email") {
+			t.Errorf("signing in with email_verified %v returned %+v; want it refused", verified, auth)
+		}
+	}
+	if user, _ := boldlygo.Repositories().Users().FindByEmail(email); user != nil {
+		t.Error("a User was provisioned for an unverified email")
+	}
+}
+
+// An ID token for another sign in, client or issuer, or one that has expired, is refused; the state is single use
+func TestOidcRejectsInvalidIdTokens(t *testing.T) {
+	issuer := startTestIssuer(t)
+	email := "oidc-invalid@example.com"
+	tests := []struct {
+		name   string
+		change func(claims jwt.MapClaims)
+	}{
+		{"another nonce", func(claims jwt.MapClaims) { claims["nonce"] = "another-sign-in" }},
+		{"no nonce", func(claims jwt.MapClaims) { delete(claims, "nonce") }},
+		{"another audience", func(claims jwt.MapClaims) { claims["aud"] = "another-client" }},
+		{"another authorized party", func(claims jwt.MapClaims) {
+			claims["aud"], claims["azp"] = []string{testOidcClientId, "another-client"}, "another-client"
+		}},
+		{"another issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://login.example.com" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() }},
+	}
+	for _, test := range tests {
+		if auth := issuer.signIn(t, "subject-invalid", email, test.change); auth.Success || auth.Message != oidcUnableMessage {
+			t.Errorf("%s: signing in returned %+v; want it refused", test.name, auth)
+		}
+	}
+	if user, _ := boldlygo.Repositories().Users().FindByEmail(email); user != nil {
+		t.Error("a User was provisioned from an invalid ID token")
+	}
+	login, err := StartOidcLogin(testOidcProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AuthenticateOidc(testOidcProvider, "unknown-code", login.State)
+	if auth := AuthenticateOidc(testOidcProvider, "unknown-code", login.State); auth.Success || !strings.Contains(auth.Message, "expired") {
+		t.Errorf("reusing the state returned %+v; want the sign in expired", auth)
+	}
+}
+
+// The issuer must use https, unless it is on localhost
+func TestCheckIssuer(t *testing.T) {
+	for issuer, valid := range map[string]bool{
+		"https://login.example.com":     true,
+		"http://localhost:8080":         true,
+		"http://127.0.0.1:8080":         true,
+		"http://login.example.com":      false,
+		"login.example.com":             false,
+		"https://login.example.com?a=b": false,
+		"ftp://login.example.com":       false,
+	} {
+		if problem := checkIssuer(issuer); (problem == "") != valid {
+			t.Errorf("checking the issuer %s returned %q; want valid %v", issuer, problem, valid)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Password Policy for registering users.
+
+	Configured from the environment:
+		- PASSWORD_MIN_LENGTH: the minimum number of characters; defaults to 8
+		- PASSWORD_REQUIRED_CLASSES: comma separated character classes every password must contain, from lower, upper,
+		  digit and symbol; defaults to lower,upper,digit. Set to none to not require any
+		- PASSWORD_COMMON_LIST_FILE: a file of common passwords to reject, one per line; defaults to common-passwords.txt
+
+	Passwords may not be longer than 72 bytes, the most bcrypt hashes; longer passwords would be silently truncated.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	passwordMinLengthKey       = "PASSWORD_MIN_LENGTH"
+	passwordRequiredClassesKey = "PASSWORD_REQUIRED_CLASSES"
+	passwordCommonListFileKey  = "PASSWORD_COMMON_LIST_FILE"
+
+	defaultPasswordMinLength       = 8
+	defaultPasswordRequiredClasses = "lower,upper,digit"
+	defaultPasswordCommonListFile  = "common-passwords.txt"
+	passwordMaxBytes               = 72
+)
+
+// The character classes a password policy can require, with the test for a character of the class
+var passwordClasses = map[string]func(r rune) bool{
+	"lower":  unicode.IsLower,
+	"upper":  unicode.IsUpper,
+	"digit":  unicode.IsDigit,
+	"symbol": func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r) },
+}
+
+// How each character class is described in password problems
+var passwordClassNames = map[string]string{
+	"lower":  "a lowercase letter",
+	"upper":  "an uppercase letter",
+	"digit":  "a digit",
+	"symbol": "a symbol",
+}
+
+type passwordPolicy struct {
+	minLength       int
+	requiredClasses []string
+	common          map[string]bool // lower cased common passwords
+}
+
+// Build the password policy from the environment. Panics on an invalid configuration
+func loadPasswordPolicy() *passwordPolicy {
+	policy := &passwordPolicy{minLength: envInt(passwordMinLengthKey, defaultPasswordMinLength), common: map[string]bool{}}
+	classes := os.Getenv(passwordRequiredClassesKey)
+	if classes == "" {
+		classes = defaultPasswordRequiredClasses
+	}
+	for _, class := range strings.Split(classes, ",") {
+		class = strings.TrimSpace(class)
+		if class == "none" {
+			continue
+		}
+		if _, ok := passwordClasses[class]; !ok {
+			panic(fmt.Errorf("invalid %s class %q: must be lower, upper, digit or symbol", passwordRequiredClassesKey, class))
+		}
+		policy.requiredClasses = append(policy.requiredClasses, class)
+	}
+	listFile := os.Getenv(passwordCommonListFileKey)
+	if err := policy.loadCommonPasswords(listFile); err != nil {
+		if listFile != "" {
+			panic(err)
+		}
+		// the default list is optional, i.e. when running outside of the repository directory
+		fmt.Println(fmt.Sprintf("Common password list not loaded: %v", err))
+	}
+	return policy
+}
+
+// Read the common password list, one password per line
+func (p *passwordPolicy) loadCommonPasswords(listFile string) error {
+	if listFile == "" {
+		listFile = defaultPasswordCommonListFile
+	}
+	f, err := os.Open(listFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pwd := strings.TrimSpace(scanner.Text()); pwd != "" {
+			p.common[strings.ToLower(pwd)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Check the password against the policy. Returns a message for every rule the password breaks
+func (p *passwordPolicy) Check(pwd, email string) []string {
+	var problems []string
+	if n := len([]rune(pwd)); n < p.minLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.minLength))
+	}
+	if len(pwd) > passwordMaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", passwordMaxBytes))
+	}
+	for _, class := range p.requiredClasses {
+		if strings.IndexFunc(pwd, passwordClasses[class]) < 0 {
+			problems = append(problems, "must contain "+passwordClassNames[class])
+		}
+	}
+	if p.common[strings.ToLower(pwd)] {
+		problems = append(problems, "is too common")
+	}
+	if email != "" && strings.EqualFold(pwd, email) {
+		problems = append(problems, "must not be the email")
+	}
+	return problems
+}
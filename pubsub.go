@@ -0,0 +1,109 @@
+/*
+Publish/Subscribe of the events the GraphQL subscriptions listen to; see subscriptions.go.
+
+	Events are published to a topic, i.e. "transactionPosted:<accountId>", and delivered to the subscribers of the topic.
+	The implementation is selected with the PUBSUB value stored in the environment:
+		- "memory" (or empty): deliver events to the subscribers in this process only
+	With the in-process PubSub, a subscriber only sees the events of the changes made through the same instance of the
+	service. Running several instances needs an implementation backed by a shared broker, i.e. Redis or SNS.
+
+	Publishing never blocks: a subscriber more than 16 events behind misses the events until it catches up.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	pubSubKey           = "PUBSUB"
+	pubSubMemory        = "memory"
+	subscriberBufferLen = 16
+)
+
+// The topics of the events of an account
+func transactionPostedTopic(accountId string) string {
+	return "transactionPosted:" + accountId
+}
+
+func balanceChangedTopic(accountId string) string {
+	return "balanceChanged:" + accountId
+}
+
+// The topic of the changes to the access of a user: they are locked, their roles or email change, or an API key or
+// connected app of theirs is revoked
+func accessChangedTopic(email string) string {
+	return "accessChanged:" + strings.ToLower(email)
+}
+
+// Let the subscriptions of the user know their access changed, so they are authorized again
+func publishAccessChanged(email string) {
+	boldlygo.PubSub().Publish(accessChangedTopic(email), email)
+}
+
+type PubSub interface {
+	Initialize()
+	Publish(topic string, event interface{})
+	Subscribe(topic string) (<-chan interface{}, func()) // returns the events and a func to unsubscribe
+}
+
+/*
+Build the PubSub implementation for the configured broker.
+
+	Uses the PUBSUB value stored in the environment:
+		- "memory" (or empty): the in-process PubSub
+*/
+func NewPubSub() PubSub {
+	switch pubSub := os.Getenv(pubSubKey); pubSub {
+	case "", pubSubMemory:
+		return &memoryPubSub{}
+	default:
+		panic(fmt.Errorf("unsupported %s value %q", pubSubKey, pubSub))
+	}
+}
+
+type memoryPubSub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan interface{}]bool // the subscribers of each topic
+}
+
+func (m *memoryPubSub) Initialize() {
+	m.subscribers = map[string]map[chan interface{}]bool{}
+}
+
+// Deliver the event to the subscribers of the topic, skipping the subscribers whose buffer is full
+func (m *memoryPubSub) Publish(topic string, event interface{}) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for events := range m.subscribers[topic] {
+		select {
+		case events <- event:
+		default:
+			fmt.Println(fmt.Sprintf("Dropped an event of %s for a subscriber that is behind", topic))
+		}
+	}
+}
+
+func (m *memoryPubSub) Subscribe(topic string) (<-chan interface{}, func()) {
+	events := make(chan interface{}, subscriberBufferLen)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscribers[topic] == nil {
+		m.subscribers[topic] = map[chan interface{}]bool{}
+	}
+	m.subscribers[topic][events] = true
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			delete(m.subscribers[topic], events)
+			if len(m.subscribers[topic]) == 0 {
+				delete(m.subscribers, topic)
+			}
+		})
+	}
+}
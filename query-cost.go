@@ -0,0 +1,467 @@
+/*
+Query Depth and Cost Limits, checked before an operation runs.
+
+	The schema is recursive (BankAccount → transactions → card, txnsConn edges), so a single operation can fan out into
+	thousands of storage reads. Each operation is analyzed before it is executed, and rejected if:
+		- it is too deep: the deepest nesting of fields is over the maximum depth
+		- it costs too much: its cost is over the maximum cost
+		- the caller has spent their cost budget
+	Introspection fields (__schema, __type and __typename) are not counted.
+
+	The cost estimates the records an operation reads:
+		- a field that returns an object or a list reads records, and costs 1; scalar fields are free, except the
+		  totalCount of a connection, which is a separate count. The edges and node of a connection are read with it
+		- the cost of the fields selected under a list, or under the edges of a connection, is multiplied by the records
+		  it can return: first or last if set, the number of ids of nodes, the default page size of a connection, and
+		  the maximum page size for the lists that read every record
+	Variables are resolved from the request, so first: $count costs what it asks for.
+
+	Each caller has a cost budget that refills over a window: a user, each of their API keys and connected apps, or the
+	client IP address if the request is not authenticated. An operation is only charged if it fits the budget; once it
+	is spent, operations are rejected until it refills enough. Over HTTP the rejection is a 429 with a Retry-After.
+	A subscription is charged once, when it starts; the events it sends are not.
+
+	Configured from the environment:
+		- GRAPHQL_MAX_DEPTH: the deepest nesting of fields; defaults to 10
+		- GRAPHQL_MAX_COST: the most an operation can cost; defaults to 3000
+		- GRAPHQL_COST_BUDGET: the cost a caller can spend per window; at least the max cost, defaults to 30000
+		- GRAPHQL_COST_BUDGET_SECONDS: the window the budget refills over; defaults to 60
+	The budgets are kept in process memory, so with several instances of the service, a caller has a budget at each.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/graphql-go/handler"
+)
+
+const (
+	graphqlMaxDepthKey      = "GRAPHQL_MAX_DEPTH"
+	graphqlMaxCostKey       = "GRAPHQL_MAX_COST"
+	graphqlCostBudgetKey    = "GRAPHQL_COST_BUDGET"
+	graphqlBudgetSecondsKey = "GRAPHQL_COST_BUDGET_SECONDS"
+
+	unboundedListSize = maxPageSize // the records assumed for a list that reads every record
+)
+
+type QueryLimits interface {
+	Initialize()
+	Check(ctx context.Context, query, operationName string, variables map[string]interface{}) error
+}
+
+type queryLimits struct {
+	schema   *graphql.Schema
+	maxDepth int
+	maxCost  int
+	budget   float64
+	window   time.Duration
+
+	mu       sync.Mutex
+	buckets  map[string]*costBucket // keyed by caller
+	prunedAt time.Time
+}
+
+// The budget left to a caller, as of when it was last charged
+type costBucket struct {
+	left      float64
+	updatedAt time.Time
+}
+
+// Initialize the Query Limits from the limits in the environment
+func (q *queryLimits) Initialize() {
+	q.schema = boldlygo.GraphQLSchema()
+	q.maxDepth = envInt(graphqlMaxDepthKey, 10)
+	q.maxCost = envInt(graphqlMaxCostKey, 3000)
+	q.budget = float64(envInt(graphqlCostBudgetKey, 30000))
+	q.window = time.Duration(envInt(graphqlBudgetSecondsKey, 60)) * time.Second
+	if q.budget < float64(q.maxCost) {
+		panic(fmt.Errorf("invalid %s: must be at least the %s of %d", graphqlCostBudgetKey, graphqlMaxCostKey, q.maxCost))
+	}
+	q.buckets = map[string]*costBucket{}
+	q.prunedAt = time.Now()
+}
+
+/*
+Check the operation is within the depth and cost limits, and charge its cost to the budget of the caller.
+A request that cannot be parsed, or does not select an operation, is not checked; it fails validation without running
+*/
+func (q *queryLimits) Check(ctx context.Context, query, operationName string, variables map[string]interface{}) error {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(query), Name: "GraphQL request"})})
+	if err != nil {
+		return nil
+	}
+	a := &operationAnalysis{schema: q.schema, fragments: map[string]*ast.FragmentDefinition{}, variables: variables}
+	var operation *ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		switch d := definition.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || (d.Name != nil && d.Name.Value == operationName) {
+				if operation != nil {
+					return nil // ambiguous; rejected by validation
+				}
+				operation = d
+			}
+		case *ast.FragmentDefinition:
+			a.fragments[d.Name.Value] = d
+		}
+	}
+	// the validation of the vendored graphql-go recurses without end on a fragment cycle, so it is rejected first
+	if name := a.fragmentCycle(); name != "" {
+		return fragmentCycleError(name)
+	}
+	if operation == nil {
+		return nil
+	}
+	a.defaults = map[string]ast.Value{}
+	for _, v := range operation.VariableDefinitions {
+		if v.DefaultValue != nil {
+			a.defaults[v.Variable.Name.Value] = v.DefaultValue
+		}
+	}
+	var root graphql.Type
+	switch operation.Operation {
+	case ast.OperationTypeQuery:
+		root = q.schema.QueryType()
+	case ast.OperationTypeMutation:
+		root = q.schema.MutationType()
+	case ast.OperationTypeSubscription:
+		root = q.schema.SubscriptionType()
+	}
+	depth, cost := a.selectionSet(operation.SelectionSet, root, 1, map[string]bool{})
+	if depth > q.maxDepth {
+		return queryTooDeepError(depth, q.maxDepth)
+	}
+	if cost > q.maxCost {
+		return queryTooCostlyError(cost, q.maxCost)
+	}
+	return q.charge(costBudgetKey(ctx), cost)
+}
+
+// The caller whose budget is charged: the API key, the connected app or the user, or the client IP address
+func costBudgetKey(ctx context.Context) string {
+	principal, err := callerPrincipal(ctx)
+	switch {
+	case err != nil:
+		return "ip:" + callerIP(ctx)
+	case principal.ApiKeyId != "":
+		return "apiKey:" + principal.ApiKeyId
+	case principal.GrantId != "":
+		return "grant:" + principal.GrantId
+	default:
+		return "email:" + strings.ToLower(principal.Email)
+	}
+}
+
+/*
+Charge the cost to the budget of the caller, if it fits.
+The budget refills continuously, the whole of it over the window. Budgets that are full again are dropped once a window
+*/
+func (q *queryLimits) charge(key string, cost int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Sub(q.prunedAt) >= q.window {
+		for k, b := range q.buckets {
+			if now.Sub(b.updatedAt) >= q.window {
+				delete(q.buckets, k)
+			}
+		}
+		q.prunedAt = now
+	}
+	refillRate := q.budget / q.window.Seconds() // per second
+	b, ok := q.buckets[key]
+	if !ok {
+		b = &costBucket{left: q.budget, updatedAt: now}
+		q.buckets[key] = b
+	}
+	b.left = math.Min(q.budget, b.left+now.Sub(b.updatedAt).Seconds()*refillRate)
+	b.updatedAt = now
+	if float64(cost) > b.left {
+		return &costBudgetError{retryAfter: int(math.Ceil((float64(cost) - b.left) / refillRate))}
+	}
+	b.left -= float64(cost)
+	return nil
+}
+
+// The state of analyzing an operation: the fragments and variables of the request it is in
+type operationAnalysis struct {
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	defaults  map[string]ast.Value // the default values of the variables of the operation
+}
+
+/*
+Return the depth and cost of the fields selected on the parent type, including those of its fragments.
+pageSize is the records the edges of the parent connection hold. spreading holds the fragments being spread; fragment cycles are rejected before, but it ends one regardless
+*/
+func (a *operationAnalysis) selectionSet(selectionSet *ast.SelectionSet, parent graphql.Type, pageSize int, spreading map[string]bool) (int, int) {
+	if selectionSet == nil || parent == nil {
+		return 0, 0
+	}
+	depth, cost := 0, 0
+	add := func(d, c int) {
+		if d > depth {
+			depth = d
+		}
+		cost += c
+	}
+	for _, selection := range selectionSet.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			add(a.field(s, parent, pageSize, spreading))
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if s.TypeCondition != nil {
+				fragmentType = a.schema.Type(s.TypeCondition.Name.Value)
+			}
+			add(a.selectionSet(s.SelectionSet, fragmentType, pageSize, spreading))
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			fragment, ok := a.fragments[name]
+			if !ok || spreading[name] {
+				continue
+			}
+			spreading[name] = true
+			add(a.selectionSet(fragment.SelectionSet, a.schema.Type(fragment.TypeCondition.Name.Value), pageSize, spreading))
+			delete(spreading, name)
+		}
+	}
+	return depth, cost
+}
+
+// Find a fragment of the request that spreads itself, directly or through other fragments; empty if none does
+func (a *operationAnalysis) fragmentCycle() string {
+	visited := map[string]bool{} // fragments whose spreads were all followed, without a cycle
+	var spreads func(selectionSet *ast.SelectionSet, path map[string]bool) string
+	spreads = func(selectionSet *ast.SelectionSet, path map[string]bool) string {
+		if selectionSet == nil {
+			return ""
+		}
+		for _, selection := range selectionSet.Selections {
+			var cycle string
+			switch s := selection.(type) {
+			case *ast.Field:
+				cycle = spreads(s.SelectionSet, path)
+			case *ast.InlineFragment:
+				cycle = spreads(s.SelectionSet, path)
+			case *ast.FragmentSpread:
+				name := s.Name.Value
+				fragment, ok := a.fragments[name]
+				switch {
+				case path[name]:
+					return name
+				case !ok || visited[name]:
+					continue
+				}
+				path[name] = true
+				cycle = spreads(fragment.SelectionSet, path)
+				delete(path, name)
+				visited[name] = true
+			}
+			if cycle != "" {
+				return cycle
+			}
+		}
+		return ""
+	}
+	for name, fragment := range a.fragments {
+		if cycle := spreads(fragment.SelectionSet, map[string]bool{name: true}); cycle != "" {
+			return cycle
+		}
+		visited[name] = true
+	}
+	return ""
+}
+
+// Return the depth and cost of the field, with the fields selected under it
+func (a *operationAnalysis) field(field *ast.Field, parent graphql.Type, pageSize int, spreading map[string]bool) (int, int) {
+	name := field.Name.Value
+	definition, ok := typeFields(parent)[name]
+	if strings.HasPrefix(name, "__") || !ok {
+		return 0, 0 // introspection, or an unknown field that validation rejects
+	}
+	if graphql.IsLeafType(definition.Type) {
+		if name == "totalCount" && isConnectionType(parent) {
+			return 1, 1
+		}
+		return 1, 0
+	}
+	fieldType := namedType(definition.Type)
+	size, childPageSize := a.listSize(field, definition.Type), 1
+	switch {
+	case isConnectionType(fieldType):
+		size, childPageSize = 1, size // only the edges hold a page; totalCount and pageInfo are read once
+	case isConnectionType(parent) && name == "edges":
+		size = pageSize
+	}
+	childDepth, childCost := a.selectionSet(field.SelectionSet, fieldType, childPageSize, spreading)
+	cost := 1
+	if isConnectionType(parent) || isEdgeType(parent) {
+		cost = 0 // the edges and nodes of a connection are read with it
+	}
+	return childDepth + 1, cost + size*childCost
+}
+
+/*
+The records a field can return: first or last if set, the number of ids, the default page size of a connection, and
+the maximum page size for a list that reads every record. 1 for a field that returns a single record
+*/
+func (a *operationAnalysis) listSize(field *ast.Field, fieldType graphql.Type) int {
+	size, set := -1, false
+	for _, argument := range field.Arguments {
+		switch argument.Name.Value {
+		case "first", "last":
+			if n, ok := a.intValue(argument.Value); ok {
+				if n > size {
+					size = n
+				}
+				set = true
+			}
+		case "ids":
+			if ids, ok := a.value(argument.Value).([]interface{}); ok {
+				size, set = len(ids), true
+			}
+		}
+	}
+	switch {
+	case set && size > maxPageSize:
+		return maxPageSize // first and last over the maximum page size fail when the field runs
+	case set && size < 0:
+		return 0
+	case set:
+		return size
+	case isConnectionType(namedType(fieldType)):
+		return defaultPageSize
+	case isListType(fieldType):
+		return unboundedListSize
+	}
+	return 1
+}
+
+// The integer value of an argument, from the literal or the variable
+func (a *operationAnalysis) intValue(value ast.Value) (int, bool) {
+	switch v := a.value(value).(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// The value of an argument: a variable resolves to its value in the request, or its default value
+func (a *operationAnalysis) value(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.Variable:
+		if value, ok := a.variables[v.Name.Value]; ok {
+			return value
+		}
+		if defaultValue, ok := a.defaults[v.Name.Value]; ok {
+			return a.value(defaultValue)
+		}
+		return nil
+	case *ast.ListValue:
+		values := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			values[i] = a.value(item)
+		}
+		return values
+	case *ast.IntValue:
+		return v.Value
+	}
+	return nil
+}
+
+// The fields of an object or interface type; none for other types
+func typeFields(t graphql.Type) graphql.FieldDefinitionMap {
+	switch t := t.(type) {
+	case *graphql.Object:
+		return t.Fields()
+	case *graphql.Interface:
+		return t.Fields()
+	}
+	return nil
+}
+
+// The named type of a type, without its list and non null wrappers
+func namedType(t graphql.Type) graphql.Type {
+	named, _ := graphql.GetNamed(t).(graphql.Type)
+	return named
+}
+
+// Check the type is a relay connection type, with edges and pageInfo
+func isConnectionType(t graphql.Type) bool {
+	fields := typeFields(t)
+	return fields["edges"] != nil && fields["pageInfo"] != nil
+}
+
+// Check the type is a relay edge type, with a node and cursor
+func isEdgeType(t graphql.Type) bool {
+	fields := typeFields(t)
+	return fields["node"] != nil && fields["cursor"] != nil
+}
+
+// Check the type is a list, or a non null list
+func isListType(t graphql.Type) bool {
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType
+	}
+	_, ok := t.(*graphql.List)
+	return ok
+}
+
+/*
+Check the limits of the operation of a /graphql request before it runs.
+Writes the error response and returns false if the operation is over a limit; the request body is left to be read again
+*/
+func checkQueryLimits(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	opts := handler.NewRequestOptions(r)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	err := boldlygo.QueryLimits().Check(ctx, opts.Query, opts.OperationName, opts.Variables)
+	if err == nil {
+		return true
+	}
+	status := http.StatusOK // like the other errors of an operation that does not run
+	if budgetErr, ok := err.(*costBudgetError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(budgetErr.retryAfter))
+		status = http.StatusTooManyRequests
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&graphql.Result{Errors: []gqlerrors.FormattedError{formatCodedError(err)}})
+	return false
+}
+
+// Format an error raised outside of running the operation with its extensions; it has no location in the request
+func formatCodedError(err error) gqlerrors.FormattedError {
+	formatted := gqlerrors.FormatError(err)
+	if extended, ok := err.(gqlerrors.ExtendedError); ok {
+		formatted.Extensions = extended.Extensions()
+	}
+	return formatted
+}
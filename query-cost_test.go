@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Query Limits over the schema, with a budget that does not noticeably refill while a test runs
+func newTestQueryLimits(maxDepth, maxCost, budget int) *queryLimits {
+	return &queryLimits{
+		schema:   boldlygo.GraphQLSchema(),
+		maxDepth: maxDepth,
+		maxCost:  maxCost,
+		budget:   float64(budget),
+		window:   time.Hour,
+		buckets:  map[string]*costBucket{},
+		prunedAt: time.Now(),
+	}
+}
+
+// The context of an anonymous request from the IP address
+func clientContext(ip string) context.Context {
+	return context.WithValue(context.Background(), "ClientIP", ip)
+}
+
+// The code of a coded error; empty if there is no error
+func codeOf(err error) string {
+	if err == nil {
+		return ""
+	}
+	if coded, ok := err.(interface{ Extensions() map[string]interface{} }); ok {
+		code, _ := coded.Extensions()["code"].(string)
+		return code
+	}
+	return err.Error()
+}
+
+const costlyAccountsQuery = `query($first: Int) {
+	bankAccountsConn(bankId: "b", first: $first) {
+		totalCount
+		edges { node { transactions { amount } } }
+	}
+}`
+
+// An operation costs the records it can read: each list under the edges of a connection is read once per edge
+func TestQueryCost(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		depth     int
+		cost      int
+	}{
+		{"a single record", `{ bankAccount(bankId: "b", accountId: "a") { accountName } }`, nil, 2, 1},
+		{"a page of 10", costlyAccountsQuery, map[string]interface{}{"first": 10}, 5, 1 + 1 + 10},
+		{"a page of 50", costlyAccountsQuery, map[string]interface{}{"first": 50}, 5, 1 + 1 + 50},
+		{"a page over the maximum size", costlyAccountsQuery, map[string]interface{}{"first": 1000}, 5, 1 + 1 + maxPageSize},
+		{"a default page", `{ bankAccountsConn(bankId: "b") { edges { node { activeCard { cardId } } } } }`, nil, 5, 1 + defaultPageSize},
+		{"nodes by id", `{ nodes(ids: ["1", "2", "3"]) { ... on BankAccount { transactions { amount } } } }`, nil, 3, 1 + 3},
+		{"introspection", `{ __schema { types { name fields { name } } } }`, nil, 0, 0},
+	}
+	for _, test := range tests {
+		if err := newTestQueryLimits(test.depth, test.cost, 10000).Check(clientContext(test.name), test.query, "", test.variables); err != nil {
+			t.Errorf("%s is over a depth of %d or a cost of %d: %v", test.name, test.depth, test.cost, err)
+		}
+		if test.depth == 0 {
+			continue
+		}
+		if code := codeOf(newTestQueryLimits(test.depth-1, 10000, 10000).Check(clientContext(test.name), test.query, "", test.variables)); code != errCodeQueryTooComplex {
+			t.Errorf("%s is not over a depth of %d; failed with %q", test.name, test.depth-1, code)
+		}
+		if code := codeOf(newTestQueryLimits(test.depth, test.cost-1, 10000).Check(clientContext(test.name), test.query, "", test.variables)); code != errCodeQueryTooComplex {
+			t.Errorf("%s is not over a cost of %d; failed with %q", test.name, test.cost-1, code)
+		}
+	}
+}
+
+// A fragment that spreads itself is rejected before validation, which would not end
+func TestQueryFragmentCycle(t *testing.T) {
+	query := `query { ...A } fragment A on RootQuery { ...B } fragment B on RootQuery { me { email } ...A }`
+	if code := codeOf(newTestQueryLimits(10, 100, 100).Check(clientContext("cycle"), query, "", nil)); code != errCodeInvalidInput {
+		t.Errorf("the fragment cycle failed with %q; want %q", code, errCodeInvalidInput)
+	}
+}
+
+// Each caller spends their own budget; once it is spent their operations are rejected
+func TestQueryCostBudget(t *testing.T) {
+	limits := newTestQueryLimits(10, 100, 30)
+	variables := map[string]interface{}{"first": 10} // costs 12
+	for i := 0; i < 2; i++ {
+		if err := limits.Check(clientContext("192.0.2.1"), costlyAccountsQuery, "", variables); err != nil {
+			t.Fatalf("operation %d was rejected within the budget: %v", i+1, err)
+		}
+	}
+	err := limits.Check(clientContext("192.0.2.1"), costlyAccountsQuery, "", variables)
+	if budgetErr, ok := err.(*costBudgetError); !ok || budgetErr.retryAfter <= 0 {
+		t.Errorf("the operation over the budget failed with %v; want a cost budget error with a retry after", err)
+	}
+	if err := limits.Check(clientContext("192.0.2.2"), costlyAccountsQuery, "", variables); err != nil {
+		t.Errorf("another caller was rejected: %v", err)
+	}
+}
@@ -0,0 +1,1602 @@
+/*
+DynamoDB Storage Repositories.
+
+	Persists the Boldly Go entities to the DynamoDB tables:
+		- Users: email primary key; a User that changed their email leaves a record at the old email pointing to the new one
+		- BankAccounts: bankId primary key, accountId sort key
+		- Cards: accountId primary key, cardId sort key
+		- Transactions: accountId primary key, transactionId sort key, with a date index to read the Transactions in date order
+		- RevokedTokens: jti primary key; expired items are deleted by the table time to live
+		- LoginAttempts: subject primary key; expired items are deleted by the table time to live
+		- AuditEvents: subject primary key, eventId sort key
+		- OneTimeTokens: tokenHash primary key; expired items are deleted by the table time to live
+		- ApiKeys: keyId primary key, with an email index to list the keys of a user
+		- OAuthClients: clientId primary key
+		- OAuthGrants: grantId primary key, with an email index to list the connected apps of a user
+
+	Table names are resolved through the AwsConfig so the environment table prefix is applied.
+*/
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/satori/go.uuid"
+)
+
+type dynamoDbRepositories struct {
+	awsSvc       AwsConfig
+	users        *dynamoDbUserRepository
+	bankAccounts *dynamoDbBankAccountRepository
+	cards        *dynamoDbCardRepository
+	transactions *dynamoDbTransactionRepository
+	revoked      *dynamoDbRevokedTokenRepository
+	attempts     *dynamoDbLoginAttemptRepository
+	audit        *dynamoDbAuditEventRepository
+	oneTime      *dynamoDbOneTimeTokenRepository
+	apiKeys      *dynamoDbApiKeyRepository
+	oauthClients *dynamoDbOAuthClientRepository
+	oauthGrants  *dynamoDbOAuthGrantRepository
+}
+
+// Initialize the AWS Service and build each of the DynamoDB repositories from the DynamoDB service instance
+func (r *dynamoDbRepositories) Initialize() {
+	r.awsSvc.Init() // build and initialize AWS Services
+	svc := r.awsSvc.DynamoDbSvc()
+	r.users = &dynamoDbUserRepository{svc: svc, table: r.awsSvc.TableName(usersTable)}
+	r.bankAccounts = &dynamoDbBankAccountRepository{svc: svc, table: r.awsSvc.TableName(bankAccountsTable)}
+	r.cards = &dynamoDbCardRepository{svc: svc, table: r.awsSvc.TableName(cardsTable)}
+	r.transactions = &dynamoDbTransactionRepository{
+		svc:      svc,
+		table:    r.awsSvc.TableName(transactionsTable),
+		accounts: r.bankAccounts,
+	}
+	r.revoked = &dynamoDbRevokedTokenRepository{svc: svc, table: r.awsSvc.TableName(revokedTokensTable)}
+	r.attempts = &dynamoDbLoginAttemptRepository{svc: svc, table: r.awsSvc.TableName(loginAttemptsTable)}
+	r.audit = &dynamoDbAuditEventRepository{svc: svc, table: r.awsSvc.TableName(auditEventsTable)}
+	r.oneTime = &dynamoDbOneTimeTokenRepository{svc: svc, table: r.awsSvc.TableName(oneTimeTokensTable)}
+	r.apiKeys = &dynamoDbApiKeyRepository{svc: svc, table: r.awsSvc.TableName(apiKeysTable)}
+	r.oauthClients = &dynamoDbOAuthClientRepository{svc: svc, table: r.awsSvc.TableName(oauthClientsTable)}
+	r.oauthGrants = &dynamoDbOAuthGrantRepository{svc: svc, table: r.awsSvc.TableName(oauthGrantsTable)}
+}
+
+func (r *dynamoDbRepositories) Users() UserRepository {
+	return r.users
+}
+
+func (r *dynamoDbRepositories) BankAccounts() BankAccountRepository {
+	return r.bankAccounts
+}
+
+func (r *dynamoDbRepositories) Cards() CardRepository {
+	return r.cards
+}
+
+func (r *dynamoDbRepositories) Transactions() TransactionRepository {
+	return r.transactions
+}
+
+func (r *dynamoDbRepositories) RevokedTokens() RevokedTokenRepository {
+	return r.revoked
+}
+
+func (r *dynamoDbRepositories) LoginAttempts() LoginAttemptRepository {
+	return r.attempts
+}
+
+func (r *dynamoDbRepositories) AuditEvents() AuditEventRepository {
+	return r.audit
+}
+
+func (r *dynamoDbRepositories) OneTimeTokens() OneTimeTokenRepository {
+	return r.oneTime
+}
+
+func (r *dynamoDbRepositories) ApiKeys() ApiKeyRepository {
+	return r.apiKeys
+}
+
+func (r *dynamoDbRepositories) OAuthClients() OAuthClientRepository {
+	return r.oauthClients
+}
+
+func (r *dynamoDbRepositories) OAuthGrants() OAuthGrantRepository {
+	return r.oauthGrants
+}
+
+/*
+Send the Query request, following the LastEvaluatedKey of each response until every matching item is read
+or the limit is reached. A limit of 0 reads every matching item.
+
+The read starts after the ExclusiveStartKey set on the input, if any.
+*/
+func queryItems(svc *dynamodb.DynamoDB, input *dynamodb.QueryInput, limit int64) ([]map[string]dynamodb.AttributeValue, error) {
+	var items []map[string]dynamodb.AttributeValue
+	for {
+		if limit > 0 {
+			input.Limit = aws.Int64(limit - int64(len(items))) // only read the remaining number of items
+		}
+		req := svc.QueryRequest(input) // build dynamodb query with key condition
+		output, err := req.Send()      // submit the dynamodb query request
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, output.Items...)
+		if len(output.LastEvaluatedKey) == 0 || (limit > 0 && int64(len(items)) >= limit) {
+			return items, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey // continue reading from the end of the previous page
+	}
+}
+
+// Convert the page cursor of a record in the partition into the ExclusiveStartKey of a Query request
+func cursorStartKey(cursor, partitionName, partitionValue, sortName string) (map[string]dynamodb.AttributeValue, error) {
+	key, err := decodePartitionCursor(cursor, partitionName, partitionValue, sortName)
+	if err != nil {
+		return nil, err
+	}
+	startKey := make(map[string]dynamodb.AttributeValue, len(key))
+	for name, value := range key {
+		startKey[name] = dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	return startKey, nil
+}
+
+/*
+Query a page of the items of the table partition, in the sort key order of the page, starting after the page StartKey.
+One extra item is read past the page limit to determine if more items exist
+*/
+func queryPage(svc *dynamodb.DynamoDB, table, partitionName, partitionValue, sortName string, page PageRequest) ([]map[string]dynamodb.AttributeValue, error) {
+	keyCond := expression.Key(partitionName).Equal(expression.Value(partitionValue)) // build find the items of the partition key expression
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+		ScanIndexForward:          aws.Bool(!page.readsDescending()),
+	}
+	if page.StartKey != "" {
+		params.ExclusiveStartKey, err = cursorStartKey(page.StartKey, partitionName, partitionValue, sortName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var limit int64
+	if page.Limit > 0 {
+		limit = int64(page.Limit) + 1
+	}
+	return queryItems(svc, params, limit)
+}
+
+// Count the items of the table partition
+func countPartition(svc *dynamodb.DynamoDB, table, partitionName, partitionValue string) (int, error) {
+	keyCond := expression.Key(partitionName).Equal(expression.Value(partitionValue)) // build find the items of the partition key expression
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	return countItems(svc, params)
+}
+
+// Count the items the Query request matches. Only the count is read, following every page of the Query
+func countItems(svc *dynamodb.DynamoDB, params *dynamodb.QueryInput) (int, error) {
+	params.Select = dynamodb.SelectCount
+	var count int64
+	for {
+		output, err := svc.QueryRequest(params).Send()
+		if err != nil {
+			return 0, err
+		}
+		count += aws.Int64Value(output.Count)
+		if len(output.LastEvaluatedKey) == 0 {
+			return int(count), nil
+		}
+		params.ExclusiveStartKey = output.LastEvaluatedKey // continue counting from the end of the previous page
+	}
+}
+
+/*
+Build the optimistic concurrency condition for updating a versioned record: the record exists with the key attribute
+and is still at the version the client read. Records written before versioning have no version; they match version 0
+*/
+func versionCondition(keyName string, expected int64) expression.ConditionBuilder {
+	version := expression.Name("version")
+	matches := version.Equal(expression.Value(expected))
+	if expected == 0 {
+		matches = expression.AttributeNotExists(version).Or(matches)
+	}
+	return expression.AttributeExists(expression.Name(keyName)).And(matches)
+}
+
+// Check if the error is a DynamoDB ConditionalCheckFailedException, i.e. the condition expression of a write failed
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+type dynamoDbUserRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Find a unique User record by the email primary key. Returns nil if no User exists with the email
+func (r *dynamoDbUserRepository) FindByEmail(email string) (*User, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"email": {
+				S: aws.String(email),
+			},
+		},
+	}) // build the request to send to DynamoDB to find a unique user record by the email primary key
+	output, err := req.Send() // send the request to the DynamoDB service; get the output result
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	// unmarshal returned map from DynamoDB into a User
+	var user = new(User)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &user)
+	if err != nil {
+		return nil, err
+	}
+	if user.MovedTo != "" {
+		return nil, nil // the record left behind when the user changed their email
+	}
+	return user, nil
+}
+
+// Save the new User record to the Users table; fails with ErrUserExists if a User already has, or previously had, the email
+func (r *dynamoDbUserRepository) Create(user *User) error {
+	userMap, err := dynamodbattribute.MarshalMap(user) // marshal User to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	// only write the item if no user exists with the email, so an existing user is never overwritten
+	input := &dynamodb.PutItemInput{
+		Item:                     userMap,
+		TableName:                aws.String(r.table),
+		ConditionExpression:      aws.String("attribute_not_exists(#email)"),
+		ExpressionAttributeNames: map[string]string{"#email": "email"},
+	}
+	_, err = r.svc.PutItemRequest(input).Send()
+	if isConditionalCheckFailed(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+/*
+Save the existing User record to the Users table, if it is still at the version of the given User; the version is incremented.
+Fails with ErrUserNotFound if the User no longer has the email, or ErrConflict if the User was saved since it was read
+*/
+func (r *dynamoDbUserRepository) Save(user *User) error {
+	saved := *user
+	saved.Version++
+	userMap, err := dynamodbattribute.MarshalMap(&saved) // marshal User to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	// never recreate a user that has changed their email since it was read, or overwrite a save made since
+	expr, err := expression.NewBuilder().
+		WithCondition(liveUserCondition().And(versionCondition("email", user.Version))).
+		Build()
+	if err != nil {
+		return err
+	}
+	// build item input request
+	input := &dynamodb.PutItemInput{
+		Item:                      userMap,
+		TableName:                 aws.String(r.table),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	req := r.svc.PutItemRequest(input) // save item to db
+	_, err = req.Send()
+	if !isConditionalCheckFailed(err) {
+		if err == nil {
+			user.Version = saved.Version
+		}
+		return err
+	}
+	// the user either changed their email or was saved since it was read
+	current, err := r.FindByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrUserNotFound
+	}
+	return ErrConflict
+}
+
+/*
+Move the User from the old email primary key to its new email in a single all-or-nothing TransactWriteItems request:
+  - Put the User at the new email, on the condition no User has it, or it is the record this User left there
+    when changing away from it before
+  - Replace the User at the old email with a record pointing to the new email, on the condition the User is still
+    there at the version that was read. The record keeps the old email from being registered again, as the bank
+    service still knows the User by it
+
+If a condition fails, neither write is applied and either ErrUserNotFound, ErrConflict or ErrUserExists is returned
+*/
+func (r *dynamoDbUserRepository) ChangeEmail(oldEmail string, user *User) error {
+	moved := *user
+	moved.Version++
+	userMap, err := dynamodbattribute.MarshalMap(&moved) // marshal User to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	movedMap, err := dynamodbattribute.MarshalMap(&User{Email: oldEmail, BankUserId: user.BankUserId, MovedTo: user.Email})
+	if err != nil {
+		return err
+	}
+	putExpr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeNotExists(expression.Name("email")).
+			Or(expression.AttributeExists(expression.Name("movedTo")).
+				And(expression.Name("bankUserId").Equal(expression.Value(user.BankUserId))))).
+		Build()
+	if err != nil {
+		return err
+	}
+	movedExpr, err := expression.NewBuilder().
+		WithCondition(liveUserCondition().And(versionCondition("email", user.Version))).
+		Build()
+	if err != nil {
+		return err
+	}
+	input := &transactWriteItemsInput{
+		TransactItems: []transactWriteItem{
+			{
+				Put: &transactPut{
+					TableName:                 aws.String(r.table),
+					Item:                      userMap,
+					ConditionExpression:       putExpr.Condition(),
+					ExpressionAttributeNames:  putExpr.Names(),
+					ExpressionAttributeValues: putExpr.Values(),
+				},
+			},
+			{
+				Put: &transactPut{
+					TableName:                 aws.String(r.table),
+					Item:                      movedMap,
+					ConditionExpression:       movedExpr.Condition(),
+					ExpressionAttributeNames:  movedExpr.Names(),
+					ExpressionAttributeValues: movedExpr.Values(),
+				},
+			},
+		},
+	}
+	err = transactWriteItems(r.svc, input)
+	if !isTransactionConditionFailed(err) {
+		if err == nil {
+			user.Version = moved.Version
+		}
+		return err
+	}
+	current, err := r.FindByEmail(oldEmail)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrUserNotFound
+	}
+	if current.Version != user.Version {
+		return ErrConflict
+	}
+	return ErrUserExists
+}
+
+// The User item exists and is not the record left behind by changing the email
+func liveUserCondition() expression.ConditionBuilder {
+	return expression.AttributeExists(expression.Name("email")).
+		And(expression.AttributeNotExists(expression.Name("movedTo")))
+}
+
+/*
+Scan the Users table for up to the limit of Users whose email or name contains the query.
+The filter is applied after the items are read, so the scan reads pages until enough Users match or the table ends
+*/
+func (r *dynamoDbUserRepository) Search(query string, limit int) ([]*User, error) {
+	filter := expression.Name("email").Contains(query).
+		Or(expression.Name("name").Contains(query)).
+		And(expression.AttributeNotExists(expression.Name("movedTo")))
+	expr, err := expression.NewBuilder().
+		WithFilter(filter).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(r.table),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	var users []*User
+	for {
+		output, err := r.svc.ScanRequest(input).Send()
+		if err != nil {
+			return nil, err
+		}
+		var page []*User
+		if err := dynamodbattribute.UnmarshalListOfMaps(output.Items, &page); err != nil {
+			return nil, err
+		}
+		users = append(users, page...)
+		if len(users) >= limit {
+			return users[:limit], nil
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return users, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey // continue reading from the end of the previous page
+	}
+}
+
+type dynamoDbBankAccountRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Query the BankAccounts table for all of the BankAccount records with the bankId primary key
+func (r *dynamoDbBankAccountRepository) FindByBankId(bankId uuid.UUID) ([]*BankAccount, error) {
+	keyCond := expression.Key("bankId").Equal(expression.Value(bankId.String())) // build find BankAccount by BankId filter expression
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	items, err := queryItems(r.svc, params, 0) // submit the dynamodb query request, following every page
+	if err != nil {
+		return nil, err
+	}
+	var accounts = make([]*BankAccount, 0)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &accounts) // unmarshal the found items into a list of accounts
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Query a page of the BankAccount records with the bankId primary key, starting after the page StartKey
+func (r *dynamoDbBankAccountRepository) FindPageByBankId(bankId uuid.UUID, page PageRequest) (*BankAccountPage, error) {
+	items, err := queryPage(r.svc, r.table, "bankId", bankId.String(), "accountId", page)
+	if err != nil {
+		return nil, err
+	}
+	var accounts = make([]*BankAccount, 0)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &accounts) // unmarshal the found items into a list of accounts
+	if err != nil {
+		return nil, err
+	}
+	return newBankAccountPage(accounts, page), nil
+}
+
+// Count the BankAccount records with the bankId primary key
+func (r *dynamoDbBankAccountRepository) CountByBankId(bankId uuid.UUID) (int, error) {
+	return countPartition(r.svc, r.table, "bankId", bankId.String())
+}
+
+// Get a unique BankAccount record by the bankId primary key and accountId sort key. Returns nil if it does not exist
+func (r *dynamoDbBankAccountRepository) Find(bankId, accountId uuid.UUID) (*BankAccount, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"bankId": {
+				S: aws.String(bankId.String()),
+			},
+			"accountId": {
+				S: aws.String(accountId.String()),
+			},
+		},
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	// unmarshal returned map into BankAccount
+	var account = new(BankAccount)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Query the accountId index for the BankAccount record with the accountId. Returns nil if it does not exist
+func (r *dynamoDbBankAccountRepository) FindByAccountId(accountId uuid.UUID) (*BankAccount, error) {
+	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String())) // build find BankAccount by AccountId key condition
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		IndexName:                 aws.String(bankAccountsAccountIdIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	items, err := queryItems(r.svc, params, 1) // account ids are unique, so at most one record matches
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	var account = new(BankAccount)
+	err = dynamodbattribute.UnmarshalMap(items[0], &account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Save the BankAccount record to the BankAccounts table
+func (r *dynamoDbBankAccountRepository) Save(account *BankAccount) error {
+	acctMap, err := dynamodbattribute.MarshalMap(account) // marshal BankAccount to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	// build item input request
+	input := &dynamodb.PutItemInput{
+		Item:      acctMap,
+		TableName: aws.String(r.table),
+	}
+	// save item to db
+	req := r.svc.PutItemRequest(input)
+	_, err = req.Send()
+	return err
+}
+
+/*
+Update the editable fields of the BankAccount record; the currentBalance is only changed by posting Transactions.
+The update is only applied if the record is still at the version of the given BankAccount; the version is incremented
+*/
+func (r *dynamoDbBankAccountRepository) Update(account *BankAccount) error {
+	// Build Update expression to set which fields should be updated
+	update := expression.
+		Set(expression.Name("accountName"), expression.Value(account.AccountName)).
+		Set(expression.Name("accountType"), expression.Value(account.AccountType)).
+		Set(expression.Name("last4"), expression.Value(account.Last4)).
+		Add(expression.Name("version"), expression.Value(1))
+	err := r.update(account, update, versionCondition("accountId", account.Version))
+	if !isConditionalCheckFailed(err) {
+		if err == nil {
+			account.Version++
+		}
+		return err
+	}
+	// the record either does not exist or was changed since it was read
+	bankId, err := uuid.FromString(account.BankId)
+	if err != nil {
+		return err
+	}
+	accountId, err := uuid.FromString(account.AccountId)
+	if err != nil {
+		return err
+	}
+	stored, err := r.Find(bankId, accountId)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return ErrBankAccountNotFound
+	}
+	return ErrConflict
+}
+
+// Build and send the UpdateItem request for the BankAccount record with the given update and condition expressions
+func (r *dynamoDbBankAccountRepository) update(account *BankAccount, update expression.UpdateBuilder, cond expression.ConditionBuilder) error {
+	// build update expression with update fields set
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return err
+	}
+	// build update BankAccount item input
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"bankId": {
+				S: aws.String(account.BankId),
+			},
+			"accountId": {
+				S: aws.String(account.AccountId),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueNone,
+		UpdateExpression:          expr.Update(),
+	}
+	req := r.svc.UpdateItemRequest(input) // build update item request
+	_, err = req.Send()                   // send update item request; expect nothing back
+	return err
+}
+
+type dynamoDbCardRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Query the Cards table for all of the Card records with the accountId primary key
+func (r *dynamoDbCardRepository) FindByAccountId(accountId uuid.UUID) ([]*Card, error) {
+	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String())) // build find Card records by AccountId filter expression
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	items, err := queryItems(r.svc, params, 0) // submit the dynamodb query request, following every page
+	if err != nil {
+		return nil, err
+	}
+	var cards = make([]*Card, 0)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &cards) // unmarshal the found items into a list of cards
+	if err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+// Query a page of the Card records with the accountId primary key, starting after the page StartKey
+func (r *dynamoDbCardRepository) FindPageByAccountId(accountId uuid.UUID, page PageRequest) (*CardPage, error) {
+	items, err := queryPage(r.svc, r.table, "accountId", accountId.String(), "cardId", page)
+	if err != nil {
+		return nil, err
+	}
+	var cards = make([]*Card, 0)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &cards) // unmarshal the found items into a list of cards
+	if err != nil {
+		return nil, err
+	}
+	return newCardPage(cards, page), nil
+}
+
+// Count the Card records with the accountId primary key
+func (r *dynamoDbCardRepository) CountByAccountId(accountId uuid.UUID) (int, error) {
+	return countPartition(r.svc, r.table, "accountId", accountId.String())
+}
+
+// Find a unique Card record by the accountId, cardId composite key. Returns nil if it does not exist
+func (r *dynamoDbCardRepository) Find(accountId, cardId uuid.UUID) (*Card, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"accountId": {
+				S: aws.String(accountId.String()),
+			},
+			"cardId": {
+				S: aws.String(cardId.String()),
+			},
+		},
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	// unmarshal returned map into Card
+	var card = new(Card)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &card)
+	if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+/*
+Find the Card record associated to the BankAccount that is marked as Active. Returns nil if there is none.
+
+Queries the accountId partition of the Cards table, filtering on the active field,
+so only the Cards of the BankAccount are read instead of scanning the whole table
+*/
+func (r *dynamoDbCardRepository) FindActive(accountId uuid.UUID) (*Card, error) {
+	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String())) // build find Card records by AccountId key condition
+	filter := expression.Name("active").Equal(expression.Value(true))                  // build filter for active true
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		WithFilter(filter).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	// the query Limit applies before the filter, so read every page of the partition
+	items, err := queryItems(r.svc, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	var card = new(Card)
+	err = dynamodbattribute.UnmarshalMap(items[0], &card) // unmarshal the first active card
+	if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// Save the Card record to the Cards table
+func (r *dynamoDbCardRepository) Save(card *Card) error {
+	cardMap, err := dynamodbattribute.MarshalMap(card) // marshal Card to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	// build item input request
+	input := &dynamodb.PutItemInput{
+		Item:      cardMap,
+		TableName: aws.String(r.table),
+	}
+	// save item to db
+	req := r.svc.PutItemRequest(input)
+	_, err = req.Send()
+	return err
+}
+
+/*
+Set the active field on the Card record to false.
+The update is only applied if the record is still at the version of the given Card; the version is incremented
+*/
+func (r *dynamoDbCardRepository) Inactivate(card *Card) error {
+	// Set the active field on the card to false
+	update := expression.Set(expression.Name("active"), expression.Value(false)).
+		Add(expression.Name("version"), expression.Value(1))
+	// build update expression with update fields set
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(versionCondition("cardId", card.Version)).
+		Build()
+	if err != nil {
+		return err
+	}
+	// build update Card item input
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"accountId": {
+				S: aws.String(card.AccountId),
+			},
+			"cardId": {
+				S: aws.String(card.CardId),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueNone,
+		UpdateExpression:          expr.Update(),
+	}
+	req := r.svc.UpdateItemRequest(input) // build update item request
+	_, err = req.Send()                   // send update item request; expect nothing back
+	if !isConditionalCheckFailed(err) {
+		if err == nil {
+			card.Active = false
+			card.Version++
+		}
+		return err
+	}
+	// the record either does not exist or was changed since it was read
+	accountId, err := uuid.FromString(card.AccountId)
+	if err != nil {
+		return err
+	}
+	cardId, err := uuid.FromString(card.CardId)
+	if err != nil {
+		return err
+	}
+	stored, err := r.Find(accountId, cardId)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return ErrCardNotFound
+	}
+	return ErrConflict
+}
+
+type dynamoDbTransactionRepository struct {
+	svc      *dynamodb.DynamoDB
+	table    string
+	accounts *dynamoDbBankAccountRepository
+}
+
+// Query a page of the Transaction records of the account matching the filter, in date order, starting after the page StartKey
+func (r *dynamoDbTransactionRepository) FindPageByAccountId(accountId uuid.UUID, filter TransactionFilter, page PageRequest) (*TransactionPage, error) {
+	params, err := r.filterQuery(accountId, filter)
+	if err != nil {
+		return nil, err
+	}
+	params.ScanIndexForward = aws.Bool(!page.readsDescending())
+	if page.StartKey != "" {
+		params.ExclusiveStartKey, err = r.dateStartKey(page.StartKey, accountId, filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var limit int64
+	if page.Limit > 0 {
+		limit = int64(page.Limit) + 1 // read one extra item to determine if more items exist
+	}
+	items, err := queryItems(r.svc, params, limit)
+	if err != nil {
+		return nil, err
+	}
+	var transactions = make([]*Transaction, 0)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &transactions) // unmarshal the found items into a list of transactions
+	if err != nil {
+		return nil, err
+	}
+	return newTransactionPage(transactions, page), nil
+}
+
+// Count the Transaction records of the account matching the filter
+func (r *dynamoDbTransactionRepository) CountByAccountId(accountId uuid.UUID, filter TransactionFilter) (int, error) {
+	params, err := r.filterQuery(accountId, filter)
+	if err != nil {
+		return 0, err
+	}
+	return countItems(r.svc, params)
+}
+
+/*
+Build the Query of the Transactions of the account matching the filter, on the date index.
+
+	The date range is a key condition on the dateKey sort key of the index, so only the Transactions in the range are read.
+	No dateKey equals a date bound, so "between" reads the dates at or after DateFrom and before DateTo.
+	The other fields of the filter are a filter expression on the Transactions read.
+*/
+func (r *dynamoDbTransactionRepository) filterQuery(accountId uuid.UUID, filter TransactionFilter) (*dynamodb.QueryInput, error) {
+	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String()))
+	dateKey := expression.Key("dateKey")
+	switch from, to := dateKeyBound(filter.DateFrom), dateKeyBound(filter.DateTo); {
+	case !filter.DateFrom.IsZero() && !filter.DateTo.IsZero():
+		keyCond = keyCond.And(dateKey.Between(expression.Value(from), expression.Value(to)))
+	case !filter.DateFrom.IsZero():
+		keyCond = keyCond.And(dateKey.GreaterThanEqual(expression.Value(from)))
+	case !filter.DateTo.IsZero():
+		keyCond = keyCond.And(dateKey.LessThan(expression.Value(to)))
+	}
+	var conds []expression.ConditionBuilder
+	if filter.AmountMin != nil {
+		conds = append(conds, expression.Name("amount.currency").Equal(expression.Value(filter.AmountMin.Currency)),
+			expression.Name("amount.amount").GreaterThanEqual(expression.Value(filter.AmountMin.Amount)))
+	}
+	if filter.AmountMax != nil {
+		conds = append(conds, expression.Name("amount.currency").Equal(expression.Value(filter.AmountMax.Currency)),
+			expression.Name("amount.amount").LessThanEqual(expression.Value(filter.AmountMax.Amount)))
+	}
+	if filter.TransactionType != "" {
+		conds = append(conds, expression.Name("transactionType").Equal(expression.Value(filter.TransactionType)))
+	}
+	if filter.CardId != "" {
+		conds = append(conds, expression.Name("cardId").Equal(expression.Value(filter.CardId)))
+	}
+	if filter.DescriptionContains != "" {
+		conds = append(conds, expression.Name("description").Contains(filter.DescriptionContains))
+	}
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	switch len(conds) {
+	case 0:
+	case 1:
+		builder = builder.WithFilter(conds[0])
+	default:
+		builder = builder.WithFilter(expression.And(conds[0], conds[1], conds[2:]...))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		IndexName:                 aws.String(transactionsDateIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	if len(conds) > 0 {
+		params.FilterExpression = expr.Filter() // an empty filter expression is rejected
+	}
+	return params, nil
+}
+
+// Convert the page cursor of a Transaction of the account into the ExclusiveStartKey of a date index Query: the index and table keys
+func (r *dynamoDbTransactionRepository) dateStartKey(cursor string, accountId uuid.UUID, filter TransactionFilter) (map[string]dynamodb.AttributeValue, error) {
+	dateKey, err := decodeTransactionCursor(cursor, accountId, filter)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]dynamodb.AttributeValue{
+		"accountId":     {S: aws.String(accountId.String())},
+		"dateKey":       {S: aws.String(dateKey)},
+		"transactionId": {S: aws.String(dateKeyTransactionId(dateKey))},
+	}, nil
+}
+
+// Find a unique Transaction record by the accountId and transactionId composite key. Returns nil if it does not exist
+func (r *dynamoDbTransactionRepository) Find(accountId, transactionId uuid.UUID) (*Transaction, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"accountId": {
+				S: aws.String(accountId.String()),
+			},
+			"transactionId": {
+				S: aws.String(transactionId.String()),
+			},
+		},
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	// unmarshal returned map into Transaction
+	var txn = new(Transaction)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &txn)
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+/*
+Post the Transaction to the BankAccount in a single all-or-nothing TransactWriteItems request:
+  - Put the Transaction record, on the condition it does not already exist
+  - Add the balance change to the BankAccount currentBalance amount, on the condition the BankAccount exists
+    and its balance is in the same currency
+
+If the condition on the BankAccount fails, neither write is applied and either ErrBankAccountNotFound
+or ErrCurrencyMismatch is returned
+*/
+func (r *dynamoDbTransactionRepository) Post(bankId uuid.UUID, txn *Transaction, balanceChange Money) error {
+	txnMap, err := dynamodbattribute.MarshalMap(txn) // marshal Transaction to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	txnMap["dateKey"] = dynamodb.AttributeValue{S: aws.String(transactionDateKey(txn))} // the sort key of the date index
+	// only create the Transaction, never overwrite an existing one
+	putExpr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeNotExists(expression.Name("transactionId"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	// atomically add the balance change to the current balance amount of an existing BankAccount in the same currency
+	amount := expression.Name("currentBalance.amount")
+	updateExpr, err := expression.NewBuilder().
+		WithUpdate(expression.Set(amount, amount.Plus(expression.Value(balanceChange.Amount))).
+			Add(expression.Name("version"), expression.Value(1))).
+		WithCondition(expression.AttributeExists(expression.Name("accountId")).
+			And(expression.Name("currentBalance.currency").Equal(expression.Value(balanceChange.Currency)))).
+		Build()
+	if err != nil {
+		return err
+	}
+	input := &transactWriteItemsInput{
+		TransactItems: []transactWriteItem{
+			{
+				Put: &transactPut{
+					TableName:                aws.String(r.table),
+					Item:                     txnMap,
+					ConditionExpression:      putExpr.Condition(),
+					ExpressionAttributeNames: putExpr.Names(),
+				},
+			},
+			{
+				Update: &transactUpdate{
+					TableName: aws.String(r.accounts.table),
+					Key: map[string]dynamodb.AttributeValue{
+						"bankId": {
+							S: aws.String(bankId.String()),
+						},
+						"accountId": {
+							S: aws.String(txn.AccountId),
+						},
+					},
+					UpdateExpression:          updateExpr.Update(),
+					ConditionExpression:       updateExpr.Condition(),
+					ExpressionAttributeNames:  updateExpr.Names(),
+					ExpressionAttributeValues: updateExpr.Values(),
+				},
+			},
+		},
+	}
+	err = transactWriteItems(r.svc, input)
+	if !isTransactionConditionFailed(err) {
+		return err
+	}
+	// the transaction id is newly generated, so the failed condition is on the BankAccount
+	acctId, err := uuid.FromString(txn.AccountId)
+	if err != nil {
+		return err
+	}
+	account, err := r.accounts.Find(bankId, acctId)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return ErrBankAccountNotFound
+	}
+	return ErrCurrencyMismatch
+}
+
+type dynamoDbRevokedTokenRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+/*
+Check if the token with the jti is revoked.
+The table time to live deletes expired items lazily, but an expired token is rejected before the denylist is checked
+*/
+func (r *dynamoDbRevokedTokenRepository) IsRevoked(jti string) (bool, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"jti": {
+				S: aws.String(jti),
+			},
+		},
+		ConsistentRead: aws.Bool(true), // a token must be rejected as soon as the logout returns
+	})
+	output, err := req.Send()
+	if err != nil {
+		return false, err
+	}
+	return len(output.Item) > 0, nil
+}
+
+// Save the RevokedToken record to the RevokedTokens table
+func (r *dynamoDbRevokedTokenRepository) Save(token *RevokedToken) error {
+	tokenMap, err := dynamodbattribute.MarshalMap(token) // marshal RevokedToken to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      tokenMap,
+		TableName: aws.String(r.table),
+	})
+	_, err = req.Send()
+	return err
+}
+
+type dynamoDbLoginAttemptRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// The key of the LoginAttempts item of the subject
+func (r *dynamoDbLoginAttemptRepository) key(subject string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"subject": {
+			S: aws.String(subject),
+		},
+	}
+}
+
+// Get the LoginAttempts of the subject. Returns nil if there are none
+func (r *dynamoDbLoginAttemptRepository) Find(subject string) (*LoginAttempts, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(r.table),
+		Key:            r.key(subject),
+		ConsistentRead: aws.Bool(true), // a lockout must apply to the very next attempt
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var attempts = new(LoginAttempts)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &attempts)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// Atomically count a failure against the subject, creating the item if it does not exist; returns the updated counts
+func (r *dynamoDbLoginAttemptRepository) AddFailure(subject string, expiresAt int64) (*LoginAttempts, error) {
+	update := expression.Add(expression.Name("failures"), expression.Value(1)).
+		Set(expression.Name("expiresAt"), expression.Value(expiresAt))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table),
+		Key:                       r.key(subject),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+		UpdateExpression:          expr.Update(),
+	}
+	output, err := r.svc.UpdateItemRequest(input).Send()
+	if err != nil {
+		return nil, err
+	}
+	var attempts = new(LoginAttempts)
+	err = dynamodbattribute.UnmarshalMap(output.Attributes, &attempts)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// Lock out the subject if its failures are still at the count read; only one of concurrent requests locks it out
+func (r *dynamoDbLoginAttemptRepository) Lock(subject string, failures int, lockedUntil, expiresAt int64) (bool, error) {
+	update := expression.Set(expression.Name("failures"), expression.Value(0)).
+		Set(expression.Name("lockedUntil"), expression.Value(lockedUntil)).
+		Set(expression.Name("expiresAt"), expression.Value(expiresAt)).
+		Add(expression.Name("lockouts"), expression.Value(1))
+	cond := expression.Name("failures").Equal(expression.Value(failures))
+	return r.update(subject, update, cond)
+}
+
+// Clear the lockout if it is still the one read; only one of concurrent requests unlocks it
+func (r *dynamoDbLoginAttemptRepository) Unlock(subject string, lockedUntil int64) (bool, error) {
+	update := expression.Set(expression.Name("lockedUntil"), expression.Value(0))
+	cond := expression.Name("lockedUntil").Equal(expression.Value(lockedUntil))
+	return r.update(subject, update, cond)
+}
+
+// Apply the conditional update to the item of the subject; returns false if the condition failed
+func (r *dynamoDbLoginAttemptRepository) update(subject string, update expression.UpdateBuilder, cond expression.ConditionBuilder) (bool, error) {
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table),
+		Key:                       r.key(subject),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueNone,
+		UpdateExpression:          expr.Update(),
+	}
+	_, err = r.svc.UpdateItemRequest(input).Send()
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *dynamoDbLoginAttemptRepository) Delete(subject string) error {
+	req := r.svc.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName: aws.String(r.table),
+		Key:       r.key(subject),
+	})
+	_, err := req.Send()
+	return err
+}
+
+type dynamoDbAuditEventRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Save the AuditEvent record to the AuditEvents table
+func (r *dynamoDbAuditEventRepository) Save(event *AuditEvent) error {
+	eventMap, err := dynamodbattribute.MarshalMap(event) // marshal AuditEvent to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      eventMap,
+		TableName: aws.String(r.table),
+	})
+	_, err = req.Send()
+	return err
+}
+
+type dynamoDbOneTimeTokenRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Save the OneTimeToken record to the OneTimeTokens table
+func (r *dynamoDbOneTimeTokenRepository) Save(token *OneTimeToken) error {
+	tokenMap, err := dynamodbattribute.MarshalMap(token) // marshal OneTimeToken to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      tokenMap,
+		TableName: aws.String(r.table),
+	})
+	_, err = req.Send()
+	return err
+}
+
+/*
+Delete and return the token with the hash if it has the purpose. Returns nil if there is no such token.
+The delete is conditional and returns the deleted item, so only one of concurrent requests consumes the token
+*/
+func (r *dynamoDbOneTimeTokenRepository) Consume(tokenHash, purpose string) (*OneTimeToken, error) {
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("purpose").Equal(expression.Value(purpose))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	req := r.svc.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"tokenHash": {
+				S: aws.String(tokenHash),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllOld,
+	})
+	output, err := req.Send()
+	if isConditionalCheckFailed(err) {
+		return nil, nil // no token with the hash, or it is for another purpose
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token = new(OneTimeToken)
+	err = dynamodbattribute.UnmarshalMap(output.Attributes, &token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+type dynamoDbApiKeyRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+func (r *dynamoDbApiKeyRepository) key(keyId string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"keyId": {
+			S: aws.String(keyId),
+		},
+	}
+}
+
+// Find the ApiKey record by the keyId primary key. Returns nil if it does not exist
+func (r *dynamoDbApiKeyRepository) Find(keyId string) (*ApiKey, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key:       r.key(keyId),
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var apiKey = new(ApiKey)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// Query the email index for the ApiKey records of the user
+func (r *dynamoDbApiKeyRepository) FindByEmail(email string) ([]*ApiKey, error) {
+	keyCond := expression.Key("email").Equal(expression.Value(email))
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		IndexName:                 aws.String(apiKeysEmailIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	items, err := queryItems(r.svc, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*ApiKey
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Save the new ApiKey record to the ApiKeys table
+func (r *dynamoDbApiKeyRepository) Create(key *ApiKey) error {
+	keyMap, err := dynamodbattribute.MarshalMap(key) // marshal ApiKey to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:                     keyMap,
+		TableName:                aws.String(r.table),
+		ConditionExpression:      aws.String("attribute_not_exists(#keyId)"),
+		ExpressionAttributeNames: map[string]string{"#keyId": "keyId"},
+	})
+	_, err = req.Send()
+	return err
+}
+
+// Record when the key was last used; does nothing if the key does not exist
+func (r *dynamoDbApiKeyRepository) Touch(keyId string, usedAt int64) error {
+	_, err := r.update(keyId, expression.Set(expression.Name("lastUsedAt"), expression.Value(usedAt)),
+		expression.AttributeExists(expression.Name("keyId")))
+	return err
+}
+
+// Revoke the key if it exists and is not already revoked; returns false otherwise
+func (r *dynamoDbApiKeyRepository) Revoke(keyId string, revokedAt int64) (bool, error) {
+	return r.update(keyId, expression.Set(expression.Name("revokedAt"), expression.Value(revokedAt)),
+		expression.AttributeExists(expression.Name("keyId")).And(expression.AttributeNotExists(expression.Name("revokedAt"))))
+}
+
+// Move the key to the new email of its user; does nothing if the key does not exist
+func (r *dynamoDbApiKeyRepository) ChangeEmail(keyId, email string) error {
+	_, err := r.update(keyId, expression.Set(expression.Name("email"), expression.Value(email)),
+		expression.AttributeExists(expression.Name("keyId")))
+	return err
+}
+
+// Apply the conditional update to the item of the key; returns false if the condition failed
+func (r *dynamoDbApiKeyRepository) update(keyId string, update expression.UpdateBuilder, cond expression.ConditionBuilder) (bool, error) {
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table),
+		Key:                       r.key(keyId),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueNone,
+		UpdateExpression:          expr.Update(),
+	}
+	_, err = r.svc.UpdateItemRequest(input).Send()
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type dynamoDbOAuthClientRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// Find the OAuthClient record by the clientId primary key. Returns nil if it does not exist
+func (r *dynamoDbOAuthClientRepository) Find(clientId string) (*OAuthClient, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]dynamodb.AttributeValue{
+			"clientId": {
+				S: aws.String(clientId),
+			},
+		},
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var client = new(OAuthClient)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Save the new OAuthClient record to the OAuthClients table
+func (r *dynamoDbOAuthClientRepository) Create(client *OAuthClient) error {
+	clientMap, err := dynamodbattribute.MarshalMap(client) // marshal OAuthClient to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:                     clientMap,
+		TableName:                aws.String(r.table),
+		ConditionExpression:      aws.String("attribute_not_exists(#clientId)"),
+		ExpressionAttributeNames: map[string]string{"#clientId": "clientId"},
+	})
+	_, err = req.Send()
+	return err
+}
+
+type dynamoDbOAuthGrantRepository struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+func (r *dynamoDbOAuthGrantRepository) key(grantId string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"grantId": {
+			S: aws.String(grantId),
+		},
+	}
+}
+
+// Find the OAuthGrant record by the grantId primary key. Returns nil if it does not exist
+func (r *dynamoDbOAuthGrantRepository) Find(grantId string) (*OAuthGrant, error) {
+	req := r.svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key:       r.key(grantId),
+	})
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var grant = new(OAuthGrant)
+	err = dynamodbattribute.UnmarshalMap(output.Item, &grant)
+	if err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// Query the email index for the OAuthGrant records of the user
+func (r *dynamoDbOAuthGrantRepository) FindByEmail(email string) ([]*OAuthGrant, error) {
+	keyCond := expression.Key("email").Equal(expression.Value(email))
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		IndexName:                 aws.String(oauthGrantsEmailIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames:  expr.Names(),
+	}
+	items, err := queryItems(r.svc, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	var grants []*OAuthGrant
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &grants)
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Save the new OAuthGrant record to the OAuthGrants table
+func (r *dynamoDbOAuthGrantRepository) Create(grant *OAuthGrant) error {
+	grantMap, err := dynamodbattribute.MarshalMap(grant) // marshal OAuthGrant to dynamodbattribute map
+	if err != nil {
+		return err
+	}
+	req := r.svc.PutItemRequest(&dynamodb.PutItemInput{
+		Item:                     grantMap,
+		TableName:                aws.String(r.table),
+		ConditionExpression:      aws.String("attribute_not_exists(#grantId)"),
+		ExpressionAttributeNames: map[string]string{"#grantId": "grantId"},
+	})
+	_, err = req.Send()
+	return err
+}
+
+// Record when the grant was last used; does nothing if the grant does not exist
+func (r *dynamoDbOAuthGrantRepository) Touch(grantId string, usedAt int64) error {
+	_, err := r.update(grantId, expression.Set(expression.Name("lastUsedAt"), expression.Value(usedAt)),
+		expression.AttributeExists(expression.Name("grantId")))
+	return err
+}
+
+// Revoke the grant if it exists and is not already revoked; returns false otherwise
+func (r *dynamoDbOAuthGrantRepository) Revoke(grantId string, revokedAt int64) (bool, error) {
+	return r.update(grantId, expression.Set(expression.Name("revokedAt"), expression.Value(revokedAt)),
+		expression.AttributeExists(expression.Name("grantId")).And(expression.AttributeNotExists(expression.Name("revokedAt"))))
+}
+
+// Move the grant to the new email of its user; does nothing if the grant does not exist
+func (r *dynamoDbOAuthGrantRepository) ChangeEmail(grantId, email string) error {
+	_, err := r.update(grantId, expression.Set(expression.Name("email"), expression.Value(email)),
+		expression.AttributeExists(expression.Name("grantId")))
+	return err
+}
+
+// Apply the conditional update to the item of the grant; returns false if the condition failed
+func (r *dynamoDbOAuthGrantRepository) update(grantId string, update expression.UpdateBuilder, cond expression.ConditionBuilder) (bool, error) {
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table),
+		Key:                       r.key(grantId),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueNone,
+		UpdateExpression:          expr.Update(),
+	}
+	_, err = r.svc.UpdateItemRequest(input).Send()
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,811 @@
+/*
+In-Memory Storage Repositories.
+
+	Keeps the Boldly Go entities in process memory, keyed the same way as the DynamoDB tables.
+	Records are copied in and out of the store so callers cannot mutate stored records.
+	Nothing is persisted; all records are lost when the process exits.
+*/
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+type memoryRepositories struct {
+	users        *memoryUserRepository
+	bankAccounts *memoryBankAccountRepository
+	cards        *memoryCardRepository
+	transactions *memoryTransactionRepository
+	revoked      *memoryRevokedTokenRepository
+	attempts     *memoryLoginAttemptRepository
+	audit        *memoryAuditEventRepository
+	oneTime      *memoryOneTimeTokenRepository
+	apiKeys      *memoryApiKeyRepository
+	oauthClients *memoryOAuthClientRepository
+	oauthGrants  *memoryOAuthGrantRepository
+}
+
+// Initialize empty in-memory repositories
+func (r *memoryRepositories) Initialize() {
+	r.users = &memoryUserRepository{items: map[string]User{}}
+	r.bankAccounts = &memoryBankAccountRepository{items: map[string]map[string]BankAccount{}}
+	r.cards = &memoryCardRepository{items: map[string]map[string]Card{}}
+	r.transactions = &memoryTransactionRepository{accounts: r.bankAccounts, items: map[string]map[string]Transaction{}}
+	r.revoked = &memoryRevokedTokenRepository{items: map[string]RevokedToken{}}
+	r.attempts = &memoryLoginAttemptRepository{items: map[string]LoginAttempts{}}
+	r.audit = &memoryAuditEventRepository{}
+	r.oneTime = &memoryOneTimeTokenRepository{items: map[string]OneTimeToken{}}
+	r.apiKeys = &memoryApiKeyRepository{items: map[string]ApiKey{}}
+	r.oauthClients = &memoryOAuthClientRepository{items: map[string]OAuthClient{}}
+	r.oauthGrants = &memoryOAuthGrantRepository{items: map[string]OAuthGrant{}}
+}
+
+func (r *memoryRepositories) Users() UserRepository {
+	return r.users
+}
+
+func (r *memoryRepositories) BankAccounts() BankAccountRepository {
+	return r.bankAccounts
+}
+
+func (r *memoryRepositories) Cards() CardRepository {
+	return r.cards
+}
+
+func (r *memoryRepositories) Transactions() TransactionRepository {
+	return r.transactions
+}
+
+func (r *memoryRepositories) RevokedTokens() RevokedTokenRepository {
+	return r.revoked
+}
+
+func (r *memoryRepositories) LoginAttempts() LoginAttemptRepository {
+	return r.attempts
+}
+
+func (r *memoryRepositories) AuditEvents() AuditEventRepository {
+	return r.audit
+}
+
+func (r *memoryRepositories) OneTimeTokens() OneTimeTokenRepository {
+	return r.oneTime
+}
+
+func (r *memoryRepositories) ApiKeys() ApiKeyRepository {
+	return r.apiKeys
+}
+
+func (r *memoryRepositories) OAuthClients() OAuthClientRepository {
+	return r.oauthClients
+}
+
+func (r *memoryRepositories) OAuthGrants() OAuthGrantRepository {
+	return r.oauthGrants
+}
+
+// Return the sort keys of the partition in ascending order, matching the DynamoDB Query result order
+func sortedKeys(partition interface{}) []string {
+	var keys []string
+	switch p := partition.(type) {
+	case map[string]BankAccount:
+		for k := range p {
+			keys = append(keys, k)
+		}
+	case map[string]Card:
+		for k := range p {
+			keys = append(keys, k)
+		}
+	case map[string]Transaction:
+		for k := range p {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Select the sorted keys of the partition to read for the page, like a DynamoDB Query: in the read direction, starting
+after the page StartKey, with one extra key past the page limit to determine if more records exist
+*/
+func pageKeys(keys []string, partitionName, partitionValue, sortName string, page PageRequest) ([]string, error) {
+	if page.readsDescending() {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	if page.StartKey != "" {
+		startKey, err := decodePartitionCursor(page.StartKey, partitionName, partitionValue, sortName)
+		if err != nil {
+			return nil, err
+		}
+		// skip to the first key past the start key in the read direction
+		start := sort.Search(len(keys), func(i int) bool {
+			if page.readsDescending() {
+				return keys[i] < startKey[sortName]
+			}
+			return keys[i] > startKey[sortName]
+		})
+		keys = keys[start:]
+	}
+	if page.Limit > 0 && len(keys) > page.Limit+1 {
+		keys = keys[:page.Limit+1] // read one extra record to determine if more records exist
+	}
+	return keys, nil
+}
+
+type memoryUserRepository struct {
+	mu    sync.RWMutex
+	items map[string]User // keyed by email
+}
+
+func (r *memoryUserRepository) FindByEmail(email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.items[email]
+	if !ok || user.MovedTo != "" {
+		return nil, nil
+	}
+	user = copyUser(user)
+	return &user, nil
+}
+
+// Save the new User; fails with ErrUserExists if a User already has, or previously had, the email
+func (r *memoryUserRepository) Create(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.items[user.Email]; ok {
+		return ErrUserExists
+	}
+	r.items[user.Email] = copyUser(*user)
+	return nil
+}
+
+/*
+Save the existing User if it is still at the same version, and increment the version.
+Fails with ErrUserNotFound if the User no longer has the email, or ErrConflict if the User was saved since it was read
+*/
+func (r *memoryUserRepository) Save(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.items[user.Email]
+	if !ok || stored.MovedTo != "" {
+		return ErrUserNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrConflict
+	}
+	user.Version++
+	r.items[user.Email] = copyUser(*user)
+	return nil
+}
+
+/*
+Move the User from the old email to its new email, leaving a record at the old email that points to the new one.
+Fails with ErrUserNotFound if the User no longer has the old email, ErrConflict if the User was saved since it was read,
+or ErrUserExists if another User has, or previously had, the new email
+*/
+func (r *memoryUserRepository) ChangeEmail(oldEmail string, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.items[oldEmail]
+	if !ok || stored.MovedTo != "" {
+		return ErrUserNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrConflict
+	}
+	if existing, ok := r.items[user.Email]; ok && (existing.MovedTo == "" || existing.BankUserId != user.BankUserId) {
+		return ErrUserExists
+	}
+	user.Version++
+	r.items[user.Email] = copyUser(*user)
+	r.items[oldEmail] = User{Email: oldEmail, BankUserId: user.BankUserId, MovedTo: user.Email}
+	return nil
+}
+
+// Find up to the limit of Users whose email or name contains the query
+func (r *memoryUserRepository) Search(query string, limit int) ([]*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var users []*User
+	for _, email := range sortedUserEmails(r.items) {
+		user := r.items[email]
+		if user.MovedTo == "" && (strings.Contains(user.Email, query) || strings.Contains(user.Name, query)) {
+			found := copyUser(user)
+			users = append(users, &found)
+			if len(users) == limit {
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+func sortedUserEmails(items map[string]User) []string {
+	var emails []string
+	for email := range items {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// Copy the User with its own Roles, RecoveryCodes and Identities, so changing one does not change the other
+func copyUser(user User) User {
+	user.Roles = append([]string(nil), user.Roles...)
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	user.Identities = append([]ExternalIdentity(nil), user.Identities...)
+	return user
+}
+
+type memoryBankAccountRepository struct {
+	mu    sync.RWMutex
+	items map[string]map[string]BankAccount // keyed by bankId, then accountId
+}
+
+func (r *memoryBankAccountRepository) FindByBankId(bankId uuid.UUID) ([]*BankAccount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	partition := r.items[bankId.String()]
+	var accounts = make([]*BankAccount, 0)
+	for _, k := range sortedKeys(partition) {
+		account := partition[k]
+		accounts = append(accounts, &account)
+	}
+	return accounts, nil
+}
+
+func (r *memoryBankAccountRepository) FindPageByBankId(bankId uuid.UUID, page PageRequest) (*BankAccountPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	partition := r.items[bankId.String()]
+	keys, err := pageKeys(sortedKeys(partition), "bankId", bankId.String(), "accountId", page)
+	if err != nil {
+		return nil, err
+	}
+	var accounts = make([]*BankAccount, 0)
+	for _, k := range keys {
+		account := partition[k]
+		accounts = append(accounts, &account)
+	}
+	return newBankAccountPage(accounts, page), nil
+}
+
+func (r *memoryBankAccountRepository) CountByBankId(bankId uuid.UUID) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.items[bankId.String()]), nil
+}
+
+func (r *memoryBankAccountRepository) Find(bankId, accountId uuid.UUID) (*BankAccount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	account, ok := r.items[bankId.String()][accountId.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &account, nil
+}
+
+func (r *memoryBankAccountRepository) FindByAccountId(accountId uuid.UUID) (*BankAccount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, partition := range r.items {
+		if account, ok := partition[accountId.String()]; ok {
+			return &account, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryBankAccountRepository) Save(account *BankAccount) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.items[account.BankId]; !ok {
+		r.items[account.BankId] = map[string]BankAccount{}
+	}
+	r.items[account.BankId][account.AccountId] = *account
+	return nil
+}
+
+// Update the editable fields of the BankAccount, not its balance, if the record is still at the same version
+func (r *memoryBankAccountRepository) Update(account *BankAccount) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.items[account.BankId][account.AccountId]
+	if !ok {
+		return ErrBankAccountNotFound
+	}
+	if stored.Version != account.Version {
+		return ErrConflict
+	}
+	stored.AccountName = account.AccountName
+	stored.AccountType = account.AccountType
+	stored.Last4 = account.Last4
+	stored.Version++
+	r.items[account.BankId][account.AccountId] = stored
+	account.Version = stored.Version
+	return nil
+}
+
+type memoryCardRepository struct {
+	mu    sync.RWMutex
+	items map[string]map[string]Card // keyed by accountId, then cardId
+}
+
+func (r *memoryCardRepository) FindByAccountId(accountId uuid.UUID) ([]*Card, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	partition := r.items[accountId.String()]
+	var cards = make([]*Card, 0)
+	for _, k := range sortedKeys(partition) {
+		card := partition[k]
+		cards = append(cards, &card)
+	}
+	return cards, nil
+}
+
+func (r *memoryCardRepository) FindPageByAccountId(accountId uuid.UUID, page PageRequest) (*CardPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	partition := r.items[accountId.String()]
+	keys, err := pageKeys(sortedKeys(partition), "accountId", accountId.String(), "cardId", page)
+	if err != nil {
+		return nil, err
+	}
+	var cards = make([]*Card, 0)
+	for _, k := range keys {
+		card := partition[k]
+		cards = append(cards, &card)
+	}
+	return newCardPage(cards, page), nil
+}
+
+func (r *memoryCardRepository) CountByAccountId(accountId uuid.UUID) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.items[accountId.String()]), nil
+}
+
+func (r *memoryCardRepository) Find(accountId, cardId uuid.UUID) (*Card, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	card, ok := r.items[accountId.String()][cardId.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &card, nil
+}
+
+func (r *memoryCardRepository) FindActive(accountId uuid.UUID) (*Card, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	partition := r.items[accountId.String()]
+	for _, k := range sortedKeys(partition) {
+		if card := partition[k]; card.Active {
+			return &card, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryCardRepository) Save(card *Card) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.items[card.AccountId]; !ok {
+		r.items[card.AccountId] = map[string]Card{}
+	}
+	r.items[card.AccountId][card.CardId] = *card
+	return nil
+}
+
+// Set the Card active field to false, if the record is still at the same version
+func (r *memoryCardRepository) Inactivate(card *Card) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.items[card.AccountId][card.CardId]
+	if !ok {
+		return ErrCardNotFound
+	}
+	if stored.Version != card.Version {
+		return ErrConflict
+	}
+	stored.Active = false
+	stored.Version++
+	r.items[card.AccountId][card.CardId] = stored
+	card.Active, card.Version = false, stored.Version
+	return nil
+}
+
+type memoryTransactionRepository struct {
+	mu       sync.RWMutex
+	accounts *memoryBankAccountRepository
+	items    map[string]map[string]Transaction // keyed by accountId, then transactionId
+}
+
+// Read a page of the Transactions matching the filter, in the date order of the page, as the DynamoDB date index would
+func (r *memoryTransactionRepository) FindPageByAccountId(accountId uuid.UUID, filter TransactionFilter, page PageRequest) (*TransactionPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if page.StartKey != "" {
+		if _, err := decodeTransactionCursor(page.StartKey, accountId, filter); err != nil {
+			return nil, err
+		}
+	}
+	byDate := r.filter(accountId, filter)
+	keys, err := pageKeys(sortedKeys(byDate), "accountId", accountId.String(), "dateKey", page)
+	if err != nil {
+		return nil, err
+	}
+	var transactions = make([]*Transaction, 0)
+	for _, k := range keys {
+		txn := byDate[k]
+		transactions = append(transactions, &txn)
+	}
+	return newTransactionPage(transactions, page), nil
+}
+
+func (r *memoryTransactionRepository) CountByAccountId(accountId uuid.UUID, filter TransactionFilter) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.filter(accountId, filter)), nil
+}
+
+// The Transactions of the account matching the filter, keyed by date key
+func (r *memoryTransactionRepository) filter(accountId uuid.UUID, filter TransactionFilter) map[string]Transaction {
+	byDate := map[string]Transaction{}
+	for _, txn := range r.items[accountId.String()] {
+		if filter.matches(&txn) {
+			byDate[transactionDateKey(&txn)] = txn
+		}
+	}
+	return byDate
+}
+
+func (r *memoryTransactionRepository) Find(accountId, transactionId uuid.UUID) (*Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	txn, ok := r.items[accountId.String()][transactionId.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &txn, nil
+}
+
+// Save the Transaction and apply the balance change to the BankAccount while holding both locks
+func (r *memoryTransactionRepository) Post(bankId uuid.UUID, txn *Transaction, balanceChange Money) error {
+	r.accounts.mu.Lock()
+	defer r.accounts.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, ok := r.accounts.items[bankId.String()][txn.AccountId]
+	if !ok {
+		return ErrBankAccountNotFound
+	}
+	balance, err := account.CurrentBalance.Add(balanceChange)
+	if err != nil {
+		return err
+	}
+	account.CurrentBalance = balance
+	account.Version++
+	r.accounts.items[bankId.String()][txn.AccountId] = account
+	if _, ok := r.items[txn.AccountId]; !ok {
+		r.items[txn.AccountId] = map[string]Transaction{}
+	}
+	r.items[txn.AccountId][txn.TransactionId] = *txn
+	return nil
+}
+
+type memoryRevokedTokenRepository struct {
+	mu    sync.RWMutex
+	items map[string]RevokedToken // keyed by jti
+}
+
+func (r *memoryRevokedTokenRepository) IsRevoked(jti string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.items[jti]
+	return ok, nil
+}
+
+// Save the RevokedToken, dropping the tokens that have expired as the DynamoDB time to live would
+func (r *memoryRevokedTokenRepository) Save(token *RevokedToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().Unix()
+	for jti, t := range r.items {
+		if t.ExpiresAt < now {
+			delete(r.items, jti)
+		}
+	}
+	r.items[token.Jti] = *token
+	return nil
+}
+
+type memoryLoginAttemptRepository struct {
+	mu    sync.Mutex
+	items map[string]LoginAttempts // keyed by subject
+}
+
+func (r *memoryLoginAttemptRepository) Find(subject string) (*LoginAttempts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, ok := r.items[subject]
+	if !ok {
+		return nil, nil
+	}
+	return &attempts, nil
+}
+
+// Count a failure against the subject, creating the record if it does not exist
+func (r *memoryLoginAttemptRepository) AddFailure(subject string, expiresAt int64) (*LoginAttempts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts := r.items[subject]
+	attempts.Subject = subject
+	attempts.Failures++
+	attempts.ExpiresAt = expiresAt
+	r.items[subject] = attempts
+	return &attempts, nil
+}
+
+// Lock out the subject if its failures are still at the count read; only one of concurrent requests locks it out
+func (r *memoryLoginAttemptRepository) Lock(subject string, failures int, lockedUntil, expiresAt int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, ok := r.items[subject]
+	if !ok || attempts.Failures != failures {
+		return false, nil
+	}
+	attempts.Failures = 0
+	attempts.Lockouts++
+	attempts.LockedUntil = lockedUntil
+	attempts.ExpiresAt = expiresAt
+	r.items[subject] = attempts
+	return true, nil
+}
+
+// Clear the lockout if it is still the one read; only one of concurrent requests unlocks it
+func (r *memoryLoginAttemptRepository) Unlock(subject string, lockedUntil int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, ok := r.items[subject]
+	if !ok || attempts.LockedUntil != lockedUntil {
+		return false, nil
+	}
+	attempts.LockedUntil = 0
+	r.items[subject] = attempts
+	return true, nil
+}
+
+func (r *memoryLoginAttemptRepository) Delete(subject string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.items, subject)
+	return nil
+}
+
+type memoryAuditEventRepository struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *memoryAuditEventRepository) Save(event *AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, *event)
+	return nil
+}
+
+type memoryOneTimeTokenRepository struct {
+	mu    sync.Mutex
+	items map[string]OneTimeToken // keyed by tokenHash
+}
+
+// Save the OneTimeToken, dropping the tokens that have expired as the DynamoDB time to live would
+func (r *memoryOneTimeTokenRepository) Save(token *OneTimeToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().Unix()
+	for hash, t := range r.items {
+		if t.ExpiresAt < now {
+			delete(r.items, hash)
+		}
+	}
+	r.items[token.TokenHash] = *token
+	return nil
+}
+
+// Remove and return the token with the hash if it has the purpose. Returns nil if there is no such token
+func (r *memoryOneTimeTokenRepository) Consume(tokenHash, purpose string) (*OneTimeToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.items[tokenHash]
+	if !ok || token.Purpose != purpose {
+		return nil, nil
+	}
+	delete(r.items, tokenHash)
+	return &token, nil
+}
+
+type memoryApiKeyRepository struct {
+	mu    sync.Mutex
+	items map[string]ApiKey // keyed by keyId
+}
+
+func (r *memoryApiKeyRepository) Find(keyId string) (*ApiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.items[keyId]
+	if !ok {
+		return nil, nil
+	}
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return &key, nil
+}
+
+// Find the ApiKeys of the user, in no particular order, as the DynamoDB index returns them
+func (r *memoryApiKeyRepository) FindByEmail(email string) ([]*ApiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []*ApiKey
+	for _, key := range r.items {
+		if key.Email == email {
+			found := key
+			found.Scopes = append([]string(nil), key.Scopes...)
+			keys = append(keys, &found)
+		}
+	}
+	return keys, nil
+}
+
+func (r *memoryApiKeyRepository) Create(key *ApiKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *key
+	stored.Scopes = append([]string(nil), key.Scopes...)
+	r.items[key.KeyId] = stored
+	return nil
+}
+
+// Record when the key was last used; does nothing if the key does not exist
+func (r *memoryApiKeyRepository) Touch(keyId string, usedAt int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.items[keyId]; ok {
+		key.LastUsedAt = usedAt
+		r.items[keyId] = key
+	}
+	return nil
+}
+
+// Revoke the key if it exists and is not already revoked; returns false otherwise
+func (r *memoryApiKeyRepository) Revoke(keyId string, revokedAt int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.items[keyId]
+	if !ok || key.RevokedAt != 0 {
+		return false, nil
+	}
+	key.RevokedAt = revokedAt
+	r.items[keyId] = key
+	return true, nil
+}
+
+// Move the key to the new email of its user; does nothing if the key does not exist
+func (r *memoryApiKeyRepository) ChangeEmail(keyId, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.items[keyId]; ok {
+		key.Email = email
+		r.items[keyId] = key
+	}
+	return nil
+}
+
+type memoryOAuthClientRepository struct {
+	mu    sync.Mutex
+	items map[string]OAuthClient // keyed by clientId
+}
+
+func (r *memoryOAuthClientRepository) Find(clientId string) (*OAuthClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.items[clientId]
+	if !ok {
+		return nil, nil
+	}
+	client.RedirectUris = append([]string(nil), client.RedirectUris...)
+	client.Scopes = append([]string(nil), client.Scopes...)
+	return &client, nil
+}
+
+func (r *memoryOAuthClientRepository) Create(client *OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *client
+	stored.RedirectUris = append([]string(nil), client.RedirectUris...)
+	stored.Scopes = append([]string(nil), client.Scopes...)
+	r.items[client.ClientId] = stored
+	return nil
+}
+
+type memoryOAuthGrantRepository struct {
+	mu    sync.Mutex
+	items map[string]OAuthGrant // keyed by grantId
+}
+
+func (r *memoryOAuthGrantRepository) Find(grantId string) (*OAuthGrant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant, ok := r.items[grantId]
+	if !ok {
+		return nil, nil
+	}
+	grant.Scopes = append([]string(nil), grant.Scopes...)
+	return &grant, nil
+}
+
+// Find the OAuthGrants of the user, in no particular order, as the DynamoDB index returns them
+func (r *memoryOAuthGrantRepository) FindByEmail(email string) ([]*OAuthGrant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var grants []*OAuthGrant
+	for _, grant := range r.items {
+		if grant.Email == email {
+			found := grant
+			found.Scopes = append([]string(nil), grant.Scopes...)
+			grants = append(grants, &found)
+		}
+	}
+	return grants, nil
+}
+
+func (r *memoryOAuthGrantRepository) Create(grant *OAuthGrant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *grant
+	stored.Scopes = append([]string(nil), grant.Scopes...)
+	r.items[grant.GrantId] = stored
+	return nil
+}
+
+// Record when the grant was last used; does nothing if the grant does not exist
+func (r *memoryOAuthGrantRepository) Touch(grantId string, usedAt int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if grant, ok := r.items[grantId]; ok {
+		grant.LastUsedAt = usedAt
+		r.items[grantId] = grant
+	}
+	return nil
+}
+
+// Revoke the grant if it exists and is not already revoked; returns false otherwise
+func (r *memoryOAuthGrantRepository) Revoke(grantId string, revokedAt int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant, ok := r.items[grantId]
+	if !ok || grant.RevokedAt != 0 {
+		return false, nil
+	}
+	grant.RevokedAt = revokedAt
+	r.items[grantId] = grant
+	return true, nil
+}
+
+// Move the grant to the new email of its user; does nothing if the grant does not exist
+func (r *memoryOAuthGrantRepository) ChangeEmail(grantId, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if grant, ok := r.items[grantId]; ok {
+		grant.Email = email
+		r.items[grantId] = grant
+	}
+	return nil
+}
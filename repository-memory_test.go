@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+func newTestMemoryRepositories() *memoryRepositories {
+	repos := &memoryRepositories{}
+	repos.Initialize()
+	return repos
+}
+
+// Changing the slices of a User that was saved or found does not change the stored User
+func TestMemoryUserRepositoryCopiesUsers(t *testing.T) {
+	users := newTestMemoryRepositories().Users()
+	user := &User{
+		Email:         "copies@example.com",
+		Roles:         []string{roleSupport},
+		RecoveryCodes: []string{"hash"},
+		Identities:    []ExternalIdentity{{Provider: "google", Subject: "1"}},
+		Version:       1,
+	}
+	if err := users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	user.Roles[0], user.RecoveryCodes[0], user.Identities[0].Subject = roleAdmin, "changed", "2"
+	found, err := users.FindByEmail(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found.Roles[0], found.RecoveryCodes[0], found.Identities[0].Subject = roleAdmin, "changed", "2"
+	stored, err := users.FindByEmail(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Roles[0] != roleSupport || stored.RecoveryCodes[0] != "hash" || stored.Identities[0].Subject != "1" {
+		t.Errorf("the stored User was changed through a copy: %+v", stored)
+	}
+	searched, err := users.Search("copies", 10)
+	if err != nil || len(searched) != 1 {
+		t.Fatalf("the search found %v, %v; want the User", searched, err)
+	}
+	searched[0].Roles[0] = roleAdmin
+	if stored, _ := users.FindByEmail(user.Email); stored.Roles[0] != roleSupport {
+		t.Errorf("the stored User was changed through a search result: %+v", stored)
+	}
+}
+
+// A User is saved only at the version it was read at, and each save increments the version
+func TestMemoryUserRepositorySaveVersion(t *testing.T) {
+	users := newTestMemoryRepositories().Users()
+	if err := users.Create(&User{Email: "version@example.com", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := users.FindByEmail("version@example.com")
+	stale, _ := users.FindByEmail("version@example.com")
+	if err := users.Save(first); err != nil || first.Version != 2 {
+		t.Fatalf("saving at the current version = %v at version %d; want nil at version 2", err, first.Version)
+	}
+	if err := users.Save(stale); err != ErrConflict {
+		t.Errorf("saving at a stale version = %v; want %v", err, ErrConflict)
+	}
+	if err := users.Save(&User{Email: "missing@example.com"}); err != ErrUserNotFound {
+		t.Errorf("saving a User that does not exist = %v; want %v", err, ErrUserNotFound)
+	}
+}
+
+// Listing a Bank or BankAccount without records returns an empty slice, as the DynamoDB repositories do
+func TestMemoryListsOfNoRecordsAreEmpty(t *testing.T) {
+	repos := newTestMemoryRepositories()
+	accounts, err := repos.BankAccounts().FindByBankId(uuid.NewV4())
+	if err != nil || accounts == nil || len(accounts) != 0 {
+		t.Errorf("the BankAccounts of an empty Bank are %#v, %v; want an empty slice", accounts, err)
+	}
+	cards, err := repos.Cards().FindByAccountId(uuid.NewV4())
+	if err != nil || cards == nil || len(cards) != 0 {
+		t.Errorf("the Cards of an empty BankAccount are %#v, %v; want an empty slice", cards, err)
+	}
+}
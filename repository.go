@@ -0,0 +1,335 @@
+/*
+Storage Repositories for the Boldly Go Application.
+
+	Declares a repository interface per entity so the service functions are not tied to a specific data store.
+	Implementations:
+		- dynamodb: persists records to the AWS DynamoDB tables (default)
+		- memory: keeps records in process memory; for unit tests and running the API offline
+*/
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	storageBackendKey      = "STORAGE_BACKEND"
+	storageBackendDynamoDb = "dynamodb"
+	storageBackendMemory   = "memory"
+)
+
+const transactionDateLayout = "2006-01-02T15:04:05.000000000Z" // fixed width, so the date keys sort in date order
+
+// Page of records to read from a repository list query
+type PageRequest struct {
+	Limit      int    // maximum number of records in the page; 0 reads every record
+	StartKey   string // cursor of the record the page starts after; empty starts at the first (or last) record
+	Reverse    bool   // read backwards from the StartKey, against the sort order
+	Descending bool   // sort the records in descending key order
+}
+
+// Read the records in descending key order: a descending sort read forward, or an ascending sort read backwards
+func (p PageRequest) readsDescending() bool {
+	return p.Reverse != p.Descending
+}
+
+/*
+Filter of the Transactions read from a list query; the zero value of each field does not filter.
+The date range is read as a key condition on the date order; the other fields filter the records read
+*/
+type TransactionFilter struct {
+	DateFrom            time.Time // transactions dated at or after
+	DateTo              time.Time // transactions dated before, so consecutive ranges do not overlap
+	AmountMin           *Money    // transactions of at least the amount, in the same currency
+	AmountMax           *Money    // transactions of at most the amount, in the same currency
+	TransactionType     string
+	CardId              string
+	DescriptionContains string // case sensitive
+}
+
+// Check the Transaction matches the filter
+func (f TransactionFilter) matches(txn *Transaction) bool {
+	dateKey := transactionDateKey(txn)
+	switch {
+	case !f.DateFrom.IsZero() && dateKey < dateKeyBound(f.DateFrom):
+		return false
+	case !f.DateTo.IsZero() && dateKey >= dateKeyBound(f.DateTo):
+		return false
+	case f.AmountMin != nil && (txn.Amount.Currency != f.AmountMin.Currency || txn.Amount.Amount < f.AmountMin.Amount):
+		return false
+	case f.AmountMax != nil && (txn.Amount.Currency != f.AmountMax.Currency || txn.Amount.Amount > f.AmountMax.Amount):
+		return false
+	case f.TransactionType != "" && txn.TransactionType != f.TransactionType:
+		return false
+	case f.CardId != "" && (txn.CardId == nil || *txn.CardId != f.CardId):
+		return false
+	}
+	return strings.Contains(txn.Description, f.DescriptionContains)
+}
+
+// Page of BankAccount records, in ascending key order
+type BankAccountPage struct {
+	Accounts []*BankAccount
+	HasMore  bool // more records exist past the page in the read direction
+}
+
+// Page of Card records, in ascending key order
+type CardPage struct {
+	Cards   []*Card
+	HasMore bool // more records exist past the page in the read direction
+}
+
+// Page of Transaction records, in the date order of the page
+type TransactionPage struct {
+	Transactions []*Transaction
+	HasMore      bool // more records exist past the page in the read direction
+}
+
+type UserRepository interface {
+	FindByEmail(email string) (*User, error)
+	Create(user *User) error
+	Save(user *User) error
+	ChangeEmail(oldEmail string, user *User) error
+	Search(query string, limit int) ([]*User, error)
+}
+
+type BankAccountRepository interface {
+	FindByBankId(bankId uuid.UUID) ([]*BankAccount, error)
+	FindPageByBankId(bankId uuid.UUID, page PageRequest) (*BankAccountPage, error)
+	CountByBankId(bankId uuid.UUID) (int, error)
+	Find(bankId, accountId uuid.UUID) (*BankAccount, error)
+	FindByAccountId(accountId uuid.UUID) (*BankAccount, error)
+	Save(account *BankAccount) error
+	Update(account *BankAccount) error
+}
+
+type CardRepository interface {
+	FindByAccountId(accountId uuid.UUID) ([]*Card, error)
+	FindPageByAccountId(accountId uuid.UUID, page PageRequest) (*CardPage, error)
+	CountByAccountId(accountId uuid.UUID) (int, error)
+	Find(accountId, cardId uuid.UUID) (*Card, error)
+	FindActive(accountId uuid.UUID) (*Card, error)
+	Save(card *Card) error
+	Inactivate(card *Card) error
+}
+
+type TransactionRepository interface {
+	FindPageByAccountId(accountId uuid.UUID, filter TransactionFilter, page PageRequest) (*TransactionPage, error)
+	CountByAccountId(accountId uuid.UUID, filter TransactionFilter) (int, error)
+	Find(accountId, transactionId uuid.UUID) (*Transaction, error)
+	Post(bankId uuid.UUID, txn *Transaction, balanceChange Money) error
+}
+
+type RevokedTokenRepository interface {
+	IsRevoked(jti string) (bool, error)
+	Save(token *RevokedToken) error
+}
+
+type LoginAttemptRepository interface {
+	Find(subject string) (*LoginAttempts, error)
+	AddFailure(subject string, expiresAt int64) (*LoginAttempts, error)
+	Lock(subject string, failures int, lockedUntil, expiresAt int64) (bool, error)
+	Unlock(subject string, lockedUntil int64) (bool, error)
+	Delete(subject string) error
+}
+
+type OneTimeTokenRepository interface {
+	Save(token *OneTimeToken) error
+	Consume(tokenHash, purpose string) (*OneTimeToken, error)
+}
+
+type ApiKeyRepository interface {
+	Find(keyId string) (*ApiKey, error)
+	FindByEmail(email string) ([]*ApiKey, error)
+	Create(key *ApiKey) error
+	Touch(keyId string, usedAt int64) error
+	Revoke(keyId string, revokedAt int64) (bool, error)
+	ChangeEmail(keyId, email string) error
+}
+
+type OAuthClientRepository interface {
+	Find(clientId string) (*OAuthClient, error)
+	Create(client *OAuthClient) error
+}
+
+type OAuthGrantRepository interface {
+	Find(grantId string) (*OAuthGrant, error)
+	FindByEmail(email string) ([]*OAuthGrant, error)
+	Create(grant *OAuthGrant) error
+	Touch(grantId string, usedAt int64) error
+	Revoke(grantId string, revokedAt int64) (bool, error)
+	ChangeEmail(grantId, email string) error
+}
+
+type AuditEventRepository interface {
+	Save(event *AuditEvent) error
+}
+
+type Repositories interface {
+	Initialize()
+	Users() UserRepository
+	BankAccounts() BankAccountRepository
+	Cards() CardRepository
+	Transactions() TransactionRepository
+	RevokedTokens() RevokedTokenRepository
+	LoginAttempts() LoginAttemptRepository
+	AuditEvents() AuditEventRepository
+	OneTimeTokens() OneTimeTokenRepository
+	ApiKeys() ApiKeyRepository
+	OAuthClients() OAuthClientRepository
+	OAuthGrants() OAuthGrantRepository
+}
+
+/*
+Build the Repositories implementation for the configured storage backend.
+
+	Uses the STORAGE_BACKEND value stored in the environment:
+		- "dynamodb" (or empty): connect to AWS and use the DynamoDB repositories
+		- "memory": use the in-memory repositories; no AWS account required
+*/
+func NewRepositories() Repositories {
+	switch backend := os.Getenv(storageBackendKey); backend {
+	case "", storageBackendDynamoDb:
+		return &dynamoDbRepositories{awsSvc: &awsConf{}}
+	case storageBackendMemory:
+		return &memoryRepositories{}
+	default:
+		panic(fmt.Errorf("unsupported %s value %q", storageBackendKey, backend))
+	}
+}
+
+/*
+Trim the slice of records read for the page to the page limit and put them in the sort order of the page.
+Returns the number of records in the page, and if more records exist past it
+*/
+func trimPage(records interface{}, page PageRequest) (int, bool) {
+	n := reflect.ValueOf(records).Len()
+	hasMore := page.Limit > 0 && n > page.Limit
+	if hasMore {
+		n = page.Limit
+	}
+	if page.Reverse {
+		swap := reflect.Swapper(records)
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	return n, hasMore
+}
+
+func newBankAccountPage(accounts []*BankAccount, page PageRequest) *BankAccountPage {
+	n, hasMore := trimPage(accounts, page)
+	return &BankAccountPage{Accounts: accounts[:n], HasMore: hasMore}
+}
+
+func newCardPage(cards []*Card, page PageRequest) *CardPage {
+	n, hasMore := trimPage(cards, page)
+	return &CardPage{Cards: cards[:n], HasMore: hasMore}
+}
+
+func newTransactionPage(transactions []*Transaction, page PageRequest) *TransactionPage {
+	n, hasMore := trimPage(transactions, page)
+	return &TransactionPage{Transactions: transactions[:n], HasMore: hasMore}
+}
+
+// Encode the primary key of a record into an opaque page cursor
+func encodeCursor(key map[string]string) string {
+	b, _ := json.Marshal(key) // a map of strings always marshals
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// Decode an opaque page cursor back into the primary key of the record it identifies
+func decodeCursor(cursor string) (map[string]string, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var key map[string]string
+	if err = json.Unmarshal(b, &key); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
+
+/*
+Decode the page cursor of a record in the partition being read.
+Fails with ErrInvalidCursor if the cursor identifies a record of another partition or table
+*/
+func decodePartitionCursor(cursor, partitionName, partitionValue, sortName string) (map[string]string, error) {
+	key, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 2 || key[partitionName] != partitionValue || key[sortName] == "" {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
+
+// The page cursor identifying the BankAccount record
+func bankAccountCursor(account *BankAccount) string {
+	return encodeCursor(map[string]string{
+		"bankId":    account.BankId,
+		"accountId": account.AccountId,
+	})
+}
+
+// The page cursor identifying the Card record
+func cardCursor(card *Card) string {
+	return encodeCursor(map[string]string{
+		"accountId": card.AccountId,
+		"cardId":    card.CardId,
+	})
+}
+
+// The page cursor identifying the Transaction record in the date order of the account
+func transactionCursor(txn *Transaction) string {
+	return encodeCursor(map[string]string{
+		"accountId": txn.AccountId,
+		"dateKey":   transactionDateKey(txn),
+	})
+}
+
+/*
+Decode the page cursor of a Transaction of the account into its date key.
+Fails with ErrInvalidCursor if the cursor is outside the date range of the filter, as DynamoDB rejects such a start key
+*/
+func decodeTransactionCursor(cursor string, accountId uuid.UUID, filter TransactionFilter) (string, error) {
+	key, err := decodePartitionCursor(cursor, "accountId", accountId.String(), "dateKey")
+	if err != nil {
+		return "", err
+	}
+	dateKey := key["dateKey"]
+	if dateKeyTransactionId(dateKey) == "" ||
+		(!filter.DateFrom.IsZero() && dateKey < dateKeyBound(filter.DateFrom)) ||
+		(!filter.DateTo.IsZero() && dateKey >= dateKeyBound(filter.DateTo)) {
+		return "", ErrInvalidCursor
+	}
+	return dateKey, nil
+}
+
+// The key ordering the Transaction by date within the account: the UTC date, then the transactionId for equal dates
+func transactionDateKey(txn *Transaction) string {
+	return dateKeyBound(txn.TransactionDate) + "#" + txn.TransactionId
+}
+
+// The date key bound of a date; it sorts before the date keys of the Transactions at the date, and after those before
+func dateKeyBound(date time.Time) string {
+	return date.UTC().Format(transactionDateLayout)
+}
+
+// The transactionId of a Transaction date key; empty if it is not a date key
+func dateKeyTransactionId(dateKey string) string {
+	if i := strings.LastIndex(dateKey, "#"); i >= 0 {
+		return dateKey[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+/*
+Role-based Access Control of the staff GraphQL fields.
+
+	Roles:
+		- customer: every user; reads and writes the records they own
+		- support: can also search users, and view any user and account
+		- admin: can also lock and unlock users, and set their roles
+
+	The roles of a user are carried in the roles claim of their access token, so a change applies from the next token
+	they get. Staff fields wrap their resolver with requireRole, which checks the claim and that the staff user is not
+	locked. Every access to a staff field, allowed or denied, is recorded in the audit trail with its arguments.
+	Staff fields cannot be used with an API key or by a connected app.
+
+	The first admin is set with the set-roles subcommand:
+		boldly-go set-roles admin@example.com admin
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+)
+
+const (
+	roleCustomer = "customer"
+	roleSupport  = "support"
+	roleAdmin    = "admin"
+)
+
+// The roles a user can have
+var validRoles = map[string]bool{roleCustomer: true, roleSupport: true, roleAdmin: true}
+
+// The staff roles allowed to use the staff fields
+var (
+	supportRoles = []string{roleSupport, roleAdmin}
+	adminRoles   = []string{roleAdmin}
+)
+
+// The roles of the user; a user without roles is a customer
+func (u *User) RoleNames() []string {
+	if len(u.Roles) == 0 {
+		return []string{roleCustomer}
+	}
+	return u.Roles
+}
+
+// Wrap the resolver so it only runs for an authenticated caller with one of the allowed roles. Audits every access
+func requireRole(allowed []string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		principal, err := callerPrincipal(p.Context)
+		if err != nil {
+			return nil, err
+		}
+		args, _ := json.Marshal(p.Args) // arguments are decoded from JSON, so they always marshal
+		detail := fmt.Sprintf("%s %s", p.Info.FieldName, args)
+		subject := loginSubjectEmail + strings.ToLower(principal.Email)
+		if principal.Delegated() {
+			audit(subject, auditStaffAccessDenied, detail+" with API key or connected app "+principal.ApiKeyId+principal.ClientId)
+			return nil, ErrSignInRequired
+		}
+		if !hasRole(principal.Roles, allowed) {
+			audit(subject, auditStaffAccessDenied, detail)
+			return nil, ErrRoleRequired
+		}
+		if _, err := findSignedInUser(principal.Email); err != nil {
+			audit(subject, auditStaffAccessDenied, detail)
+			return nil, err
+		}
+		audit(subject, auditStaffAccess, detail)
+		return resolve(p)
+	}
+}
+
+// Check if any of the roles is allowed
+func hasRole(roles, allowed []string) bool {
+	for _, role := range roles {
+		for _, a := range allowed {
+			if role == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the roles are known, and normalize them; fails with the problem on the roles field
+func checkRoles(roles []string) ([]string, error) {
+	invalid := &validationError{}
+	var normalized []string
+	seen := map[string]bool{}
+	for _, role := range roles {
+		role = strings.ToLower(strings.TrimSpace(role))
+		if !validRoles[role] {
+			invalid.Add("roles", fmt.Sprintf("%q is not a role. must be customer, support or admin", role))
+			continue
+		}
+		if !seen[role] {
+			seen[role] = true
+			normalized = append(normalized, role)
+		}
+	}
+	if len(roles) == 0 {
+		invalid.Add("roles", "must not be empty")
+	}
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// Set the roles of a user from the command line, i.e. to make the first admin. Usage: set-roles <email> <role,...>
+func runSetRoles(args []string) {
+	if len(args) != 2 {
+		log.Fatal("usage: set-roles <email> <role,...>")
+	}
+	boldlygo.Initialize()
+	user, err := SetUserRoles("set-roles command", args[0], strings.Split(args[1], ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if user == nil {
+		log.Fatalf("no user is registered with the email %s", args[0])
+	}
+	fmt.Println(fmt.Sprintf("Set the roles of %s to %s", user.Email, strings.Join(user.Roles, ",")))
+}
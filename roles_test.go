@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Register a user with the roles and sign in, so the token carries the roles claim; returns the Authorization header value
+func signUpStaff(t *testing.T, email string, roles ...string) string {
+	t.Helper()
+	signUp(t, email)
+	if _, err := SetUserRoles("test", email, roles); err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + signIn(t, email).Token
+}
+
+// Support can view any user but not change them; admins can do both; customers can do neither
+func TestStaffFieldsRequireRole(t *testing.T) {
+	customer := signUp(t, "rbac-customer@example.com")
+	support := signUpStaff(t, "rbac-support@example.com", roleSupport)
+	admin := signUpStaff(t, "rbac-admin@example.com", roleAdmin)
+	view := `{ adminUser(email: "rbac-customer@example.com") { email } }`
+	lock := `mutation { adminLockUser(email: "rbac-customer@example.com", reason: "testing") { locked } }`
+	unlock := `mutation { adminUnlockUser(email: "rbac-customer@example.com") { locked } }`
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+		want          string
+	}{
+		{"customer views", customer, view, errCodeForbidden},
+		{"customer locks", customer, lock, errCodeForbidden},
+		{"support views", support, view, ""},
+		{"support locks", support, lock, errCodeForbidden},
+		{"admin views", admin, view, ""},
+		{"admin locks", admin, lock, ""},
+		{"admin unlocks", admin, unlock, ""},
+	}
+	for _, test := range tests {
+		if code := errorCode(do(test.authorization, test.query, nil)); code != test.want {
+			t.Errorf("%s: failed with %q; want %q", test.name, code, test.want)
+		}
+	}
+	want := []string{auditStaffAccessDenied, auditStaffAccessDenied, auditUserLocked, auditUserUnlocked}
+	if types := auditEventTypes(loginSubjectEmail + "rbac-customer@example.com"); !reflect.DeepEqual(types, want) {
+		t.Errorf("the audit trail of the customer is %v; want %v", types, want)
+	}
+}
+
+// A locked user cannot sign in or use the tokens they have until they are unlocked
+func TestLockedUserCannotSignIn(t *testing.T) {
+	email := "rbac-locked@example.com"
+	authorization := signUp(t, email)
+	if _, err := LockUser("test", email, "testing"); err != nil {
+		t.Fatal(err)
+	}
+	if auth := Authenticate(email, testPwd, "192.0.2.1"); auth.Success || auth.Message != lockedUserMessage {
+		t.Errorf("signing in while locked returned %+v; want the locked message", auth)
+	}
+	if code := errorCode(do(authorization, `{ me { email } }`, nil)); code != errCodeForbidden {
+		t.Errorf("using a token while locked failed with %q; want %q", code, errCodeForbidden)
+	}
+	if _, err := UnlockUser("test", email); err != nil {
+		t.Fatal(err)
+	}
+	if auth := Authenticate(email, testPwd, "192.0.2.1"); !auth.Success {
+		t.Errorf("unable to sign in once unlocked: %s", auth.Message)
+	}
+}
+
+// An admin cannot remove their own admin role
+func TestAdminKeepsOwnAdminRole(t *testing.T) {
+	admin := signUpStaff(t, "rbac-self@example.com", roleAdmin)
+	result := do(admin, `mutation { adminSetUserRoles(email: "rbac-self@example.com", roles: ["support"]) { roles } }`, nil)
+	if code := errorCode(result); code != errCodeInvalidInput {
+		t.Errorf("removing the own admin role failed with %q; want %q", code, errCodeInvalidInput)
+	}
+}
+
+// Roles are trimmed, lower-cased and deduplicated; unknown roles and no roles are rejected
+func TestCheckRoles(t *testing.T) {
+	roles, err := checkRoles([]string{" Admin", "support", "admin"})
+	if err != nil || !reflect.DeepEqual(roles, []string{roleAdmin, roleSupport}) {
+		t.Errorf("the roles were checked as %v, %v; want admin and support", roles, err)
+	}
+	for _, invalid := range [][]string{{"owner"}, {}} {
+		if _, err := checkRoles(invalid); err == nil {
+			t.Errorf("the roles %v were accepted", invalid)
+		}
+	}
+}
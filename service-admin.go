@@ -0,0 +1,109 @@
+/*
+Staff Operations, for the support and admin roles.
+
+	Support and admin staff can search users, and view any user and account without the customer's token.
+	Admins can lock and unlock users, and set their roles.
+	Locking a user stops them signing in, refreshing tokens, and using the tokens they already have.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+)
+
+// Search the users by a case sensitive part of their email or name; sorted by email
+func SearchUsers(query string, limit int) ([]*User, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		invalid := &validationError{}
+		invalid.Add("query", "must not be empty")
+		return nil, invalid
+	}
+	if limit <= 0 {
+		limit = defaultUserSearchLimit
+	}
+	if limit > maxUserSearchLimit {
+		limit = maxUserSearchLimit
+	}
+	users, err := boldlygo.Repositories().Users().Search(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users, nil
+}
+
+// Get any User by their email. Returns nil if no User has the email
+func GetUser(email string) (*User, error) {
+	return boldlygo.Repositories().Users().FindByEmail(normalizeEmail(email))
+}
+
+// Get any BankAccount by its account id. Returns nil if no BankAccount has the id
+func GetAnyBankAccount(accountId uuid.UUID) (*BankAccount, error) {
+	return boldlygo.Repositories().BankAccounts().FindByAccountId(accountId)
+}
+
+// Lock the User, so they cannot sign in or use their tokens until unlocked. Returns nil if no User has the email
+func LockUser(staffEmail, email, reason string) (*User, error) {
+	user, err := updateUser(email, func(user *User) error {
+		if strings.EqualFold(user.Email, staffEmail) {
+			return &codedError{errCodeInvalidInput, "you cannot lock your own account"}
+		}
+		user.Locked, user.LockedReason = true, strings.TrimSpace(reason)
+		return nil
+	})
+	if err != nil || user == nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditUserLocked, fmt.Sprintf("by %s: %s", staffEmail, user.LockedReason))
+	publishAccessChanged(user.Email)
+	return user, nil
+}
+
+// Unlock the User locked by staff. Returns nil if no User has the email
+func UnlockUser(staffEmail, email string) (*User, error) {
+	user, err := updateUser(email, func(user *User) error {
+		user.Locked, user.LockedReason = false, ""
+		return nil
+	})
+	if err != nil || user == nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditUserUnlocked, "by "+staffEmail)
+	return user, nil
+}
+
+/*
+Set the roles of the User. Returns nil if no User has the email.
+An admin cannot remove their own admin role, so there is always an admin left to grant it back
+*/
+func SetUserRoles(staffEmail, email string, roles []string) (*User, error) {
+	roles, err := checkRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+	previous := ""
+	user, err := updateUser(email, func(user *User) error {
+		if strings.EqualFold(user.Email, staffEmail) && !hasRole(roles, adminRoles) {
+			return &codedError{errCodeInvalidInput, "you cannot remove your own admin role"}
+		}
+		previous = strings.Join(user.RoleNames(), ",")
+		user.Roles = roles
+		return nil
+	})
+	if err != nil || user == nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditRolesChanged, fmt.Sprintf("by %s: from %s to %s", staffEmail, previous, strings.Join(roles, ",")))
+	publishAccessChanged(user.Email)
+	return user, nil
+}
@@ -0,0 +1,113 @@
+/*
+API Keys of the signed in User.
+
+	createApiKey returns the key once; only the hash of its secret is kept, so a lost key is revoked and replaced.
+	apiKeys lists the keys of the user, newest first, including revoked ones so their use can still be traced.
+	The keys move with the user when they change their email.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxApiKeyExpiryDays = 3650
+
+// Create an API key for the signed in User with the scopes; returns the stored key and the key to show once
+func CreateApiKey(email, name string, scopes []string, expiresInDays int) (*NewApiKey, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	invalid := &validationError{}
+	if name = strings.TrimSpace(name); name == "" {
+		invalid.Add("name", "must not be empty")
+	}
+	if expiresInDays < 0 || expiresInDays > maxApiKeyExpiryDays {
+		invalid.Add("expiresInDays", fmt.Sprintf("must be between 1 and %d, or 0 for a key that does not expire", maxApiKeyExpiryDays))
+	}
+	scopes = checkScopes(scopes, invalid)
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+	key, keyId, secretHash, err := newApiKey()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stored := &ApiKey{
+		KeyId:      keyId,
+		Email:      user.Email,
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: secretHash,
+		CreatedAt:  now.Unix(),
+	}
+	if expiresInDays > 0 {
+		stored.ExpiresAt = now.AddDate(0, 0, expiresInDays).Unix()
+	}
+	if err := boldlygo.Repositories().ApiKeys().Create(stored); err != nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditApiKeyCreated, fmt.Sprintf("%s %q with %s", keyId, name, strings.Join(scopes, ",")))
+	return &NewApiKey{ApiKey: stored, Key: key}, nil
+}
+
+// List the API keys of the signed in User, newest first
+func ListApiKeys(email string) ([]*ApiKey, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := boldlygo.Repositories().ApiKeys().FindByEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt > keys[j].CreatedAt })
+	return keys, nil
+}
+
+// Revoke the API key of the signed in User. Fails with ErrApiKeyNotFound if the user has no key with the id
+func RevokeApiKey(email, keyId string) (*ApiKey, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	repo := boldlygo.Repositories().ApiKeys()
+	key, err := repo.Find(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.Email != user.Email {
+		return nil, ErrApiKeyNotFound
+	}
+	if key.RevokedAt != 0 {
+		return key, nil // already revoked
+	}
+	revokedAt := time.Now().Unix()
+	if _, err := repo.Revoke(keyId, revokedAt); err != nil {
+		return nil, err
+	}
+	key.RevokedAt = revokedAt
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditApiKeyRevoked, fmt.Sprintf("%s %q", keyId, key.Name))
+	publishAccessChanged(user.Email)
+	return key, nil
+}
+
+// Move the API keys of the user to their new email, so they keep working. Failures are logged
+func moveApiKeys(oldEmail, newEmail string) {
+	repo := boldlygo.Repositories().ApiKeys()
+	keys, err := repo.FindByEmail(oldEmail)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to move the API keys of %s: %v", oldEmail, err))
+		return
+	}
+	for _, key := range keys {
+		if err := repo.ChangeEmail(key.KeyId, newEmail); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to move API key %s to %s: %v", key.KeyId, newEmail, err))
+		}
+	}
+}
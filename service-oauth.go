@@ -0,0 +1,310 @@
+/*
+Connected Apps: the OAuth2 clients, and the grants users give them.
+
+	Admins register apps; users connect them on the consent page, and list and revoke them as their connected apps.
+	A user has at most one active grant per app: connecting an app again replaces its grant, so the tokens issued
+	for the old grant stop working. The grants move with the user when they change their email.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const clientSecretBytes = 32
+
+// Register an app that may request the scopes; a confidential app also gets a client secret, returned only this once
+func RegisterOAuthClient(staffEmail, name string, redirectUris, scopes []string, confidential bool) (*NewOAuthClient, error) {
+	invalid := &validationError{}
+	if name = strings.TrimSpace(name); name == "" {
+		invalid.Add("name", "must not be empty")
+	}
+	for _, uri := range redirectUris {
+		if problem := checkRedirectUri(uri); problem != "" {
+			invalid.Add("redirectUris", problem)
+		}
+	}
+	if len(redirectUris) == 0 {
+		invalid.Add("redirectUris", "must not be empty")
+	}
+	scopes = checkScopes(scopes, invalid)
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+	client := &OAuthClient{
+		ClientId:     uuid.NewV4().String(),
+		Name:         name,
+		RedirectUris: redirectUris,
+		Scopes:       scopes,
+		CreatedAt:    time.Now().Unix(),
+		CreatedBy:    staffEmail,
+	}
+	created := &NewOAuthClient{Client: client}
+	if confidential {
+		b := make([]byte, clientSecretBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		created.ClientSecret = base64.RawURLEncoding.EncodeToString(b)
+		client.SecretHash = hashClientSecret(created.ClientSecret)
+	}
+	if err := boldlygo.Repositories().OAuthClients().Create(client); err != nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(staffEmail), auditOAuthClientRegistered, fmt.Sprintf("%s %q", client.ClientId, client.Name))
+	return created, nil
+}
+
+// List the apps the signed in User connected and has not revoked, most recently connected first
+func ConnectedApps(email string) ([]*ConnectedApp, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := boldlygo.Repositories().OAuthGrants().FindByEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	var apps []*ConnectedApp
+	for _, grant := range grants {
+		if grant.RevokedAt != 0 {
+			continue
+		}
+		client, err := boldlygo.Repositories().OAuthClients().Find(grant.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			continue
+		}
+		apps = append(apps, &ConnectedApp{
+			ClientId:    client.ClientId,
+			Name:        client.Name,
+			Scopes:      grant.Scopes,
+			ConnectedAt: grant.CreatedAt,
+			LastUsedAt:  grant.LastUsedAt,
+		})
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ConnectedAt > apps[j].ConnectedAt })
+	return apps, nil
+}
+
+// Revoke the access of an app the signed in User connected. Fails with ErrConnectedAppNotFound if it is not connected
+func RevokeConnectedApp(email, clientId string) (bool, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := revokeGrants(user.Email, clientId)
+	if err != nil {
+		return false, err
+	}
+	if revoked == 0 {
+		return false, ErrConnectedAppNotFound
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditAppRevoked, clientId)
+	publishAccessChanged(user.Email)
+	return true, nil
+}
+
+/*
+Verify the credentials the user entered on the consent page, throttled like signing in.
+Returns the user, or nil and the problem to show on the page
+*/
+func signInForConsent(email, pwd, code, ip string) (*User, string) {
+	email = normalizeEmail(email)
+	throttle := boldlygo.LoginThrottle()
+	lockedOut, err := throttle.LockedOut(email, ip)
+	if err != nil {
+		return nil, "Unable to sign in right now. Please try again later"
+	}
+	if lockedOut {
+		return nil, "Too many failed sign in attempts. Please try again later"
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(email)
+	if err != nil {
+		return nil, "Unable to sign in right now. Please try again later"
+	}
+	hashedPwd := ""
+	if user != nil {
+		hashedPwd = user.Pwd
+	}
+	// always compare so timing is uniform
+	if !boldlygo.AuthService().VerifyPwd(hashedPwd, pwd) {
+		if err := throttle.RecordFailure(email, ip); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record failed sign in attempt: %v", err))
+		}
+		return nil, "The email or password is incorrect. Please check the email and password and try again"
+	}
+	if user.Locked {
+		return nil, lockedUserMessage
+	}
+	if user.TotpEnabled {
+		if code == "" {
+			return nil, "Enter the code from your authenticator app, or a recovery code"
+		}
+		usedRecoveryCode, err := checkSecondFactor(user, code, ip, true)
+		if err != nil {
+			if _, invalid := err.(*validationError); invalid {
+				return nil, "The code is incorrect. Please check the code and try again"
+			} else if err == ErrTooManyAttempts {
+				return nil, "Too many failed sign in attempts. Please try again later"
+			}
+			return nil, "Unable to sign in right now. Please try again later"
+		}
+		if err := boldlygo.Repositories().Users().Save(user); err != nil {
+			return nil, "Unable to sign in right now. Please try again later"
+		}
+		if usedRecoveryCode {
+			auditRecoveryCodeUse(user.Email, len(user.RecoveryCodes))
+		}
+	}
+	if err := throttle.RecordSuccess(user.Email); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to clear failed sign in attempts: %v", err))
+	}
+	return user, ""
+}
+
+// Generate a single use authorization code for the request the user allowed, and store its hash
+func issueAuthorizationCode(user *User, req *authorizationRequest) (string, error) {
+	code, stored, err := newOneTimeToken(user.Email, purposeOAuthCode, oauthCodeExpiry)
+	if err != nil {
+		return "", err
+	}
+	stored.ClientId = req.Client.ClientId
+	stored.RedirectUri = req.RedirectUri
+	stored.Scopes = req.Scopes
+	stored.CodeChallenge = req.CodeChallenge
+	if err := boldlygo.Repositories().OneTimeTokens().Save(stored); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+/*
+Exchange an authorization code for app tokens.
+
+	The code is consumed by the first request that uses it. It must have been issued to the client for the redirect URI,
+	and the code verifier must match the code challenge. Connecting the app replaces any grant the user gave it before.
+*/
+func exchangeAuthorizationCode(client *OAuthClient, code, redirectUri, verifier string) (*oauthTokenResponse, error) {
+	stored, err := boldlygo.Repositories().OneTimeTokens().Consume(hashOneTimeToken(code), purposeOAuthCode)
+	if err != nil {
+		return nil, err
+	}
+	// the table time to live deletes expired codes lazily, so the expiry is checked too
+	if stored == nil || stored.ExpiresAt <= time.Now().Unix() || stored.ClientId != client.ClientId || stored.RedirectUri != redirectUri {
+		return nil, &oauthError{oauthInvalidGrant, "the code is invalid or has expired"}
+	}
+	if !verifyCodeChallenge(verifier, stored.CodeChallenge) {
+		return nil, &oauthError{oauthInvalidGrant, "the code_verifier does not match the code_challenge"}
+	}
+	user, err := findSignedInUser(stored.Email)
+	if err == ErrUserNotFound || err == ErrUserLocked {
+		return nil, &oauthError{oauthInvalidGrant, err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := revokeGrants(user.Email, client.ClientId); err != nil {
+		return nil, err
+	}
+	grant := &OAuthGrant{
+		GrantId:   uuid.NewV4().String(),
+		Email:     user.Email,
+		ClientId:  client.ClientId,
+		Scopes:    stored.Scopes,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := boldlygo.Repositories().OAuthGrants().Create(grant); err != nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditAppConnected, fmt.Sprintf("%s %q with %s", client.ClientId, client.Name, strings.Join(grant.Scopes, ",")))
+	refreshToken, _, err := boldlygo.AuthService().BuildAppRefreshToken(*grant)
+	if err != nil {
+		return nil, err
+	}
+	return issueAppToken(grant, *refreshToken)
+}
+
+// Issue a new app access token with an app refresh token; the grant must not be revoked, and be for the client
+func refreshAppToken(client *OAuthClient, refreshToken string) (*oauthTokenResponse, error) {
+	grantId, err := boldlygo.AuthService().ValidateAppRefreshToken(refreshToken)
+	if err != nil {
+		return nil, &oauthError{oauthInvalidGrant, err.Error()}
+	}
+	grant, err := boldlygo.Repositories().OAuthGrants().Find(grantId)
+	if err != nil {
+		return nil, err
+	}
+	if grant == nil || grant.RevokedAt != 0 || grant.ClientId != client.ClientId {
+		return nil, &oauthError{oauthInvalidGrant, "the app's access has been revoked"}
+	}
+	if _, err := findSignedInUser(grant.Email); err == ErrUserNotFound || err == ErrUserLocked {
+		return nil, &oauthError{oauthInvalidGrant, err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+	return issueAppToken(grant, refreshToken)
+}
+
+// Build the token endpoint response with a new app access token for the grant
+func issueAppToken(grant *OAuthGrant, refreshToken string) (*oauthTokenResponse, error) {
+	token, expiry, err := boldlygo.AuthService().BuildAppToken(*grant)
+	if err != nil {
+		return nil, err
+	}
+	return &oauthTokenResponse{
+		AccessToken:  *token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(time.Unix(0, *expiry)).Round(time.Second) / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(grant.Scopes, " "),
+	}, nil
+}
+
+// Revoke the active grants the user gave the app; returns how many were revoked
+func revokeGrants(email, clientId string) (int, error) {
+	repo := boldlygo.Repositories().OAuthGrants()
+	grants, err := repo.FindByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	now := time.Now().Unix()
+	for _, grant := range grants {
+		if grant.ClientId != clientId || grant.RevokedAt != 0 {
+			continue
+		}
+		ok, err := repo.Revoke(grant.GrantId, now)
+		if err != nil {
+			return revoked, err
+		}
+		if ok {
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// Move the grants of the user to their new email, so their connected apps keep working. Failures are logged
+func moveOAuthGrants(oldEmail, newEmail string) {
+	repo := boldlygo.Repositories().OAuthGrants()
+	grants, err := repo.FindByEmail(oldEmail)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to move the connected apps of %s: %v", oldEmail, err))
+		return
+	}
+	for _, grant := range grants {
+		if err := repo.ChangeEmail(grant.GrantId, newEmail); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to move grant %s to %s: %v", grant.GrantId, newEmail, err))
+		}
+	}
+}
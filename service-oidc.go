@@ -0,0 +1,190 @@
+/*
+Sign In with external OIDC identity providers, alongside signing in with a password; see oidc.go.
+
+	The client application signs the user in with an identity provider in two steps:
+		- startOidcLogin returns the authorization URL to send the user to, and the state to keep, i.e. in session storage
+		- the provider redirects the user back to the redirectUri with a code and the state. The client checks the state
+		  is the one it kept, and passes both to authenticateOidc for the tokens, like authenticate
+	The state is single use and expires after 10 minutes. The nonce and PKCE code verifier of the sign in are kept with
+	it, and never leave the service.
+
+	The User is found by the email the provider asserts; the provider must have verified it:
+		- an email without a User provisions one, without a password; they can set one with a password reset
+		- the first time a User signs in with a provider, the account at the provider is linked to them. If the User had
+		  not verified their email, their password is cleared, as someone else may have registered it with the email
+		- a User linked to a different account at the provider is refused, so a reused email cannot take over the User
+	Users with two-factor authentication enabled still enter a code, and locked users cannot sign in.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	purposeOidcLogin  = "oidc-login"
+	oidcLoginExpiry   = 10 * time.Minute
+	oidcCallbackPath  = "/oidc/callback"
+	oidcRandomBytes   = 32
+	oidcUnableMessage = "Unable to sign in with the identity provider. Please try again"
+)
+
+// The identity providers users can sign in with
+func IdentityProviders() []IdentityProvider {
+	return boldlygo.OidcClient().Providers()
+}
+
+// Start signing in with the identity provider; returns the URL to send the user to, and the state it sends back
+func StartOidcLogin(providerId string) (*OidcLogin, error) {
+	state, stored, err := newOneTimeToken("", purposeOidcLogin, oidcLoginExpiry)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomOidcValue()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomOidcValue()
+	if err != nil {
+		return nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	authorizationUrl, err := boldlygo.OidcClient().AuthorizationUrl(providerId, state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return nil, err
+	}
+	stored.Provider, stored.Nonce, stored.CodeVerifier = providerId, nonce, verifier
+	if err := boldlygo.Repositories().OneTimeTokens().Save(stored); err != nil {
+		return nil, err
+	}
+	return &OidcLogin{AuthorizationUrl: authorizationUrl, State: state, ExpiresAt: stored.ExpiresAt}, nil
+}
+
+/*
+Sign in with the code and state the identity provider redirected the user back with.
+
+	Consume the state of the sign in; it must have been issued for the provider, and not be expired.
+	Exchange the code for the identity of the user, and find, link or provision their User.
+	Return the tokens of the User, or the challenge token if they have two-factor authentication enabled
+*/
+func AuthenticateOidc(providerId, code, state string) Auth {
+	stored, err := boldlygo.Repositories().OneTimeTokens().Consume(hashOneTimeToken(state), purposeOidcLogin)
+	if err != nil {
+		return Auth{
+			Success: false,
+			Message: "Unable to sign in right now. Please try again later",
+		}
+	}
+	// the table time to live deletes expired states lazily, so the expiry is checked too
+	if stored == nil || stored.ExpiresAt <= time.Now().Unix() || stored.Provider != providerId {
+		return Auth{
+			Success: false,
+			Message: "The sign in has expired. Please sign in again",
+		}
+	}
+	identity, err := boldlygo.OidcClient().Exchange(providerId, code, stored.CodeVerifier, stored.Nonce)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to sign in with identity provider %s: %v", providerId, err))
+		return Auth{
+			Success: false,
+			Message: oidcUnableMessage,
+		}
+	}
+	var provider IdentityProvider
+	for _, p := range IdentityProviders() {
+		if p.Id == providerId {
+			provider = p
+		}
+	}
+	identity.Email = normalizeEmail(identity.Email)
+	if !identity.EmailVerified || !validEmail(identity.Email) {
+		return Auth{
+			Success: false,
+			Message: fmt.Sprintf("%s has not verified your email. Please verify it with them and try again", provider.Name),
+		}
+	}
+	if !provider.AllowsEmail(identity.Email) {
+		return Auth{
+			Success: false,
+			Message: fmt.Sprintf("Your email cannot be used to sign in with %s", provider.Name),
+		}
+	}
+	user, message := oidcUser(provider, identity)
+	if user == nil {
+		return Auth{
+			Success: false,
+			Message: message,
+		}
+	}
+	if user.TotpEnabled {
+		return twoFactorChallenge(*user)
+	}
+	return issueAuth(*user)
+}
+
+// Find the User with the email of the identity, linking or provisioning them. Returns nil and the problem if they cannot sign in
+func oidcUser(provider IdentityProvider, identity *OidcIdentity) (*User, string) {
+	repo := boldlygo.Repositories().Users()
+	user, err := repo.FindByEmail(identity.Email)
+	if err != nil {
+		return nil, "Unable to sign in right now. Please try again later"
+	}
+	now := time.Now().Unix()
+	linked := ExternalIdentity{Provider: provider.Id, Subject: identity.Subject, LinkedAt: now}
+	if user == nil {
+		user = &User{
+			Email:         identity.Email,
+			Name:          identity.Name,
+			EmailVerified: true,
+			BankUserId:    identity.Email, // the bank service knows the user by the email they were provisioned with
+			Identities:    []ExternalIdentity{linked},
+			Version:       1, // first version of the record
+		}
+		if user.Name == "" {
+			user.Name = identity.Email[:strings.LastIndex(identity.Email, "@")]
+		}
+		if err := repo.Create(user); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to provision a user for %s from identity provider %s: %v", identity.Email, provider.Id, err))
+			return nil, oidcUnableMessage
+		}
+		audit(loginSubjectEmail+strings.ToLower(user.Email), auditUserProvisioned, fmt.Sprintf("by %s as %s", provider.Id, identity.Subject))
+		return user, ""
+	}
+	if user.Locked {
+		return nil, lockedUserMessage
+	}
+	for _, existing := range user.Identities {
+		if existing.Provider != provider.Id {
+			continue
+		}
+		if existing.Subject != identity.Subject {
+			audit(loginSubjectEmail+strings.ToLower(user.Email), auditIdentityRefused, fmt.Sprintf("%s %s is not the linked %s", provider.Id, identity.Subject, existing.Subject))
+			return nil, fmt.Sprintf("Your account is linked to a different %s account. Please contact support", provider.Name)
+		}
+		return user, ""
+	}
+	if !user.EmailVerified {
+		// someone else may have registered the email; the password they chose stops working, with its refresh tokens
+		user.Pwd, user.PwdChangedAt, user.EmailVerified = "", now, true
+	}
+	user.Identities = append(user.Identities, linked)
+	if err := repo.Save(user); err != nil {
+		return nil, "Unable to sign in right now. Please try again later"
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditIdentityLinked, fmt.Sprintf("%s as %s", provider.Id, identity.Subject))
+	return user, ""
+}
+
+// A random value for the nonce or PKCE code verifier of a sign in
+func randomOidcValue() (string, error) {
+	b := make([]byte, oidcRandomBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
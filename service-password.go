@@ -0,0 +1,299 @@
+/*
+Password Reset, Password Change and Email Verification.
+
+	Password reset and email verification links carry a single use token:
+		- the token is 32 random bytes; only its SHA-256 hash is stored in the OneTimeTokens repository
+		- a token is consumed by the first request that uses it, and rejected once expired
+		- password reset links expire after 1 hour, email verification links after 48 hours
+	Links point at the client application at APP_URL (defaults to http://localhost:3000), i.e.
+	{APP_URL}/reset-password?token=... and {APP_URL}/verify-email?token=...
+
+	Changing or resetting the password revokes the refresh tokens issued before it, so every other session must
+	sign in again.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	appUrlKey     = "APP_URL"
+	defaultAppUrl = "http://localhost:3000"
+
+	purposePasswordReset     = "password-reset"
+	purposeEmailVerification = "email-verification"
+
+	passwordResetExpiry     = time.Hour
+	emailVerificationExpiry = 48 * time.Hour
+	oneTimeTokenBytes       = 32
+)
+
+// The problem reported for a reset or verification token that cannot be used
+const invalidTokenMessage = "is invalid or has expired. request a new link"
+
+/*
+Email the user a link to reset their password.
+Always succeeds, whether or not a user is registered with the email, so the response does not reveal it;
+failures to send are logged
+*/
+func RequestPasswordReset(email string) (bool, error) {
+	user, err := boldlygo.Repositories().Users().FindByEmail(normalizeEmail(email))
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return true, nil
+	}
+	token, err := issueOneTimeToken(user.Email, purposePasswordReset, passwordResetExpiry)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to issue password reset token: %v", err))
+		return true, nil
+	}
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Reset your Boldly Go password",
+		Body: fmt.Sprintf("Hi %s,\n\nFollow this link within the next hour to choose a new password:\n\n%s\n\n"+
+			"If you did not ask to reset your password, you can ignore this email.\n",
+			user.Name, appLink("/reset-password", token)),
+	})
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditPasswordResetRequested, "")
+	return true, nil
+}
+
+/*
+Set a new password using the token from a password reset link.
+
+	The new password must pass the password policy; it is checked before the token is consumed,
+	so a rejected password does not use up the link.
+	A token issued before the last password change is rejected, as an older link should not undo a newer change.
+	Following the link proves the user owns the email, so it is marked verified too.
+*/
+func ResetPassword(token, pwd string) (bool, error) {
+	if err := checkNewPassword("password", pwd, ""); err != nil {
+		return false, err
+	}
+	resetToken, err := consumeOneTimeToken(token, purposePasswordReset)
+	if err != nil {
+		return false, err
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(resetToken.Email)
+	if err != nil {
+		return false, err
+	}
+	if user == nil || resetToken.IssuedAt < user.PwdChangedAt {
+		return false, invalidOneTimeToken()
+	}
+	if err := checkNewPassword("password", pwd, user.Email); err != nil {
+		return false, err
+	}
+	user.EmailVerified = true
+	if err := setPassword(user, pwd); err != nil {
+		return false, err
+	}
+	if err := boldlygo.LoginThrottle().RecordSuccess(user.Email); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to clear failed sign in attempts: %v", err))
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditPasswordReset, "")
+	sendPasswordChangedMail(user)
+	return true, nil
+}
+
+/*
+Change the password of the signed in user.
+The current password must be verified; a wrong current password counts as a failed sign in attempt
+*/
+func ChangePassword(email, currentPwd, newPwd, ip string) (bool, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return false, err
+	}
+	throttle := boldlygo.LoginThrottle()
+	lockedOut, err := throttle.LockedOut(user.Email, ip)
+	if err != nil {
+		return false, err
+	}
+	if lockedOut {
+		return false, ErrTooManyAttempts
+	}
+	if !boldlygo.AuthService().VerifyPwd(user.Pwd, currentPwd) {
+		if err := throttle.RecordFailure(user.Email, ip); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record failed sign in attempt: %v", err))
+		}
+		invalid := &validationError{}
+		invalid.Add("currentPassword", "is incorrect")
+		return false, invalid
+	}
+	if err := checkNewPassword("newPassword", newPwd, user.Email); err != nil {
+		return false, err
+	}
+	if err := setPassword(user, newPwd); err != nil {
+		return false, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditPasswordChanged, "")
+	sendPasswordChangedMail(user)
+	return true, nil
+}
+
+// Mark the email of the user verified using the token from an email verification link
+func VerifyEmail(token string) (bool, error) {
+	verifyToken, err := consumeOneTimeToken(token, purposeEmailVerification)
+	if err != nil {
+		return false, err
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(verifyToken.Email)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, invalidOneTimeToken()
+	}
+	if user.EmailVerified {
+		return true, nil
+	}
+	user.EmailVerified = true
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return false, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditEmailVerified, "")
+	return true, nil
+}
+
+// Email the signed in user a new link to verify their email, unless it is already verified
+func RequestEmailVerification(email string) (bool, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return false, err
+	}
+	if !user.EmailVerified {
+		sendEmailVerification(user)
+	}
+	return true, nil
+}
+
+// Email the user a link to verify their email. Failures are logged, as the user can request another link
+func sendEmailVerification(user *User) {
+	token, err := issueOneTimeToken(user.Email, purposeEmailVerification, emailVerificationExpiry)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to issue email verification token: %v", err))
+		return
+	}
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Verify your Boldly Go email",
+		Body: fmt.Sprintf("Hi %s,\n\nFollow this link within the next 48 hours to verify your email:\n\n%s\n",
+			user.Name, appLink("/verify-email", token)),
+	})
+}
+
+// Let the user know their password changed, in case they did not change it themselves
+func sendPasswordChangedMail(user *User) {
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Your Boldly Go password was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe password of your Boldly Go account was just changed, and every other "+
+			"session was signed out.\n\nIf you did not change it, reset your password now:\n\n%s\n",
+			user.Name, appLink("/forgot-password", "")),
+	})
+}
+
+// Send the mail with the configured Mailer. A failure to send is logged rather than failing the request
+func sendMail(mail Mail) {
+	if err := boldlygo.Mailer().Send(mail); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to send mail %q to %s: %v", mail.Subject, mail.To, err))
+	}
+}
+
+// Hash and store the new password; refresh tokens issued before now are no longer accepted
+func setPassword(user *User, pwd string) error {
+	hashedPwd, err := boldlygo.AuthService().HashPwd(pwd)
+	if err != nil {
+		return err
+	}
+	user.Pwd = *hashedPwd
+	user.PwdChangedAt = time.Now().Unix()
+	return boldlygo.Repositories().Users().Save(user)
+}
+
+// Check the new password against the password policy; the problems are reported on the input field
+func checkNewPassword(field, pwd, email string) error {
+	invalid := &validationError{}
+	for _, problem := range boldlygo.AuthService().CheckPwdPolicy(pwd, email) {
+		invalid.Add(field, problem)
+	}
+	return invalid.Err()
+}
+
+// Generate a single use token for the purpose and store its hash; returns the token to send to the user
+func issueOneTimeToken(email, purpose string, lifetime time.Duration) (string, error) {
+	token, stored, err := newOneTimeToken(email, purpose, lifetime)
+	if err != nil {
+		return "", err
+	}
+	if err := boldlygo.Repositories().OneTimeTokens().Save(stored); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Generate a single use token for the purpose; returns the token and the record of its hash to store
+func newOneTimeToken(email, purpose string, lifetime time.Duration) (string, *OneTimeToken, error) {
+	b := make([]byte, oneTimeTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	return token, &OneTimeToken{
+		TokenHash: hashOneTimeToken(token),
+		Purpose:   purpose,
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	}, nil
+}
+
+// Consume the token for the purpose. Fails with an INVALID_INPUT error on the token if it is unknown or expired
+func consumeOneTimeToken(token, purpose string) (*OneTimeToken, error) {
+	stored, err := boldlygo.Repositories().OneTimeTokens().Consume(hashOneTimeToken(token), purpose)
+	if err != nil {
+		return nil, err
+	}
+	// the table time to live deletes expired tokens lazily, so the expiry is checked too
+	if stored == nil || stored.ExpiresAt <= time.Now().Unix() {
+		return nil, invalidOneTimeToken()
+	}
+	return stored, nil
+}
+
+func invalidOneTimeToken() error {
+	invalid := &validationError{}
+	invalid.Add("token", invalidTokenMessage)
+	return invalid
+}
+
+func hashOneTimeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Build a link to the path of the client application, with the token as a query parameter if set
+func appLink(path, token string) string {
+	base := os.Getenv(appUrlKey)
+	if base == "" {
+		base = defaultAppUrl
+	}
+	link := strings.TrimRight(base, "/") + path
+	if token != "" {
+		link += "?" + url.Values{"token": {token}}.Encode()
+	}
+	return link
+}
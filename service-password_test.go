@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+var mailedLink = regexp.MustCompile(`https?://\S+`)
+
+// The token of the latest link to the path mailed to the email, read from the outbox
+func mailedToken(t *testing.T, email, path string) string {
+	t.Helper()
+	dir := os.Getenv(mailOutboxDirKey)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names))) // the file names start with the time the mail was sent
+	for _, name := range names {
+		msg, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(msg), "\r\nTo: "+email+"\r\n") {
+			continue
+		}
+		for _, link := range mailedLink.FindAllString(string(msg), -1) {
+			if u, err := url.Parse(link); err == nil && u.Path == path {
+				return u.Query().Get("token")
+			}
+		}
+	}
+	t.Fatalf("no link to %s was mailed to %s", path, email)
+	return ""
+}
+
+// A password reset link sets a new password once; a password rejected by the policy does not use it up
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	email := "reset@example.com"
+	signUp(t, email)
+	var requested struct{ RequestPasswordReset bool }
+	mustDo(t, "", `mutation($email: String!) { requestPasswordReset(email: $email) }`, map[string]interface{}{"email": "Reset@Example.com"}, &requested)
+	if !requested.RequestPasswordReset {
+		t.Fatal("unable to request a password reset")
+	}
+	token := mailedToken(t, email, "/reset-password")
+	reset := func(pwd string) *graphql.Result {
+		return do("", `mutation($token: String!, $pwd: String!) { resetPassword(token: $token, password: $pwd) }`,
+			map[string]interface{}{"token": token, "pwd": pwd})
+	}
+	if code := errorCode(reset("short")); code != errCodeInvalidInput {
+		t.Errorf("resetting to a weak password failed with %q; want %q", code, errCodeInvalidInput)
+	}
+	if result := reset("Another2Horse"); len(result.Errors) != 0 {
+		t.Fatalf("unable to reset the password: %v", result.Errors)
+	}
+	if code := errorCode(reset("Third3Horse")); code != errCodeInvalidInput {
+		t.Errorf("reusing the reset link failed with %q; want %q", code, errCodeInvalidInput)
+	}
+	if auth := Authenticate(email, testPwd, "192.0.2.1"); auth.Success {
+		t.Error("signed in with the password from before the reset")
+	}
+	if auth := Authenticate(email, "Another2Horse", "192.0.2.1"); !auth.Success {
+		t.Errorf("unable to sign in with the new password: %s", auth.Message)
+	}
+}
+
+// Requesting a password reset for an email that is not registered succeeds the same, so it does not reveal who is registered
+func TestPasswordResetOfUnknownEmail(t *testing.T) {
+	var requested struct{ RequestPasswordReset bool }
+	mustDo(t, "", `mutation { requestPasswordReset(email: "nobody@example.com") }`, nil, &requested)
+	if !requested.RequestPasswordReset {
+		t.Error("requesting a password reset for an unknown email did not succeed")
+	}
+}
+
+// The link mailed on registering verifies the email once
+func TestEmailVerification(t *testing.T) {
+	email := "verify@example.com"
+	authorization := signUp(t, email)
+	var me struct{ Me struct{ EmailVerified bool } }
+	mustDo(t, authorization, `{ me { emailVerified } }`, nil, &me)
+	if me.Me.EmailVerified {
+		t.Fatal("the email is verified before following the link")
+	}
+	token := mailedToken(t, email, "/verify-email")
+	var verified struct{ VerifyEmail bool }
+	mustDo(t, "", `mutation($token: String!) { verifyEmail(token: $token) }`, map[string]interface{}{"token": token}, &verified)
+	mustDo(t, authorization, `{ me { emailVerified } }`, nil, &me)
+	if !verified.VerifyEmail || !me.Me.EmailVerified {
+		t.Error("the email is not verified after following the link")
+	}
+	if code := errorCode(do("", `mutation($token: String!) { verifyEmail(token: $token) }`, map[string]interface{}{"token": token})); code != errCodeInvalidInput {
+		t.Errorf("reusing the verification link failed with %q; want %q", code, errCodeInvalidInput)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Profile of the signed in User.
+
+	Changing the email is confirmed from the new address before it takes effect:
+		- changeEmail verifies the password and emails a link to the new address, valid for 24 hours
+		- confirmEmailChange moves the User to the new email primary key in a single atomic write
+	Tokens identify the user by email, so every token issued for the old email stops working once the change is
+	confirmed, and the user signs in again with the new email. The bank service keeps knowing the user by the
+	email they registered with (User.BankUserId), so their banks stay theirs. Their API keys and connected apps move
+	to the new email.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	purposeEmailChange = "email-change"
+	emailChangeExpiry  = 24 * time.Hour
+)
+
+// Get the signed in User by the email of their token
+func GetProfile(email string) (*User, error) {
+	return findSignedInUser(email)
+}
+
+// Update the profile of the signed in User; only the fields that are set are changed
+func UpdateProfile(email string, name *string) (*User, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if name != nil {
+		invalid := &validationError{}
+		if user.Name = strings.TrimSpace(*name); user.Name == "" {
+			invalid.Add("name", "must not be empty")
+		}
+		if err := invalid.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+/*
+Request changing the email of the signed in User.
+
+	The password must be verified; a wrong password counts as a failed sign in attempt.
+	The new email must be valid and not belong to another User.
+	Email a link to confirm the change to the new email, and let the current email know a change was requested.
+*/
+func ChangeEmail(email, newEmail, pwd, ip string) (bool, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return false, err
+	}
+	throttle := boldlygo.LoginThrottle()
+	lockedOut, err := throttle.LockedOut(user.Email, ip)
+	if err != nil {
+		return false, err
+	}
+	if lockedOut {
+		return false, ErrTooManyAttempts
+	}
+	if !boldlygo.AuthService().VerifyPwd(user.Pwd, pwd) {
+		if err := throttle.RecordFailure(user.Email, ip); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record failed sign in attempt: %v", err))
+		}
+		invalid := &validationError{}
+		invalid.Add("password", "is incorrect")
+		return false, invalid
+	}
+	newEmail = normalizeEmail(newEmail)
+	invalid := &validationError{}
+	if !validEmail(newEmail) {
+		invalid.Add("newEmail", "must be a valid email address, i.e. name@example.com")
+	} else if newEmail == user.Email {
+		invalid.Add("newEmail", "must be different from the current email")
+	}
+	if err := invalid.Err(); err != nil {
+		return false, err
+	}
+	existing, err := boldlygo.Repositories().Users().FindByEmail(newEmail)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		return false, ErrUserExists
+	}
+	token, err := issueEmailChangeToken(user.Email, newEmail)
+	if err != nil {
+		return false, err
+	}
+	sendMail(Mail{
+		To:      newEmail,
+		Subject: "Confirm your new Boldly Go email",
+		Body: fmt.Sprintf("Hi %s,\n\nFollow this link within the next 24 hours to change the email of your Boldly Go "+
+			"account to %s:\n\n%s\n\nIf you did not ask to change your email, you can ignore this email.\n",
+			user.Name, newEmail, appLink("/confirm-email-change", token)),
+	})
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Your Boldly Go email is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nA change of the email of your Boldly Go account to %s was requested. It takes "+
+			"effect once confirmed from the new email.\n\nIf you did not ask for this, change your password now.\n",
+			user.Name, newEmail),
+	})
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditEmailChangeRequested, "to "+newEmail)
+	return true, nil
+}
+
+/*
+Change the email of the User using the token from an email change link.
+Moves the User record to the new email and marks it verified, as following the link proves the user owns it.
+Fails with ErrUserExists if another User registered the new email since the change was requested
+*/
+func ConfirmEmailChange(token string) (bool, error) {
+	changeToken, err := consumeOneTimeToken(token, purposeEmailChange)
+	if err != nil {
+		return false, err
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(changeToken.Email)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, invalidOneTimeToken()
+	}
+	oldEmail := user.Email
+	user.BankUserId = user.BankOwnerId() // record it before the email changes, for users registered before it was
+	user.Email, user.EmailVerified = changeToken.NewEmail, true
+	if err := boldlygo.Repositories().Users().ChangeEmail(oldEmail, user); err != nil {
+		if err == ErrUserNotFound {
+			return false, invalidOneTimeToken()
+		}
+		return false, err
+	}
+	moveApiKeys(oldEmail, user.Email)
+	moveOAuthGrants(oldEmail, user.Email)
+	detail := fmt.Sprintf("from %s to %s", oldEmail, user.Email)
+	audit(loginSubjectEmail+strings.ToLower(oldEmail), auditEmailChanged, detail)
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditEmailChanged, detail)
+	publishAccessChanged(oldEmail)
+	sendMail(Mail{
+		To:      oldEmail,
+		Subject: "Your Boldly Go email was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email of your Boldly Go account was changed to %s. Sign in with the new "+
+			"email from now on.\n", user.Name, user.Email),
+	})
+	return true, nil
+}
+
+// Generate a single use email change token and store its hash; returns the token to send to the new email
+func issueEmailChangeToken(email, newEmail string) (string, error) {
+	token, stored, err := newOneTimeToken(email, purposeEmailChange, emailChangeExpiry)
+	if err != nil {
+		return "", err
+	}
+	stored.NewEmail = newEmail
+	if err := boldlygo.Repositories().OneTimeTokens().Save(stored); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,231 @@
+/*
+Two-factor Authentication of users with TOTP authenticator apps.
+
+	Enrolling is two steps, so a user cannot lock themselves out with a secret their app did not save:
+		- enrollTotp generates the secret and otpauth URI to add to the authenticator app
+		- confirmTotp enables two-factor authentication once a code from the app is verified,
+		  and returns the recovery codes; they are only shown this once
+	Once enabled, authenticate returns a challenge token instead of the JWT, which verifyTotp exchanges for the JWT
+	together with a code from the app or an unused recovery code.
+
+	Failed codes count towards the same lockouts as failed passwords, so codes cannot be guessed.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The problem reported for a code that does not verify
+const invalidCodeMessage = "is not a valid authenticator or recovery code"
+
+/*
+Start enrolling the user in two-factor authentication.
+Generate and save a new TOTP secret; two-factor authentication is not enabled until the secret is confirmed.
+Return the secret and the otpauth URI to add to the authenticator app
+*/
+func EnrollTotp(email string) (*TotpEnrollment, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled {
+		return nil, ErrTotpEnabled
+	}
+	secret, uri, err := boldlygo.AuthService().GenerateTotpSecret(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	user.TotpSecret, user.TotpLastStep = secret, 0
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return nil, err
+	}
+	return &TotpEnrollment{Secret: secret, OtpauthUri: uri}, nil
+}
+
+/*
+Enable two-factor authentication once a code from the authenticator app verifies against the enrolled secret.
+Return the recovery codes; only their hashes are stored, so they cannot be shown again
+*/
+func ConfirmTotp(email, code, ip string) ([]string, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled {
+		return nil, ErrTotpEnabled
+	}
+	if user.TotpSecret == "" {
+		return nil, ErrTotpNotEnrolled
+	}
+	if _, err := checkSecondFactor(user, code, ip, false); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := boldlygo.AuthService().GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.TotpEnabled, user.RecoveryCodes = true, hashes
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return nil, err
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditTotpEnabled, "")
+	return codes, nil
+}
+
+// Disable two-factor authentication, after verifying a code from the authenticator app or a recovery code
+func DisableTotp(email, code, ip string) (bool, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return false, err
+	}
+	if !user.TotpEnabled {
+		return false, ErrTotpNotEnabled
+	}
+	usedRecoveryCode, err := checkSecondFactor(user, code, ip, true)
+	if err != nil {
+		return false, err
+	}
+	recoveryCodesLeft := len(user.RecoveryCodes)
+	user.TotpEnabled, user.TotpSecret, user.TotpLastStep, user.RecoveryCodes = false, "", 0, nil
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return false, err
+	}
+	if usedRecoveryCode {
+		auditRecoveryCodeUse(user.Email, recoveryCodesLeft)
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditTotpDisabled, "")
+	return true, nil
+}
+
+// Replace the recovery codes with a new set, after verifying a code from the authenticator app or a recovery code
+func RegenerateRecoveryCodes(email, code, ip string) ([]string, error) {
+	user, err := findSignedInUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TotpEnabled {
+		return nil, ErrTotpNotEnabled
+	}
+	usedRecoveryCode, err := checkSecondFactor(user, code, ip, true)
+	if err != nil {
+		return nil, err
+	}
+	recoveryCodesLeft := len(user.RecoveryCodes)
+	codes, hashes, err := boldlygo.AuthService().GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.RecoveryCodes = hashes
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return nil, err
+	}
+	if usedRecoveryCode {
+		auditRecoveryCodeUse(user.Email, recoveryCodesLeft)
+	}
+	audit(loginSubjectEmail+strings.ToLower(user.Email), auditRecoveryCodesRegenerated, "")
+	return codes, nil
+}
+
+/*
+Complete signing in a user with two-factor authentication enabled.
+
+	Validate the challenge token returned by authenticate; it proves the password was verified.
+	Verify the code from the authenticator app, or an unused recovery code, against the user:
+		- if it verifies, clear the failed attempts of the email, generate a JWT and return
+		- if it does not, count the failed attempt and return an error
+*/
+func VerifyTotpChallenge(challengeToken, code, ip string) Auth {
+	email, err := boldlygo.AuthService().ValidateChallengeToken(challengeToken)
+	if err != nil {
+		return Auth{
+			Success: false,
+			Message: "The sign in challenge is invalid or has expired. Please sign in again",
+		}
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(email)
+	if err != nil || user == nil || !user.TotpEnabled {
+		return Auth{
+			Success: false,
+			Message: "Unable to sign in right now. Please sign in again",
+		}
+	}
+	if user.Locked {
+		return Auth{
+			Success: false,
+			Message: lockedUserMessage,
+		}
+	}
+	usedRecoveryCode, err := checkSecondFactor(user, code, ip, true)
+	if err != nil {
+		message := "Unable to sign in right now. Please try again later"
+		if _, invalid := err.(*validationError); invalid {
+			message = "The code is incorrect. Please check the code and try again"
+		} else if err == ErrTooManyAttempts {
+			message = "Too many failed sign in attempts. Please try again later"
+		}
+		return Auth{
+			Success: false,
+			Message: message,
+		}
+	}
+	if err := boldlygo.Repositories().Users().Save(user); err != nil {
+		return Auth{
+			Success: false,
+			Message: "Unable to sign in right now. Please try again later",
+		}
+	}
+	if usedRecoveryCode {
+		auditRecoveryCodeUse(user.Email, len(user.RecoveryCodes))
+	}
+	if err := boldlygo.LoginThrottle().RecordSuccess(user.Email); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to clear failed sign in attempts: %v", err))
+	}
+	return issueAuth(*user)
+}
+
+/*
+Verify the code of the user, throttled like signing in.
+
+	The code is checked against the TOTP secret first and, if allowed, the unused recovery codes.
+	A verified code is consumed on the user: the time step is recorded, or the recovery code removed.
+	The caller saves the user, so the code cannot be used again. The save is conditional on the version of the user,
+	so if another request used the same code at the same time, only one of the saves succeeds; the other fails with
+	ErrConflict and must not accept the code.
+	Returns whether the code was a recovery code; the caller records its use in the audit trail once the save succeeds.
+*/
+func checkSecondFactor(user *User, code, ip string, allowRecovery bool) (bool, error) {
+	throttle := boldlygo.LoginThrottle()
+	lockedOut, err := throttle.LockedOut(user.Email, ip)
+	if err != nil {
+		return false, err
+	}
+	if lockedOut {
+		return false, ErrTooManyAttempts
+	}
+	if step, ok := boldlygo.AuthService().VerifyTotp(user.TotpSecret, code, user.TotpLastStep); ok {
+		user.TotpLastStep = step
+		return false, nil
+	}
+	if allowRecovery {
+		hash := boldlygo.AuthService().HashRecoveryCode(code)
+		for i, h := range user.RecoveryCodes {
+			if h == hash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return true, nil
+			}
+		}
+	}
+	if err := throttle.RecordFailure(user.Email, ip); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to record failed two-factor attempt: %v", err))
+	}
+	invalid := &validationError{}
+	invalid.Add("code", invalidCodeMessage)
+	return false, invalid
+}
+
+// Record the use of a recovery code in the audit trail, with the number of unused recovery codes left
+func auditRecoveryCodeUse(email string, left int) {
+	audit(loginSubjectEmail+strings.ToLower(email), auditRecoveryCodeUsed, fmt.Sprintf("%d recovery codes left", left))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Enroll the user in two-factor authentication and enable it with the current code; returns the recovery codes
+func enableTotp(t *testing.T, authorization string) []string {
+	t.Helper()
+	var enrolled struct {
+		EnrollTotp struct{ Secret string }
+	}
+	mustDo(t, authorization, `mutation { enrollTotp { secret } }`, nil, &enrolled)
+	key, err := totpEncoding.DecodeString(enrolled.EnrollTotp.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confirmed struct{ ConfirmTotp []string }
+	code := totpCode(key, totpStep(time.Now()))
+	mustDo(t, authorization, `mutation($code: String!) { confirmTotp(code: $code) }`, map[string]interface{}{"code": code}, &confirmed)
+	if len(confirmed.ConfirmTotp) != recoveryCodeCount {
+		t.Fatalf("enabling two-factor authentication returned %d recovery codes; want %d", len(confirmed.ConfirmTotp), recoveryCodeCount)
+	}
+	return confirmed.ConfirmTotp
+}
+
+// Sign in with the password and the second factor code; returns if it succeeded
+func signInWithCode(t *testing.T, email, code string) bool {
+	t.Helper()
+	var challenged struct {
+		Authenticate struct {
+			TwoFactorRequired bool
+			ChallengeToken    string
+		}
+	}
+	mustDo(t, "", `mutation($email: String!, $pwd: String!) { authenticate(email: $email, password: $pwd) { twoFactorRequired challengeToken } }`,
+		map[string]interface{}{"email": email, "pwd": testPwd}, &challenged)
+	if !challenged.Authenticate.TwoFactorRequired {
+		t.Fatal("signed in without a second factor")
+	}
+	var verified struct {
+		VerifyTotp struct {
+			Success bool
+			Token   string
+		}
+	}
+	mustDo(t, "", `mutation($challengeToken: String!, $code: String!) { verifyTotp(challengeToken: $challengeToken, code: $code) { success token } }`,
+		map[string]interface{}{"challengeToken": challenged.Authenticate.ChallengeToken, "code": code}, &verified)
+	return verified.VerifyTotp.Success && verified.VerifyTotp.Token != ""
+}
+
+// A recovery code signs in once; it is removed when used
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	email := "recovery@example.com"
+	codes := enableTotp(t, signUp(t, email))
+	if !signInWithCode(t, email, codes[0]) {
+		t.Fatal("unable to sign in with an unused recovery code")
+	}
+	if signInWithCode(t, email, codes[0]) {
+		t.Error("signed in twice with the same recovery code")
+	}
+	if !signInWithCode(t, email, codes[1]) {
+		t.Error("unable to sign in with another recovery code")
+	}
+	used := 0
+	for _, eventType := range auditEventTypes(loginSubjectEmail + email) {
+		if eventType == auditRecoveryCodeUsed {
+			used++
+		}
+	}
+	if used != 2 {
+		t.Errorf("the audit trail records %d uses of recovery codes; want 2", used)
+	}
+}
+
+// Two requests that verify the same code on the same version of the user cannot both save it, so only one is accepted
+func TestSecondFactorCodeRaceConflicts(t *testing.T) {
+	email := "race@example.com"
+	codes := enableTotp(t, signUp(t, email))
+	users := boldlygo.Repositories().Users()
+	first, err := users.FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := users.FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*User{first, second} {
+		if used, err := checkSecondFactor(user, codes[0], "192.0.2.1", true); err != nil || !used {
+			t.Fatalf("the unused recovery code did not verify: %v", err)
+		}
+	}
+	if err := users.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Save(second); err != ErrConflict {
+		t.Errorf("saving the second use of the code failed with %v; want %v", err, ErrConflict)
+	}
+	if types := auditEventTypes(loginSubjectEmail + email); len(types) != 1 || types[0] != auditTotpEnabled {
+		t.Errorf("the audit trail of the user is %v; want the code uses left to the callers that saved them", types)
+	}
+	stored, err := users.FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("the user has %d recovery codes left; want %d", len(stored.RecoveryCodes), recoveryCodeCount-1)
+	}
+}
+
+// A staff lock is not lost when a sign in saves the user it read before the lock
+func TestUserSaveKeepsConcurrentLock(t *testing.T) {
+	email := "locked@example.com"
+	signUp(t, email)
+	users := boldlygo.Repositories().Users()
+	signingIn, err := users.FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updateUser(email, func(user *User) error {
+		user.Locked = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	signingIn.TotpLastStep = 1
+	if err := users.Save(signingIn); err != ErrConflict {
+		t.Errorf("saving the user read before the lock failed with %v; want %v", err, ErrConflict)
+	}
+	stored, err := users.FindByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Locked {
+		t.Error("the lock was lost")
+	}
+}
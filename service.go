@@ -2,99 +2,173 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
-	"sort"
+	"net/mail"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
 	"github.com/satori/go.uuid"
 )
 
 const (
-	bankUrl = "http://localhost:5002/api/v1/user/{email}/bank/{bankId}"
+	lockedUserMessage = "This account is locked. Please contact support"
+
+	maxUserSaveAttempts = 3 // the times a change is applied to a User that other requests keep saving
 )
 
+// The Bank endpoint of the bank service; a var so the tests can point it at a fake
+var bankUrl = "http://localhost:5002/api/v1/user/{email}/bank/{bankId}"
+
 /*
 Register a new User.
+Validate the email, name and password policy; the problems are returned together, by input field.
 Hash the password before storing.
+Fails with ErrUserExists if a User is already registered with the email, in any case; emails are stored lower-cased.
+Email the user a link to verify their email.
 Return the created User record.
 */
 func (u *User) Register() (*User, error) {
-	hashedPwd, err := boldlygo.AuthService().HashPwd(u.Pwd) // use the AuthSvc to hash the users password
-	if err != nil {
+	u.Email, u.Name = normalizeEmail(u.Email), strings.TrimSpace(u.Name)
+	invalid := &validationError{}
+	if !validEmail(u.Email) {
+		invalid.Add("email", "must be a valid email address, i.e. name@example.com")
+	}
+	if u.Name == "" {
+		invalid.Add("name", "must not be empty")
+	}
+	for _, problem := range boldlygo.AuthService().CheckPwdPolicy(u.Pwd, u.Email) {
+		invalid.Add("pwd", problem)
+	}
+	if err := invalid.Err(); err != nil {
 		return nil, err
 	}
-	u.Pwd = *hashedPwd                              // set new hashed password on user
-	userMap, err := dynamodbattribute.MarshalMap(u) // marshal User to dynamodbattribute map
+	hashedPwd, err := boldlygo.AuthService().HashPwd(u.Pwd) // use the AuthSvc to hash the users password
 	if err != nil {
 		return nil, err
 	}
-	// build item input request
-	input := &dynamodb.PutItemInput{
-		Item:      userMap,
-		TableName: aws.String("Users"),
-	}
-	req := boldlygo.DynamoDbSvc().PutItemRequest(input) // save item to db
-	_, err = req.Send()
+	u.Pwd = *hashedPwd                              // set new hashed password on user
+	u.BankUserId = u.Email                          // the bank service knows the user by the email they registered with
+	u.Version = 1                                   // first version of the record
+	err = boldlygo.Repositories().Users().Create(u) // save new user to the store
 	if err != nil {
 		return nil, err
 	}
+	sendEmailVerification(u)
 	return u, nil
 }
 
+// Trim and lower-case the email, so a User is found by their email whatever its case
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Check the email is a bare address, i.e. name@example.com, with a dot in the domain
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return false
+	}
+	at := strings.LastIndex(email, "@")
+	return at > 0 && strings.Contains(email[at+1:], ".")
+}
+
 /*
-Authenticate a user by their email and password.
+Authenticate a user by their email and password, from the client IP address.
 
+	If the email or client IP address is locked out after too many failed attempts, fail without checking the password.
 	Attempt to find the user by the email.
 		- If the user is found; get their hashed password, use the AuthSvc to compare it to the passed in password:
-			- if the passwords match, generate a JWT and return
-			- If the passwords do not match, return an error
-		- If the user cannot be found, return an error
+			- if the passwords match but the user was locked by staff, return an error
+			- if the passwords match and the user has two-factor authentication enabled, return a challenge token to
+			  exchange, together with a code, for the JWT with VerifyTotpChallenge
+			- if the passwords match otherwise, clear the failed attempts of the email, generate a JWT and return
+			- If the passwords do not match, count the failed attempt and return an error
+		- If the user cannot be found, count the failed attempt and return the same error,
+		  so the response does not reveal whether a user exists with the email
 */
-func Authenticate(email, pwd string) Auth {
-	req := boldlygo.DynamoDbSvc().GetItemRequest(&dynamodb.GetItemInput{
-		TableName: aws.String("Users"),
-		Key: map[string]dynamodb.AttributeValue{
-			"email": {
-				S: aws.String(email),
-			},
-		},
-	}) // build the request to send to DynamoDB to find a unique user record by the email primary key
-	output, err := req.Send() // send the request to the DynamoDB service; get the output result
+func Authenticate(email, pwd, ip string) Auth {
+	email = normalizeEmail(email)
+	throttle := boldlygo.LoginThrottle()
+	lockedOut, err := throttle.LockedOut(email, ip)
 	if err != nil {
 		return Auth{
 			Success: false,
-			Message: "Unable to find user by that email. Please check your email and try again",
+			Message: "Unable to sign in right now. Please try again later",
+		}
+	}
+	if lockedOut {
+		return Auth{
+			Success: false,
+			Message: "Too many failed sign in attempts. Please try again later",
+		}
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(email) // find a unique user record by the email primary key
+	if err != nil {
+		return Auth{
+			Success: false,
+			Message: "Unable to sign in right now. Please try again later",
+		}
+	}
+	hashedPwd := ""
+	if user != nil {
+		hashedPwd = user.Pwd
+	}
+	// verify that the passed in password matches the saved password for the user; always compare so timing is uniform
+	if verify := boldlygo.AuthService().VerifyPwd(hashedPwd, pwd); !verify {
+		if err := throttle.RecordFailure(email, ip); err != nil {
+			fmt.Println(fmt.Sprintf("Unable to record failed sign in attempt: %v", err))
+		}
+		return Auth{
+			Success: false,
+			Message: "The email or password is incorrect. Please check the email and password and try again",
 		}
 	}
-	if len(output.Item) == 0 {
+	if user.Locked {
 		return Auth{
 			Success: false,
-			Message: "Unable to find user by that email. Please check your email and try again",
+			Message: lockedUserMessage,
 		}
 	}
-	// unmarshal returned map from DynamoDB into a User
-	var user = new(User)
-	err = dynamodbattribute.UnmarshalMap(output.Item, &user)
+	if user.TotpEnabled {
+		// the failed attempts are cleared once the second factor is verified too
+		return twoFactorChallenge(*user)
+	}
+	if err := throttle.RecordSuccess(email); err != nil {
+		fmt.Println(fmt.Sprintf("Unable to clear failed sign in attempts: %v", err))
+	}
+	return issueAuth(*user)
+}
+
+// Generate the challenge token a user with two-factor authentication enabled exchanges, with a code, for their tokens
+func twoFactorChallenge(user User) Auth {
+	challengeToken, challengeExpiry, err := boldlygo.AuthService().BuildChallengeToken(user)
 	if err != nil {
 		return Auth{
 			Success: false,
 			Message: err.Error(),
 		}
 	}
-	// verify that the passed in password matches the saved password for the user
-	if verify := boldlygo.AuthService().VerifyPwd(user.Pwd, pwd); !verify {
+	return Auth{
+		Success:            false,
+		Message:            "Enter the code from your authenticator app, or a recovery code",
+		TwoFactorRequired:  true,
+		ChallengeToken:     *challengeToken,
+		ChallengeExpiresAt: *challengeExpiry,
+	}
+}
+
+// Generate the access token and refresh token of a signed in user
+func issueAuth(user User) Auth {
+	token, expiry, err := boldlygo.AuthService().BuildToken(user) // generate token from user
+	if err != nil {
 		return Auth{
 			Success: false,
-			Message: "The password submitted does not match this users password. Please check the email and password and try again",
+			Message: err.Error(),
 		}
 	}
-	token, expiry, err := boldlygo.AuthService().BuildToken(*user) // generate token from user
+	refreshToken, refreshExpiry, err := boldlygo.AuthService().BuildRefreshToken(user) // generate refresh token from user
 	if err != nil {
 		return Auth{
 			Success: false,
@@ -102,113 +176,207 @@ func Authenticate(email, pwd string) Auth {
 		}
 	}
 	return Auth{
-		Success:   true,
-		Message:   "Success",
-		Token:     *token,
-		ExpiresAt: *expiry,
+		Success:          true,
+		Message:          "Success",
+		Token:            *token,
+		ExpiresAt:        *expiry,
+		RefreshToken:     *refreshToken,
+		RefreshExpiresAt: *refreshExpiry,
 	}
 }
 
 /*
-Utilize the HTTP client to make a REST call to get the Bank info by its PK id
+Issue a new access token using a refresh token.
+
+	Validate the refresh token:
+		- it must be signed by this service, not expired, and a refresh token
+		- it must not have been revoked by logging out
+		- the user it was issued to must still exist, and not have changed their password since
+	If valid, generate a new access token and return it with the same refresh token
 */
-func GetBank(email string, bankId uuid.UUID) (*Bank, error) {
-	url := strings.Replace(bankUrl, "{email}", email, -1)       // replace email placeholder with passed in email
-	url = strings.Replace(url, "{bankId}", bankId.String(), -1) // replace bankId placeholder with passed in bankId
-	resp, err := http.Get(url)
+func RefreshToken(refreshToken string) Auth {
+	claims, err := boldlygo.AuthService().ValidateRefreshToken(refreshToken)
 	if err != nil {
-		return nil, err
+		return Auth{
+			Success: false,
+			Message: err.Error(),
+		}
 	}
-	defer resp.Body.Close()
-	// get the response body and parse into Bank
-	body, err := ioutil.ReadAll(resp.Body)
+	revoked, err := boldlygo.Repositories().RevokedTokens().IsRevoked(claims.Jti)
+	if err != nil || revoked {
+		return Auth{
+			Success: false,
+			Message: "The refresh token has been revoked. Please authenticate again",
+		}
+	}
+	user, err := boldlygo.Repositories().Users().FindByEmail(claims.Email)
+	if err != nil || user == nil {
+		return Auth{
+			Success: false,
+			Message: "Unable to find the user the refresh token was issued to. Please authenticate again",
+		}
+	}
+	if user.Locked {
+		return Auth{
+			Success: false,
+			Message: lockedUserMessage,
+		}
+	}
+	if claims.IssuedAt < user.PwdChangedAt {
+		return Auth{
+			Success: false,
+			Message: "The password was changed since the refresh token was issued. Please authenticate again",
+		}
+	}
+	token, expiry, err := boldlygo.AuthService().BuildToken(*user) // generate a new access token from user
 	if err != nil {
-		return nil, err
+		return Auth{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+	return Auth{
+		Success:          true,
+		Message:          "Success",
+		Token:            *token,
+		ExpiresAt:        *expiry,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: time.Unix(claims.ExpiresAt, 0).UnixNano(),
 	}
-	var bank = new(Bank)
-	json.Unmarshal(body, &bank) // unmarshal the response body into a bank
-	return bank, nil
 }
 
 /*
-Get a list of all of the users bank accounts by the bank id
+Log out by revoking the refresh token, so it cannot be used to issue new access tokens.
+The revoked token id is kept in the RevokedTokens denylist until the token expires.
+Access tokens already issued remain valid until they expire
 */
-func GetUserBankAccounts(bankId uuid.UUID) ([]*BankAccount, error) {
-	keyCond := expression.Key("bankId").Equal(expression.Value(bankId.String())) // build find BankAccount by BankId filter expression
-	expr, err := expression.NewBuilder().
-		WithKeyCondition(keyCond).
-		Build()
+func Logout(refreshToken string) (bool, error) {
+	claims, err := boldlygo.AuthService().ValidateRefreshToken(refreshToken)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	params := &dynamodb.QueryInput{
-		TableName:                 aws.String("BankAccounts"),
-		KeyConditionExpression:    expr.KeyCondition(),
-		ExpressionAttributeValues: expr.Values(),
-		ExpressionAttributeNames:  expr.Names(),
+	err = boldlygo.Repositories().RevokedTokens().Save(&RevokedToken{Jti: claims.Jti, ExpiresAt: claims.ExpiresAt})
+	if err != nil {
+		return false, err
 	}
-	req := boldlygo.DynamoDbSvc().QueryRequest(params) // build dynamodb query with key condition
-	output, err := req.Send()                          // submit the dynamodb query request
+	return true, nil
+}
+
+// Find the signed in user by the email of their token. Fails if the user was locked by staff
+func findSignedInUser(email string) (*User, error) {
+	user, err := boldlygo.Repositories().Users().FindByEmail(email)
 	if err != nil {
 		return nil, err
 	}
-	// unmarshal the return into the object
-	if output.Items == nil {
-		return nil, err
+	if user == nil {
+		return nil, ErrUserNotFound
 	}
-	var accounts = make([]*BankAccount, 0)
-	err = dynamodbattribute.UnmarshalListOfMaps(output.Items, &accounts) // unmarshal the found items into a list of accounts
-	if err != nil {
-		return nil, err
+	if user.Locked {
+		return nil, ErrUserLocked
 	}
-	return accounts, nil
+	return user, nil
 }
 
 /*
-Get a unique BankAccount record by the Primary Key and Sort Key conditions
+Apply the change to the User with the email and save it. Returns nil if no User has the email.
+If the User was saved by another request since it was read, i.e. a sign in recording a code, the User is read again
+and the change applied again, so neither save is lost
 */
-func GetUserBankAccount(bankId, accountId uuid.UUID) (*BankAccount, error) {
-	req := boldlygo.DynamoDbSvc().GetItemRequest(&dynamodb.GetItemInput{
-		TableName: aws.String("BankAccounts"),
-		Key: map[string]dynamodb.AttributeValue{
-			"bankId": {
-				S: aws.String(bankId.String()),
-			},
-			"accountId": {
-				S: aws.String(accountId.String()),
-			},
-		},
-	})
-	output, err := req.Send()
+func updateUser(email string, change func(user *User) error) (*User, error) {
+	for attempt := 1; ; attempt++ {
+		user, err := boldlygo.Repositories().Users().FindByEmail(normalizeEmail(email))
+		if err != nil || user == nil {
+			return nil, err
+		}
+		if err := change(user); err != nil {
+			return nil, err
+		}
+		err = boldlygo.Repositories().Users().Save(user)
+		if err == ErrConflict && attempt < maxUserSaveAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+}
+
+/*
+Utilize the HTTP client to make a REST call to get the Bank info by its PK id.
+The user is identified by the id the bank service knows them by; see User.BankOwnerId.
+Returns nil if the user has no Bank with the id
+*/
+func GetBank(bankUserId string, bankId uuid.UUID) (*Bank, error) {
+	url := strings.Replace(bankUrl, "{email}", bankUserId, -1)  // replace email placeholder with the bank user id
+	url = strings.Replace(url, "{bankId}", bankId.String(), -1) // replace bankId placeholder with passed in bankId
+	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
-	// unmarshal returned map into BankAccount
-	var account = new(BankAccount)
-	err = dynamodbattribute.UnmarshalMap(output.Item, &account)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get the Bank: the bank service responded %s", resp.Status)
+	}
+	// get the response body and parse into Bank
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	return account, nil
+	var bank = new(Bank)
+	json.Unmarshal(body, &bank) // unmarshal the response body into a bank
+	return bank, nil
 }
 
 /*
-Save a new BankAccount record to DynamoDB
+Get a list of all of the users bank accounts by the bank id
+*/
+func GetUserBankAccounts(bankId uuid.UUID) ([]*BankAccount, error) {
+	return boldlygo.Repositories().BankAccounts().FindByBankId(bankId)
+}
+
+/*
+Get a page of the users bank accounts by the bank id, in BankAccount key order
+*/
+func GetUserBankAccountsPage(bankId uuid.UUID, page PageRequest) (*BankAccountPage, error) {
+	return boldlygo.Repositories().BankAccounts().FindPageByBankId(bankId, page)
+}
+
+/*
+Count the users bank accounts by the bank id
+*/
+func CountUserBankAccounts(bankId uuid.UUID) (int, error) {
+	return boldlygo.Repositories().BankAccounts().CountByBankId(bankId)
+}
+
+/*
+Get a unique BankAccount record by the Primary Key and Sort Key conditions
+*/
+func GetUserBankAccount(bankId, accountId uuid.UUID) (*BankAccount, error) {
+	return boldlygo.Repositories().BankAccounts().Find(bankId, accountId)
+}
+
+/*
+Save a new BankAccount record, in the currency of its CurrentBalance or the default currency.
+The balance starts at zero; only posting Transactions changes it
 */
 func (a *BankAccount) Save() (*BankAccount, error) {
-	a.AccountId = uuid.NewV4().String()             // set unique account id
-	acctMap, err := dynamodbattribute.MarshalMap(a) // marshal BankAccount to dynamodbattribute map
-	if err != nil {
-		return nil, err
+	currency := strings.ToUpper(a.CurrentBalance.Currency)
+	if currency == "" {
+		currency = defaultCurrency
 	}
-	// build item input request
-	input := &dynamodb.PutItemInput{
-		Item:      acctMap,
-		TableName: aws.String("BankAccounts"),
+	if _, ok := currencyMinorUnits[currency]; !ok {
+		invalid := &validationError{}
+		invalid.Add("currency", fmt.Sprintf("%q is not a supported ISO 4217 currency", a.CurrentBalance.Currency))
+		return nil, invalid
 	}
-	// save item to db
-	req := boldlygo.DynamoDbSvc().PutItemRequest(input)
-	_, err = req.Send()
+	a.AccountId = uuid.NewV4().String() // set unique account id
+	a.Version = 1                       // first version of the record
+	a.CurrentBalance = Money{Currency: currency}
+	err := boldlygo.Repositories().BankAccounts().Save(a)
 	if err != nil {
 		return nil, err
 	}
@@ -216,205 +384,66 @@ func (a *BankAccount) Save() (*BankAccount, error) {
 }
 
 /*
-Update a BankAccount record in DynamoDB
+Update the editable fields of a BankAccount record; the balance is not one of them.
+Fails with ErrConflict if the record was changed since the version of the BankAccount was read.
+Publish the updated BankAccount to the balanceChanged subscribers
 */
 func (a *BankAccount) Update() (*BankAccount, error) {
-	// Build Update expression to set which fields should be updated
-	update := expression.
-		Set(expression.Name("accountName"), expression.Value(a.AccountName)).
-		Set(expression.Name("accountType"), expression.Value(a.AccountType)).
-		Set(expression.Name("last4"), expression.Value(a.Last4)).
-		Set(expression.Name("currentBalance"), expression.Value(a.CurrentBalance))
-	// build update expression with update fields set
-	expr, err := expression.NewBuilder().
-		WithUpdate(update).
-		Build()
+	err := boldlygo.Repositories().BankAccounts().Update(a)
 	if err != nil {
 		return nil, err
 	}
-	// build update BankAccount item input
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("BankAccounts"),
-		Key: map[string]dynamodb.AttributeValue{
-			"bankId": {
-				S: aws.String(a.BankId),
-			},
-			"accountId": {
-				S: aws.String(a.AccountId),
-			},
-		},
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		ReturnValues:              dynamodb.ReturnValueNone,
-		UpdateExpression:          expr.Update(),
-	}
-	req := boldlygo.DynamoDbSvc().UpdateItemRequest(input) // build update item request
-	_, err = req.Send()                                    // send update item request; expect nothing back
-	if err != nil {
-		return nil, err
+	// return and publish the stored record, as the update does not carry the balance
+	stored, err := GetUserBankAccount(uuid.FromStringOrNil(a.BankId), uuid.FromStringOrNil(a.AccountId))
+	if err != nil || stored == nil {
+		return a, err
 	}
-	return a, nil // return BankAccount
+	boldlygo.PubSub().Publish(balanceChangedTopic(a.AccountId), stored)
+	return stored, nil
 }
 
 /*
-Update a BankAccount record in DynamoDB.
-Update the CurrentBalance as the result of a Transaction occurring on the BankAccount
+Get a list of Cards associated to the BankAccount
 */
-func (a *BankAccount) UpdateCurrentBalance(txnAmount float64, txnType string) error {
-	// calculate the new Current Balance
-	currBalance := a.CurrentBalance
-	if txnType == "CREDIT" {
-		txnAmount = math.Abs(txnAmount) * -1 // if transaction type is CREDIT, it needs to subtracted from the current balance of the BankAccount
-	}
-	currBalance += txnAmount
-	// Build Update expression to set which fields should be updated
-	update := expression.Set(expression.Name("currentBalance"), expression.Value(currBalance))
-	// build update expression with update fields set
-	expr, err := expression.NewBuilder().
-		WithUpdate(update).
-		Build()
-	if err != nil {
-		return err
-	}
-	// build update BankAccount item input
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("BankAccounts"),
-		Key: map[string]dynamodb.AttributeValue{
-			"bankId": {
-				S: aws.String(a.BankId),
-			},
-			"accountId": {
-				S: aws.String(a.AccountId),
-			},
-		},
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		ReturnValues:              dynamodb.ReturnValueNone,
-		UpdateExpression:          expr.Update(),
-	}
-	req := boldlygo.DynamoDbSvc().UpdateItemRequest(input) // build update item request
-	_, err = req.Send()                                    // send update item request; expect nothing back
-	if err != nil {
-		return err
-	}
-	return nil
+func GetAccountCards(accountId uuid.UUID) ([]*Card, error) {
+	return boldlygo.Repositories().Cards().FindByAccountId(accountId)
 }
 
 /*
-Get a list of Cards associated to the BankAccount
+Get a page of the Cards associated to the BankAccount, in Card key order
 */
-func GetAccountCards(accountId uuid.UUID) ([]*Card, error) {
-	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String())) // build find Card records by AccountId filter expression
-	expr, err := expression.NewBuilder().
-		WithKeyCondition(keyCond).
-		Build()
-	if err != nil {
-		return nil, err
-	}
-	params := &dynamodb.QueryInput{
-		TableName:                 aws.String("Cards"),
-		KeyConditionExpression:    expr.KeyCondition(),
-		ExpressionAttributeValues: expr.Values(),
-		ExpressionAttributeNames:  expr.Names(),
-	}
-	req := boldlygo.DynamoDbSvc().QueryRequest(params) // build dynamodb query with key condition
-	output, err := req.Send()                          // submit the dynamodb query request
-	if err != nil {
-		return nil, err
-	}
-	// unmarshal the return into the object
-	if output.Items == nil {
-		return nil, err
-	}
-	var cards = make([]*Card, 0)
-	err = dynamodbattribute.UnmarshalListOfMaps(output.Items, &cards) // unmarshal the found items into a list of cards
-	if err != nil {
-		return nil, err
-	}
-	return cards, nil
+func GetAccountCardsPage(accountId uuid.UUID, page PageRequest) (*CardPage, error) {
+	return boldlygo.Repositories().Cards().FindPageByAccountId(accountId, page)
+}
+
+/*
+Count the Cards associated to the BankAccount
+*/
+func CountAccountCards(accountId uuid.UUID) (int, error) {
+	return boldlygo.Repositories().Cards().CountByAccountId(accountId)
 }
 
 /*
 Find a unique Card record by the accountId, cardId composite key
 */
 func GetAccountCard(accountId, cardId uuid.UUID) (*Card, error) {
-	req := boldlygo.DynamoDbSvc().GetItemRequest(&dynamodb.GetItemInput{
-		TableName: aws.String("Cards"),
-		Key: map[string]dynamodb.AttributeValue{
-			"accountId": {
-				S: aws.String(accountId.String()),
-			},
-			"cardId": {
-				S: aws.String(cardId.String()),
-			},
-		},
-	})
-	output, err := req.Send()
-	if err != nil {
-		return nil, err
-	}
-	// unmarshal returned map into Card
-	var card = new(Card)
-	err = dynamodbattribute.UnmarshalMap(output.Item, &card)
-	if err != nil {
-		return nil, err
-	}
-	return card, nil
+	return boldlygo.Repositories().Cards().Find(accountId, cardId)
 }
 
 /*
 Find the Card record associated to the BankAccount that is marked as Active
 */
 func GetActiveAccountCard(accountId uuid.UUID) (*Card, error) {
-	filter := expression.
-		Name("accountId").Equal(expression.Value(accountId.String())).
-		And(expression.Name("active").Equal(expression.Value(true))) // build filter for account id and active true
-	expr, err := expression.NewBuilder().
-		WithFilter(filter).
-		Build()
-	if err != nil {
-		return nil, err
-	}
-	params := &dynamodb.ScanInput{
-		TableName:                 aws.String("Cards"),
-		FilterExpression:          expr.Filter(),
-		ExpressionAttributeValues: expr.Values(),
-		ExpressionAttributeNames:  expr.Names(),
-	}
-	req := boldlygo.DynamoDbSvc().ScanRequest(params) // build dynamodb query with key condition
-	output, err := req.Send()                         // submit the dynamodb query request
-	if err != nil {
-		return nil, err
-	}
-	// unmarshal the return into the object
-	if output.Items == nil || len(output.Items) == 0 {
-		return nil, err
-	}
-	var cards = make([]*Card, 0)
-	err = dynamodbattribute.UnmarshalListOfMaps(output.Items, &cards) // unmarshal the found items into a list of cards
-	if err != nil {
-		return nil, err
-	}
-	return cards[0], nil
+	return boldlygo.Repositories().Cards().FindActive(accountId)
 }
 
 /*
 Save a Card record
 */
 func (c *Card) Save() (*Card, error) {
-	c.CardId = uuid.NewV4().String()                // set unique card id
-	cardMap, err := dynamodbattribute.MarshalMap(c) // marshal Card to dynamodbattribute map
-	if err != nil {
-		return nil, err
-	}
-	// build item input request
-	input := &dynamodb.PutItemInput{
-		Item:      cardMap,
-		TableName: aws.String("Cards"),
-	}
-	// save item to db
-	req := boldlygo.DynamoDbSvc().PutItemRequest(input)
-	_, err = req.Send()
+	c.CardId = uuid.NewV4().String() // set unique card id
+	c.Version = 1                    // first version of the record
+	err := boldlygo.Repositories().Cards().Save(c)
 	if err != nil {
 		return nil, err
 	}
@@ -422,36 +451,11 @@ func (c *Card) Save() (*Card, error) {
 }
 
 /*
-Update an existing Card record
+Update an existing Card record.
+Fails with ErrConflict if the record was changed since the version of the Card was read
 */
 func (c *Card) Inactivate() (*Card, error) {
-	// Set the active field on the card to false
-	update := expression.Set(expression.Name("active"), expression.Value(false))
-	// build update expression with update fields set
-	expr, err := expression.NewBuilder().
-		WithUpdate(update).
-		Build()
-	if err != nil {
-		return nil, err
-	}
-	// build update BankAccount item input
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("Cards"),
-		Key: map[string]dynamodb.AttributeValue{
-			"accountId": {
-				S: aws.String(c.AccountId),
-			},
-			"cardId": {
-				S: aws.String(c.CardId),
-			},
-		},
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		ReturnValues:              dynamodb.ReturnValueNone,
-		UpdateExpression:          expr.Update(),
-	}
-	req := boldlygo.DynamoDbSvc().UpdateItemRequest(input) // build update item request
-	_, err = req.Send()                                    // send update item request; expect nothing back
+	err := boldlygo.Repositories().Cards().Inactivate(c)
 	if err != nil {
 		return nil, err
 	}
@@ -459,105 +463,89 @@ func (c *Card) Inactivate() (*Card, error) {
 }
 
 /*
-Get a list of all Transactions associated to the BankAccount
+Get a list of all Transactions associated to the BankAccount, in date order
 */
 func GetAccountTransactions(accountId uuid.UUID) ([]*Transaction, error) {
-	keyCond := expression.Key("accountId").Equal(expression.Value(accountId.String())) // build find Transaction records by AccountId filter expression
-	expr, err := expression.NewBuilder().
-		WithKeyCondition(keyCond).
-		Build()
+	page, err := boldlygo.Repositories().Transactions().FindPageByAccountId(accountId, TransactionFilter{}, PageRequest{})
 	if err != nil {
 		return nil, err
 	}
-	params := &dynamodb.QueryInput{
-		TableName:                 aws.String("Transactions"),
-		KeyConditionExpression:    expr.KeyCondition(),
-		ExpressionAttributeValues: expr.Values(),
-		ExpressionAttributeNames:  expr.Names(),
-	}
-	req := boldlygo.DynamoDbSvc().QueryRequest(params) // build dynamodb query with key condition
-	output, err := req.Send()                          // submit the dynamodb query request
-	if err != nil {
+	return page.Transactions, nil
+}
+
+/*
+Get a page of the Transactions associated to the BankAccount that match the filter, in date order
+*/
+func GetAccountTransactionsPage(accountId uuid.UUID, filter TransactionFilter, page PageRequest) (*TransactionPage, error) {
+	if err := validateTransactionFilter(filter); err != nil {
 		return nil, err
 	}
-	// unmarshal the return into the object
-	if output.Items == nil {
-		return nil, err
+	return boldlygo.Repositories().Transactions().FindPageByAccountId(accountId, filter, page)
+}
+
+/*
+Count the Transactions associated to the BankAccount that match the filter
+*/
+func CountAccountTransactions(accountId uuid.UUID, filter TransactionFilter) (int, error) {
+	if err := validateTransactionFilter(filter); err != nil {
+		return 0, err
 	}
-	var transactions = make([]*Transaction, 0)
-	err = dynamodbattribute.UnmarshalListOfMaps(output.Items, &transactions) // unmarshal the found items into a list of transactions
-	if err != nil {
-		return nil, err
+	return boldlygo.Repositories().Transactions().CountByAccountId(accountId, filter)
+}
+
+// Check the ranges of the filter are not empty; an amount range must be in a single currency
+func validateTransactionFilter(filter TransactionFilter) error {
+	if !filter.DateFrom.IsZero() && !filter.DateTo.IsZero() && !filter.DateFrom.Before(filter.DateTo) {
+		return ErrInvalidDateRange
+	}
+	if filter.AmountMin != nil && filter.AmountMax != nil &&
+		(filter.AmountMin.Currency != filter.AmountMax.Currency || filter.AmountMin.Amount > filter.AmountMax.Amount) {
+		return ErrInvalidAmountRange
 	}
-	sort.Slice(transactions, func(i, j int) bool {
-		return transactions[i].TransactionDate.Before(transactions[j].TransactionDate)
-	})
-	return transactions, nil
+	return nil
 }
 
 /*
 Find a unique BankAccount Transaction record by the accountId and transactionId composite key
 */
 func GetAccountTransaction(accountId, transactionId uuid.UUID) (*Transaction, error) {
-	req := boldlygo.DynamoDbSvc().GetItemRequest(&dynamodb.GetItemInput{
-		TableName: aws.String("Transactions"),
-		Key: map[string]dynamodb.AttributeValue{
-			"accountId": {
-				S: aws.String(accountId.String()),
-			},
-			"transactionId": {
-				S: aws.String(transactionId.String()),
-			},
-		},
-	})
-	output, err := req.Send()
-	if err != nil {
-		return nil, err
-	}
-	// unmarshal returned map into Transaction
-	var txn = new(Transaction)
-	err = dynamodbattribute.UnmarshalMap(output.Item, &txn)
-	if err != nil {
-		return nil, err
-	}
-	return txn, nil
+	return boldlygo.Repositories().Transactions().Find(accountId, transactionId)
 }
 
 /*
 Save a Transaction to the BankAccount.
-Update the CurrentBalance on the BankAccount as a result of the Transaction
+Update the CurrentBalance on the BankAccount as a result of the Transaction.
+The Transaction record and the balance change are written together; either both are applied or neither is.
+The Transaction amount must be in the currency of the BankAccount.
+Publish the Transaction to the transactionPosted subscribers, and the BankAccount to the balanceChanged subscribers
 */
 func (t *Transaction) Save(bankId uuid.UUID) (*Transaction, error) {
-	t.TransactionId = uuid.NewV4().String()        // set unique transaction id
-	txnMap, err := dynamodbattribute.MarshalMap(t) // marshal Transaction to dynamodbattribute map
-	if err != nil {
+	if _, err := uuid.FromString(t.AccountId); err != nil {
 		return nil, err
 	}
-	// build item input request
-	input := &dynamodb.PutItemInput{
-		Item:      txnMap,
-		TableName: aws.String("Transactions"),
+	t.TransactionId = uuid.NewV4().String() // set unique transaction id
+	// calculate the change to the Current Balance
+	balanceChange := t.Amount
+	if t.TransactionType == "CREDIT" {
+		balanceChange = t.Amount.Abs().Negate() // if transaction type is CREDIT, it needs to subtracted from the current balance of the BankAccount
 	}
-	// save item to db
-	req := boldlygo.DynamoDbSvc().PutItemRequest(input)
-	_, err = req.Send()
-	if err != nil {
-		return nil, err
-	}
-	// update the current balance of the BankAccount
-	acctId, err := uuid.FromString(t.AccountId)
-	if err != nil {
-		return nil, err
-	}
-	// get the BankAccount record
-	bankAccount, err := GetUserBankAccount(bankId, acctId)
-	if err != nil {
-		return nil, err
-	}
-	err = bankAccount.UpdateCurrentBalance(t.Amount, t.TransactionType)
+	err := boldlygo.Repositories().Transactions().Post(bankId, t, balanceChange)
 	if err != nil {
 		return nil, err
 	}
+	posted := *t
+	boldlygo.PubSub().Publish(transactionPostedTopic(t.AccountId), &posted)
+	publishBalanceChanged(bankId, t.AccountId)
 	// return the Transaction
 	return t, nil
 }
+
+// Publish the BankAccount with its balance after a change to the balanceChanged subscribers. Failures are logged
+func publishBalanceChanged(bankId uuid.UUID, accountId string) {
+	account, err := GetUserBankAccount(bankId, uuid.FromStringOrNil(accountId))
+	if err != nil || account == nil {
+		fmt.Println(fmt.Sprintf("Unable to publish the balance of BankAccount %s: %v", accountId, err))
+		return
+	}
+	boldlygo.PubSub().Publish(balanceChangedTopic(accountId), account)
+}
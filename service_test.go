@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+// The problems with each input field are returned together
+func TestRegisterValidatesEveryField(t *testing.T) {
+	_, err := (&User{Email: "not an email", Name: "  ", Pwd: "short"}).Register()
+	invalid, ok := err.(*validationError)
+	if !ok {
+		t.Fatalf("registering invalid input failed with %v; want a validationError", err)
+	}
+	fields := map[string]bool{}
+	for _, f := range invalid.fields {
+		fields[f.Field] = true
+	}
+	if !fields["email"] || !fields["name"] || !fields["pwd"] {
+		t.Errorf("the problems are with %v; want email, name and pwd", fields)
+	}
+}
+
+// An email is registered once whatever its case, and the user signs in with it in any case
+func TestRegisterEmailIgnoresCase(t *testing.T) {
+	user, err := (&User{Email: " Case@Example.com ", Name: "Case", Pwd: testPwd}).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "case@example.com" || user.BankUserId != "case@example.com" {
+		t.Errorf("the user was registered as %q, %q; want the lower-cased email", user.Email, user.BankUserId)
+	}
+	for _, email := range []string{"case@example.com", "CASE@example.com"} {
+		if _, err := (&User{Email: email, Name: "Case", Pwd: testPwd}).Register(); err != ErrUserExists {
+			t.Errorf("registering %s again failed with %v; want ErrUserExists", email, err)
+		}
+	}
+	if auth := Authenticate("Case@EXAMPLE.com", testPwd, "192.0.2.1"); !auth.Success {
+		t.Errorf("unable to sign in with the email in another case: %s", auth.Message)
+	}
+	if user, problem := signInForConsent("CASE@example.com", testPwd, "", "192.0.2.1"); user == nil {
+		t.Errorf("unable to sign in on the consent page with the email in another case: %s", problem)
+	}
+}
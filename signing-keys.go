@@ -0,0 +1,209 @@
+/*
+Asymmetric JWT Signing Keys.
+
+	The signing keys are configured in the JSON file at AUTH_KEYS_FILE:
+		[
+			{"kid": "2018-10", "privateKeyFile": "2018-10.pem", "activateAt": "2018-10-01T00:00:00Z", "retireAt": "2018-11-01T00:00:00Z"},
+			{"kid": "2018-11", "privateKeyFile": "2018-11.pem", "activateAt": "2018-11-01T00:00:00Z"}
+		]
+	Each key is an RSA (RS256) or EC P-256 (ES256) private key in PEM format; the algorithm follows the key type.
+	Relative privateKeyFile paths are resolved from the directory of the keys file.
+
+	Rotation is scheduled by the activateAt and retireAt times of the keys:
+		- tokens are signed with the most recently activated key that is not retired, identified by the kid header
+		- a key is published in the JWKS before it is activated, so verifiers can fetch it ahead of time
+		- a retired key no longer signs tokens, but keeps validating them until every token it signed has expired
+*/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const authKeysFileKey = "AUTH_KEYS_FILE"
+
+// A public key in the JSON Web Key format (RFC 7517), published for other services to verify tokens
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // EC curve
+	X   string `json:"x,omitempty"`   // EC point x coordinate
+	Y   string `json:"y,omitempty"`   // EC point y coordinate
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// A key entry of the AUTH_KEYS_FILE
+type signingKeyConfig struct {
+	Kid            string     `json:"kid"`
+	PrivateKeyFile string     `json:"privateKeyFile"`
+	ActivateAt     time.Time  `json:"activateAt"`
+	RetireAt       *time.Time `json:"retireAt"` // optional; the key signs tokens until it is replaced or retired
+}
+
+type signingKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+	activateAt time.Time
+	retireAt   time.Time // zero if the key is not scheduled to retire
+}
+
+type signingKeySet struct {
+	keys           []*signingKey
+	maxTokenExpiry time.Duration // the longest lifetime of a token; how long a retired key keeps validating
+}
+
+// Load the signing keys configured in the keys file
+func loadSigningKeys(path string, maxTokenExpiry time.Duration) (*signingKeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []signingKeyConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", authKeysFileKey, path, err)
+	}
+	set := &signingKeySet{maxTokenExpiry: maxTokenExpiry}
+	seen := map[string]bool{}
+	for _, config := range configs {
+		if config.Kid == "" || seen[config.Kid] {
+			return nil, fmt.Errorf("invalid %s %s: every key needs a unique kid", authKeysFileKey, path)
+		}
+		seen[config.Kid] = true
+		keyFile := config.PrivateKeyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(path), keyFile)
+		}
+		key, err := loadSigningKey(config.Kid, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key.activateAt = config.ActivateAt
+		if config.RetireAt != nil {
+			key.retireAt = *config.RetireAt
+		}
+		set.keys = append(set.keys, key)
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("invalid %s %s: no keys configured", authKeysFileKey, path)
+	}
+	return set, nil
+}
+
+// Read the PEM private key and pick the signing method from the key type
+func loadSigningKey(kid, keyFile string) (*signingKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s: %s is not PEM encoded", kid, keyFile)
+	}
+	// accept PKCS8 as well as the key type specific PKCS1 (RSA) and SEC1 (EC) encodings
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if privateKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("signing key %s: %s is not an RSA or EC private key", kid, keyFile)
+			}
+		}
+	}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, privateKey: k, publicKey: &k.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("signing key %s: only P-256 EC keys are supported", kid)
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodES256, privateKey: k, publicKey: &k.PublicKey}, nil
+	}
+	return nil, fmt.Errorf("signing key %s: unsupported key type %T", kid, privateKey)
+}
+
+// Check if the key signs tokens at the time
+func (k *signingKey) active(now time.Time) bool {
+	return !now.Before(k.activateAt) && (k.retireAt.IsZero() || now.Before(k.retireAt))
+}
+
+// Check if tokens signed by the key may still be unexpired at the time
+func (k *signingKey) published(now time.Time, maxTokenExpiry time.Duration) bool {
+	return k.retireAt.IsZero() || now.Before(k.retireAt.Add(maxTokenExpiry))
+}
+
+// The key to sign tokens with: the most recently activated key that is not retired
+func (s *signingKeySet) current(now time.Time) (*signingKey, error) {
+	var current *signingKey
+	for _, k := range s.keys {
+		if k.active(now) && (current == nil || k.activateAt.After(current.activateAt)) {
+			current = k
+		}
+	}
+	if current == nil {
+		return nil, errors.New("no signing key is active. check the activateAt and retireAt times of the signing keys")
+	}
+	return current, nil
+}
+
+// The key with the kid, if tokens signed with it can still be valid
+func (s *signingKeySet) find(kid string, now time.Time) *signingKey {
+	for _, k := range s.keys {
+		if k.kid == kid && k.published(now, s.maxTokenExpiry) {
+			return k
+		}
+	}
+	return nil
+}
+
+// The public keys that are, or will be, used to sign unexpired tokens
+func (s *signingKeySet) JWKS(now time.Time) JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, k := range s.keys {
+		if !k.published(now, s.maxTokenExpiry) {
+			continue
+		}
+		jwk := JSONWebKey{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+		switch pub := k.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = pub.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padCoordinate(pub.X, pub.Curve))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(pub.Y, pub.Curve))
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// EC coordinates are encoded with the full byte length of the curve, including leading zeros
+func padCoordinate(n *big.Int, curve elliptic.Curve) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
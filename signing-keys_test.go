@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Write the keys file and a PEM private key for each key config into the directory; returns the keys file path
+func writeSigningKeys(t *testing.T, dir string, configs []signingKeyConfig, privateKeys []interface{}) string {
+	t.Helper()
+	for i, config := range configs {
+		var block *pem.Block
+		switch k := privateKeys[i].(type) {
+		case *rsa.PrivateKey:
+			block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, config.PrivateKeyFile), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A retired key, the current key and the next key, as a keys file rotates them
+func loadRotatingKeys(t *testing.T, now time.Time) *signingKeySet {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "boldly-go-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retiredAt := now.Add(-time.Hour)
+	path := writeSigningKeys(t, dir, []signingKeyConfig{
+		{Kid: "retired", PrivateKeyFile: "retired.pem", ActivateAt: now.Add(-2 * time.Hour), RetireAt: &retiredAt},
+		{Kid: "current", PrivateKeyFile: "current.pem", ActivateAt: now.Add(-time.Hour)},
+		{Kid: "next", PrivateKeyFile: "next.pem", ActivateAt: now.Add(time.Hour)},
+	}, []interface{}{rsaKey, ecKey, rsaKey})
+	keys, err := loadSigningKeys(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// The latest activated key signs; the next key is published before it activates, the retired key until its tokens expire
+func TestSigningKeyRotation(t *testing.T) {
+	now := time.Now()
+	keys := loadRotatingKeys(t, now)
+	current, err := keys.current(now)
+	if err != nil || current.kid != "current" || current.method != jwt.SigningMethodES256 {
+		t.Fatalf("the current key is %+v, %v; want the ES256 key current", current, err)
+	}
+	if next, _ := keys.current(now.Add(2 * time.Hour)); next.kid != "next" {
+		t.Errorf("once activated, the key %s signs; want next", next.kid)
+	}
+	kids := func(at time.Time) map[string]bool {
+		published := map[string]bool{}
+		for _, jwk := range keys.JWKS(at).Keys {
+			published[jwk.Kid] = true
+		}
+		return published
+	}
+	if published := kids(now); !published["retired"] || !published["current"] || !published["next"] || len(published) != 3 {
+		t.Errorf("the JWKS publishes %v; want retired, current and next", published)
+	}
+	later := now.Add(24 * time.Hour)
+	if published := kids(later); published["retired"] || keys.find("retired", later) != nil {
+		t.Error("the retired key is still published after every token it signed has expired")
+	}
+}
+
+// Tokens are signed by the current key, and verify with the public key published for its kid in the JWKS
+func TestSignedTokensVerifyWithJWKS(t *testing.T) {
+	auth := &authSvc{signingKeys: loadRotatingKeys(t, time.Now())}
+	token, _, err := auth.signToken(jwt.MapClaims{"email": "jwks@example.com"}, tokenTypeAccess, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := auth.ValidateToken(bearerTokenKey + *token); err != nil || principal.Email != "jwks@example.com" {
+		t.Errorf("the signed token validated as %+v, %v", principal, err)
+	}
+	published := map[string]JSONWebKey{}
+	for _, jwk := range auth.JWKS().Keys {
+		published[jwk.Kid] = jwk
+	}
+	parsed, err := jwt.Parse(*token, func(token *jwt.Token) (interface{}, error) {
+		jwk := published[token.Header["kid"].(string)]
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	})
+	if err != nil || !parsed.Valid || parsed.Header["kid"] != "current" {
+		t.Errorf("the token did not verify with the published key: %v", err)
+	}
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email": "jwks@example.com", "typ": tokenTypeAccess, "exp": time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ValidateToken(bearerTokenKey + hs256); err == nil {
+		t.Error("an HS256 token validated when only signing keys are configured")
+	}
+}
+
+// The JWKS endpoint publishes the keys as JSON; none when tokens are signed with the auth secret
+func TestJwksHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var set JSONWebKeySet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil || set.Keys == nil || len(set.Keys) != 0 {
+		t.Errorf("the JWKS endpoint returned %q, %v; want an empty key set", w.Body.String(), err)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("the JWKS endpoint returned %s; want application/json", contentType)
+	}
+}
@@ -0,0 +1,442 @@
+/*
+GraphQL Subscriptions over WebSocket, at /subscriptions next to /graphql.
+
+	Both GraphQL over WebSocket subprotocols are spoken; the client picks one with the Sec-WebSocket-Protocol header:
+		- graphql-transport-ws: the protocol of the graphql-ws library
+		- graphql-ws: the older protocol of subscriptions-transport-ws (Apollo)
+
+	The client authenticates in the connection_init payload, with the Authorization header it would send to /graphql:
+		{"type": "connection_init", "payload": {"Authorization": "Bearer <token>"}}
+	An auth token, app access token or API key may be used. The connection is closed if the payload does not
+	authenticate the client, or no connection_init is sent within 10 seconds.
+
+	A subscription operation selects a single field of the Subscription type:
+		subscription { transactionPosted(accountId: "...") { transactionId amount } }
+	Starting it runs the operation once to authorize it, like a query, and subscribe to the topic of the field
+	(see pubsub.go). Each event published to the topic runs the operation again with the event, and sends the result.
+	The events run as the caller validated when the subscription was authorized, without checking their access to the
+	account again. The subscription is authorized again when the token or API key expires, or the access of the user
+	changes: they are locked, their roles or email change, or an API key or app of theirs is revoked. If it is no longer
+	authorized, the subscription sends the error and completes; the client connects again with a new token.
+	Queries and mutations sent over the connection run once.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+const (
+	protocolGraphqlTransportWs = "graphql-transport-ws"
+	protocolGraphqlWs          = "graphql-ws"
+
+	subscriptionInitTimeout   = 10 * time.Second
+	subscriptionKeepAlive     = 20 * time.Second
+	maxSubscriptionOperations = 100 // per connection
+
+	// the keys of the root object a subscription field resolves from
+	subscribeRootKey = "subscribe" // while subscribing: the func that records the topic of the field
+	topicRootKey     = "topic"     // for an event: the topic it was published to
+	eventRootKey     = "event"     // for an event: the published record
+)
+
+// The close codes of graphql-transport-ws
+const (
+	wsCloseBadRequest        = 4400
+	wsCloseUnauthorized      = 4401
+	wsCloseForbidden         = 4403
+	wsCloseInitTimeout       = 4408
+	wsCloseSubscriberExists  = 4409
+	wsCloseTooManyInitialize = 4429
+)
+
+// A message of either subprotocol
+type wsMessage struct {
+	Id      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type wsIncomingMessage struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// The GraphQL request of an operation
+type wsOperation struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// The message types that differ between the subprotocols
+type wsProtocol struct {
+	start  string // the client starts an operation
+	stop   string // the client stops an operation
+	result string // the server sends a result of an operation
+}
+
+var wsProtocols = map[string]wsProtocol{
+	protocolGraphqlTransportWs: {start: "subscribe", stop: "complete", result: "next"},
+	protocolGraphqlWs:          {start: "start", stop: "stop", result: "data"},
+}
+
+// A WebSocket connection of a client, and the operations it is running
+type subscriptionSession struct {
+	conn     *wsConn
+	protocol string
+	ip       string
+
+	ctx    context.Context // carries the Authorization of the client once the connection is initialized
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	operations map[string]context.CancelFunc // stops the running operations, by id
+}
+
+// Serve the GraphQL subscriptions of a client over WebSocket
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, protocol, err := upgradeWebSocket(w, r, []string{protocolGraphqlTransportWs, protocolGraphqlWs})
+	if err != nil {
+		return // the error response was written
+	}
+	s := &subscriptionSession{conn: conn, protocol: protocol, ip: requestIP(r), operations: map[string]context.CancelFunc{}}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	go s.keepAlive(s.ctx)
+	s.serve()
+}
+
+// Read the messages of the client until the connection closes
+func (s *subscriptionSession) serve() {
+	protocol := wsProtocols[s.protocol]
+	initialized := false
+	s.conn.SetReadDeadline(time.Now().Add(subscriptionInitTimeout))
+	for {
+		data, err := s.conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !initialized {
+				s.conn.Close(wsCloseInitTimeout, "Connection initialisation timeout")
+				return
+			}
+			s.conn.Close(wsCloseNormal, "")
+			return
+		}
+		var msg wsIncomingMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			s.conn.Close(wsCloseBadRequest, "Invalid message received")
+			return
+		}
+		switch {
+		case msg.Type == "connection_init":
+			if initialized {
+				s.conn.Close(wsCloseTooManyInitialize, "Too many initialisation requests")
+				return
+			}
+			if !s.initialize(msg.Payload) {
+				return
+			}
+			initialized = true
+			s.conn.SetReadDeadline(time.Time{})
+		case msg.Type == "ping" && s.protocol == protocolGraphqlTransportWs:
+			s.send(wsMessage{Type: "pong"})
+		case msg.Type == "pong" && s.protocol == protocolGraphqlTransportWs:
+		case msg.Type == "connection_terminate" && s.protocol == protocolGraphqlWs:
+			s.conn.Close(wsCloseNormal, "")
+			return
+		case !initialized:
+			s.conn.Close(wsCloseUnauthorized, "Unauthorized")
+			return
+		case msg.Type == protocol.start:
+			if !s.start(msg.Id, msg.Payload) {
+				return
+			}
+		case msg.Type == protocol.stop:
+			s.stop(msg.Id)
+		default:
+			s.conn.Close(wsCloseBadRequest, fmt.Sprintf("Unexpected message of type %q", msg.Type))
+			return
+		}
+	}
+}
+
+// Authenticate the client with the Authorization of the connection_init payload, and acknowledge it
+func (s *subscriptionSession) initialize(payload json.RawMessage) bool {
+	var params map[string]interface{}
+	json.Unmarshal(payload, &params)
+	var authorization interface{}
+	for key, value := range params {
+		if strings.EqualFold(key, "Authorization") {
+			authorization = value
+		}
+	}
+	ctx := context.WithValue(s.ctx, "Authorization", authorization)
+	ctx = context.WithValue(ctx, "ClientIP", s.ip)
+	if _, err := callerPrincipal(ctx); err != nil {
+		if s.protocol == protocolGraphqlWs {
+			s.send(wsMessage{Type: "connection_error", Payload: map[string]string{"message": err.Error()}})
+		}
+		s.conn.Close(wsCloseForbidden, "Forbidden")
+		return false
+	}
+	s.ctx = ctx
+	s.send(wsMessage{Type: "connection_ack"})
+	if s.protocol == protocolGraphqlWs {
+		s.send(wsMessage{Type: "ka"})
+	}
+	return true
+}
+
+/*
+Start the operation with the id.
+
+	A query or mutation runs once, and completes. A subscription runs once to subscribe to the topic of its field, then
+	again for every event published to it until the client stops it, or the connection closes.
+	Returns false if the connection was closed, because the id is already running
+*/
+func (s *subscriptionSession) start(id string, payload json.RawMessage) bool {
+	s.mu.Lock()
+	_, running := s.operations[id]
+	count := len(s.operations)
+	s.mu.Unlock()
+	if running {
+		s.conn.Close(wsCloseSubscriberExists, fmt.Sprintf("Subscriber for %s already exists", id))
+		return false
+	}
+	var op wsOperation
+	if err := json.Unmarshal(payload, &op); err != nil || op.Query == "" {
+		s.fail(id, gqlerrors.FormatErrors(fmt.Errorf("the payload must have a query")))
+		return true
+	}
+	operationType, err := operationTypeOf(op)
+	if err != nil {
+		s.fail(id, gqlerrors.FormatErrors(err))
+		return true
+	}
+	if err := boldlygo.QueryLimits().Check(s.ctx, op.Query, op.OperationName, op.Variables); err != nil {
+		s.fail(id, []gqlerrors.FormattedError{formatCodedError(err)})
+		return true
+	}
+	if operationType != ast.OperationTypeSubscription {
+		s.send(wsMessage{Id: id, Type: wsProtocols[s.protocol].result, Payload: s.execute(s.ctx, op, nil)})
+		s.send(wsMessage{Id: id, Type: "complete"})
+		return true
+	}
+	if count >= maxSubscriptionOperations {
+		s.fail(id, gqlerrors.FormatErrors(fmt.Errorf("a connection can run at most %d subscriptions", maxSubscriptionOperations)))
+		return true
+	}
+	var topics []string
+	principal, result := s.authorize(s.ctx, op, func(topic string) { topics = append(topics, topic) })
+	if result.HasErrors() {
+		s.fail(id, result.Errors)
+		return true
+	}
+	if len(topics) != 1 {
+		s.fail(id, gqlerrors.FormatErrors(fmt.Errorf("a subscription must select exactly one field")))
+		return true
+	}
+	events, unsubscribe := boldlygo.PubSub().Subscribe(topics[0])
+	accessChanges, unsubscribeAccess := boldlygo.PubSub().Subscribe(accessChangedTopic(principal.Email))
+	ctx, stop := context.WithCancel(s.ctx)
+	s.mu.Lock()
+	s.operations[id] = stop
+	s.mu.Unlock()
+	go func() {
+		defer unsubscribe()
+		defer unsubscribeAccess()
+		expiry := expiryTimer(principal)
+		defer expiry.Stop()
+		for {
+			eventCtx := context.WithValue(ctx, "Principal", principal)
+			select {
+			case <-ctx.Done():
+				return
+			case <-accessChanges:
+			case <-expiry.C:
+			case event := <-events:
+				result := s.execute(eventCtx, op, map[string]interface{}{topicRootKey: topics[0], eventRootKey: event})
+				if ctx.Err() != nil {
+					return // stopped while the event ran
+				}
+				s.send(wsMessage{Id: id, Type: wsProtocols[s.protocol].result, Payload: result})
+				continue
+			}
+			// the access of the caller changed or expired: authorize the subscription again
+			var reauthorized *Principal
+			if reauthorized, result = s.authorize(ctx, op, func(string) {}); ctx.Err() != nil {
+				return
+			}
+			if result.HasErrors() {
+				s.stop(id)
+				s.send(wsMessage{Id: id, Type: wsProtocols[s.protocol].result, Payload: result})
+				s.send(wsMessage{Id: id, Type: "complete"})
+				return
+			}
+			principal = reauthorized
+			expiry.Stop()
+			expiry = expiryTimer(principal)
+		}
+	}()
+	return true
+}
+
+/*
+Authorize the subscription operation as the client: run it to subscribe, which checks their access to its field.
+Returns the validated principal of the client, and the result of the run; its errors are why it is not authorized
+*/
+func (s *subscriptionSession) authorize(ctx context.Context, op wsOperation, subscribe func(string)) (*Principal, *graphql.Result) {
+	result := s.execute(ctx, op, map[string]interface{}{subscribeRootKey: subscribe})
+	if result.HasErrors() {
+		return nil, result
+	}
+	principal, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, &graphql.Result{Errors: []gqlerrors.FormattedError{formatCodedError(err)}}
+	}
+	return principal, result
+}
+
+// A timer that fires when the token or API key of the principal expires; it never fires if they do not expire
+func expiryTimer(principal *Principal) *time.Timer {
+	if principal.ExpiresAt == 0 {
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		return timer
+	}
+	return time.NewTimer(time.Until(time.Unix(principal.ExpiresAt, 0)))
+}
+
+// Stop the operation with the id, if it is running
+func (s *subscriptionSession) stop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.operations[id]; ok {
+		stop()
+		delete(s.operations, id)
+	}
+}
+
+// Run the operation with the root object, as the client of the context
+func (s *subscriptionSession) execute(ctx context.Context, op wsOperation, root map[string]interface{}) *graphql.Result {
+	return graphql.Do(graphql.Params{
+		Schema:         *boldlygo.GraphQLSchema(),
+		RequestString:  op.Query,
+		RootObject:     root,
+		VariableValues: op.Variables,
+		OperationName:  op.OperationName,
+		Context:        ctx,
+	})
+}
+
+// Send the errors that stopped the operation from starting
+func (s *subscriptionSession) fail(id string, errs []gqlerrors.FormattedError) {
+	if s.protocol == protocolGraphqlTransportWs {
+		s.send(wsMessage{Id: id, Type: "error", Payload: errs})
+		return
+	}
+	// subscriptions-transport-ws sends the errors as the result, then completes the operation
+	s.send(wsMessage{Id: id, Type: "data", Payload: &graphql.Result{Errors: errs}})
+	s.send(wsMessage{Id: id, Type: "complete"})
+}
+
+func (s *subscriptionSession) send(msg wsMessage) {
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = s.conn.WriteMessage(data)
+	}
+	if err != nil && err != errWsClosed {
+		fmt.Println(fmt.Sprintf("Unable to send the %s message of a subscription: %v", msg.Type, err))
+	}
+}
+
+// Ping the client until the connection closes; a client that is gone fails the write, which closes the connection
+func (s *subscriptionSession) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(subscriptionKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.protocol == protocolGraphqlWs {
+				s.send(wsMessage{Type: "ka"})
+			}
+			if err := s.conn.Ping(); err != nil {
+				s.conn.Close(wsCloseNormal, "")
+				return
+			}
+		}
+	}
+}
+
+// Find the type of the operation the request runs; the request is validated when it runs
+func operationTypeOf(op wsOperation) (string, error) {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(op.Query), Name: "GraphQL request"})})
+	if err != nil {
+		return "", err
+	}
+	var operations []*ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			if op.OperationName == "" || (operation.Name != nil && operation.Name.Value == op.OperationName) {
+				operations = append(operations, operation)
+			}
+		}
+	}
+	if len(operations) != 1 {
+		return "", fmt.Errorf("the request must have one operation, or the operationName of one")
+	}
+	return operations[0].Operation, nil
+}
+
+/*
+Resolve a subscription field of an accountId to the events published to the topic of the account.
+The caller's access to the account is checked when the subscription is authorized; the events only check the scope
+*/
+func subscriptionField(scope string, topic func(accountId string) string) graphql.FieldResolveFn {
+	resolve := func(p graphql.ResolveParams) (interface{}, error) {
+		return subscriptionEvent(p, topic(p.Args["accountId"].(string)))
+	}
+	authorized := authorizeScope(scope, arg("accountId", ownsAccount), resolve)
+	event := requireScope(scope, resolve)
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if root, _ := p.Source.(map[string]interface{}); root[topicRootKey] != nil {
+			return event(p)
+		}
+		return authorized(p)
+	}
+}
+
+/*
+Resolve a subscription field to the event published to its topic.
+While the operation subscribes, the topic is recorded and the field resolves to nil
+*/
+func subscriptionEvent(p graphql.ResolveParams, topic string) (interface{}, error) {
+	root, _ := p.Source.(map[string]interface{})
+	if subscribe, ok := root[subscribeRootKey].(func(string)); ok {
+		subscribe(topic)
+		return nil, nil
+	}
+	if _, ok := root[topicRootKey]; !ok {
+		return nil, fmt.Errorf("subscriptions are served over WebSocket at /subscriptions")
+	}
+	if root[topicRootKey] != topic {
+		return nil, nil
+	}
+	return root[eventRootKey], nil
+}
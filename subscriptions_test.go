@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connect to the subscriptions endpoint with the subprotocol, and initialize the connection with the Authorization
+func dialSubscriptions(t *testing.T, server *httptest.Server, protocol, authorization string) *websocket.Conn {
+	t.Helper()
+	dialer := &websocket.Dialer{Subprotocols: []string{protocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendWs(t, conn, wsMessage{Type: "connection_init", Payload: map[string]string{"Authorization": authorization}})
+	return conn
+}
+
+func sendWs(t *testing.T, conn *websocket.Conn, msg wsMessage) {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read the next message, skipping keep alives
+func readWs(t *testing.T, conn *websocket.Conn) wsIncomingMessage {
+	t.Helper()
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg wsIncomingMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "ka" && msg.Type != "ping" {
+			return msg
+		}
+	}
+}
+
+// Read the next message, failing unless it is of the type for the operation id
+func expectWs(t *testing.T, conn *websocket.Conn, id, messageType string) wsIncomingMessage {
+	t.Helper()
+	msg := readWs(t, conn)
+	if msg.Id != id || msg.Type != messageType {
+		t.Fatalf("received %s %s %s; want %s %s", msg.Id, msg.Type, msg.Payload, id, messageType)
+	}
+	return msg
+}
+
+// A subscription sends each Transaction posted to the account, and completes once the API key it runs as is revoked
+func TestSubscriptionFollowsAccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(subscriptionsHandler))
+	defer server.Close()
+	email := "subscriber@example.com"
+	authorization := signUp(t, email)
+	account := openAccount(t, authorization, email, "USD")
+	for _, protocol := range []string{protocolGraphqlTransportWs, protocolGraphqlWs} {
+		key, keyId := createApiKey(t, authorization, scopeTransactionsRead)
+		conn := dialSubscriptions(t, server, protocol, "ApiKey "+key)
+		expectWs(t, conn, "", "connection_ack")
+		messages := wsProtocols[protocol]
+		sendWs(t, conn, wsMessage{Id: "1", Type: messages.start, Payload: wsOperation{
+			Query:     `subscription($accountId: String!) { transactionPosted(accountId: $accountId) { amount } }`,
+			Variables: map[string]interface{}{"accountId": account.AccountId},
+		}})
+		// the messages are handled in order, so once the query completes the subscription is running
+		sendWs(t, conn, wsMessage{Id: "2", Type: messages.start, Payload: wsOperation{Query: `{ __typename }`}})
+		expectWs(t, conn, "2", messages.result)
+		expectWs(t, conn, "2", "complete")
+
+		if result := postTransaction(t, authorization, email, account.AccountId, "2024-02-01T10:00:00Z", "4.20 USD", "DEBIT"); result.HasErrors() {
+			t.Fatal(result.Errors)
+		}
+		var posted struct {
+			Data struct{ TransactionPosted struct{ Amount string } }
+		}
+		json.Unmarshal(expectWs(t, conn, "1", messages.result).Payload, &posted)
+		if posted.Data.TransactionPosted.Amount != "4.20 USD" {
+			t.Errorf("%s: the posted Transaction was sent as %+v; want 4.20 USD", protocol, posted.Data)
+		}
+
+		var revoked struct{ RevokeApiKey struct{ KeyId string } }
+		mustDo(t, authorization, `mutation($keyId: String!) { revokeApiKey(keyId: $keyId) { keyId } }`, map[string]interface{}{"keyId": keyId}, &revoked)
+		var denied struct {
+			Errors []struct{ Extensions map[string]interface{} }
+		}
+		json.Unmarshal(expectWs(t, conn, "1", messages.result).Payload, &denied)
+		if len(denied.Errors) != 1 || denied.Errors[0].Extensions["code"] != errCodeUnauthenticated {
+			t.Errorf("%s: the revoked subscription sent %+v; want %s", protocol, denied.Errors, errCodeUnauthenticated)
+		}
+		expectWs(t, conn, "1", "complete")
+		conn.Close()
+	}
+}
+
+// A connection that does not authenticate is closed
+func TestSubscriptionRequiresAuthentication(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(subscriptionsHandler))
+	defer server.Close()
+	conn := dialSubscriptions(t, server, protocolGraphqlTransportWs, "Bearer not-a-token")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, wsCloseForbidden) {
+		t.Errorf("the unauthenticated connection ended with %v; want close %d", err, wsCloseForbidden)
+	}
+}
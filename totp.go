@@ -0,0 +1,124 @@
+/*
+Time-based One-Time Passwords (RFC 6238) and Recovery Codes for two-factor authentication.
+
+	Codes are 6 digits, from an HMAC-SHA1 of the 30 second time step, compatible with the common authenticator apps.
+	A code is accepted for the time step before and after the current one, to allow for clock drift,
+	and each time step can only be used once.
+
+	Recovery codes are single use codes for when the authenticator app is not available.
+	Only their SHA-256 hashes are stored; the codes are random, so a fast hash is enough.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuerKey = "TOTP_ISSUER" // the issuer shown in authenticator apps; defaults to Boldly Go
+
+	defaultTotpIssuer  = "Boldly Go"
+	totpDigits         = 6
+	totpPeriod         = 30 // seconds
+	totpSkew           = 1  // time steps accepted either side of the current one
+	totpSecretBytes    = 20
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate a random TOTP secret, base32 encoded
+func newTotpSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// Build the otpauth URI authenticator apps enroll from, usually shown as a QR code
+func totpUri(issuer, email, secret string) string {
+	label := url.PathEscape(issuer + ":" + email)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// The time step of the time
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// Compute the code of the time step (RFC 4226 HOTP with the time step as the counter)
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	// dynamic truncation: the low nibble of the last byte picks the 4 bytes to use
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Check the code against the base32 secret, for the time steps around now that are after the last used step.
+// Returns the time step the code matched
+func verifyTotpCode(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.Replace(code, " ", "", -1)
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Generate a set of recovery codes, i.e. "k7d2m-x9p4q"; returns the codes and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789" // no 0/o, 1/l/i to avoid misreading
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeLength)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet)))) // uniform, unlike a byte modulo
+			if err != nil {
+				return nil, nil, err
+			}
+			b[j] = alphabet[n.Int64()]
+		}
+		code := string(b[:recoveryCodeLength/2]) + "-" + string(b[recoveryCodeLength/2:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Hash the recovery code, ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The codes of the RFC 6238 SHA1 test vectors, truncated to 6 digits
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(test.unix, 0))); got != test.want {
+			t.Errorf("the code at %d is %s; want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+// A code verifies one step either side of now, and only once: not at or before the last step used
+func TestVerifyTotpCode(t *testing.T) {
+	secret, err := newTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1700000000, 0)
+	current := totpStep(now)
+	tests := []struct {
+		step     int64
+		lastStep int64
+		ok       bool
+	}{
+		{current, 0, true},
+		{current - 1, 0, true},
+		{current + 1, 0, true},
+		{current - 2, 0, false},
+		{current + 2, 0, false},
+		{current, current, false},
+		{current - 1, current - 1, false},
+		{current + 1, current, true},
+	}
+	for _, test := range tests {
+		step, ok := verifyTotpCode(secret, totpCode(key, test.step), test.lastStep, now)
+		if ok != test.ok || (ok && step != test.step) {
+			t.Errorf("the code of step %+d after step %+d verified %v at step %+d; want %v", test.step-current, test.lastStep-current, ok, step-current, test.ok)
+		}
+	}
+}
+
+// Recovery codes hash the same however they are typed, and are unique
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("generated %d codes and %d hashes; want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[hashes[i]] {
+			t.Errorf("the recovery code %s is repeated", code)
+		}
+		seen[hashes[i]] = true
+		typed := " " + code[:3] + " " + code[3:5] + code[6:] + " "
+		if hashRecoveryCode(typed) != hashes[i] || hashRecoveryCode(strings.ToUpper(code)) != hashes[i] {
+			t.Errorf("the recovery code %s does not match as typed %q or in upper case", code, typed)
+		}
+	}
+}
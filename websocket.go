@@ -0,0 +1,124 @@
+/*
+The WebSocket server connections of the GraphQL subscriptions, over gorilla/websocket.
+
+	Only text messages are accepted: binary messages, messages that are not UTF-8, and messages over 64KB close the
+	connection. Clients authenticate in the connection_init message rather than with cookies, so, like /graphql with
+	its CORS policy, any origin may connect.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsMaxMessageBytes = 64 << 10
+	wsWriteTimeout    = 10 * time.Second
+)
+
+// The close code of a normal closure; the subscription protocols add their own, from 4400
+const wsCloseNormal = websocket.CloseNormalClosure
+
+var errWsClosed = errors.New("the WebSocket connection is closed")
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// A WebSocket connection; one goroutine reads, and any may write
+type wsConn struct {
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+	closing bool // a close message was sent; nothing more can be written
+}
+
+/*
+Upgrade the request to a WebSocket connection, speaking the first of the subprotocols that the client offers.
+Returns the subprotocol; if the request cannot be upgraded, the error response is written and an error returned
+*/
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, protocols []string) (*wsConn, string, error) {
+	protocol := ""
+	for _, p := range protocols {
+		if contains(websocket.Subprotocols(r), p) {
+			protocol = p
+			break
+		}
+	}
+	if protocol == "" && websocket.IsWebSocketUpgrade(r) {
+		message := "unsupported subprotocol; expected one of " + strings.Join(protocols, ", ")
+		http.Error(w, message, http.StatusBadRequest)
+		return nil, "", errors.New(message)
+	}
+	upgrader := wsUpgrader
+	upgrader.Subprotocols = []string{protocol}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetReadLimit(wsMaxMessageBytes)
+	return &wsConn{conn: conn}, protocol, nil
+}
+
+// Read the next text message; pings are answered, and a close from the client is answered and returned as an error
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	messageType, message, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if messageType != websocket.TextMessage {
+		return nil, c.fail(websocket.CloseUnsupportedData, "binary messages are not supported")
+	}
+	if !utf8.Valid(message) {
+		return nil, c.fail(websocket.CloseInvalidFramePayloadData, "text messages must be UTF-8")
+	}
+	return message, nil
+}
+
+// Send a text message
+func (c *wsConn) WriteMessage(message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closing {
+		return errWsClosed
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// Send a ping, so a client that is gone is noticed when the write fails
+func (c *wsConn) Ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// Set the time a message must be read by; the zero time waits indefinitely
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Send a close message with the code and reason, unless one was sent already, then close the connection
+func (c *wsConn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	if !c.closing {
+		c.closing = true
+		if len(reason) > 123 {
+			reason = reason[:123] // control messages carry at most 125 bytes
+		}
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+	}
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+// Close the connection with the code and reason; returns the error to stop reading with
+func (c *wsConn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return errors.New(reason)
+}